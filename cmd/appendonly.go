@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// appendOnlyProbeKey is the object written and deleted to probe an S3 repository, outside the restic directories
+const appendOnlyProbeKey = "restic_wrapper-append-only-probe"
+
+// destructiveOperation returns what the restic command would delete from the repository, empty if it only adds data
+func destructiveOperation(args []string) string {
+	switch args[0] {
+	case "forget", "prune":
+		return "removes snapshots or data"
+	case "rewrite", "tag":
+		return "replaces snapshots"
+	case "unlock":
+		if slices.Contains(args, "--remove-all") {
+			return "removes the locks of running operations"
+		}
+	case "key":
+		if slices.Contains(args, "remove") {
+			return "removes a key"
+		}
+	case "repair":
+		if slices.Contains(args, "--forget") {
+			return "removes snapshots"
+		}
+	}
+	return ""
+}
+
+// checkAppendOnly refuses the restic commands deleting data in the append-only mode
+func checkAppendOnly(args []string) error {
+	if !appConfig.Security.AppendOnly {
+		return nil
+	}
+	if operation := destructiveOperation(args); operation != "" {
+		return fmt.Errorf("restic %s %s, refused by security.append_only", args[0], operation)
+	}
+	return nil
+}
+
+// errNotAppendOnly is returned when the probe deleted from the repository
+var errNotAppendOnly = errors.New("the repository is not append-only")
+
+// errProbeCredentials is returned when the repository refused the credentials of the probe
+var errProbeCredentials = errors.New("the repository refused the credentials")
+
+// probeAppendOnly checks that the credentials cannot delete from the repository, returning an error wrapping
+// errNotAppendOnly when the deletion succeeded. An S3 repository gets a small object written and deleted next to the restic directories
+// (with its version, so an object lock protects it), a REST server the deletion of a missing pack, which an
+// append-only rest-server forbids before looking it up.
+func probeAppendOnly(ctx context.Context, repository string) error {
+	backend, location, _ := strings.Cut(repository, ":")
+	if !strings.Contains(location, "://") {
+		location = "https://" + location
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL: %w", err)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	client := newHTTPClient(time.Minute)
+
+	switch backend {
+	case "rest":
+		name := make([]byte, 32)
+		rand.Read(name)
+		target := base.JoinPath("data", hex.EncodeToString(name))
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target.String(), nil)
+		if err != nil {
+			return err
+		}
+		// restic passes the credentials of the environment when the URL has none
+		if base.User == nil {
+			if username := os.Getenv("RESTIC_REST_USERNAME"); username != "" {
+				req.SetBasicAuth(username, os.Getenv("RESTIC_REST_PASSWORD"))
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to probe the REST server: %w", err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusForbidden:
+			return nil
+		case http.StatusOK, http.StatusNotFound:
+			return fmt.Errorf("%w: the REST server accepts deletions, start rest-server with --append-only", errNotAppendOnly)
+		case http.StatusUnauthorized, http.StatusProxyAuthRequired:
+			return fmt.Errorf("%w: %s, check RESTIC_REST_USERNAME and RESTIC_REST_PASSWORD", errProbeCredentials, resp.Status)
+		}
+		return fmt.Errorf("unexpected response of the REST server: %s", resp.Status)
+	case "s3":
+		return probeS3AppendOnly(ctx, client, base.JoinPath(appendOnlyProbeKey))
+	}
+	return fmt.Errorf("the %s backend cannot be probed", repositoryBackend(repository))
+}
+
+// probeS3AppendOnly writes the probe object and tries to delete it with the credentials of restic
+func probeS3AppendOnly(ctx context.Context, client *http.Client, object *url.URL) error {
+	cfg, err := loadAwsConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load the AWS credentials: %w", err)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	send := func(method string, target *url.URL, body []byte) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(body)
+		payloadHash := hex.EncodeToString(hash[:])
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		if err = v4.NewSigner().SignHTTP(ctx, credentials, req, payloadHash, "s3", region, time.Now()); err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	host, _ := os.Hostname()
+	resp, err := send(http.MethodPut, object, []byte("append-only probe of restic_wrapper on "+host+"\n"))
+	if err != nil {
+		return fmt.Errorf("failed to write the probe object: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to write the probe object: %s", resp.Status)
+	}
+	// Delete the version itself, deleting an object of a versioned bucket only hides it
+	target := *object
+	if version := resp.Header.Get("X-Amz-Version-Id"); version != "" && version != "null" {
+		target.RawQuery = url.Values{"versionId": {version}}.Encode()
+	}
+	resp, err = send(http.MethodDelete, &target, nil)
+	if err != nil {
+		return fmt.Errorf("failed to probe the deletion: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return nil
+	case resp.StatusCode/100 == 2:
+		return fmt.Errorf("%w: the S3 credentials can delete the objects of the repository, deny s3:DeleteObject "+
+			"and s3:DeleteObjectVersion or enable an object lock", errNotAppendOnly)
+	}
+	return fmt.Errorf("unexpected response to the deletion: %s", resp.Status)
+}
+
+// appendOnlyProbeInterval is how long a successful append-only probe is trusted
+const appendOnlyProbeInterval = 7 * 24 * time.Hour
+
+// appendOnlyProbeDue reports whether the repository has to be probed again before the backup: the probe writes to
+// the repository, so it runs when the repository changed and once a week, not on every run
+func (s *runState) appendOnlyProbeDue(repository string, now time.Time) bool {
+	return s.AppendOnlyRepository != repository || now.Sub(s.AppendOnlyVerified) >= appendOnlyProbeInterval
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/cobra"
+)
+
+// Password strength thresholds of the audit, in estimated bits of entropy
+const (
+	weakPasswordBits     = 60
+	insecurePasswordBits = 40
+)
+
+// repositoryKey is a key of the repository as listed by restic key list --json
+type repositoryKey struct {
+	Current  bool      `json:"current"`
+	ID       string    `json:"id"`
+	UserName string    `json:"userName"`
+	HostName string    `json:"hostName"`
+	Created  time.Time `json:"created"`
+}
+
+// repositoryConfig is the configuration of the repository as printed by restic cat config
+type repositoryConfig struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+}
+
+// repositoryPassword returns the repository password from the environment, the password file or the password command
+func repositoryPassword(ctx context.Context) (string, error) {
+	if password := os.Getenv("RESTIC_PASSWORD"); password != "" {
+		return password, nil
+	}
+	switch {
+	case appConfig.Secrets.PasswordFile != "":
+		data, err := os.ReadFile(expandPath(appConfig.Secrets.PasswordFile))
+		if err != nil {
+			return "", fmt.Errorf("failed to read the password file: %w", err)
+		}
+		// restic reads the first line of the file
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimRight(line, "\r"), nil
+	case appConfig.Secrets.PasswordCommand != "":
+		output, err := exec.CommandContext(ctx, "sh", "-c", appConfig.Secrets.PasswordCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run the password command: %w", err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	}
+	return "", errors.New("no repository password is configured")
+}
+
+// passwordEntropy estimates the entropy of the password in bits from its length and the character classes it uses.
+// A password made of a few repeated characters counts as shorter.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	seen := map[rune]bool{}
+	for _, r := range password {
+		seen[r] = true
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case r < unicode.MaxASCII && unicode.IsDigit(r):
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(min(len(seen)*2, len([]rune(password)))) * math.Log2(float64(pool))
+}
+
+// listRepositoryKeys returns the keys of the repository
+func listRepositoryKeys(ctx context.Context) ([]repositoryKey, error) {
+	output, err := runResticCommand(ctx, "key", "list", "--json", "--no-lock")
+	if err != nil {
+		return nil, fmt.Errorf("restic key list failed: %w", err)
+	}
+	var keys []repositoryKey
+	if err = json.Unmarshal([]byte(output), &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse restic key list output: %w", err)
+	}
+	return keys, nil
+}
+
+// lastSnapshotOf returns the time of the last snapshot created by the user on the host, zero if there is none
+func lastSnapshotOf(snapshots []snapshot, userName, hostName string) time.Time {
+	var last time.Time
+	for _, s := range snapshots {
+		if s.Hostname == hostName && (userName == "" || s.Username == "" || s.Username == userName) && s.Time.After(last) {
+			last = s.Time
+		}
+	}
+	return last
+}
+
+// runAudit checks the repository password, the repository keys and the repository format, printing a
+// pass/warn/fail report
+func runAudit(ctx context.Context, w io.Writer) bool {
+	r := &doctorReport{w: w, color: isTerminal(w)}
+	now := time.Now()
+
+	// Password
+	if password, err := repositoryPassword(ctx); err != nil {
+		r.add(doctorWarn, "password", "not checked: %v", err)
+	} else {
+		bits := passwordEntropy(password)
+		switch {
+		case bits < insecurePasswordBits:
+			r.add(doctorFail, "password", "about %.0f bits of entropy (%d characters), it can be guessed, change it with restic key passwd", bits, len([]rune(password)))
+		case bits < weakPasswordBits:
+			r.add(doctorWarn, "password", "about %.0f bits of entropy (%d characters), use a longer password or a passphrase", bits, len([]rune(password)))
+		default:
+			r.add(doctorPass, "password", "about %.0f bits of entropy (%d characters)", bits, len([]rune(password)))
+		}
+	}
+
+	// Repository format
+	output, err := runResticCommand(ctx, "cat", "config", "--no-lock")
+	var config repositoryConfig
+	if err == nil {
+		err = json.Unmarshal([]byte(output), &config)
+	}
+	switch {
+	case err != nil:
+		r.add(doctorFail, "repository", "cannot read the configuration: %v", err)
+		return false
+	case config.Version < 2:
+		r.add(doctorWarn, "repository format", "version %d without compression, upgrade it with restic migrate upgrade_repo_v2", config.Version)
+	default:
+		r.add(doctorPass, "repository format", "version %d with compression", config.Version)
+	}
+	if appConfig.Security.AppendOnly {
+		err := probeAppendOnly(ctx, os.Getenv("RESTIC_REPOSITORY"))
+		switch {
+		case errors.Is(err, errNotAppendOnly), errors.Is(err, errProbeCredentials):
+			r.add(doctorFail, "append-only", "%v", err)
+		case err != nil:
+			r.add(doctorWarn, "append-only", "not verified: %v", err)
+		default:
+			r.add(doctorPass, "append-only", "the credentials cannot delete from the repository")
+		}
+	}
+	if version, err := installedResticVersion(ctx); err != nil {
+		r.add(doctorWarn, "restic", "cannot run %s: %v", appConfig.Restic.Path, err)
+	} else {
+		r.add(doctorPass, "restic", "version %s", version)
+	}
+
+	// Keys
+	keys, err := listRepositoryKeys(ctx)
+	if err != nil {
+		r.add(doctorFail, "keys", "%v", err)
+		return false
+	}
+	snapshots, err := listSnapshots(ctx, "--no-lock")
+	usageKnown := err == nil
+	if !usageKnown {
+		r.add(doctorWarn, "keys", "the use of the keys is not checked: %v", err)
+	}
+	r.add(doctorPass, "keys", "%d keys", len(keys))
+	for _, key := range keys {
+		name := "key " + key.ID
+		if len(key.ID) > 8 {
+			name = "key " + key.ID[:8]
+		}
+		description := fmt.Sprintf("%s@%s, created %s", key.UserName, key.HostName, key.Created.Local().Format("2006-01-02"))
+		if key.Current {
+			r.add(doctorPass, name, "%s, used by this host", description)
+			continue
+		}
+		if !usageKnown || now.Sub(key.Created) < appConfig.Audit.KeyUnusedAfter {
+			r.add(doctorPass, name, "%s", description)
+			continue
+		}
+		last := lastSnapshotOf(snapshots, key.UserName, key.HostName)
+		switch {
+		case last.IsZero():
+			r.add(doctorWarn, name, "%s, no snapshot from its host, remove it with restic key remove %s if it is not used", description, key.ID)
+		case now.Sub(last) > appConfig.Audit.KeyUnusedAfter:
+			r.add(doctorWarn, name, "%s, last snapshot from its host on %s, remove it with restic key remove %s if the host is retired", description, last.Local().Format("2006-01-02"), key.ID)
+		default:
+			r.add(doctorPass, name, "%s, last snapshot from its host on %s", description, last.Local().Format("2006-01-02"))
+		}
+	}
+	return !r.failed
+}
+
+// newAuditCmd returns the command auditing the security of the repository
+func newAuditCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "audit",
+		Short: "Audit the repository password, keys and format",
+		Long: "Estimates the strength of the repository password, lists the repository keys with their creation " +
+			"dates and hosts, flags the keys of hosts that did not back up for audit.key_unused_after, and reports " +
+			"the repository format and the restic version. It exits with an error if any check failed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			setupEnv()
+			if !runAudit(ctx, cmd.OutOrStdout()) {
+				return errors.New("some checks failed")
+			}
+			return nil
+		},
+	}
+}
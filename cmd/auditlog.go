@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// auditRecord is a run in the audit log. Every record holds the hash of the previous one, so removing or changing
+// a record breaks the chain of the records after it.
+type auditRecord struct {
+	Seq        int       `json:"seq"`
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Profile    string    `json:"profile,omitempty"`
+	Status     string    `json:"status"`
+	Duration   float64   `json:"duration_seconds"`
+	SnapshotID string    `json:"snapshot_id,omitempty"`
+	BytesAdded int64     `json:"bytes_added,omitempty"`
+	Uploaded   int64     `json:"bytes_uploaded,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Prev       string    `json:"prev"`
+	Hash       string    `json:"hash,omitempty"`
+	Signature  string    `json:"sig,omitempty"`
+}
+
+// digest returns the hash of the record without its hash and signature
+func (r auditRecord) digest() string {
+	r.Hash, r.Signature = "", ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLogPath returns the path of the audit log, inside the git repository when one is configured
+func auditLogPath() string {
+	if appConfig.AuditLog.GitRepository != "" {
+		return filepath.Join(expandPath(appConfig.AuditLog.GitRepository), appConfig.AuditLog.Path)
+	}
+	path := expandPath(appConfig.AuditLog.Path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(appConfig.BackupDir, path)
+	}
+	return path
+}
+
+// auditSigningKey loads the private key signing the records, creating it on the first use. It returns nil when no
+// key is configured.
+func auditSigningKey() (ed25519.PrivateKey, error) {
+	if appConfig.AuditLog.SigningKey == "" {
+		return nil, nil
+	}
+	path := expandPath(appConfig.AuditLog.SigningKey)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write the audit signing key: %w", err)
+		}
+		log.WithField("public_key", base64.StdEncoding.EncodeToString(public)).Info("Created the audit signing key, keep the public key to verify the audit log")
+		return private, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the audit signing key: %w", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid audit signing key %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// readAuditLog returns the records of the audit log, oldest first
+func readAuditLog(path string) ([]auditRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return records, fmt.Errorf("line %d is not a record: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// appendAuditRecord chains the run to the audit log and commits it to the git repository when one is configured
+func appendAuditRecord(ctx context.Context, summary *runSummary) error {
+	path := auditLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create the audit log directory: %w", err)
+	}
+	// The profiles share the log, their records are chained one at a time
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("cannot lock the audit log: %w", err)
+	}
+	defer lock.Unlock()
+
+	records, err := readAuditLog(path)
+	if err != nil {
+		return fmt.Errorf("cannot read the audit log: %w", err)
+	}
+	record := auditRecord{
+		Seq:        1,
+		Time:       summary.StartedAt.UTC(),
+		Host:       summary.HostName,
+		Profile:    activeProfile,
+		Status:     summary.Status,
+		Duration:   summary.Duration.Seconds(),
+		SnapshotID: summary.SnapshotID,
+		BytesAdded: summary.BytesAdded,
+		Uploaded:   summary.BytesUploaded,
+		Error:      summary.Error,
+	}
+	if n := len(records); n > 0 {
+		record.Seq = records[n-1].Seq + 1
+		record.Prev = records[n-1].Hash
+	}
+	record.Hash = record.digest()
+	key, err := auditSigningKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(record.Hash)))
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the audit log: %w", err)
+	}
+	if appConfig.AuditLog.GitRepository != "" {
+		return commitAuditRecord(ctx, path, record)
+	}
+	return nil
+}
+
+// commitAuditRecord commits the audit log to its git repository, one commit per run, and pushes it when configured
+func commitAuditRecord(ctx context.Context, path string, record auditRecord) error {
+	repository := expandPath(appConfig.AuditLog.GitRepository)
+	git := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repository}, args...)...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s failed: %w: %s", args[0], err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+	if err := git("add", path); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s %s: %s (#%d)", record.Host, record.Time.Format(time.RFC3339), record.Status, record.Seq)
+	if err := git("commit", "-q", "-m", message, "--", path); err != nil {
+		return err
+	}
+	if appConfig.AuditLog.GitPush {
+		return git("push", "-q")
+	}
+	return nil
+}
+
+// auditLogHandler appends the finished runs to the audit log
+func auditLogHandler(ctx context.Context, event any) {
+	finished, ok := event.(runFinishedEvent)
+	if !ok || !appConfig.AuditLog.Enabled {
+		return
+	}
+	if err := appendAuditRecord(ctx, finished.Summary); err != nil {
+		log.WithField("err", err).Error("cannot append the run to the audit log")
+	}
+}
+
+// verifyAuditLog checks the chain of the records and their signatures with the public key, returning the first
+// broken record
+func verifyAuditLog(records []auditRecord, public ed25519.PublicKey) error {
+	prev := ""
+	for i, record := range records {
+		switch {
+		case record.Seq != i+1:
+			return fmt.Errorf("record %d has the sequence number %d, records were removed or reordered", i+1, record.Seq)
+		case record.Prev != prev:
+			return fmt.Errorf("record %d does not follow the previous record, records were removed or changed", record.Seq)
+		case record.digest() != record.Hash:
+			return fmt.Errorf("record %d was changed, its hash does not match its content", record.Seq)
+		}
+		if public != nil {
+			signature, err := base64.StdEncoding.DecodeString(record.Signature)
+			if err != nil || !ed25519.Verify(public, []byte(record.Hash), signature) {
+				return fmt.Errorf("record %d is not signed by the key", record.Seq)
+			}
+		}
+		prev = record.Hash
+	}
+	return nil
+}
+
+// newAuditLogCmd returns the command verifying the audit log
+func newAuditLogCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit-log",
+		Short: "Verify the tamper-evident log of the runs",
+		Args:  cobra.NoArgs,
+	}
+	var publicKey string
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that no record of the audit log was changed or removed",
+		Long: "Checks the hash chain of the audit log written with audit_log.enabled: every record must follow the " +
+			"previous one and match its hash. With audit_log.signing_key the signatures are verified too, with the " +
+			"public key given by --public-key, which should come from a copy kept away from the machine, or the one " +
+			"of the signing key otherwise.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := auditLogPath()
+			records, err := readAuditLog(path)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				return fmt.Errorf("the audit log %s has no records", path)
+			}
+			var public ed25519.PublicKey
+			switch {
+			case publicKey != "":
+				key, err := base64.StdEncoding.DecodeString(publicKey)
+				if err != nil || len(key) != ed25519.PublicKeySize {
+					return errors.New("invalid public key, expected the base64 of an Ed25519 public key")
+				}
+				public = key
+			case appConfig.AuditLog.SigningKey != "":
+				if _, err := os.Stat(expandPath(appConfig.AuditLog.SigningKey)); err != nil {
+					return fmt.Errorf("cannot read the audit signing key: %w", err)
+				}
+				private, err := auditSigningKey()
+				if err != nil {
+					return err
+				}
+				public = private.Public().(ed25519.PublicKey)
+			}
+			if err = verifyAuditLog(records, public); err != nil {
+				return fmt.Errorf("the audit log %s is broken: %w", path, err)
+			}
+			w := cmd.OutOrStdout()
+			last := records[len(records)-1]
+			fmt.Fprintf(w, "%d records, the chain is intact, the last from %s\n", len(records), last.Time.Local().Format("2006-01-02 15:04"))
+			if public != nil {
+				fmt.Fprintf(w, "All records are signed by %s\n", base64.StdEncoding.EncodeToString(public))
+			}
+			return nil
+		},
+	}
+	verify.Flags().StringVar(&publicKey, "public-key", "", "the base64 public key the records must be signed with")
+	cmd.AddCommand(verify)
+	return cmd
+}
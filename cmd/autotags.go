@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The tags of the snapshots taken when a precondition of the backup was not met
+const (
+	tagOnBattery  = "on-battery"
+	tagPartial    = "partial"
+	tagIncomplete = "incomplete"
+	// tagInterrupted marks the snapshots of a run stopped by the runtime budget, the sleep or the upload cap
+	tagInterrupted = "interrupted"
+)
+
+// preconditionTags returns the tags of the snapshot about to be taken: on-battery when the backup runs on battery
+// power, partial when some of the backup sources are missing
+func preconditionTags(sources []string) []string {
+	var tags []string
+	if !inContainer() {
+		// The power source is unknown without pmset
+		if onPower, err := isOnPower(); err == nil && !onPower {
+			tags = append(tags, tagOnBattery)
+		}
+	}
+	for _, source := range sources {
+		if _, err := os.Lstat(source); err != nil {
+			log.WithField("path", source).Warn("The backup source is missing, the snapshot is tagged as partial")
+			tags = append(tags, tagPartial)
+			break
+		}
+	}
+	return tags
+}
+
+// tagSnapshot adds the tag to the snapshot. Tagging rewrites the snapshot, it returns the ID of the new snapshot, or
+// the given ID when tagging failed.
+func tagSnapshot(ctx context.Context, snapshotID, tag string) string {
+	if _, err := runResticCommand(ctx, "tag", "--add", tag, snapshotID); err != nil {
+		log.WithFields(log.Fields{"tag": tag, "err": err}).Warn("cannot tag the snapshot")
+		return snapshotID
+	}
+	snapshots, err := listSnapshots(ctx, "--host", appConfig.HostName, "--tag", tag)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot find the tagged snapshot")
+		return snapshotID
+	}
+	for _, s := range snapshots {
+		if strings.HasPrefix(s.Original, snapshotID) {
+			return s.ShortID
+		}
+	}
+	log.WithField("snapshot", snapshotID).Warn("cannot find the tagged snapshot")
+	return snapshotID
+}
+
+// tagIncompleteSnapshot tags the snapshot missing unreadable files as incomplete, the summary then refers to the
+// new snapshot
+func tagIncompleteSnapshot(ctx context.Context, summary *runSummary) {
+	summary.SnapshotID = tagSnapshot(ctx, summary.SnapshotID, tagIncomplete)
+}
+
+// tagInterruptedSnapshots tags the snapshots taken by a run stopped before the backup completed as interrupted: the
+// snapshots of the priority groups, and the snapshot of the backup if restic saved one. They lack the sources backed
+// up after them.
+func tagInterruptedSnapshots(ctx context.Context, summary *runSummary, results []groupResult) {
+	for i := range results {
+		if results[i].SnapshotID != "" {
+			results[i].SnapshotID = tagSnapshot(ctx, results[i].SnapshotID, tagInterrupted)
+		}
+	}
+	if summary.SnapshotID != "" {
+		summary.SnapshotID = tagSnapshot(ctx, summary.SnapshotID, tagInterrupted)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// monthlyUpload is the data uploaded by the backups in a calendar month
+type monthlyUpload struct {
+	// Month is the local calendar month, e.g. "2026-10"
+	Month string `json:"month"`
+	Bytes int64  `json:"bytes"`
+}
+
+// uploadMonthsKept is the number of months of uploads kept in the state
+const uploadMonthsKept = 12
+
+// uploadMonth returns the calendar month of the time as stored in the state
+func uploadMonth(t time.Time) string {
+	return t.Local().Format("2006-01")
+}
+
+// recordUpload adds the data uploaded by a run to its month
+func (s *runState) recordUpload(at time.Time, bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+	month := uploadMonth(at)
+	if n := len(s.Uploads); n > 0 && s.Uploads[n-1].Month == month {
+		s.Uploads[n-1].Bytes += bytes
+		return
+	}
+	s.Uploads = append(s.Uploads, monthlyUpload{Month: month, Bytes: bytes})
+	if len(s.Uploads) > uploadMonthsKept {
+		s.Uploads = s.Uploads[len(s.Uploads)-uploadMonthsKept:]
+	}
+}
+
+// monthUploaded returns the data uploaded in the month of the time by the backups of every profile, which share the
+// connection
+func monthUploaded(now time.Time) int64 {
+	paths := []string{statePath()}
+	for _, profile := range profileNames() {
+		if path := profileStatePath(profile); !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	month := uploadMonth(now)
+	var total int64
+	for _, path := range paths {
+		state, err := loadStateFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{"path": path, "err": err}).Warn("cannot load the state")
+			continue
+		}
+		for _, upload := range state.Uploads {
+			if upload.Month == month {
+				total += upload.Bytes
+			}
+		}
+	}
+	return total
+}
+
+// budgetStatus is the use of the monthly bandwidth budget
+type budgetStatus struct {
+	Used   int64
+	Budget int64
+}
+
+// currentBudget returns the use of the bandwidth budget in the month of the time, nil when no budget is configured
+func currentBudget(now time.Time) *budgetStatus {
+	budget, _ := parseSize(appConfig.BandwidthBudget.Monthly)
+	if appConfig.BandwidthBudget.Monthly == "" || budget <= 0 {
+		return nil
+	}
+	return &budgetStatus{Used: monthUploaded(now), Budget: budget}
+}
+
+// approaching reports whether the use reached bandwidth_budget.approach_percent of the budget, false for a nil status
+func (b *budgetStatus) approaching() bool {
+	return b != nil && b.Used*100 >= b.Budget*int64(appConfig.BandwidthBudget.ApproachPercent)
+}
+
+// remaining returns the data that can still be uploaded this month
+func (b *budgetStatus) remaining() int64 {
+	return max(b.Budget-b.Used, 0)
+}
+
+func (b *budgetStatus) String() string {
+	return fmt.Sprintf("%s of %s used this month, %s remaining", formatBytes(b.Used), formatBytes(b.Budget), formatBytes(b.remaining()))
+}
+
+// applyBudget decides how the backup runs with the bandwidth budget of the month. It returns the reason to defer the
+// backup of a non-essential profile, or the extra arguments of restic backup limiting the upload rate.
+func applyBudget(now time.Time) (string, []string) {
+	budget := currentBudget(now)
+	if !budget.approaching() {
+		return "", nil
+	}
+	fields := log.Fields{"used": formatBytes(budget.Used), "budget": appConfig.BandwidthBudget.Monthly}
+	if !appConfig.BandwidthBudget.Essential {
+		return "the bandwidth budget of the month is almost used: " + budget.String(), nil
+	}
+	if appConfig.BandwidthBudget.LimitUpload <= 0 {
+		log.WithFields(fields).Warn("The bandwidth budget of the month is almost used")
+		return "", nil
+	}
+	fields["limit_upload"] = appConfig.BandwidthBudget.LimitUpload
+	log.WithFields(fields).Warn("The bandwidth budget of the month is almost used, limiting the upload rate")
+	return "", []string{"--limit-upload", fmt.Sprint(appConfig.BandwidthBudget.LimitUpload)}
+}
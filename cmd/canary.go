@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// canaryPaths returns the canary paths as they are stored in the snapshots
+func canaryPaths() []string {
+	paths := make([]string, 0, len(appConfig.Canary.Paths))
+	for _, p := range appConfig.Canary.Paths {
+		paths = append(paths, filepath.Clean(hostPath(expandPath(p))))
+	}
+	return paths
+}
+
+// sameContent reports whether the two files have the same content
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		nA, errA := io.ReadFull(fa, bufA)
+		nB, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// compareCanary compares the regular files of the canary path with their restored copies under the target.
+// Files changed since the backup started are skipped, they may differ from the snapshot legitimately.
+func compareCanary(canary, target string, since time.Time) (int, error) {
+	verified := 0
+	err := filepath.WalkDir(canary, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(since) {
+			return nil
+		}
+		same, err := sameContent(p, filepath.Join(target, p))
+		if err != nil {
+			return fmt.Errorf("cannot compare the canary file %s: %w", p, err)
+		}
+		if !same {
+			return fmt.Errorf("the restored canary file %s differs from the source", p)
+		}
+		verified++
+		return nil
+	})
+	return verified, err
+}
+
+// verifyCanary restores the canary files from the new snapshot to a temporary directory and compares them
+// byte by byte with the source, verifying the backup end to end
+func verifyCanary(ctx context.Context, summary *runSummary) error {
+	target, err := os.MkdirTemp("", "restic_wrapper-canary-")
+	if err != nil {
+		return fmt.Errorf("failed to create the canary restore directory: %w", err)
+	}
+	defer os.RemoveAll(target)
+
+	paths := canaryPaths()
+	args := []string{"restore", summary.SnapshotID, "--target", target}
+	for _, p := range paths {
+		args = append(args, "--include", p)
+	}
+	if _, err = summary.runNamedStage(ctx, "canary", args...); err != nil {
+		return fmt.Errorf("failed to restore the canary files: %w", err)
+	}
+	for _, p := range paths {
+		verified, err := compareCanary(p, target, summary.StartedAt)
+		summary.CanaryVerified += verified
+		if err != nil {
+			summary.stage("canary").Err = err
+			return err
+		}
+	}
+	return nil
+}
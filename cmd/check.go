@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// checkDue reports whether the scheduled repository check is due
+func checkDue(state *runState, now time.Time) bool {
+	return appConfig.Check.Interval > 0 && now.Sub(state.LastCheck) >= appConfig.Check.Interval
+}
+
+// runCheck checks the repository as a stage of the run. When read_data_subsets is set, the next subset of
+// the data is read, so the whole repository is read over the course of read_data_subsets checks.
+func runCheck(ctx context.Context, summary *runSummary, state *runState) (string, error) {
+	args := []string{"check"}
+	if subsets := appConfig.Check.ReadDataSubsets; subsets > 0 {
+		summary.CheckSubset = state.CheckSubset%subsets + 1
+		args = append(args, "--read-data-subset", fmt.Sprintf("%d/%d", summary.CheckSubset, subsets))
+	}
+	return summary.runStage(ctx, args...)
+}
+
+// pruneBlockedReason returns why pruning the repository is unsafe, or an empty string if it is safe.
+// Pruning a possibly corrupt repository could make the damage permanent.
+func pruneBlockedReason(state *runState, summary *runSummary, now time.Time) string {
+	if summary != nil {
+		if check := summary.stage("check"); check != nil {
+			if check.Err != nil {
+				return "the repository check of this run failed"
+			}
+			return ""
+		}
+	}
+	if state.CheckFailed {
+		return "the last repository check failed"
+	}
+	if maxAge := appConfig.Check.PruneMaxAge; maxAge > 0 && now.Sub(state.LastCheck) > maxAge {
+		if state.LastCheck.IsZero() {
+			return "the repository was never checked"
+		}
+		return fmt.Sprintf("the last repository check is older than %s", maxAge)
+	}
+	return ""
+}
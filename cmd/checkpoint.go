@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// checkpointTag is added to the snapshots created by the checkpoint command
+const checkpointTag = "checkpoint"
+
+// newCheckpointCmd returns the command creating a protected snapshot before a risky operation
+func newCheckpointCmd() *cobra.Command {
+	var reason string
+	cmd := &cobra.Command{
+		Use:   "checkpoint",
+		Short: "Back up immediately and protect the snapshot, e.g. before an OS upgrade",
+		Long: "Backs up immediately, regardless of the power source, waiting for a running backup to finish first. " +
+			"The backup is not deferred by the disk contention, the backup script, the bandwidth budget or the " +
+			"offline mode. " +
+			"The snapshot is protected from the retention policy and the reason is attached as its note. " +
+			"The command exits with a non-zero status when no snapshot was created, so scripts can abort.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			summary := runBackup(backupOptions{
+				waitForLock: true,
+				ignorePower: true,
+				force:       true,
+				tags:        []string{appConfig.Retention.KeepTag, checkpointTag},
+			})
+			if summary == nil || !summary.snapshotCreated() || summary.SnapshotID == "" {
+				return errors.New("the checkpoint snapshot was not created, see the log for details")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+			if err := setNote(ctx, summary.SnapshotID, reason); err != nil {
+				return fmt.Errorf("cannot attach the reason to snapshot %s: %w", summary.SnapshotID, err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), summary.SnapshotID)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&reason, "reason", "", "the reason of the checkpoint, attached to the snapshot as its note")
+	cmd.MarkFlagRequired("reason")
+	return cmd
+}
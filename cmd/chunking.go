@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// seedState is the progress of the initial backup split into chunks
+type seedState struct {
+	// Chunks is the number of chunks of the seed, Done the keys of the chunks backed up
+	Chunks    int       `json:"chunks"`
+	Done      []string  `json:"done,omitempty"`
+	Completed time.Time `json:"completed,omitempty"`
+	// ChunksForgotten is set once the snapshots of the chunks are removed after the first full backup
+	ChunksForgotten bool `json:"chunks_forgotten,omitempty"`
+}
+
+// tagSeedChunk is the tag of the snapshots of the chunks, removed once a full backup covers them
+const tagSeedChunk = "seed-chunk"
+
+// String describes the progress of the seed
+func (s *seedState) String() string {
+	if !s.Completed.IsZero() {
+		return "completed on " + s.Completed.Local().Format("2006-01-02")
+	}
+	return fmt.Sprintf("%d of %d chunks backed up", len(s.Done), s.Chunks)
+}
+
+// chunkingActive reports whether the backup sources are split into chunks, until the seed is completed
+func chunkingActive(state *runState) bool {
+	return appConfig.Chunking.Enabled && (state.Seed == nil || state.Seed.Completed.IsZero())
+}
+
+// chunkKey returns the key identifying the chunk in the state, stable as long as the chunk has the same paths
+func chunkKey(paths []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(paths, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// pathSize returns the size of the regular files in the path
+func pathSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// topLevelEntries splits a source directory into its entries, the other sources are returned as they are
+func topLevelEntries(source string) ([]string, []string) {
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, []string{source}
+	}
+	var dirs, files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(source, entry.Name()))
+		} else {
+			files = append(files, filepath.Join(source, entry.Name()))
+		}
+	}
+	return dirs, files
+}
+
+// sourceChunks splits the sources into the chunks of the seed: by chunking.by "directory" every top-level directory
+// of the sources is a chunk and the other entries of a source make one more, by "size" the top-level entries are
+// packed in their order into chunks of up to chunking.max_size. An entry larger than max_size is a chunk of its own.
+func sourceChunks(sources []string) [][]string {
+	var chunks [][]string
+	if appConfig.Chunking.By == "directory" {
+		for _, source := range sources {
+			dirs, files := topLevelEntries(source)
+			for _, dir := range dirs {
+				chunks = append(chunks, []string{dir})
+			}
+			if len(files) > 0 {
+				chunks = append(chunks, files)
+			}
+		}
+		return chunks
+	}
+
+	maxSize, _ := parseSize(appConfig.Chunking.MaxSize)
+	var (
+		chunk     []string
+		chunkSize int64
+	)
+	for _, source := range sources {
+		dirs, files := topLevelEntries(source)
+		for _, entry := range append(dirs, files...) {
+			size := pathSize(entry)
+			if len(chunk) > 0 && chunkSize+size > maxSize {
+				chunks = append(chunks, chunk)
+				chunk, chunkSize = nil, 0
+			}
+			chunk = append(chunk, entry)
+			chunkSize += size
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// pendingChunks returns the chunks of the sources not backed up yet, as source groups named after their position,
+// and records the number of chunks in the state
+func pendingChunks(state *runState, sources []string) []sourceGroup {
+	chunks := sourceChunks(sources)
+	if state.Seed == nil {
+		state.Seed = &seedState{}
+	}
+	state.Seed.Chunks = len(chunks)
+	var (
+		pending []sourceGroup
+		done    []string
+	)
+	for i, chunk := range chunks {
+		key := chunkKey(chunk)
+		if slices.Contains(state.Seed.Done, key) {
+			done = append(done, key)
+		} else {
+			pending = append(pending, sourceGroup{Name: fmt.Sprintf("chunk-%d", i+1), Sources: chunk, Chunk: key})
+		}
+	}
+	// The chunks that changed since, e.g. a new top-level directory, don't count towards the seed
+	state.Seed.Done = done
+	log.WithFields(log.Fields{"chunks": len(chunks), "pending": len(pending)}).Info("Backing up the initial seed in chunks")
+	return pending
+}
+
+// seedGroups replaces the remaining sources after the priority groups with the chunks of the seed not backed up yet.
+// Without pending chunks, e.g. the remaining sources are empty, the seed is completed.
+func seedGroups(state *runState, groups []sourceGroup) []sourceGroup {
+	if len(groups) == 0 || groups[len(groups)-1].Name != "default" {
+		return groups
+	}
+	pending := pendingChunks(state, groups[len(groups)-1].Sources)
+	if len(pending) == 0 {
+		state.Seed.Completed = time.Now()
+		state.Seed.Done = nil
+		return groups
+	}
+	// The paths split off by the priority groups stay excluded
+	for i := range pending {
+		pending[i].Excludes = groups[len(groups)-1].Excludes
+	}
+	return append(groups[:len(groups)-1], pending...)
+}
+
+// recordChunk records the backed up chunk of the seed, completing the seed with the last one. The state is saved
+// right away, so an interrupted run resumes after the chunk.
+func recordChunk(state *runState, key string, now time.Time) {
+	if state.Seed == nil || slices.Contains(state.Seed.Done, key) {
+		return
+	}
+	state.Seed.Done = append(state.Seed.Done, key)
+	if len(state.Seed.Done) >= state.Seed.Chunks {
+		state.Seed.Completed = now
+		state.Seed.Done = nil
+		log.Info("The initial seed is completed, the next backups back up all sources at once")
+	}
+	if err := state.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the progress of the seed")
+	}
+}
+
+// forgetSeedChunks removes the snapshots of the chunks once the first full backup after the seed covers their files.
+// Each chunk has its own paths, so the retention policy would keep its snapshot forever as a group of its own.
+func forgetSeedChunks(ctx context.Context, state *runState) {
+	if state.Seed == nil || state.Seed.Completed.IsZero() || state.Seed.ChunksForgotten {
+		return
+	}
+	if appConfig.Security.AppendOnly {
+		log.Info("The snapshots of the seed chunks are kept, an append-only repository refuses to remove them")
+		state.Seed.ChunksForgotten = true
+		return
+	}
+	snapshots, err := listSnapshots(ctx, "--no-lock", "--host", appConfig.HostName, "--tag", tagSeedChunk)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot list the snapshots of the seed chunks")
+		return
+	}
+	if len(snapshots) > 0 {
+		args := []string{"forget"}
+		for _, s := range snapshots {
+			args = append(args, s.ID)
+		}
+		if _, err = runResticCommand(ctx, args...); err != nil {
+			log.WithField("err", err).Warn("cannot remove the snapshots of the seed chunks")
+			return
+		}
+		log.WithField("snapshots", len(snapshots)).Info("Removed the snapshots of the seed chunks covered by the full backup")
+	}
+	state.Seed.ChunksForgotten = true
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// coldStorageClasses are the S3 storage classes whose objects must be restored before they can be read
+var coldStorageClasses = []string{"GLACIER", "DEEP_ARCHIVE"}
+
+// coldStorageTiers are the retrieval tiers of the S3 restore requests
+var coldStorageTiers = []string{"Expedited", "Standard", "Bulk"}
+
+// coldStorageConcurrency is the number of S3 requests made at once
+const coldStorageConcurrency = 16
+
+// s3RestoreExpiryRe matches the expiry of the restored copy in the x-amz-restore header
+var s3RestoreExpiryRe = regexp.MustCompile(`expiry-date="([^"]+)"`)
+
+// s3Bucket is the bucket of an S3 repository and the credentials signing its requests
+type s3Bucket struct {
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials aws.CredentialsProvider
+	// virtualHosted addresses the bucket as a subdomain of the AWS endpoint
+	virtualHosted bool
+}
+
+// openS3Bucket returns the bucket of the S3 repository, e.g. "s3:s3.amazonaws.com/bucket/restic"
+func openS3Bucket(ctx context.Context, repository string) (*s3Bucket, error) {
+	location, found := strings.CutPrefix(repository, "s3:")
+	if !found {
+		return nil, fmt.Errorf("the repository %s is not an S3 repository", repository)
+	}
+	if !strings.Contains(location, "://") {
+		location = "https://" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("the repository %s has no bucket", repository)
+	}
+	cfg, err := loadAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	// Fail early without credentials, they are retrieved again for every request as they may expire while waiting
+	if _, err = cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	b := &s3Bucket{
+		endpoint:    &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:      bucket,
+		prefix:      prefix,
+		region:      cfg.Region,
+		credentials: cfg.Credentials,
+	}
+	host := u.Hostname()
+	if strings.HasSuffix(host, ".amazonaws.com") {
+		// e.g. s3.eu-west-1.amazonaws.com, the endpoint of the region wins over the configured one
+		if region, ok := strings.CutPrefix(strings.TrimSuffix(host, ".amazonaws.com"), "s3."); ok && !strings.HasPrefix(region, "dualstack") {
+			b.region = region
+		}
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		b.endpoint.Host = "s3." + b.region + ".amazonaws.com"
+		b.virtualHosted = !strings.Contains(bucket, ".")
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+	return b, nil
+}
+
+// packKey returns the key of the data pack, e.g. "restic/data/3f/3f2a..."
+func (b *s3Bucket) packKey(id string) string {
+	return path.Join(b.prefix, "data", id[:2], id)
+}
+
+// objectURL returns the URL of the object
+func (b *s3Bucket) objectURL(key string) string {
+	u := *b.endpoint
+	if b.virtualHosted {
+		u.Host = b.bucket + "." + u.Host
+		u.Path = "/" + key
+	} else {
+		u.Path = "/" + b.bucket + "/" + key
+	}
+	return u.String()
+}
+
+// do sends the signed request for the object, the bucket itself when the key is empty
+func (b *s3Bucket) do(ctx context.Context, method, key, query string, body []byte, header http.Header) (*http.Response, error) {
+	rawURL := b.objectURL(key)
+	if query != "" {
+		rawURL += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	// The provider caches the credentials and refreshes them before they expire
+	credentials, err := b.credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	if err = v4.NewSigner().SignHTTP(ctx, credentials, req, payloadHash, "s3", b.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign the request: %w", err)
+	}
+	return newHTTPClient(time.Minute).Do(req)
+}
+
+// coldPack is a data pack of the restore and the state of its restored copy
+type coldPack struct {
+	id string
+	// cold is true when the pack is in a storage class that must be restored
+	cold bool
+	// ongoing is true while the restore of the pack is in progress
+	ongoing bool
+	// expiry is when the restored copy is removed again, zero when the pack is not restored
+	expiry time.Time
+}
+
+// ready reports whether the pack can be read by restic
+func (p coldPack) ready() bool {
+	return !p.cold || (!p.ongoing && !p.expiry.IsZero())
+}
+
+// headPack returns the storage class and the restore state of the pack
+func (b *s3Bucket) headPack(ctx context.Context, id string) (coldPack, error) {
+	pack := coldPack{id: id}
+	resp, err := b.do(ctx, http.MethodHead, b.packKey(id), "", nil, nil)
+	if err != nil {
+		return pack, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pack, fmt.Errorf("unexpected response %s for the pack %s", resp.Status, id)
+	}
+	class := resp.Header.Get("X-Amz-Storage-Class")
+	for _, cold := range coldStorageClasses {
+		pack.cold = pack.cold || class == cold
+	}
+	restore := resp.Header.Get("X-Amz-Restore")
+	pack.ongoing = strings.Contains(restore, `ongoing-request="true"`)
+	if match := s3RestoreExpiryRe.FindStringSubmatch(restore); match != nil {
+		pack.expiry, _ = time.Parse(http.TimeFormat, match[1])
+	}
+	return pack, nil
+}
+
+// restorePack requests a restored copy of the pack, or extends the one restored already
+func (b *s3Bucket) restorePack(ctx context.Context, id string) error {
+	body := fmt.Sprintf("<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>",
+		appConfig.Restore.ColdStorage.Days, appConfig.Restore.ColdStorage.Tier)
+	resp, err := b.do(ctx, http.MethodPost, b.packKey(id), "restore", []byte(body), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	case http.StatusConflict:
+		// RestoreAlreadyInProgress
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("unexpected response %s for the pack %s: %s", resp.Status, id, bytes.TrimSpace(message))
+}
+
+// eachPack runs the function for the packs, a few at a time, and returns the first error
+func eachPack(ids []string, fn func(id string) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	work := make(chan string)
+	for range coldStorageConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				if err := fn(id); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// splitIncludePath splits the path or the include pattern into its components, the first is "/" for an absolute one
+func splitIncludePath(p string) []string {
+	parts := strings.Split(path.Clean(p), "/")
+	if parts[0] == "" {
+		parts[0] = "/"
+	}
+	return parts
+}
+
+// matchInclude reports whether the include pattern matches the path like restic does: an absolute pattern matches
+// the path and everything below it, a relative one the components anywhere in the path, and ** matches zero or more
+// directories
+func matchInclude(pattern, parts []string) bool {
+	if pos := slices.Index(pattern, "**"); pos >= 0 {
+		for i := 0; i <= len(parts)-len(pattern)+1; i++ {
+			if matchInclude(slices.Concat(pattern[:pos], slices.Repeat([]string{"*"}, i), pattern[pos+1:]), parts) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pattern) == 0 || len(pattern) > len(parts) {
+		return len(pattern) == 0 && len(parts) == 0
+	}
+	minOffset, maxOffset := 0, len(parts)-len(pattern)
+	if pattern[0] == "/" {
+		maxOffset = 0
+	} else if parts[0] == "/" {
+		minOffset = 1
+	}
+outer:
+	for offset := maxOffset; offset >= minOffset; offset-- {
+		for i, part := range pattern {
+			if ok, _ := path.Match(part, parts[offset+i]); !ok {
+				continue outer
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// childMayMatch reports whether the include pattern may match a path below the directory, a relative pattern always
+// may
+func childMayMatch(pattern, parts []string) bool {
+	if pattern[0] != "/" {
+		return true
+	}
+	if pos := slices.Index(pattern, "**"); pos >= 0 && len(parts) >= pos {
+		parts = parts[:pos]
+	}
+	return matchInclude(pattern[:min(len(parts), len(pattern))], parts)
+}
+
+// includedPath reports whether the path of the snapshot is restored with the include patterns, or may contain
+// restored files when it is a directory
+func includedPath(p string, dir bool, includes []string) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	parts := splitIncludePath(p)
+	for _, include := range includes {
+		pattern := splitIncludePath(include)
+		if matchInclude(pattern, parts) || (dir && childMayMatch(pattern, parts)) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotBlobs returns the data blobs of the files of the snapshot restored with the include patterns. The
+// directories are read with restic cat tree, a few at a time.
+func snapshotBlobs(ctx context.Context, snapshotID string, includes []string) (map[string]bool, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	blobs := map[string]bool{}
+	limit := make(chan struct{}, coldStorageConcurrency)
+	var walk func(dir string)
+	walk = func(dir string) {
+		defer wg.Done()
+		limit <- struct{}{}
+		output, err := runResticCommand(ctx, "cat", "tree", snapshotID+":"+dir, "--no-lock")
+		<-limit
+		var tree struct {
+			Nodes []treeNode `json:"nodes"`
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(output), &tree)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("cannot read the directory %s of the snapshot: %w", dir, err)
+			}
+			return
+		}
+		for _, node := range tree.Nodes {
+			p := path.Join(dir, node.Name)
+			switch {
+			case node.Type == "dir" && includedPath(p, true, includes):
+				wg.Add(1)
+				go walk(p)
+			case node.Type == "file" && includedPath(p, false, includes):
+				for _, blob := range node.Content {
+					blobs[blob] = true
+				}
+			}
+		}
+	}
+	wg.Add(1)
+	go walk("/")
+	wg.Wait()
+	return blobs, firstErr
+}
+
+// blobPacks returns the packs holding the blobs, looked up in the index of the repository
+func blobPacks(ctx context.Context, blobs map[string]bool) ([]string, error) {
+	output, err := runResticCommand(ctx, "list", "index", "--no-lock")
+	if err != nil {
+		return nil, fmt.Errorf("restic list index failed: %w", err)
+	}
+	needed := map[string]bool{}
+	for _, id := range strings.Fields(output) {
+		output, err := runResticCommand(ctx, "cat", "index", id, "--no-lock")
+		if err != nil {
+			return nil, fmt.Errorf("restic cat index failed: %w", err)
+		}
+		var index struct {
+			Packs []struct {
+				ID    string `json:"id"`
+				Blobs []struct {
+					ID string `json:"id"`
+				} `json:"blobs"`
+			} `json:"packs"`
+		}
+		if err = json.Unmarshal([]byte(output), &index); err != nil {
+			return nil, fmt.Errorf("failed to parse the index %s: %w", id, err)
+		}
+		for _, pack := range index.Packs {
+			for _, blob := range pack.Blobs {
+				if blobs[blob.ID] {
+					needed[pack.ID] = true
+					break
+				}
+			}
+		}
+	}
+	var packs []string
+	for id := range needed {
+		packs = append(packs, id)
+	}
+	return packs, nil
+}
+
+// coldStorageStatus returns the state of the packs
+func coldStorageStatus(ctx context.Context, b *s3Bucket, ids []string) ([]coldPack, error) {
+	var mu sync.Mutex
+	packs := make([]coldPack, 0, len(ids))
+	err := eachPack(ids, func(id string) error {
+		pack, err := b.headPack(ctx, id)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		packs = append(packs, pack)
+		mu.Unlock()
+		return nil
+	})
+	return packs, err
+}
+
+// warmUpColdStorage restores the packs of the snapshot needed by the restore from the cold storage classes. It
+// requests a restored copy of the archived packs and, unless wait is false, polls until all of them are readable,
+// extending the copies about to expire meanwhile, so restic restore does not fail on the archived packs.
+func warmUpColdStorage(ctx context.Context, w io.Writer, snapshotID string, includes []string, wait bool) (bool, error) {
+	b, err := openS3Bucket(ctx, os.Getenv("RESTIC_REPOSITORY"))
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintln(w, "Planning the restore from the cold storage, reading the directories of the snapshot")
+	blobs, err := snapshotBlobs(ctx, snapshotID, includes)
+	if err != nil {
+		return false, err
+	}
+	ids, err := blobPacks(ctx, blobs)
+	if err != nil {
+		return false, err
+	}
+	settings := appConfig.Restore.ColdStorage
+	deadline := time.Now().Add(settings.Timeout)
+	requested := map[string]bool{}
+	for {
+		packs, err := coldStorageStatus(ctx, b, ids)
+		if err != nil {
+			return false, fmt.Errorf("cannot get the storage class of the packs: %w", err)
+		}
+		var pending, restore []string
+		cold, ready := 0, 0
+		for _, pack := range packs {
+			if pack.cold {
+				cold++
+			}
+			if pack.ready() {
+				ready++
+			}
+			switch {
+			case !pack.cold || pack.ongoing:
+			case pack.expiry.IsZero() && !requested[pack.id]:
+				restore = append(restore, pack.id)
+			case !pack.expiry.IsZero() && time.Until(pack.expiry) < settings.RenewBefore:
+				// Keep the restored copy while the restore waits for the other packs
+				restore = append(restore, pack.id)
+			}
+			if !pack.ready() {
+				pending = append(pending, pack.id)
+			}
+		}
+		if len(restore) > 0 {
+			if err = eachPack(restore, func(id string) error { return b.restorePack(ctx, id) }); err != nil {
+				return false, fmt.Errorf("cannot restore the packs from the cold storage: %w", err)
+			}
+			for _, id := range restore {
+				requested[id] = true
+			}
+			log.WithFields(log.Fields{"packs": len(restore), "tier": settings.Tier, "days": settings.Days}).Info("Requested the restore of the packs from the cold storage")
+		}
+		fmt.Fprintf(w, "%d packs needed, %d in cold storage, %d readable, %d requested now\n", len(packs), cold, ready, len(restore))
+		if len(pending) == 0 {
+			return true, nil
+		}
+		if !wait {
+			fmt.Fprintln(w, "Run the restore again once the packs are restored")
+			return false, nil
+		}
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("%d packs are still being restored after %s", len(pending), settings.Timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(settings.PollInterval):
+		}
+	}
+}
+
+// validateColdStorage checks the settings of the restores from the cold storage
+func validateColdStorage() error {
+	settings := appConfig.Restore.ColdStorage
+	for _, tier := range coldStorageTiers {
+		if settings.Tier == tier {
+			if settings.Days < 1 {
+				return errors.New("invalid restore.cold_storage.days, expected at least 1 day")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid restore.cold_storage.tier %q, expected Expedited, Standard or Bulk", settings.Tier)
+}
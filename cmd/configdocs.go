@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configKeyDoc is the documentation of a configuration key
+type configKeyDoc struct {
+	help    string
+	example string
+}
+
+// configDocs documents the configuration keys, the keys of the Config struct without an entry are listed without
+// a description
+var configDocs = map[string]configKeyDoc{
+	"backup_directory": {"Directory for backup-related files and logs.", ""},
+	"lock_file":        {"The lock file preventing concurrent backups, relative to backup_directory.", ""},
+	"log_file":         {"The log file, relative to backup_directory.", ""},
+	"state_file":       {"The file where the status of the last run is kept between runs.", ""},
+	"notes_file":       {"The file where the notes attached to snapshots are kept.", ""},
+	"history_file":     {"The database of the past runs, listed by `restic_wrapper history`.", ""},
+	"history.max_age":  {"The runs older than this are removed from the history.", ""},
+
+	"audit_log.enabled":        {"Append every run to a hash-chained audit log, see audit-log verify.", "true"},
+	"audit_log.path":           {"The audit log, relative to the backup directory or to git_repository.", "audit/macbook.jsonl"},
+	"audit_log.signing_key":    {"The Ed25519 key signing the records, created on the first run.", "~/.restic_backup/audit.key"},
+	"audit_log.git_repository": {"A clone of a git repository the audit log is committed to after every run.", "~/audit-log"},
+	"audit_log.git_push":       {"Push the commits of the audit log.", "true"},
+
+	"restic.executable_path":  {"Path to the restic executable.", "/opt/homebrew/bin/restic"},
+	"restic.files_from":       {"The file listing the files and directories to back up, globs are expanded.", ""},
+	"restic.exclude_file":     {"The file listing the files and directories excluded from the backup.", ""},
+	"restic.s3_storage_class": {"S3 storage class of the backup.", "STANDARD"},
+	"restic.sudo":             {"Run `restic backup` via `sudo -n` and the wrapper script to back up root-owned paths.", "true"},
+	"restic.sudo_wrapper":     {"The root-owned wrapper script sudo runs for restic.sudo.", "/usr/local/libexec/restic_wrapper-sudo"},
+	"restic.memory_limit":     {"The soft memory limit of restic, passed as GOMEMLIMIT.", "2GiB"},
+	"restic.gogc":             {"The garbage collection target of restic, passed as GOGC, 0 keeps the default.", "50"},
+	"restic.verify_checksum":  {"Verify the SHA256 of the restic executable before running it.", "true"},
+	"restic.sha256":           {"The pinned SHA256 of the restic executable, empty trusts the one recorded at provisioning.", "5f2a...e4c1"},
+	"restic.memory_max":       {"The hard memory cap of restic, enforced with a systemd scope on Linux.", "4GiB"},
+
+	"remote_config.url":        {"The shared configuration merged under the local one, an https:// URL or an s3://bucket/key object.", "https://config.example.com/backup.yaml"},
+	"remote_config.public_key": {"A base64 encoded Ed25519 key verifying the signature of the remote configuration.", ""},
+	"remote_config.region":     {"The region of the S3 bucket of the remote configuration.", "eu-west-1"},
+
+	"secrets.source":           {"Where the repository and AWS secrets are read from: keychain, files or env.", "files"},
+	"secrets.dir":              {"The directory of the secret files.", ""},
+	"secrets.prefix":           {"Namespaces the keychain accounts (or secret files) of the secrets.", "nas-"},
+	"secrets.accounts":         {"Overrides the keychain account (or secret file) of a secret by its environment variable.", `{"RESTIC_PASSWORD": "restic-password"}`},
+	"secrets.password_command": {"A command printing the repository password, passed as RESTIC_PASSWORD_COMMAND.", "op read op://Private/restic/password"},
+	"secrets.password_file":    {"A file holding the repository password, passed as RESTIC_PASSWORD_FILE.", "~/.config/restic/password"},
+	"aws.profile":              {"The profile of the shared AWS configuration used for the metrics and the notifications.", "monitoring"},
+	"aws.role_arn":             {"A role assumed for the metrics and the notifications.", "arn:aws:iam::123456789012:role/backup-monitoring"},
+	"aws.region":               {"The region of the metrics and the notifications, defaults to the region of the repository.", "us-east-1"},
+	"host_root":                {"Where the host filesystem is mounted when backing up the host from a container.", "/host"},
+
+	"enabled":                  {"Back up the configuration or the profile, unset to keep a profile without backing it up.", "false"},
+	"host_name":                {"Hostname of the snapshots and the metrics, the computer name on macOS or the hostname by default, localhost for the installations made before.", "macbook"},
+	"timezone":                 {"The IANA timezone of the quiet hours, the digest time, the suspensions, the monthly budgets and the retention policy, the local timezone if empty.", "Europe/Berlin"},
+	"security_service":         {"The macOS Keychain service of the secrets.", ""},
+	"require_ac_power":         {"Skip the backups while on battery.", ""},
+	"require_full_disk_access": {"Refuse to back up without macOS Full Disk Access.", ""},
+	"cleanup_old_backups":      {"Apply the retention policy and prune the repository after the backup.", "true"},
+	"auto_tags":                {"Tag the snapshots taken on battery, with missing sources or unreadable files.", ""},
+	"self_backup":              {"Back up the configuration with the secrets redacted, the source lists and the state after every backup.", ""},
+
+	"system_manifest.enabled":          {"Add the installed packages, the scheduled jobs and the exported settings to every backup.", "true"},
+	"system_manifest.defaults_domains": {"The macOS defaults domains exported to the system manifest.", `["com.apple.dock"]`},
+	"system_manifest.commands":         {"Shell commands whose output is added to the system manifest, by file name.", `{"vscode-extensions": "code --list-extensions"}`},
+	"system_manifest.timeout":          {"How long every command of the system manifest may run.", ""},
+
+	"retention.keep_tag": {"Snapshots with this tag are never removed by the retention policy.", ""},
+
+	"restore.sparse":         {"Restore files as sparse files (restic 0.14.0 or later).", "true"},
+	"restore.include_xattrs": {"The extended attributes to restore, all of them when empty (restic 0.17.0 or later).", `["user.*"]`},
+	"restore.exclude_xattrs": {"The extended attributes not to restore (restic 0.17.0 or later).", `["com.apple.quarantine"]`},
+	"restore.acls":           {"Restore the POSIX ACLs stored as extended attributes on Linux.", ""},
+	"restore.overwrite":      {"How existing files in the target are handled: always, if-changed, if-newer or never.", "if-changed"},
+	"restore.verify":         {"Verify the restored files against the snapshot.", "true"},
+	"restore.connections":    {"The number of parallel connections to the backend while restoring, 0 keeps the default.", "16"},
+
+	"restore.cold_storage.enabled":       {"Restore the packs of S3 repositories from the Glacier storage classes before restoring.", "true"},
+	"restore.cold_storage.tier":          {"The retrieval tier of the S3 restore requests: Expedited, Standard or Bulk.", "Bulk"},
+	"restore.cold_storage.days":          {"How many days the restored copies of the packs are kept.", "7"},
+	"restore.cold_storage.poll_interval": {"How often the restore checks whether the packs are readable.", "30m"},
+	"restore.cold_storage.timeout":       {"How long the restore waits for the packs before it fails.", "72h"},
+	"restore.cold_storage.renew_before":  {"The restored copies expiring within this duration are extended while the restore waits.", "24h"},
+
+	"size_rules":           {"Size caps per path, checked before every backup.", ""},
+	"size_rules.path":      {"The directory the rule applies to.", "~/Downloads"},
+	"size_rules.max_size":  {"The size above which the directory is excluded from the backup.", "2GB"},
+	"size_rules.warn_size": {"The size above which a warning is logged and notified.", "5GB"},
+
+	"priorities":       {"Groups of backup sources backed up first, in their order, each in its own snapshot.", ""},
+	"priorities.name":  {"The name of the group.", "critical"},
+	"priorities.paths": {"The sources within these paths belong to the group.", `["~/Documents", "~/.ssh"]`},
+
+	"chunking.enabled":  {"Split the initial backup into chunks backed up in sequence, each in its own snapshot, resuming after the last one backed up.", "true"},
+	"chunking.by":       {"directory makes every top-level directory of the sources a chunk, size packs them into chunks of up to max_size.", "size"},
+	"chunking.max_size": {"The size of the chunks with by size.", "1TB"},
+
+	"docker_volumes.executable_path": {"Path to the docker executable.", ""},
+	"docker_volumes.helper_image":    {"The image of the temporary container reading the volumes, it must provide tar.", ""},
+	"docker_volumes.volumes":         {"Named Docker volumes backed up after the files.", `["nextcloud_data", "postgres_data"]`},
+
+	"staging.repository":       {"A local repository backed up to first, its snapshots are copied to the remote one in the background.", "/Volumes/Backup/restic"},
+	"staging.keep_last":        {"The number of last snapshots kept in the staging repository.", ""},
+	"staging.keep_daily":       {"The number of daily snapshots kept in the staging repository.", ""},
+	"staging.max_sync_runtime": {"The maximum duration of a sync.", ""},
+	"staging.secrets_prefix":   {"Reads the password of the staging repository from its own namespace.", "nas-"},
+
+	"canary.paths": {"Files restored from every new snapshot and compared with the source.", `["~/Documents/canary"]`},
+
+	"warnings.max_groups": {"The number of kinds of unreadable files listed in the notifications.", ""},
+	"warnings.ignore":     {"Patterns of the known warnings not reported, matched against \"<path>: <reason>\".", `["~/Library/*/com.apple.*: operation not permitted"]`},
+
+	"script.file":    {"A Starlark script deciding whether to back up and computing the snapshot tags.", "~/.restic_backup/backup.star"},
+	"script.timeout": {"The maximum duration of the script and of each command it runs.", ""},
+
+	"plugins.dir":        {"The directory of the executables receiving the run events, relative to backup_directory.", ""},
+	"plugins.timeout":    {"The maximum duration of a plugin.", ""},
+	"plugins.env":        {"The environment variables passed to the hooks besides PATH, HOME, USER, the locale and TZ.", `["SLACK_WEBHOOK_URL"]`},
+	"plugins.work_dir":   {"The working directory of the hooks, a fresh temporary directory when empty.", "~/.restic_backup/plugins"},
+	"plugins.max_output": {"The output of a hook kept for the log, the rest is dropped.", "1MiB"},
+
+	"manifests.enabled": {"Store the file list of every snapshot in backup_directory/manifests.", "true"},
+	"manifests.max_age": {"The manifests older than this are removed.", ""},
+
+	"preset":                  {"The built-in exclude lists added to the exclude file, listed by restic_wrapper presets.", `["macos-home", "developer-node"]`},
+	"app_settings":            {"The applications whose settings are added to the backup sources, listed by restic_wrapper presets.", `["vscode", "iterm2", "dotfiles"]`},
+	"macos_metadata.verify":   {"Check that the resource forks and the Finder metadata of sampled files are in every new snapshot.", "true"},
+	"macos_metadata.samples":  {"The number of sampled files with a resource fork or Finder metadata.", ""},
+	"time_machine_exclusions": {"Exclude the items excluded from Time Machine.", "true"},
+
+	"secrets_scan.enabled":   {"Scan the backup sources for files that look like credentials before every backup.", "true"},
+	"secrets_scan.patterns":  {"The file name patterns of credential-looking files.", ""},
+	"secrets_scan.allow":     {"Files that are backed up on purpose and not reported.", `["~/.ssh/id_ed25519"]`},
+	"secrets_scan.max_files": {"The maximum number of files visited by the scan.", ""},
+
+	"check.interval":          {"How often to check the repository after a backup, 0 disables the scheduled checks.", "168h"},
+	"check.read_data_subsets": {"Reads the next 1/K of the repository data with every check, 0 reads none.", "12"},
+	"check.repair_index":      {"Run restic repair index when the check finds a damaged index.", "true"},
+	"check.prune_max_age":     {"Skip prune when the last passed check is older, 0 never skips it.", "336h"},
+
+	"health.warning_threshold":    {"The repository health score (0-100) below which a warning is logged and notified.", ""},
+	"health.max_check_age":        {"The age of the last check after which the score is lowered.", ""},
+	"health.max_prune_age":        {"The age of the last prune after which the score is lowered.", ""},
+	"health.stale_lock_age":       {"The age after which a repository lock is considered stale.", ""},
+	"health.max_growth_ratio":     {"The week-over-week growth of the added data above which the score is lowered.", ""},
+	"health.min_throughput_ratio": {"The share of the usual backup throughput below which it is considered collapsed.", ""},
+
+	"guardrails.max_snapshot_age": {"The age of the newest snapshot of the host above which an alert is sent, 0 disables it.", "48h"},
+	"guardrails.max_count_drop":   {"The share of the snapshots of the host that may disappear unexpectedly, 1 disables the check.", "0.2"},
+
+	"grafana.url":           {"The Grafana server to annotate the backup windows on.", "https://grafana.example.com"},
+	"grafana.token":         {"A Grafana service account token with the permission to write annotations.", ""},
+	"grafana.dashboard_uid": {"Limits the annotations to a dashboard.", ""},
+	"grafana.panel_id":      {"Limits the annotations to a panel of the dashboard.", ""},
+	"grafana.tags":          {"Additional tags of the annotations.", `["backup"]`},
+
+	"influxdb.url":    {"An InfluxDB v2 server receiving the metrics of every run.", "http://influxdb:8086"},
+	"influxdb.org":    {"The InfluxDB organization.", "home"},
+	"influxdb.bucket": {"The InfluxDB bucket.", ""},
+	"influxdb.token":  {"An InfluxDB token with the permission to write to the bucket.", ""},
+
+	"zabbix.server":     {"A Zabbix server or proxy receiving the result of every run in trapper items.", "zabbix.example.com:10051"},
+	"zabbix.host":       {"The host name in Zabbix, defaults to host_name.", ""},
+	"zabbix.key_prefix": {"The prefix of the item keys.", ""},
+
+	"fleet.required_profiles": {"The profiles every host must configure and successfully back up.", `["documents"]`},
+	"fleet.max_backup_age":    {"The age of the last successful backup after which the host is not compliant.", ""},
+	"fleet.locked_keys":       {"The settings that must not be changed by the local configuration or the profiles.", `["retention"]`},
+
+	"system.conf_dir": {"The directory with the per-user configurations of the system-wide mode.", ""},
+
+	"network.http_proxy":     {"The proxy of the HTTP connections of restic and the program.", "http://proxy.example.com:3128"},
+	"network.https_proxy":    {"The proxy of the HTTPS connections of restic and the program.", "http://proxy.example.com:3128"},
+	"network.no_proxy":       {"The hosts connected to directly.", "localhost,.internal"},
+	"network.ca_bundle":      {"A PEM file with additional CA certificates to trust.", "/etc/ssl/corporate-ca.pem"},
+	"network.address_family": {"Pins the connections of the program to ipv4 or ipv6.", "ipv4"},
+
+	"offline.enabled":        {"Check that the repository is reachable before the backup and defer it while it is not.", ""},
+	"offline.retry_interval": {"The first delay between the reachability checks, doubled after every attempt.", ""},
+	"offline.retry_for":      {"How long the run waits for the network before deferring the backup.", ""},
+	"offline.max_deferral":   {"A failure is notified once the backups have been deferred for longer.", ""},
+
+	"restore_credentials.role_arn": {"The IAM role assumed for the restore credentials, empty uses a federation token of the IAM user.", "arn:aws:iam::123456789012:role/restic-restore"},
+	"restore_credentials.duration": {"How long the restore credentials are valid.", "4h"},
+	"security.append_only":         {"Refuse the restic commands deleting data and probe that the credentials cannot delete.", "true"},
+
+	"rest_server.enabled":         {"Run a local rest-server serving rest_server.path and back up to it.", "true"},
+	"rest_server.executable_path": {"Path to the rest-server executable.", ""},
+	"rest_server.path":            {"The directory of the repositories served by rest-server, e.g. on a NAS.", "/Volumes/NAS/restic"},
+	"rest_server.listen":          {"The address rest-server listens on.", ""},
+	"rest_server.append_only":     {"Run rest-server with --append-only, which implies security.append_only.", "false"},
+	"rest_server.htpasswd_file":   {"The htpasswd file of rest-server, empty runs it without authentication.", "~/.restic_backup/.htpasswd"},
+	"rest_server.args":            {"Additional arguments of rest-server.", `["--prometheus"]`},
+
+	"audit.key_unused_after": {"The audit flags the keys whose host has no snapshot for this long.", "2160h"},
+
+	"daemon.interval":              {"How often the daemon backs up.", "30m"},
+	"daemon.watch.enabled":         {"Watch the backup sources and back up when enough files changed.", "true"},
+	"daemon.watch.paths":           {"The directories watched instead of the backup sources.", `["~/Projects"]`},
+	"daemon.watch.min_files":       {"The number of changed files triggering a backup.", ""},
+	"daemon.watch.min_size":        {"The size of the changed files triggering a backup.", "1GiB"},
+	"daemon.watch.debounce":        {"How long no file must change before the triggered backup starts.", ""},
+	"daemon.watch.min_interval":    {"The minimum time between two backups triggered by changes.", ""},
+	"daemon.watch.max_directories": {"The maximum number of watched directories, 1000 by default on macOS.", ""},
+	"daemon.catch_up.enabled":      {"Back up after the login and after a wake from sleep when the last backup is stale.", ""},
+	"daemon.catch_up.max_age":      {"The age of the last successful backup after which it is stale.", "12h"},
+	"daemon.catch_up.delay":        {"How long after the login or the wake the catch-up backup starts.", "10m"},
+	"daemon.heartbeat":             {"How often the daemon checks the snapshot guardrails between the backups, 0 disables it.", "1h"},
+	"daemon.health_listen":         {"The address of the health endpoint of the daemon, GET /healthz, disabled when empty.", ":8080"},
+	"daemon.report.interval":       {"How often the daemon sends the report of the backups, 0 disables it.", "168h"},
+	"daemon.report.format":         {"The format of the report sent by the daemon: markdown or html.", "html"},
+
+	"debug_http.max_age": {"The HTTP debug logs written with --debug-http older than this are removed.", "72h"},
+
+	"max_runtime":                       {"The maximum duration of a run.", "2h"},
+	"bandwidth_budget.monthly":          {"The data the backups may upload per calendar month, empty for no budget.", "200GB"},
+	"bandwidth_budget.approach_percent": {"The percentage of the monthly budget from which the budget is approached.", "90"},
+	"bandwidth_budget.limit_upload":     {"The upload rate in KiB/s once the budget is approached, 0 for no limit.", "512"},
+	"bandwidth_budget.essential":        {"Keep backing up once the budget is approached, false defers the backups of the profile.", "false"},
+	"max_upload_per_run":                {"The data uploaded by a backup after which it stops and resumes on the next run, empty for no cap.", "5GB"},
+	"concurrency_guard.enabled":         {"Defer the backup while Time Machine, restic or another profile is backing up.", "true"},
+	"concurrency_guard.detect":          {"The backups detected by the guard: time-machine, restic and profiles.", `["time-machine", "profiles"]`},
+	"concurrency_guard.action":          {"What to do when another backup is running: defer, wait or warn.", "wait"},
+	"concurrency_guard.max_wait":        {"How long the wait action waits for the other backup before deferring the run.", "1h"},
+	"prevent_sleep":                     {"Keep the system from sleeping while idle during the run.", ""},
+	"sleep_grace_period":                {"How long the sleep or the shutdown of the system is delayed while the backup stops, 0 does not stop it (Linux only).", "10s"},
+	"stop_grace_period":                 {"restic is interrupted this long before max_runtime so it can stop gracefully.", ""},
+
+	"notifications.on_success":                   {"Send notifications for successful runs.", ""},
+	"notifications.digest":                       {"Batch the notifications of non-failed runs into a daily digest.", "true"},
+	"notifications.digest_time":                  {"The time of day (HH:MM) after which the daily digest is sent by the next run.", ""},
+	"notifications.quiet_hours.start":            {"The start of the quiet hours (HH:MM) holding back the notifications of non-failed runs.", "22:00"},
+	"notifications.quiet_hours.end":              {"The end of the quiet hours (HH:MM).", "07:00"},
+	"notifications.title_template":               {"The Go template of the notification title.", "{{ .HostName }}: {{ upper .Status }}"},
+	"notifications.body_template":                {"The Go template of the notification body.", "{{ bytes .BytesAdded }} added in {{ .Duration }}"},
+	"notifications.sns.topic_arn":                {"The SNS topic to publish the run summary to.", "arn:aws:sns:us-east-1:123456789012:backups"},
+	"notifications.sns.region":                   {"The region of the SNS topic.", ""},
+	"notifications.pagerduty.routing_key":        {"The integration key of a PagerDuty service (Events API v2).", ""},
+	"notifications.opsgenie.api_url":             {"The Opsgenie API endpoint.", "https://api.eu.opsgenie.com"},
+	"notifications.opsgenie.api_key":             {"The API key of an Opsgenie integration.", ""},
+	"notifications.mqtt.broker":                  {"The MQTT broker to publish the run status to.", "tcp://homeassistant.local:1883"},
+	"notifications.mqtt.username":                {"The MQTT user name.", ""},
+	"notifications.mqtt.password":                {"The MQTT password.", ""},
+	"notifications.mqtt.topic_prefix":            {"The prefix of the MQTT topics.", ""},
+	"notifications.mqtt.homeassistant_discovery": {"Publish Home Assistant discovery messages.", "true"},
+	"notifications.mqtt.discovery_prefix":        {"The Home Assistant discovery prefix.", ""},
+	"notifications.ntfy.server":                  {"The ntfy server.", ""},
+	"notifications.ntfy.topic":                   {"The ntfy topic to push the run summary to.", "backups"},
+	"notifications.ntfy.token":                   {"The access token of protected ntfy topics.", ""},
+	"notifications.gotify.server":                {"The Gotify server to push the run summary to.", "https://gotify.example.com"},
+	"notifications.gotify.token":                 {"The Gotify application token.", ""},
+	"notifications.apprise.executable_path":      {"Path to the apprise executable.", ""},
+	"notifications.apprise.urls":                 {"Apprise notification URLs to send the run summary to.", `["tgram://bottoken/ChatID"]`},
+}
+
+// configOption is a configuration key with its type and default value
+type configOption struct {
+	Key     string
+	Type    string
+	Default interface{}
+	Help    string
+	Example string
+}
+
+// configTypeName returns the name of the type of a configuration key
+func configTypeName(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Struct {
+			return "list of objects"
+		}
+		return "list of " + configTypeName(t.Elem()) + "s"
+	case reflect.Map:
+		return "map of " + configTypeName(t.Elem()) + "s"
+	}
+	return t.Kind().String()
+}
+
+// collectConfigOptions appends the keys of the struct type to the options, in the order of the fields
+func collectConfigOptions(options []configOption, t reflect.Type, prefix string) []configOption {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, squash := field.Tag.Get("mapstructure"), false
+		if name == ",squash" {
+			name, squash = "", true
+		}
+		if name == "" && !squash {
+			continue
+		}
+		key := prefix + name
+		switch {
+		case squash:
+			options = collectConfigOptions(options, field.Type, prefix)
+		case field.Type.Kind() == reflect.Struct:
+			options = collectConfigOptions(options, field.Type, key+".")
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			options = append(options, configOption{Key: key, Type: configTypeName(field.Type)})
+			options = collectConfigOptions(options, field.Type.Elem(), key+".")
+		default:
+			options = append(options, configOption{Key: key, Type: configTypeName(field.Type)})
+		}
+	}
+	return options
+}
+
+// configOptions returns the documented configuration keys with their default values. The keys read directly from
+// viper, e.g. the remote configuration, are found among the defaults.
+func configOptions() []configOption {
+	defaults := viper.New()
+	setDefaults(defaults, "~")
+	options := collectConfigOptions(nil, reflect.TypeOf(Config{}), "")
+	known := map[string]bool{}
+	for _, option := range options {
+		known[option.Key] = true
+	}
+	var extra []string
+	for _, key := range defaults.AllKeys() {
+		if !known[key] {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		options = append(options, configOption{Key: key, Type: configTypeName(reflect.TypeOf(defaults.Get(key)))})
+	}
+
+	for i := range options {
+		option := &options[i]
+		option.Default = defaults.Get(option.Key)
+		doc, ok := configDocs[option.Key]
+		if !ok {
+			// The notification channels share the documentation of the templates
+			if base := option.Key[strings.LastIndex(option.Key, ".")+1:]; strings.HasSuffix(base, "_template") {
+				doc = configDocs["notifications."+base]
+				doc.help = strings.TrimSuffix(doc.help, ".") + " of the channel, overriding notifications." + base + "."
+			}
+		}
+		option.Help, option.Example = doc.help, doc.example
+	}
+	return options
+}
+
+// configDocsDrift returns the configuration keys without an entry in configDocs and the entries of configDocs that
+// are not configuration keys, so a key added to Config without documentation is noticed
+func configDocsDrift(options []configOption) (missing, stale []string) {
+	keys := map[string]bool{}
+	for _, option := range options {
+		keys[option.Key] = true
+		base := option.Key[strings.LastIndex(option.Key, ".")+1:]
+		if _, ok := configDocs[option.Key]; !ok && !strings.HasSuffix(base, "_template") {
+			missing = append(missing, option.Key)
+		}
+	}
+	for key := range configDocs {
+		if !keys[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return missing, stale
+}
+
+// formatConfigValue formats a default value as YAML
+func formatConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return `""`
+	case time.Duration:
+		s := v.String()
+		if strings.HasSuffix(s, "m0s") {
+			s = strings.TrimSuffix(s, "0s")
+		}
+		if strings.HasSuffix(s, "h0m") {
+			s = strings.TrimSuffix(s, "0m")
+		}
+		return `"` + s + `"`
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// writeConfigMarkdown writes the reference of the configuration keys as Markdown, grouped by their top-level key
+func writeConfigMarkdown(w io.Writer, options []configOption) {
+	sections := []string{"General"}
+	grouped := map[string][]configOption{}
+	for _, option := range options {
+		section := "General"
+		if i := strings.Index(option.Key, "."); i >= 0 {
+			section = option.Key[:i]
+		}
+		if _, ok := grouped[section]; !ok && section != "General" {
+			sections = append(sections, section)
+		}
+		grouped[section] = append(grouped[section], option)
+	}
+
+	fmt.Fprintln(w, "# Configuration reference")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Generated by `restic_wrapper config docs`. The keys are set in `~/.restic_backup/config.yaml`.")
+	for _, section := range sections {
+		fmt.Fprintf(w, "\n## %s\n\n", section)
+		for _, option := range grouped[section] {
+			fmt.Fprintf(w, "- `%s` (%s", option.Key, option.Type)
+			if option.Default != nil {
+				fmt.Fprintf(w, ", default `%s`", formatConfigValue(option.Default))
+			}
+			fmt.Fprint(w, ")")
+			if option.Help != "" {
+				fmt.Fprint(w, ": "+option.Help)
+			}
+			if option.Example != "" {
+				fmt.Fprintf(w, " Example: `%s`", option.Example)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// writeConfigYAML writes a configuration file with every key set to its default value and the documentation in
+// comments
+func writeConfigYAML(w io.Writer, options []configOption) {
+	fmt.Fprintln(w, "# Generated by restic_wrapper config docs, every key is set to its default value")
+	var open []string
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		parts := strings.Split(option.Key, ".")
+		common := 0
+		for common < len(open) && common < len(parts)-1 && open[common] == parts[common] {
+			common++
+		}
+		open = open[:common]
+		if common == 0 && len(parts) > 1 {
+			fmt.Fprintln(w)
+		}
+		for _, part := range parts[common : len(parts)-1] {
+			fmt.Fprintf(w, "%s%s:\n", strings.Repeat("  ", len(open)), part)
+			open = append(open, part)
+		}
+		indent := strings.Repeat("  ", len(open))
+		if option.Help != "" {
+			fmt.Fprintf(w, "%s# %s\n", indent, option.Help)
+		}
+		if option.Example != "" {
+			fmt.Fprintf(w, "%s# Example: %s\n", indent, option.Example)
+		}
+		if option.Type != "list of objects" {
+			fmt.Fprintf(w, "%s%s: %s\n", indent, parts[len(parts)-1], formatConfigValue(option.Default))
+			continue
+		}
+		fmt.Fprintf(w, "%s%s: []\n", indent, parts[len(parts)-1])
+		// The list is empty by default, its item is shown in comments
+		for first := true; i+1 < len(options) && strings.HasPrefix(options[i+1].Key, option.Key+"."); first = false {
+			i++
+			item := options[i]
+			bullet := "  "
+			if first {
+				bullet = "- "
+			}
+			fmt.Fprintf(w, "%s#   %s%s: %s", indent, bullet, strings.TrimPrefix(item.Key, option.Key+"."), formatConfigValue(item.Example))
+			if item.Help != "" {
+				fmt.Fprintf(w, "  # %s", item.Help)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// newConfigCmd returns the command working with the configuration
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Work with the configuration",
+		Args:  cobra.NoArgs,
+	}
+	var (
+		format string
+		check  bool
+	)
+	docs := &cobra.Command{
+		Use:   "docs",
+		Short: "Print the reference of the configuration keys",
+		Long: "Prints every configuration key with its type, default value, description and an example, generated from " +
+			"the program itself so it matches the installed version. --format yaml prints a configuration file with " +
+			"every key set to its default value and the documentation in comments, a starting point for a new " +
+			"configuration. --check prints nothing else and fails when a key has no documentation or a documented " +
+			"key does not exist, run by make check.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := configOptions()
+			if check {
+				missing, stale := configDocsDrift(options)
+				for _, key := range missing {
+					fmt.Fprintf(cmd.OutOrStdout(), "undocumented key: %s\n", key)
+				}
+				for _, key := range stale {
+					fmt.Fprintf(cmd.OutOrStdout(), "documented key not in the configuration: %s\n", key)
+				}
+				if len(missing) > 0 || len(stale) > 0 {
+					return fmt.Errorf("the configuration documentation is out of date, %d undocumented and %d unknown keys", len(missing), len(stale))
+				}
+				return nil
+			}
+			switch format {
+			case "markdown":
+				writeConfigMarkdown(cmd.OutOrStdout(), options)
+			case "yaml":
+				writeConfigYAML(cmd.OutOrStdout(), options)
+			default:
+				return fmt.Errorf("unknown format %q, expected markdown or yaml", format)
+			}
+			return nil
+		},
+	}
+	docs.Flags().BoolVar(&check, "check", false, "fail when the documentation of the keys is out of date")
+	cmd.AddCommand(docs)
+	cmd.PersistentFlags().StringVar(&format, "format", "markdown", "the output format (markdown or yaml)")
+	return cmd
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inContainer reports whether the program runs in a Docker or Kubernetes container
+func inContainer() bool {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return true
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" || os.Getenv("container") != "" {
+		return true
+	}
+	cgroup, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(cgroup), runtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPath returns the path of the host file within the bind-mounted host filesystem
+func hostPath(path string) string {
+	if appConfig.HostRoot == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appConfig.HostRoot, path)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// contentionDetectors checks whether other backups read the disks, each returning what it found or ""
+var contentionDetectors = map[string]func(ctx context.Context) string{
+	"time-machine": timeMachineRunning,
+	"restic":       otherResticProcess,
+	"profiles":     otherProfileRunning,
+}
+
+// validateConcurrencyGuard checks the detection list and the action of the concurrency guard
+func validateConcurrencyGuard() error {
+	for _, name := range appConfig.ConcurrencyGuard.Detect {
+		if _, ok := contentionDetectors[name]; !ok {
+			return fmt.Errorf("invalid concurrency_guard.detect %q, expected time-machine, restic or profiles", name)
+		}
+	}
+	switch appConfig.ConcurrencyGuard.Action {
+	case "defer", "wait", "warn":
+		return nil
+	}
+	return fmt.Errorf("invalid concurrency_guard.action %q, expected defer, wait or warn", appConfig.ConcurrencyGuard.Action)
+}
+
+// timeMachineRunning reports a running Time Machine backup
+func timeMachineRunning(ctx context.Context) string {
+	if runtime.GOOS != "darwin" {
+		return ""
+	}
+	output, err := exec.CommandContext(ctx, "tmutil", "status").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) == "Running = 1;" {
+			return "a Time Machine backup is running"
+		}
+	}
+	return ""
+}
+
+// process is an entry of the process list
+type process struct {
+	pid, ppid int
+	name      string
+}
+
+// listProcesses returns the running processes, from /proc on Linux and ps elsewhere
+func listProcesses(ctx context.Context) ([]process, error) {
+	if runtime.GOOS == "linux" {
+		entries, err := os.ReadDir("/proc")
+		if err != nil {
+			return nil, err
+		}
+		var processes []process
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			// The name is in parentheses and may contain spaces, the state and the parent follow it
+			stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+			if err != nil {
+				continue
+			}
+			open, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+			if open < 0 || end < open {
+				continue
+			}
+			fields := strings.Fields(string(stat[end+1:]))
+			// The exited processes not yet reaped by their parent don't read anything
+			if len(fields) < 2 || fields[0] == "Z" {
+				continue
+			}
+			ppid, _ := strconv.Atoi(fields[1])
+			processes = append(processes, process{pid, ppid, string(stat[open+1 : end])})
+		}
+		return processes, nil
+	}
+	output, err := exec.CommandContext(ctx, "ps", "-axo", "pid=,ppid=,stat=,comm=").Output()
+	if err != nil {
+		return nil, err
+	}
+	var processes []process
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || strings.HasPrefix(fields[2], "Z") {
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[0])
+		ppid, _ := strconv.Atoi(fields[1])
+		processes = append(processes, process{pid, ppid, filepath.Base(strings.Join(fields[3:], " "))})
+	}
+	return processes, nil
+}
+
+// otherResticProcess reports a restic process not started by this run, e.g. another backup tool or a manual prune
+func otherResticProcess(ctx context.Context) string {
+	processes, err := listProcesses(ctx)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot list the processes")
+		return ""
+	}
+	names := []string{"restic", filepath.Base(appConfig.Restic.Path)}
+	self := os.Getpid()
+	for _, p := range processes {
+		if p.pid != self && p.ppid != self && slices.Contains(names, p.name) {
+			return fmt.Sprintf("restic is running with the PID %d", p.pid)
+		}
+	}
+	return ""
+}
+
+// profileLockFiles returns the lock files of the runs of the other profiles and of the run without a profile
+func profileLockFiles() []string {
+	base := viper.GetString("lock_file")
+	if unprofiled, ok := unprofiledFiles["lock_file"]; ok {
+		base = unprofiled
+	}
+	var paths []string
+	if activeProfile != "" {
+		paths = append(paths, filepath.Join(appConfig.BackupDir, base))
+	}
+	for _, profile := range profileNames() {
+		if profile == activeProfile {
+			continue
+		}
+		name := viper.GetString("profiles." + profile + ".lock_file")
+		if name == "" {
+			name = profileFileName(base, profile)
+		}
+		paths = append(paths, filepath.Join(appConfig.BackupDir, name))
+	}
+	return paths
+}
+
+// otherProfileRunning reports a backup of another profile holding its lock
+func otherProfileRunning(context.Context) string {
+	for _, path := range profileLockFiles() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		lock := flock.New(path)
+		locked, err := lock.TryRLock()
+		if err != nil {
+			continue
+		}
+		if !locked {
+			return "the backup of another profile is running (" + filepath.Base(path) + ")"
+		}
+		lock.Unlock()
+	}
+	return ""
+}
+
+// detectContention returns the first backup found reading the disks, checked with the configured detectors
+func detectContention(ctx context.Context) string {
+	for _, name := range appConfig.ConcurrencyGuard.Detect {
+		if found := contentionDetectors[name](ctx); found != "" {
+			return found
+		}
+	}
+	return ""
+}
+
+// checkContention checks that no other backup reads the disks before the backup, so two backups don't compete for
+// the heads of a spinning disk. It returns false when the run is deferred to the next scheduled run.
+func checkContention(ctx context.Context) bool {
+	if !appConfig.ConcurrencyGuard.Enabled {
+		return true
+	}
+	found := detectContention(ctx)
+	if found == "" {
+		return true
+	}
+	switch appConfig.ConcurrencyGuard.Action {
+	case "warn":
+		log.WithField("reason", found).Warn("Another backup is running, backing up anyway")
+		return true
+	case "wait":
+		log.WithFields(log.Fields{"reason": found, "max_wait": appConfig.ConcurrencyGuard.MaxWait}).Info("Another backup is running, waiting for it to finish")
+		deadline := time.Now().Add(appConfig.ConcurrencyGuard.MaxWait)
+		for found != "" && time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(30 * time.Second):
+			}
+			found = detectContention(ctx)
+		}
+		if found == "" {
+			return true
+		}
+	}
+	log.WithField("reason", found).Info("Another backup is running, the backup is deferred to the next run")
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// runDaemonBackup backs up in a child process, like a scheduled run, so a failing run does not stop the daemon
+func runDaemonBackup(ctx context.Context, reason string) {
+	executable, err := os.Executable()
+	if err != nil {
+		log.WithField("err", err).Error("cannot find the executable")
+		return
+	}
+	var args []string
+	if activeProfile != "" {
+		args = append(args, "--profile", activeProfile)
+	}
+	if debugHTTP {
+		args = append(args, "--debug-http")
+	}
+	log.WithField("reason", reason).Info("Starting a backup")
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Stop the backup gracefully with the daemon
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = appConfig.StopGracePeriod
+	if err = cmd.Run(); err != nil {
+		log.WithFields(log.Fields{"reason": reason, "err": err}).Error("The backup failed")
+	}
+}
+
+// runDaemon backs up every daemon.interval and whenever a trigger fires, until the context is done
+func runDaemon(ctx context.Context) error {
+	triggers := make(chan string, 1)
+	var watcher *changeWatcher
+	if appConfig.Daemon.Watch.Enabled {
+		var paths []string
+		for _, path := range appConfig.Daemon.Watch.Paths {
+			paths = append(paths, expandPath(path))
+		}
+		if len(paths) == 0 {
+			sources, err := expandSources(filepath.Join(appConfig.BackupDir, appConfig.Restic.FilesFrom))
+			if err != nil {
+				return err
+			}
+			paths = sources
+		}
+		var err error
+		if watcher, err = newChangeWatcher(paths); err != nil {
+			return err
+		}
+		go watcher.run(ctx, triggers)
+	}
+
+	// The daemon starts at login, a stale backup is caught up after the login and after every wake from sleep
+	var (
+		catchUp       <-chan time.Time
+		catchUpReason string
+		wakes         = make(chan time.Duration, 1)
+	)
+	scheduleCatchUp := func(reason string) {
+		if !appConfig.Daemon.CatchUp.Enabled || catchUp != nil || !lastBackupStale(appConfig.Daemon.CatchUp.MaxAge, time.Now()) {
+			return
+		}
+		log.WithFields(log.Fields{"reason": reason, "delay": appConfig.Daemon.CatchUp.Delay}).Info("The last backup is stale, catching up")
+		catchUp, catchUpReason = time.After(appConfig.Daemon.CatchUp.Delay), reason
+	}
+	go watchWake(ctx, wakes)
+	scheduleCatchUp("login")
+	started := time.Now()
+
+	if appConfig.RestServer.Enabled {
+		supervised := make(chan struct{})
+		go func() {
+			superviseRestServer(ctx)
+			close(supervised)
+		}()
+		// Stop rest-server before the daemon exits
+		defer func() { <-supervised }()
+	}
+
+	if appConfig.Daemon.HealthListen != "" {
+		stopped, err := serveHealth(ctx, started)
+		if err != nil {
+			return err
+		}
+		defer stopped()
+	}
+
+	log.WithField("interval", appConfig.Daemon.Interval).Info("The daemon started")
+	ticker := time.NewTicker(appConfig.Daemon.Interval)
+	defer ticker.Stop()
+	var heartbeat <-chan time.Time
+	if appConfig.Daemon.Heartbeat > 0 && guardrailsEnabled() {
+		heartbeats := time.NewTicker(appConfig.Daemon.Heartbeat)
+		defer heartbeats.Stop()
+		heartbeat = heartbeats.C
+		setupEnv()
+	}
+	// The report is scheduled from the state, so a restarted daemon keeps the interval
+	var report <-chan time.Time
+	scheduleReport := func() {
+		if due := reportDue(started); !due.IsZero() {
+			report = time.After(time.Until(due))
+		}
+	}
+	scheduleReport()
+	var lastBackup time.Time
+	backup := func(reason string) {
+		lastBackup = time.Now()
+		if watcher != nil {
+			watcher.reset()
+		}
+		runDaemonBackup(ctx, reason)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("The daemon stopped")
+			return nil
+		case <-ticker.C:
+			backup("schedule")
+		case <-heartbeat:
+			runGuardrailHeartbeat(ctx)
+		case <-report:
+			runDaemonReport(ctx)
+			scheduleReport()
+		case slept := <-wakes:
+			log.WithField("slept", slept.Round(time.Second)).Info("The system woke from sleep")
+			scheduleCatchUp("wake")
+		case <-catchUp:
+			catchUp = nil
+			// A scheduled backup may have run in the meantime
+			if lastBackupStale(appConfig.Daemon.CatchUp.MaxAge, time.Now()) {
+				backup(catchUpReason)
+			}
+		case reason := <-triggers:
+			// The changes keep accumulating and trigger the backup once the minimum interval has passed
+			if time.Since(lastBackup) < appConfig.Daemon.Watch.MinInterval {
+				continue
+			}
+			backup(reason)
+		}
+	}
+}
+
+// newDaemonCmd returns the command running the backups from a long-running process
+func newDaemonCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "daemon",
+		Short: "Run the backups from a long-running process",
+		Long: "Runs in the foreground and backs up every daemon.interval, as an alternative to the launchd agent " +
+			"or a cron job, e.g. as a systemd user service. With daemon.watch.enabled the backup sources are " +
+			"watched for changes, and an extra backup runs when enough files changed and the changes settled, " +
+			"giving near-continuous protection to active project directories. When the last backup is older than " +
+			"daemon.catch_up.max_age at the start of the daemon (e.g. at login) or after the system woke from sleep, " +
+			"a catch-up backup runs after daemon.catch_up.delay. Every backup runs in its own process. Every " +
+			"daemon.heartbeat the snapshot guardrails are checked between the backups. With daemon.health_listen " +
+			"GET /healthz answers 503 while the last backup is older than daemon.catch_up.max_age. Every " +
+			"daemon.report.interval the report of the backups is sent via the notifiers, like report --weekly.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if appConfig.Daemon.Interval <= 0 {
+				return fmt.Errorf("invalid daemon.interval %s", appConfig.Daemon.Interval)
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runDaemon(ctx)
+		},
+	}
+}
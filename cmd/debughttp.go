@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// debugHTTP enables the HTTP debug log of the run, set with --debug-http
+var debugHTTP bool
+
+// debugLog is the HTTP debug log of the run, nil without --debug-http
+var debugLog *debugLogFile
+
+// debugLogPrefix is the prefix of the names of the HTTP debug logs in the log directory
+const debugLogPrefix = "debug-http-"
+
+// debugSecretHeaderRe matches the headers holding credentials in the dumped requests
+var debugSecretHeaderRe = regexp.MustCompile(`(?im)^((?:authorization|proxy-authorization|x-amz-security-token|cookie|set-cookie|x-api-key|x-gotify-key)\s*:\s*).*$`)
+
+// debugSecretParamRe matches the names of the query parameters holding credentials
+var debugSecretParamRe = regexp.MustCompile(`(?i)token|key|secret|password|signature|credential`)
+
+// debugLogFile is the HTTP debug log shared by the program and restic, writing whole entries
+type debugLogFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// write appends the entry to the log with the credentials redacted
+func (l *debugLogFile) write(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry = debugSecretHeaderRe.ReplaceAllString(entry, "${1}"+redactedValue)
+	fmt.Fprintf(l.file, "%s %s\n\n", time.Now().Format(time.RFC3339Nano), bytes.TrimSpace([]byte(entry)))
+}
+
+// Logf implements the logger of the AWS SDK
+func (l *debugLogFile) Logf(classification logging.Classification, format string, v ...any) {
+	l.write(fmt.Sprintf("[aws %s] ", classification) + fmt.Sprintf(format, v...))
+}
+
+// debugLogDir returns the directory of the HTTP debug logs, next to the log of the program
+func debugLogDir() string {
+	return filepath.Join(appConfig.BackupDir, "logs")
+}
+
+// startDebugHTTP opens the HTTP debug log of the run with --debug-http and removes the expired ones
+func startDebugHTTP() error {
+	expireDebugLogs(time.Now())
+	if !debugHTTP {
+		return nil
+	}
+	name := debugLogPrefix
+	if activeProfile != "" {
+		name += activeProfile + "-"
+	}
+	path := filepath.Join(debugLogDir(), name+time.Now().Format("20060102-150405")+".log")
+	if err := os.MkdirAll(debugLogDir(), 0o700); err != nil {
+		return fmt.Errorf("failed to create the log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the HTTP debug log: %w", err)
+	}
+	debugLog = &debugLogFile{file: file}
+	log.WithField("path", path).Info("Logging the HTTP requests")
+	return nil
+}
+
+// expireDebugLogs removes the HTTP debug logs older than debug_http.max_age
+func expireDebugLogs(now time.Time) {
+	paths, _ := filepath.Glob(filepath.Join(debugLogDir(), debugLogPrefix+"*.log"))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || now.Sub(info.ModTime()) <= appConfig.DebugHTTP.MaxAge {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			log.WithFields(log.Fields{"path": path, "err": err}).Warn("cannot remove the expired HTTP debug log")
+		}
+	}
+}
+
+// debugResticEnv returns the environment of restic writing its debug log to the HTTP debug log, which only restic
+// built with the debug tag does
+func debugResticEnv() []string {
+	if debugLog == nil {
+		return nil
+	}
+	return []string{"DEBUG_LOG=" + debugLog.file.Name()}
+}
+
+// debugAwsOptions returns the options of the AWS SDK logging the requests, the responses and the retries
+func debugAwsOptions() []func(*config.LoadOptions) error {
+	if debugLog == nil {
+		return nil
+	}
+	return []func(*config.LoadOptions) error{
+		config.WithLogger(debugLog),
+		config.WithClientLogMode(aws.LogRequest | aws.LogResponse | aws.LogRetries | aws.LogSigning),
+	}
+}
+
+// debugTransport logs the requests of the program and their responses without the bodies
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logged := req.Clone(req.Context())
+	if query := logged.URL.Query(); len(query) > 0 {
+		for name := range query {
+			if debugSecretParamRe.MatchString(name) {
+				query.Set(name, redactedValue)
+			}
+		}
+		logged.URL.RawQuery = query.Encode()
+	}
+	if dump, err := httputil.DumpRequestOut(logged, false); err == nil {
+		debugLog.write("Request\n" + string(dump))
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		debugLog.write(fmt.Sprintf("Request to %s failed after %s: %v", req.URL.Host, time.Since(start), err))
+		return nil, err
+	}
+	if dump, err := httputil.DumpResponse(resp, false); err == nil {
+		debugLog.write(fmt.Sprintf("Response after %s\n%s", time.Since(start).Round(time.Millisecond), dump))
+	}
+	return resp, nil
+}
+
+// debugRoundTripper wraps the transport with the HTTP debug log of the run
+func debugRoundTripper(transport http.RoundTripper) http.RoundTripper {
+	if debugLog == nil {
+		return transport
+	}
+	return &debugTransport{next: transport}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotNode is a file, directory or symlink of a snapshot as printed by restic ls --json
+type snapshotNode struct {
+	Path       string      `json:"path"`
+	Type       string      `json:"type"`
+	Size       int64       `json:"size"`
+	Mode       os.FileMode `json:"mode"`
+	Mtime      time.Time   `json:"mtime"`
+	LinkTarget string      `json:"linktarget"`
+	StructType string      `json:"struct_type"`
+}
+
+// differsFrom reports whether the file restored to the path differs from the node. The size and the modification
+// time are compared like rsync does, restic then compares the contents of the differing files chunk by chunk.
+func (n snapshotNode) differsFrom(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return true
+	}
+	switch n.Type {
+	case "file":
+		return !info.Mode().IsRegular() || info.Size() != n.Size || info.ModTime().Unix() != n.Mtime.Unix()
+	case "symlink":
+		link, err := os.Readlink(path)
+		return err != nil || link != n.LinkTarget
+	}
+	return false
+}
+
+// restoreDelta compares the target directory with the files of the snapshot under the paths, all of them if none
+// are given. It returns the paths of the snapshot that differ, the number of compared files and the size to restore.
+func restoreDelta(ctx context.Context, snapshotID, target string, paths []string) ([]string, int, int64, error) {
+	args := []string{"ls", "--json", snapshotID}
+	if len(paths) > 0 {
+		// Without --recursive restic only lists the direct children of the directories
+		args = append(append(args, "--recursive"), paths...)
+	}
+	output, err := runResticCommand(ctx, args...)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("restic ls failed: %w", err)
+	}
+	var (
+		changed []string
+		total   int
+		size    int64
+	)
+	for _, line := range strings.Split(output, "\n") {
+		var node snapshotNode
+		if json.Unmarshal([]byte(line), &node) != nil || node.StructType != "node" {
+			continue
+		}
+		if node.Type != "file" && node.Type != "symlink" {
+			continue
+		}
+		total++
+		if node.differsFrom(filepath.Join(target, node.Path)) {
+			changed = append(changed, node.Path)
+			size += node.Size
+		}
+	}
+	return changed, total, size, nil
+}
+
+// writeIncludeFile writes the paths to a temporary restic --include-file, returning its path
+func writeIncludeFile(paths []string) (string, error) {
+	file, err := os.CreateTemp("", "restic_wrapper-include-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the include file: %w", err)
+	}
+	defer file.Close()
+	for _, path := range paths {
+		if _, err = fmt.Fprintln(file, excludePatternReplacer.Replace(path)); err != nil {
+			os.Remove(file.Name())
+			return "", fmt.Errorf("failed to write the include file: %w", err)
+		}
+	}
+	return file.Name(), file.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerVolumeTag is added to the snapshots of Docker volumes
+const dockerVolumeTag = "docker-volume"
+
+// backupDockerVolumes backs up every configured Docker volume as a tar stream, each into its own snapshot.
+// A helper container mounts the volume read-only and restic reads the tar archive from its output.
+func backupDockerVolumes(ctx context.Context, summary *runSummary) error {
+	version, err := installedResticVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get the restic version: %w", err)
+	}
+	if !version.atLeast(0, 17, 0) {
+		return fmt.Errorf("restic %s cannot back up Docker volumes, 0.17.0 or later is required", version)
+	}
+
+	var failed error
+	for _, volume := range appConfig.DockerVolumes.Volumes {
+		args := []string{"backup",
+			"--host", appConfig.HostName,
+			"--stdin-from-command",
+			"--stdin-filename", volume + ".tar",
+			"--tag", dockerVolumeTag,
+			"--tag", "volume=" + volume,
+			"--",
+			appConfig.DockerVolumes.Path, "run", "--rm",
+			"-v", volume + ":/volume:ro",
+			appConfig.DockerVolumes.HelperImage,
+			"tar", "-C", "/volume", "-cf", "-", ".",
+		}
+		if _, err := summary.runNamedStage(ctx, "volume "+volume, args...); err != nil {
+			log.WithFields(log.Fields{"volume": volume, "err": err}).Error("cannot back up the Docker volume")
+			if failed == nil {
+				failed = fmt.Errorf("failed to back up the Docker volume %s: %w", volume, err)
+			}
+			continue
+		}
+		log.WithField("volume", volume).Info("Backed up the Docker volume")
+	}
+	return failed
+}
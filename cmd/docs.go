@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+// newGenDocsCmd returns the command generating the man pages or the Markdown documentation of the commands
+func newGenDocsCmd() *cobra.Command {
+	var (
+		dir    string
+		format string
+	)
+	cmd := &cobra.Command{
+		Use:   "gen-docs",
+		Short: "Generate the man pages of the commands",
+		Long: "Generates a man page for every command in the directory, e.g. " +
+			"\"restic_wrapper gen-docs --dir /usr/local/share/man/man1\". --format markdown generates Markdown instead.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return fmt.Errorf("failed to create the documentation directory: %w", err)
+			}
+			root := cmd.Root()
+			root.DisableAutoGenTag = true
+			switch format {
+			case "man":
+				return doc.GenManTree(root, &doc.GenManHeader{Title: "RESTIC_WRAPPER", Section: "1"}, dir)
+			case "markdown":
+				return doc.GenMarkdownTree(root, dir)
+			}
+			return fmt.Errorf("unknown format %q, expected man or markdown", format)
+		},
+	}
+	cmd.Flags().StringVar(&dir, "dir", "man", "the directory to write the documentation to")
+	cmd.Flags().StringVar(&format, "format", "man", "the documentation format (man or markdown)")
+	return cmd
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// addressFamilies maps the network.address_family values to the networks dialed
+var addressFamilies = map[string]string{
+	"":     "tcp",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+// dialNetwork returns the network the program connects over, pinning the configured address family
+func dialNetwork() string {
+	if network, ok := addressFamilies[appConfig.Network.AddressFamily]; ok {
+		return network
+	}
+	return "tcp"
+}
+
+// diagnoseEndpoint resolves the endpoint and connects to every address of the allowed family,
+// printing the resolution and connection times
+func diagnoseEndpoint(ctx context.Context, w io.Writer, endpoint, family string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	fmt.Fprintf(w, "Repository endpoint: %s\n", endpoint)
+	if proxy := endpointProxy(endpoint); proxy != nil {
+		fmt.Fprintf(w, "Proxy: %s (restic connects through it, the checks below do not)\n", proxy.Redacted())
+	}
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		fmt.Fprintf(w, "DNS: FAIL after %s: %v\n", time.Since(start).Round(time.Millisecond), err)
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	fmt.Fprintf(w, "DNS: resolved in %s\n", time.Since(start).Round(time.Millisecond))
+
+	reachable := false
+	for _, addr := range addrs {
+		label := "IPv4"
+		if addr.IP.To4() == nil {
+			label = "IPv6"
+		}
+		if (family == "ipv4" && label != "IPv4") || (family == "ipv6" && label != "IPv6") {
+			fmt.Fprintf(w, "  %s %s: skipped, the address family is pinned to %s\n", label, addr.String(), family)
+			continue
+		}
+		dialer := net.Dialer{Timeout: 10 * time.Second}
+		start = time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Fprintf(w, "  %s %s: FAIL after %s: %v\n", label, addr.String(), elapsed, err)
+			continue
+		}
+		conn.Close()
+		reachable = true
+		fmt.Fprintf(w, "  %s %s: connected in %s\n", label, addr.String(), elapsed)
+	}
+	if !reachable {
+		return errors.New("the repository endpoint is unreachable")
+	}
+	return nil
+}
+
+// Results of a doctor check
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// doctorColors are the ANSI colors of the check results
+var doctorColors = map[string]string{
+	doctorPass: "\033[32m",
+	doctorWarn: "\033[33m",
+	doctorFail: "\033[31m",
+}
+
+// doctorReport prints the results of the doctor checks
+type doctorReport struct {
+	w      io.Writer
+	color  bool
+	failed bool
+}
+
+// add prints the result of a check
+func (r *doctorReport) add(result, name, format string, args ...any) {
+	label := "[" + result + "]"
+	if r.color {
+		label = doctorColors[result] + label + "\033[0m"
+	}
+	fmt.Fprintf(r.w, "%s %s: %s\n", label, name, fmt.Sprintf(format, args...))
+	if result == doctorFail {
+		r.failed = true
+	}
+}
+
+// isTerminal reports whether the writer is a terminal that can show colors
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// lookupSecret reads the secret from the configured secrets source without failing when it is missing
+func lookupSecret(ctx context.Context, env, account string) (string, bool, error) {
+	switch appConfig.Secrets.Source {
+	case "env":
+		value, ok := os.LookupEnv(env)
+		return value, ok, nil
+	case "files":
+		data, err := os.ReadFile(filepath.Join(appConfig.Secrets.Dir, account))
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(bytes.TrimSpace(data)), true, nil
+	}
+	value, err := lookupKeychainSecret(ctx, appConfig.SecurityService, account)
+	if err != nil {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// freeSpace returns the space available to the user on the filesystem holding the path
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// resticCacheDir returns the cache directory of restic
+func resticCacheDir() string {
+	if dir := os.Getenv("RESTIC_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "restic")
+}
+
+// directorySize returns the total size of the files in the directory
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// Free space below which the doctor warns and fails
+const (
+	lowDiskSpace      = 1 << 30
+	criticalDiskSpace = 100 << 20
+)
+
+// runDoctor checks the environment of the program and prints a report, returning false if any check failed
+func runDoctor(ctx context.Context, w io.Writer) bool {
+	r := &doctorReport{w: w, color: isTerminal(w)}
+
+	// restic
+	if version, err := installedResticVersion(ctx); err != nil {
+		r.add(doctorFail, "restic", "cannot run %s: %v", appConfig.Restic.Path, err)
+	} else if !version.atLeast(0, 17, 0) {
+		r.add(doctorWarn, "restic", "version %s is outdated, the Docker volume backups and the extended attribute restore options need 0.17 or later", version)
+	} else {
+		r.add(doctorPass, "restic", "version %s", version)
+	}
+
+	if appConfig.Restic.VerifyChecksum {
+		expected, err := expectedResticChecksum()
+		switch {
+		case err != nil:
+			r.add(doctorFail, "restic checksum", "%v", err)
+		case expected == "":
+			r.add(doctorWarn, "restic checksum", "not recorded yet, run restic_wrapper pin-restic")
+		default:
+			if err = verifyResticChecksum(); err != nil {
+				r.add(doctorFail, "restic checksum", "%v", err)
+			} else {
+				r.add(doctorPass, "restic checksum", "matches %s", expected[:min(len(expected), 12)])
+			}
+		}
+	}
+
+	// Configuration, it was already loaded and validated
+	if file := viper.ConfigFileUsed(); file == "" {
+		r.add(doctorWarn, "config", "no configuration file found, using the defaults")
+	} else if _, err := os.Stat(file); err != nil {
+		r.add(doctorWarn, "config", "no configuration file at %s, using the defaults", file)
+	} else {
+		r.add(doctorPass, "config", "%s is valid", file)
+	}
+
+	// Secrets
+	secretsOK := true
+	for _, secret := range secretEnvs() {
+		value, ok, err := lookupSecret(ctx, secret.env, secret.account)
+		switch {
+		case err != nil:
+			r.add(doctorFail, "secret "+secret.account, "cannot be read from %s: %v", appConfig.Secrets.Source, err)
+		case ok:
+			os.Setenv(secret.env, value)
+			r.add(doctorPass, "secret "+secret.account, "available from %s", appConfig.Secrets.Source)
+			continue
+		case secret.env == "RESTIC_REPOSITORY" || secret.env == "RESTIC_PASSWORD" || secret.env == stagingPasswordEnv:
+			r.add(doctorFail, "secret "+secret.account, "missing from %s", appConfig.Secrets.Source)
+		default:
+			r.add(doctorWarn, "secret "+secret.account, "missing from %s", appConfig.Secrets.Source)
+			continue
+		}
+		secretsOK = false
+	}
+	switch {
+	case appConfig.Secrets.PasswordCommand != "":
+		r.add(doctorPass, "password", "read by restic from secrets.password_command")
+	case appConfig.Secrets.PasswordFile != "":
+		if _, err := os.Stat(expandPath(appConfig.Secrets.PasswordFile)); err != nil {
+			r.add(doctorFail, "password", "cannot read the password file: %v", err)
+			secretsOK = false
+		} else {
+			r.add(doctorPass, "password", "read by restic from %s", expandPath(appConfig.Secrets.PasswordFile))
+		}
+	}
+	setPasswordSourceEnv()
+
+	// Repository
+	if !secretsOK {
+		r.add(doctorFail, "repository", "not checked, the repository secrets are missing")
+	} else {
+		repositories := map[string]context.Context{"repository": ctx}
+		if stagingEnabled() {
+			repositories["staging repository"] = withStagingRepository(ctx)
+		}
+		for name, repoCtx := range repositories {
+			if _, err := runResticCommand(repoCtx, "cat", "config", "--no-lock"); err != nil {
+				r.add(doctorFail, name, "cannot be opened: %v", err)
+			} else {
+				r.add(doctorPass, name, "reachable")
+			}
+		}
+	}
+
+	// Cache
+	cacheDir := resticCacheDir()
+	if info, err := os.Stat(cacheDir); err != nil || !info.IsDir() {
+		r.add(doctorWarn, "cache", "no cache at %s, the next backup will be slower", cacheDir)
+	} else if file, err := os.CreateTemp(cacheDir, ".doctor"); err != nil {
+		r.add(doctorFail, "cache", "%s is not writable: %v", cacheDir, err)
+	} else {
+		file.Close()
+		os.Remove(file.Name())
+		r.add(doctorPass, "cache", "%s, %s", cacheDir, formatBytes(directorySize(cacheDir)))
+	}
+
+	// Disk space
+	for _, dir := range []string{appConfig.BackupDir, filepath.Dir(cacheDir)} {
+		free, err := freeSpace(dir)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case err != nil:
+			r.add(doctorWarn, "disk space", "cannot check %s: %v", dir, err)
+		case free < criticalDiskSpace:
+			r.add(doctorFail, "disk space", "%s free on %s", formatBytes(int64(free)), dir)
+		case free < lowDiskSpace:
+			r.add(doctorWarn, "disk space", "%s free on %s", formatBytes(int64(free)), dir)
+		default:
+			r.add(doctorPass, "disk space", "%s free on %s", formatBytes(int64(free)), dir)
+		}
+	}
+
+	// macOS permissions and schedule
+	if runtime.GOOS == "darwin" && !inContainer() {
+		if ok, path := hasFullDiskAccess(); ok {
+			r.add(doctorPass, "full disk access", "granted")
+		} else if appConfig.RequireFullDiskAccess {
+			r.add(doctorFail, "full disk access", "missing, %s cannot be read", path)
+		} else {
+			r.add(doctorWarn, "full disk access", "missing, %s cannot be read", path)
+		}
+		if agent, err := newLaunchAgent(0); err != nil {
+			r.add(doctorWarn, "schedule", "%v", err)
+		} else if _, err = os.Stat(agent.path()); err != nil {
+			r.add(doctorWarn, "schedule", "no launchd agent at %s, run restic_wrapper provision", agent.path())
+		} else {
+			r.add(doctorPass, "schedule", "installed at %s", agent.path())
+		}
+	}
+
+	// Last run
+	state, err := loadState()
+	switch {
+	case err != nil:
+		r.add(doctorFail, "last run", "%v", err)
+	case state.LastRun == nil:
+		r.add(doctorWarn, "last run", "never")
+	case state.LastRun.Status == runStatusFailed:
+		r.add(doctorFail, "last run", "failed at %s", state.LastRun.StartedAt.Local().Format("2006-01-02 15:04"))
+	case !state.DeferredSince.IsZero():
+		r.add(doctorWarn, "last run", "backups deferred since %s: %s", state.DeferredSince.Local().Format("2006-01-02 15:04"), state.DeferReason)
+	case state.LastRun.Status != runStatusSuccess:
+		r.add(doctorWarn, "last run", "%s at %s", state.LastRun.Status, state.LastRun.StartedAt.Local().Format("2006-01-02 15:04"))
+	default:
+		r.add(doctorPass, "last run", "succeeded at %s", state.LastRun.StartedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return !r.failed
+}
+
+// newDoctorCmd returns the command diagnosing the environment of the program
+func newDoctorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose problems with the environment of the program",
+		Long: "Checks the restic version, the configuration, the secrets, the repository, the restic cache, the free " +
+			"disk space, the Full Disk Access permission, the launchd schedule and the last run, and prints a " +
+			"pass/warn/fail report. It exits with an error if any check failed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			if !runDoctor(ctx, cmd.OutOrStdout()) {
+				return errors.New("some checks failed")
+			}
+			return nil
+		},
+	}
+	cmd.AddCommand(newDoctorNetworkCmd())
+	return cmd
+}
+
+// newDoctorNetworkCmd returns the command diagnosing the connectivity to the repository
+func newDoctorNetworkCmd() *cobra.Command {
+	var family string
+	cmd := &cobra.Command{
+		Use:   "network",
+		Short: "Diagnose the connectivity to the repository",
+		Long: "Resolves the repository endpoint and connects to each of its IPv4 and IPv6 addresses, printing the " +
+			"resolution and connection times. An address that cannot be reached or takes long to connect explains " +
+			"backups hanging until they time out; pin the working address family with network.address_family.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, ok := addressFamilies[family]; !ok {
+				return fmt.Errorf("invalid address family %q, expected ipv4 or ipv6", family)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			setupEnv()
+			endpoint := repositoryEndpoint(os.Getenv("RESTIC_REPOSITORY"))
+			if endpoint == "" {
+				fmt.Fprintln(cmd.OutOrStdout(), "The repository is local or its backend has no network endpoint to check")
+				return nil
+			}
+			return diagnoseEndpoint(ctx, cmd.OutOrStdout(), endpoint, family)
+		},
+	}
+	cmd.Flags().StringVar(&family, "family", appConfig.Network.AddressFamily, "only check the addresses of the family (ipv4 or ipv6)")
+	return cmd
+}
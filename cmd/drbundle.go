@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// drSecretHint describes where a secret is kept, without revealing it
+func drSecretHint(secret secretEnv) string {
+	switch appConfig.Secrets.Source {
+	case "env":
+		return "the " + secret.env + " environment variable"
+	case "files":
+		return "the file " + filepath.Join(appConfig.Secrets.Dir, secret.account)
+	}
+	return fmt.Sprintf("the keychain item of the service %q and the account %q", appConfig.SecurityService, secret.account)
+}
+
+// drInstructions returns the recovery instructions of the bundle
+func drInstructions(repository string, state *runState, version string, withSecrets bool, files []string) string {
+	var b strings.Builder
+	host := appConfig.HostName
+	fmt.Fprintf(&b, "# Recovering the backups of %s\n\n", host)
+	fmt.Fprintf(&b, "This bundle was created on %s by restic_wrapper. The backups are restic snapshots, they can be\n",
+		time.Now().Format("2006-01-02"))
+	b.WriteString("restored with restic alone (https://restic.net) on any computer.\n\n")
+
+	b.WriteString("## Repository\n\n")
+	fmt.Fprintf(&b, "- Location: %s\n", repository)
+	fmt.Fprintf(&b, "- Hostname of the snapshots: %s\n", host)
+	if state != nil && !state.LastSuccess.IsZero() {
+		fmt.Fprintf(&b, "- Last successful backup: %s", state.LastSuccess.Format("2006-01-02 15:04 MST"))
+		if state.LastRun != nil && state.LastRun.SnapshotID != "" {
+			fmt.Fprintf(&b, ", snapshot %s", state.LastRun.SnapshotID)
+		}
+		b.WriteString("\n")
+	}
+	if version != "" {
+		fmt.Fprintf(&b, "- restic version: %s\n", version)
+	}
+
+	b.WriteString("\n## Keys\n\n")
+	if withSecrets {
+		b.WriteString("The repository password and the storage credentials are in secrets.env in this bundle.\n\n")
+	} else {
+		fmt.Fprintf(&b, "The secrets in config.yaml are replaced with %s, fill them in before using it.\n\n", redactedValue)
+	}
+	switch {
+	case appConfig.Secrets.PasswordCommand != "":
+		fmt.Fprintf(&b, "- Repository password: printed by the command `%s`\n", appConfig.Secrets.PasswordCommand)
+	case appConfig.Secrets.PasswordFile != "":
+		fmt.Fprintf(&b, "- Repository password: the file %s\n", expandPath(appConfig.Secrets.PasswordFile))
+	}
+	for _, secret := range secretEnvs() {
+		fmt.Fprintf(&b, "- %s: %s\n", secret.env, drSecretHint(secret))
+	}
+
+	b.WriteString("\n## Restoring\n\n")
+	b.WriteString("1. Install restic.\n")
+	b.WriteString("2. Set the repository location, its password and the storage credentials, e.g.\n\n")
+	fmt.Fprintf(&b, "       export RESTIC_REPOSITORY='%s'\n", repository)
+	b.WriteString("       export RESTIC_PASSWORD='...'\n")
+	if strings.HasPrefix(repository, "s3:") {
+		b.WriteString("       export AWS_ACCESS_KEY_ID='...' AWS_SECRET_ACCESS_KEY='...'\n")
+	}
+	if withSecrets {
+		b.WriteString("\n   or load them from this bundle with `set -a; . ./secrets.env; set +a`.\n")
+	}
+	fmt.Fprintf(&b, "\n3. List the snapshots: `restic snapshots --host %s`\n", host)
+	fmt.Fprintf(&b, "4. Restore the latest backup: `restic restore <ID> --target ~/restore`. The snapshots tagged %s and\n", tagSelfBackup)
+	fmt.Fprintf(&b, "   %s hold the configuration and the description of the machine, restored the same way.\n\n", tagSystemManifest)
+	b.WriteString("With restic_wrapper installed, copy config.yaml to ~/.restic_backup/ and run `restic_wrapper recover`,\n")
+	b.WriteString("which guides the restore step by step.\n")
+
+	if len(files) > 0 {
+		b.WriteString("\n## Contents\n\n")
+		for _, name := range files {
+			fmt.Fprintf(&b, "- %s\n", name)
+		}
+	}
+	return b.String()
+}
+
+// drSecretsEnv returns the secrets found in the configured secrets source as a shell environment file
+func drSecretsEnv(ctx context.Context) string {
+	var b strings.Builder
+	for _, secret := range secretEnvs() {
+		if value, ok, _ := lookupSecret(ctx, secret.env, secret.account); ok && value != "" {
+			fmt.Fprintf(&b, "%s='%s'\n", secret.env, strings.ReplaceAll(value, "'", `'\''`))
+		}
+	}
+	return b.String()
+}
+
+// writeDRBundle writes the files to the gzipped tar archive encrypted with the passphrase, ASCII armored so it
+// can be printed
+func writeDRBundle(w io.Writer, passphrase string, files map[string][]byte, order []string) error {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return err
+	}
+	armored := armor.NewWriter(w)
+	encrypted, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(encrypted)
+	tw := tar.NewWriter(zw)
+	for _, name := range order {
+		data := files[name]
+		header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: time.Now()}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = tw.Write(data); err != nil {
+			return err
+		}
+	}
+	for _, closer := range []io.Closer{tw, zw, encrypted, armored} {
+		if err = closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drConfig returns the configuration file for the bundle, with the secrets redacted unless they are included, or
+// nil without a configuration file
+func drConfig(withSecrets bool) ([]byte, error) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return nil, nil
+	}
+	if withSecrets {
+		return os.ReadFile(file)
+	}
+	dir, err := os.MkdirTemp("", "restic_wrapper-dr-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = writeRedactedConfig(path); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// newExportDRBundleCmd returns the command exporting the disaster-recovery bundle
+func newExportDRBundleCmd() *cobra.Command {
+	var (
+		output      string
+		withSecrets bool
+	)
+	cmd := &cobra.Command{
+		Use:   "export-dr-bundle",
+		Short: "Export an encrypted disaster-recovery bundle",
+		Long: "Writes an archive with the configuration, the repository location, hints on where the keys are kept " +
+			"and step-by-step recovery instructions, so the backups can be restored by someone else, e.g. to store " +
+			"with estate documents. The archive is encrypted with a passphrase using age (https://age-encryption.org) " +
+			"and ASCII armored so it can be printed. Decrypt it with \"age -d bundle.age | tar xz\". With " +
+			"--include-secrets the repository password and the storage credentials are included as well, otherwise the " +
+			"secrets in the configuration are redacted.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			w := &wizard{in: bufio.NewReader(cmd.InOrStdin()), out: cmd.ErrOrStderr()}
+
+			repository := ""
+			for _, secret := range secretEnvs() {
+				if secret.env == "RESTIC_REPOSITORY" {
+					repository, _, _ = lookupSecret(ctx, secret.env, secret.account)
+				}
+			}
+			if repository == "" {
+				repository = "(not found in " + appConfig.Secrets.Source + ")"
+			}
+			version := ""
+			if v, err := installedResticVersion(ctx); err == nil {
+				version = v.String()
+			}
+			state, _ := loadState()
+
+			files := map[string][]byte{}
+			order := []string{"RECOVERY.md"}
+			add := func(name string, data []byte) {
+				files[name] = data
+				order = append(order, name)
+			}
+			config, err := drConfig(withSecrets)
+			if err != nil {
+				return err
+			}
+			if config != nil {
+				add("config.yaml", config)
+			}
+			for _, name := range []string{appConfig.Restic.FilesFrom, appConfig.Restic.ExcludeFile} {
+				if data, err := os.ReadFile(filepath.Join(appConfig.BackupDir, name)); err == nil {
+					add(filepath.Base(name), data)
+				}
+			}
+			if withSecrets {
+				add("secrets.env", []byte(drSecretsEnv(ctx)))
+			}
+			files["RECOVERY.md"] = []byte(drInstructions(repository, state, version, withSecrets, order))
+
+			passphrase, err := w.askSecret("Passphrase of the bundle")
+			if err != nil {
+				return err
+			}
+			if len(passphrase) < 12 {
+				return errors.New("the passphrase must be at least 12 characters long")
+			}
+			if again, err := w.askSecret("Passphrase again"); err != nil {
+				return err
+			} else if again != passphrase {
+				return errors.New("the passphrases do not match")
+			}
+
+			var buf bytes.Buffer
+			if err = writeDRBundle(&buf, passphrase, files, order); err != nil {
+				return fmt.Errorf("failed to encrypt the bundle: %w", err)
+			}
+			if output == "" {
+				output = "restic_wrapper-dr-" + appConfig.HostName + ".age"
+			}
+			if output == "-" {
+				_, err = cmd.OutOrStdout().Write(buf.Bytes())
+				return err
+			}
+			if err = os.WriteFile(output, buf.Bytes(), 0o600); err != nil {
+				return fmt.Errorf("failed to write the bundle: %w", err)
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Wrote the disaster-recovery bundle to %s\n", output)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "the file to write the bundle to, - for the standard output (default restic_wrapper-dr-<host>.age)")
+	cmd.Flags().BoolVar(&withSecrets, "include-secrets", false, "include the repository password and the storage credentials")
+	return cmd
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runStartedEvent is published when a backup run starts
+type runStartedEvent struct {
+	StartedAt time.Time
+	Recovery  string
+}
+
+// resticLineEvent is published for every line printed by a restic command once it exits
+type resticLineEvent struct {
+	Operation string
+	Line      string
+	// Stderr is set for the lines of the error output
+	Stderr bool
+	// Failed is set when the command failed
+	Failed bool
+}
+
+// stageCompletedEvent is published when a stage of the run completes
+type stageCompletedEvent struct {
+	Stage stageResult
+}
+
+// runFinishedEvent is published when a backup run finished, with its summary and the updated state
+type runFinishedEvent struct {
+	Summary *runSummary
+	State   *runState
+}
+
+// eventHandler handles the events published by the program. It ignores the event types it is not interested in.
+type eventHandler func(ctx context.Context, event any)
+
+// eventSubscribers are called in order for every published event
+var eventSubscribers []eventHandler
+
+// subscribe adds the handler to the subscribers of the events
+func subscribe(handler eventHandler) {
+	eventSubscribers = append(eventSubscribers, handler)
+}
+
+// publish passes the event to all the subscribers
+func publish(ctx context.Context, event any) {
+	for _, handler := range eventSubscribers {
+		handler(ctx, event)
+	}
+}
+
+// subscribeIntegrations subscribes the log, the plugins, the audit log, the metrics, the annotations and
+// the notifiers to the events
+func subscribeIntegrations() {
+	subscribe(logEvent)
+	subscribe(pluginHandler)
+	subscribe(auditLogHandler)
+	subscribe(grafanaHandler)
+	subscribe(influxHandler)
+	subscribe(zabbixHandler)
+	subscribe(func(ctx context.Context, event any) {
+		if finished, ok := event.(runFinishedEvent); ok {
+			if err := sendAwsMetrics(ctx, finished.Summary); err != nil {
+				log.WithField("err", err).Error("cannot send backup metrics to CloudWatch")
+			}
+		}
+	})
+	subscribe(func(ctx context.Context, event any) {
+		if finished, ok := event.(runFinishedEvent); ok {
+			sendNotifications(ctx, finished.Summary, finished.State)
+		}
+	})
+}
+
+// logEvent writes the output of the restic commands and the stages to the log
+func logEvent(_ context.Context, event any) {
+	switch e := event.(type) {
+	case resticLineEvent:
+		fields := log.Fields{
+			"cmd":       appConfig.Restic.Path,
+			"operation": e.Operation,
+		}
+		switch {
+		case e.Failed && e.Stderr && isResticWarning(e.Line):
+			log.WithFields(fields).Warn(e.Line)
+		case e.Failed && e.Stderr:
+			log.WithFields(fields).Error(e.Line)
+		case !e.Failed && !e.Stderr:
+			log.WithFields(fields).Info(e.Line)
+		}
+	case stageCompletedEvent:
+		log.WithFields(log.Fields{
+			"stage":    e.Stage.Name,
+			"duration": e.Stage.Duration,
+			"err":      e.Stage.Err,
+		}).Debug("Stage completed")
+	}
+}
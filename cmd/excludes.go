@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sizeUnits maps the size suffixes to their multipliers
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1 << 40,
+	"TIB": 1 << 40,
+}
+
+// parseSize parses a size like "2GB", "500M" or "1.5 GiB", using powers of 1024 like restic does
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(size)
+	}
+	number, err := strconv.ParseFloat(size[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	multiplier, ok := sizeUnits[strings.TrimSpace(size[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// excludePatternReplacer escapes the characters with a special meaning in restic exclude patterns
+var excludePatternReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// applySizeRules scans the paths of the size rules. It returns exclude patterns for the files larger
+// than the max size of their rule, and the files changed since the given time that exceed the warn size.
+func applySizeRules(since time.Time) ([]string, []string) {
+	var excludes []string
+	excluded := map[string]bool{}
+	largeFiles := map[string]int64{}
+	for _, rule := range appConfig.SizeRules {
+		var maxSize, warnSize int64
+		var err error
+		if rule.MaxSize != "" {
+			if maxSize, err = parseSize(rule.MaxSize); err != nil {
+				log.WithFields(log.Fields{"path": rule.Path, "err": err}).Error("invalid size rule")
+				continue
+			}
+		}
+		if rule.WarnSize != "" {
+			if warnSize, err = parseSize(rule.WarnSize); err != nil {
+				log.WithFields(log.Fields{"path": rule.Path, "err": err}).Error("invalid size rule")
+				continue
+			}
+		}
+		root := expandPath(rule.Path)
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			switch {
+			case maxSize > 0 && info.Size() > maxSize && !excluded[path]:
+				log.WithFields(log.Fields{
+					"path":     path,
+					"size":     formatBytes(info.Size()),
+					"max_size": rule.MaxSize,
+				}).Info("excluding a file larger than the size cap")
+				excluded[path] = true
+				excludes = append(excludes, excludePatternReplacer.Replace(path))
+			case warnSize > 0 && info.Size() > warnSize && info.ModTime().After(since):
+				largeFiles[path] = info.Size()
+			}
+			return nil
+		})
+	}
+
+	// Only warn about the large files that are not excluded by another rule
+	var warnings []string
+	for path, size := range largeFiles {
+		if excluded[path] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"path": path,
+			"size": formatBytes(size),
+		}).Warn("A large new file is backed up")
+		warnings = append(warnings, path)
+	}
+	slices.Sort(warnings)
+	return excludes, warnings
+}
+
+// writeGeneratedExcludes writes the exclude patterns generated at run time to a file next to the
+// configured exclude file, returning its path
+func writeGeneratedExcludes(patterns []string) (string, error) {
+	path := filepath.Join(appConfig.BackupDir, "."+appConfig.Restic.ExcludeFile+".generated")
+	if err := os.WriteFile(path, []byte(strings.Join(patterns, "\n")+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write the generated exclude file: %w", err)
+	}
+	return path, nil
+}
+
+// readExcludeFile reads the patterns of an exclude file like restic does: the lines are trimmed, the empty lines and
+// the comments skipped and the environment variables expanded
+func readExcludeFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the exclude file: %w", err)
+	}
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, os.ExpandEnv(line))
+	}
+	return patterns, scanner.Err()
+}
+
+// excludedPath reports whether restic excludes the path with the exclude patterns, matched like the include
+// patterns: the last matching pattern wins and a pattern starting with ! includes the path again. skip is set for an
+// excluded directory below which no negated pattern may match, restic does not descend into it.
+func excludedPath(p string, dir bool, patterns []string) (excluded, skip bool) {
+	parts := splitIncludePath(p)
+	descend := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if pattern == "" {
+			continue
+		}
+		split := splitIncludePath(pattern)
+		if matchInclude(split, parts) {
+			excluded = !negated
+		}
+		if negated && dir && childMayMatch(split, parts) {
+			descend = true
+		}
+	}
+	return excluded, excluded && dir && !descend
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// remotePolicy holds the remote configuration with the host overrides, nil when no remote configuration is used
+var remotePolicy *viper.Viper
+
+// applyHostOverrides merges the settings of the "hosts" block matching the host name over the configuration
+func applyHostOverrides(v *viper.Viper) error {
+	// Read the block as a map, host names may contain dots
+	hosts := v.GetStringMap("hosts")
+	overrides, ok := hosts[strings.ToLower(v.GetString("host_name"))].(map[string]any)
+	if !ok {
+		return nil
+	}
+	if err := v.MergeConfigMap(overrides); err != nil {
+		return fmt.Errorf("failed to apply the host overrides: %w", err)
+	}
+	return nil
+}
+
+// complianceReport lists the deviations of the host from the fleet policy
+type complianceReport struct {
+	Issues []string
+}
+
+// compliant reports whether the host follows the fleet policy
+func (r *complianceReport) compliant() bool {
+	return len(r.Issues) == 0
+}
+
+// String returns a one-line description of the compliance
+func (r *complianceReport) String() string {
+	if r.compliant() {
+		return "compliant"
+	}
+	return "non-compliant: " + strings.Join(r.Issues, "; ")
+}
+
+// checkCompliance compares the effective configuration and the recent runs of the host with the fleet policy
+func checkCompliance(now time.Time) *complianceReport {
+	report := &complianceReport{}
+
+	// The locked settings must not be changed by the local configuration or the profiles
+	for _, key := range appConfig.Fleet.LockedKeys {
+		if !reflect.DeepEqual(viper.Get(key), remotePolicy.Get(key)) {
+			report.Issues = append(report.Issues, fmt.Sprintf("%s differs from the policy", key))
+		}
+	}
+
+	configured := profileNames()
+	for _, profile := range appConfig.Fleet.RequiredProfiles {
+		if !slices.Contains(configured, profile) {
+			report.Issues = append(report.Issues, fmt.Sprintf("profile %s is not configured", profile))
+			continue
+		}
+		state, err := loadStateFile(profileStatePath(profile))
+		if err != nil {
+			report.Issues = append(report.Issues, fmt.Sprintf("profile %s: %v", profile, err))
+			continue
+		}
+		if appConfig.Fleet.MaxBackupAge > 0 && now.Sub(state.LastSuccess) > appConfig.Fleet.MaxBackupAge {
+			report.Issues = append(report.Issues, fmt.Sprintf("profile %s has no successful backup within %s", profile, appConfig.Fleet.MaxBackupAge))
+		}
+	}
+	return report
+}
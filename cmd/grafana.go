@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// grafanaAnnotationID is the annotation created at the start of the run, completed into a region when it finishes
+var grafanaAnnotationID int64
+
+// grafanaEnabled reports whether the runs are annotated in Grafana
+func grafanaEnabled() bool {
+	return appConfig.Grafana.URL != ""
+}
+
+// grafanaRequest sends the annotation request to the Grafana HTTP API and decodes the response into result
+func grafanaRequest(ctx context.Context, method, path string, payload, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode the annotation: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(appConfig.Grafana.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if appConfig.Grafana.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+appConfig.Grafana.Token)
+	}
+	resp, err := newHTTPClient(notificationTimeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// grafanaAnnotation returns the annotation of the run
+func grafanaAnnotation(start time.Time, text string, tags ...string) map[string]any {
+	annotation := map[string]any{
+		"time": start.UnixMilli(),
+		"text": text,
+		"tags": append(append([]string{"restic_wrapper", appConfig.HostName}, appConfig.Grafana.Tags...), tags...),
+	}
+	if appConfig.Grafana.DashboardUID != "" {
+		annotation["dashboardUID"] = appConfig.Grafana.DashboardUID
+	}
+	if appConfig.Grafana.PanelID != 0 {
+		annotation["panelId"] = appConfig.Grafana.PanelID
+	}
+	return annotation
+}
+
+// grafanaHandler annotates the backup window in Grafana: the annotation created when the run starts becomes a
+// region ending when the run finishes, so the backups show up as bands on the dashboards
+func grafanaHandler(ctx context.Context, event any) {
+	if !grafanaEnabled() {
+		return
+	}
+	switch e := event.(type) {
+	case runStartedEvent:
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		err := grafanaRequest(ctx, http.MethodPost, "/api/annotations",
+			grafanaAnnotation(e.StartedAt, "Backup of "+appConfig.HostName+" running"), &created)
+		if err != nil {
+			log.WithField("err", err).Warn("cannot annotate the start of the run in Grafana")
+			return
+		}
+		grafanaAnnotationID = created.ID
+	case runFinishedEvent:
+		s := e.Summary
+		annotation := grafanaAnnotation(s.StartedAt, s.subject(), s.Status)
+		annotation["timeEnd"] = s.StartedAt.Add(s.Duration).UnixMilli()
+		var err error
+		if grafanaAnnotationID != 0 {
+			err = grafanaRequest(ctx, http.MethodPatch, fmt.Sprintf("/api/annotations/%d", grafanaAnnotationID), annotation, nil)
+		} else {
+			// The start was not annotated, annotate the whole run
+			err = grafanaRequest(ctx, http.MethodPost, "/api/annotations", annotation, nil)
+		}
+		if err != nil {
+			log.WithField("err", err).Warn("cannot annotate the run in Grafana")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hostSnapshots returns the snapshots of the host and the time of the newest one
+func hostSnapshots(ctx context.Context) (int, time.Time, error) {
+	snapshots, err := listSnapshots(ctx, "--no-lock", "--host", appConfig.HostName)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var newest time.Time
+	for _, s := range snapshots {
+		if s.Time.After(newest) {
+			newest = s.Time
+		}
+	}
+	return len(snapshots), newest, nil
+}
+
+// checkGuardrails compares the snapshots of the host with the guardrails: the newest snapshot must be younger than
+// guardrails.max_snapshot_age, and the snapshot count must not drop by more than guardrails.max_count_drop from the
+// count recorded by the last run plus the snapshots added since. It returns the violations and the current count.
+func checkGuardrails(ctx context.Context, state *runState, added int, now time.Time) ([]string, int, error) {
+	count, newest, err := hostSnapshots(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var violations []string
+	if maxAge := appConfig.Guardrails.MaxSnapshotAge; maxAge > 0 {
+		switch {
+		case newest.IsZero():
+			violations = append(violations, fmt.Sprintf("the repository has no snapshot of %s", appConfig.HostName))
+		case now.Sub(newest) > maxAge:
+			// The violation does not change until the next snapshot, so it is notified once by the heartbeats
+			violations = append(violations, fmt.Sprintf("no snapshot of %s for more than %s, the newest is from %s",
+				appConfig.HostName, formatAge(maxAge), newest.Local().Format("2006-01-02 15:04")))
+		}
+	}
+	if expected := state.SnapshotCount + added; state.SnapshotCount > 0 &&
+		float64(count) < float64(expected)*(1-appConfig.Guardrails.MaxCountDrop) {
+		violations = append(violations, fmt.Sprintf("the snapshot count of %s dropped from %d to %d, check the "+
+			"retention policy and whether restic forget was run by hand", appConfig.HostName, expected, count))
+	}
+	return violations, count, nil
+}
+
+// guardrailsEnabled reports whether any guardrail is configured
+func guardrailsEnabled() bool {
+	return appConfig.Guardrails.MaxSnapshotAge > 0 || appConfig.Guardrails.MaxCountDrop < 1
+}
+
+// runGuardrailHeartbeat checks the guardrails between the backups of the daemon, notifying the violations when they
+// change, so a repository emptied by hand or a host that stopped backing up is noticed without waiting for a run
+func runGuardrailHeartbeat(ctx context.Context) {
+	fileLock := newFileLock()
+	if locked, err := fileLock.TryLock(); err != nil || !locked {
+		// A backup is running, it checks the guardrails itself
+		return
+	}
+	defer fileLock.Unlock()
+
+	state, err := loadState()
+	if err != nil {
+		log.WithField("err", err).Error("cannot load the state")
+		return
+	}
+	violations, count, err := checkGuardrails(ctx, state, 0, time.Now())
+	if err != nil {
+		log.WithField("err", err).Warn("cannot check the snapshot guardrails")
+		return
+	}
+	for _, violation := range violations {
+		log.WithField("violation", violation).Warn("A snapshot guardrail is violated")
+	}
+	changed := !slices.Equal(violations, state.GuardrailViolations)
+	state.SnapshotCount, state.GuardrailViolations = count, violations
+	if err = state.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the state")
+	}
+	if !changed || len(violations) == 0 {
+		return
+	}
+	now := time.Now()
+	sendNotifications(ctx, &runSummary{
+		HostName:    appConfig.HostName,
+		StartedAt:   now,
+		Status:      runStatusFailed,
+		Error:       "snapshot guardrails: " + violations[0],
+		LastSuccess: state.LastSuccess,
+		Guardrails:  violations,
+	}, state)
+}
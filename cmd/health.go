@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// healthIssue is a problem lowering the health score of the repository
+type healthIssue struct {
+	Penalty     int
+	Description string
+}
+
+// healthReport is the health score of the repository and the issues lowering it
+type healthReport struct {
+	Score  int
+	Issues []healthIssue
+}
+
+// add records the issue and lowers the score
+func (h *healthReport) add(penalty int, format string, args ...any) {
+	h.Issues = append(h.Issues, healthIssue{Penalty: penalty, Description: fmt.Sprintf(format, args...)})
+	h.Score = max(h.Score-penalty, 0)
+}
+
+// degraded reports whether the score is below the warning threshold
+func (h *healthReport) degraded() bool {
+	return h.Score < appConfig.Health.WarningThreshold
+}
+
+// String returns a one-line description of the health
+func (h *healthReport) String() string {
+	if len(h.Issues) == 0 {
+		return fmt.Sprintf("%d/100", h.Score)
+	}
+	descriptions := make([]string, 0, len(h.Issues))
+	for _, issue := range h.Issues {
+		descriptions = append(descriptions, issue.Description)
+	}
+	return fmt.Sprintf("%d/100 (%s)", h.Score, strings.Join(descriptions, "; "))
+}
+
+// oldestLockAge returns the age of the oldest repository lock, or zero if there are no locks
+func oldestLockAge(ctx context.Context) (time.Duration, error) {
+	output, err := runResticCommand(ctx, "list", "locks", "--no-lock")
+	if err != nil {
+		return 0, fmt.Errorf("restic list locks failed: %w", err)
+	}
+	var oldest time.Duration
+	for _, id := range strings.Fields(output) {
+		lockOutput, err := runResticCommand(ctx, "cat", "lock", id, "--no-lock")
+		if err != nil {
+			// The lock may have been removed in the meantime
+			continue
+		}
+		var lock struct {
+			Time time.Time `json:"time"`
+		}
+		if err = json.Unmarshal([]byte(lockOutput), &lock); err != nil {
+			return 0, fmt.Errorf("failed to parse lock %s: %w", id, err)
+		}
+		oldest = max(oldest, time.Since(lock.Time))
+	}
+	return oldest, nil
+}
+
+// minThroughputSample is the source data a backup has to read for its throughput to be compared, the throughput of
+// a small backup is dominated by the startup of restic
+const minThroughputSample = 256 << 20
+
+// comparableThroughput reports whether the throughput of the run is compared with the others: a recovery re-reads all
+// files with --force and a small backup is dominated by the startup, neither says anything about the disks
+func comparableThroughput(run historyRun) bool {
+	return run.Throughput > 0 && run.Recovery == "" && run.BytesProcessed >= minThroughputSample
+}
+
+// throughputTrend returns the throughput of the last backup and the median throughput of the backups before it,
+// or zeros when there are too few backups to compare
+func throughputTrend(runs []historyRun) (last, usual float64) {
+	var throughputs []float64
+	for _, run := range runs {
+		if comparableThroughput(run) {
+			throughputs = append(throughputs, run.Throughput)
+		}
+	}
+	if len(throughputs) < 4 || !comparableThroughput(runs[len(runs)-1]) {
+		return 0, 0
+	}
+	last = throughputs[len(throughputs)-1]
+	previous := slices.Clone(throughputs[max(len(throughputs)-11, 0) : len(throughputs)-1])
+	slices.Sort(previous)
+	return last, previous[len(previous)/2]
+}
+
+// throughputDrop describes the collapse of the throughput of the last backup, or returns an empty string
+// if the throughput is as usual
+func throughputDrop(runs []historyRun) string {
+	last, usual := throughputTrend(runs)
+	if usual == 0 || last >= usual*appConfig.Health.MinThroughputRatio {
+		return ""
+	}
+	return fmt.Sprintf("the backup throughput dropped to %s, %.0f%% of the usual %s", formatRate(last), last/usual*100, formatRate(usual))
+}
+
+// healthPeriod is how far back the runs of the history are assessed
+const healthPeriod = 90 * 24 * time.Hour
+
+// assessHealth combines the check results, lock age, last prune time, growth rate and failed runs of the history
+// into a health score from 0 to 100
+func assessHealth(ctx context.Context, state *runState, runs []historyRun) *healthReport {
+	health := &healthReport{Score: 100}
+	now := time.Now()
+
+	// Failed runs in a row
+	streak := 0
+	for i := len(runs) - 1; i >= 0 && runs[i].Status == runStatusFailed; i-- {
+		streak++
+	}
+	if streak > 0 {
+		health.add(min(streak*15, 45), "%d failed runs in a row", streak)
+	}
+
+	// The latest repository check
+	switch {
+	case state.CheckFailed:
+		health.add(40, "the last repository check failed")
+	case state.LastCheck.IsZero():
+		health.add(10, "the repository was never checked")
+	case now.Sub(state.LastCheck) > appConfig.Health.MaxCheckAge:
+		health.add(10, "the repository was not checked for %s", now.Sub(state.LastCheck).Round(time.Hour))
+	}
+
+	// Prune only runs when old backups are cleaned up
+	if appConfig.CleanupOldBackups {
+		if state.LastPrune.IsZero() {
+			health.add(10, "the repository was never pruned")
+		} else if age := now.Sub(state.LastPrune); age > appConfig.Health.MaxPruneAge {
+			health.add(10, "the repository was not pruned for %s", age.Round(time.Hour))
+		}
+	}
+
+	// A sudden growth suggests unwanted files are backed up
+	var lastWeek, previousWeek int64
+	for _, run := range runs {
+		switch age := now.Sub(run.StartedAt); {
+		case age <= 7*24*time.Hour:
+			lastWeek += run.BytesAdded
+		case age <= 14*24*time.Hour:
+			previousWeek += run.BytesAdded
+		}
+	}
+	if previousWeek > 0 && float64(lastWeek) > float64(previousWeek)*appConfig.Health.MaxGrowthRatio {
+		health.add(10, "%s added in the last 7 days, %.1fx more than the week before",
+			formatBytes(lastWeek), float64(lastWeek)/float64(previousWeek))
+	}
+
+	// A collapsing throughput suggests throttling or a failing disk
+	if drop := throughputDrop(runs); drop != "" {
+		health.add(15, "%s", drop)
+	}
+
+	// Locks left behind by crashed restic processes block pruning
+	lockAge, err := oldestLockAge(ctx)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot list the repository locks")
+	} else if lockAge > appConfig.Health.StaleLockAge {
+		health.add(20, "a repository lock is %s old", lockAge.Round(time.Minute))
+	}
+	return health
+}
+
+// newStatusCmd returns the command showing the status of the backups
+func newStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of the backups and the health of the repository",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			state, err := loadState()
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			if state.LastRun != nil {
+				fmt.Fprintf(w, "Last run: %s, %s\n", state.LastRun.StartedAt.Local().Format("2006-01-02 15:04"), state.LastRun.Status)
+			} else {
+				fmt.Fprintln(w, "Last run: never")
+			}
+			if !state.LastSuccess.IsZero() {
+				fmt.Fprintf(w, "Last successful backup: %s\n", state.LastSuccess.Local().Format("2006-01-02 15:04"))
+			} else {
+				fmt.Fprintln(w, "Last successful backup: never")
+			}
+
+			if state.LastRun != nil && state.LastRun.Throughput > 0 {
+				fmt.Fprintf(w, "Last backup throughput: %s", formatRate(state.LastRun.Throughput))
+				if state.LastRun.BytesAdded > 0 {
+					fmt.Fprintf(w, ", dedup ratio %.1fx", float64(state.LastRun.BytesProcessed)/float64(state.LastRun.BytesAdded))
+				}
+				fmt.Fprintln(w)
+			}
+			runs := profileRuns(time.Now().Add(-healthPeriod))
+			if last, usual := throughputTrend(runs); usual > 0 {
+				fmt.Fprintf(w, "Usual backup throughput: %s (last %.0f%%)\n", formatRate(usual), last/usual*100)
+			}
+
+			if reason := backupsDisabled(time.Now()); reason != "" {
+				fmt.Fprintf(w, "Backups %s\n", reason)
+			}
+			if budget := currentBudget(time.Now()); budget != nil {
+				fmt.Fprintf(w, "Bandwidth budget: %s\n", budget)
+			}
+			if appConfig.Chunking.Enabled && state.Seed != nil {
+				fmt.Fprintf(w, "Initial seed: %s\n", state.Seed)
+			}
+			if !state.DeferredSince.IsZero() {
+				fmt.Fprintf(w, "Backups deferred since %s: %s\n", state.DeferredSince.Local().Format("2006-01-02 15:04"), state.DeferReason)
+			}
+			if stagingEnabled() {
+				lastSync := "never"
+				if !state.LastSync.IsZero() {
+					lastSync = state.LastSync.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Fprintf(w, "Last sync to the remote repository: %s, %d snapshots waiting\n", lastSync, state.SyncBacklog)
+				if state.SyncError != "" {
+					fmt.Fprintf(w, "Last sync failed: %s\n", state.SyncError)
+				}
+			}
+
+			setupEnv()
+			health := assessHealth(ctx, state, runs)
+			fmt.Fprintf(w, "Health score: %d/100\n", health.Score)
+			for _, issue := range health.Issues {
+				fmt.Fprintf(w, "  -%d: %s\n", issue.Penalty, issue.Description)
+			}
+			if health.degraded() {
+				fmt.Fprintf(w, "Warning: the health score is below %d\n", appConfig.Health.WarningThreshold)
+			}
+			if remotePolicy != nil {
+				fmt.Fprintf(w, "Fleet policy: %s\n", checkCompliance(time.Now()))
+			}
+			return nil
+		},
+	}
+}
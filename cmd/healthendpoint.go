@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthStateResponse is the status of the backups of a state file in the response of the health endpoint
+type healthStateResponse struct {
+	State         string     `json:"state"`
+	LastRunStatus string     `json:"last_run_status,omitempty"`
+	LastRunAt     *time.Time `json:"last_run_at,omitempty"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	Stale         bool       `json:"stale"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// healthResponse is the response of the health endpoint
+type healthResponse struct {
+	Status string                `json:"status"`
+	States []healthStateResponse `json:"states"`
+}
+
+// backupHealth returns the health of the backups: they are stale when the last successful backup of a backed up
+// profile is older than daemon.catch_up.max_age. A profile without a successful backup yet is given
+// daemon.catch_up.max_age from the start of the daemon, so a new container is not restarted by its liveness probe.
+func backupHealth(now, started time.Time) *healthResponse {
+	health := &healthResponse{Status: "ok"}
+	for _, path := range backedUpStatePaths() {
+		entry := healthStateResponse{State: filepath.Base(path), Stale: true}
+		state, err := loadStateFile(path)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			if state.LastRun != nil {
+				entry.LastRunStatus, entry.LastRunAt = state.LastRun.Status, &state.LastRun.StartedAt
+			}
+			lastSuccess := state.LastSuccess
+			if lastSuccess.IsZero() {
+				lastSuccess = started
+			} else {
+				entry.LastSuccess = &state.LastSuccess
+			}
+			entry.Stale = now.Sub(lastSuccess) > appConfig.Daemon.CatchUp.MaxAge
+		}
+		if entry.Stale {
+			health.Status = "stale"
+		}
+		health.States = append(health.States, entry)
+	}
+	return health
+}
+
+// serveHealth answers GET /healthz on daemon.health_listen until the context is done, for the liveness probe of a
+// container or an uptime monitor: 200 while the backups are fresh, 503 when they are stale. started is when the
+// daemon started, see backupHealth.
+func serveHealth(ctx context.Context, started time.Time) (func(), error) {
+	listener, err := net.Listen("tcp", appConfig.Daemon.HealthListen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on daemon.health_listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		health := backupHealth(time.Now(), started)
+		w.Header().Set("Content-Type", "application/json")
+		if health.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.WithField("err", err).Error("The health endpoint stopped")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	log.WithField("listen", listener.Addr().String()).Info("Serving the health endpoint")
+	return func() { <-done }, nil
+}
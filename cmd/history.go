@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyBucket holds the runs keyed by their start time
+var historyBucket = []byte("runs")
+
+// historyStage is a stage of a run stored in the history
+type historyStage struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+
+	UserCPU   float64 `json:"user_cpu_seconds,omitempty"`
+	SystemCPU float64 `json:"system_cpu_seconds,omitempty"`
+	MaxRSS    int64   `json:"max_rss_bytes,omitempty"`
+	InBlocks  int64   `json:"in_blocks,omitempty"`
+	OutBlocks int64   `json:"out_blocks,omitempty"`
+}
+
+// historyRun is a run stored in the history database
+type historyRun struct {
+	StartedAt       time.Time      `json:"started_at"`
+	Duration        float64        `json:"duration_seconds"`
+	Status          string         `json:"status"`
+	Profile         string         `json:"profile,omitempty"`
+	Recovery        string         `json:"recovery,omitempty"`
+	SnapshotID      string         `json:"snapshot_id,omitempty"`
+	BytesAdded      int64          `json:"bytes_added,omitempty"`
+	BytesProcessed  int64          `json:"bytes_processed,omitempty"`
+	Throughput      float64        `json:"throughput_bytes_per_second,omitempty"`
+	DedupRatio      float64        `json:"dedup_ratio,omitempty"`
+	PruneFreedBytes int64          `json:"prune_freed_bytes,omitempty"`
+	CheckPassed     *bool          `json:"check_passed,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	Stages          []historyStage `json:"stages,omitempty"`
+	Warnings        []warningGroup `json:"warnings,omitempty"`
+}
+
+// newHistoryRun converts the summary of a run for the history
+func newHistoryRun(summary *runSummary) historyRun {
+	run := historyRun{
+		StartedAt:       summary.StartedAt.UTC(),
+		Duration:        summary.Duration.Seconds(),
+		Status:          summary.Status,
+		Profile:         activeProfile,
+		Recovery:        summary.Recovery,
+		SnapshotID:      summary.SnapshotID,
+		BytesAdded:      summary.BytesAdded,
+		BytesProcessed:  summary.BytesProcessed,
+		Throughput:      summary.throughput(),
+		DedupRatio:      summary.dedupRatio(),
+		PruneFreedBytes: summary.PruneFreedBytes,
+		Error:           summary.Error,
+		Warnings:        summary.Warnings,
+	}
+	if check := summary.stage("check"); check != nil {
+		passed := check.Err == nil
+		run.CheckPassed = &passed
+	}
+	for _, stage := range summary.Stages {
+		s := historyStage{Name: stage.Name, Duration: stage.Duration.Seconds()}
+		if stage.Err != nil {
+			s.Error = stage.Err.Error()
+		}
+		if u := stage.Usage; u != nil {
+			s.UserCPU, s.SystemCPU = u.UserCPU.Seconds(), u.SystemCPU.Seconds()
+			s.MaxRSS, s.InBlocks, s.OutBlocks = u.MaxRSS, u.InBlocks, u.OutBlocks
+		}
+		run.Stages = append(run.Stages, s)
+	}
+	return run
+}
+
+// historyKey returns the key of the run started at the time, ordering the runs by time
+func historyKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// openHistory opens the history database, waiting for another process holding it
+func openHistory(readOnly bool) (*bolt.DB, error) {
+	path := filepath.Join(appConfig.BackupDir, appConfig.HistoryFile)
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the history database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// recordRun stores the run in the history database and removes the runs older than history.max_age
+func recordRun(summary *runSummary) error {
+	payload, err := json.Marshal(newHistoryRun(summary))
+	if err != nil {
+		return err
+	}
+	db, err := openHistory(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(historyKey(summary.StartedAt), payload); err != nil {
+			return err
+		}
+		if appConfig.History.MaxAge <= 0 {
+			return nil
+		}
+		// The keys are ordered by time, the expired runs come first
+		expired := historyKey(time.Now().Add(-appConfig.History.MaxAge))
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, expired) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// historyRuns returns the stored runs started since the time, oldest first
+func historyRuns(since time.Time) ([]historyRun, error) {
+	if _, err := os.Stat(filepath.Join(appConfig.BackupDir, appConfig.HistoryFile)); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	db, err := openHistory(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var runs []historyRun
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(historyKey(since)); k != nil; k, v = c.Next() {
+			var run historyRun
+			if err := json.Unmarshal(v, &run); err != nil {
+				return fmt.Errorf("failed to read the run %x: %w", k, err)
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// profileRuns returns the runs of the active profile started since the time, oldest first. A history database that
+// cannot be read is logged and treated as empty, the runs only feed the health and the reports.
+func profileRuns(since time.Time) []historyRun {
+	runs, err := historyRuns(since)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot read the history")
+		return nil
+	}
+	return slices.DeleteFunc(runs, func(run historyRun) bool { return run.Profile != activeProfile })
+}
+
+// parseAge parses a duration that may be given in days, e.g. "30d" or "12h"
+func parseAge(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// newHistoryCmd returns the command listing the stored runs
+func newHistoryCmd() *cobra.Command {
+	var (
+		since    string
+		stage    string
+		jsonFlag bool
+	)
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the past runs",
+		Long: "Lists the runs stored in the history database with their status, snapshot, added data and warnings. " +
+			"With --stage the duration, CPU time, peak memory and block IO of that stage of every run are listed " +
+			"instead, e.g. to follow the memory used by prune. With --json every run is printed as a JSON object with " +
+			"its stages and warnings, one per line.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			age, err := parseAge(since)
+			if err != nil {
+				return fmt.Errorf("invalid --since: %w", err)
+			}
+			runs, err := historyRuns(time.Now().Add(-age))
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			if jsonFlag {
+				encoder := json.NewEncoder(w)
+				for _, run := range runs {
+					if err = encoder.Encode(run); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			if stage != "" {
+				fmt.Fprintln(tw, "STARTED\tDURATION\tCPU\tPEAK MEMORY\tIN BLOCKS\tOUT BLOCKS")
+				for _, run := range runs {
+					for _, s := range run.Stages {
+						if s.Name != stage {
+							continue
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", run.StartedAt.Local().Format("2006-01-02 15:04"),
+							time.Duration(s.Duration*float64(time.Second)).Round(time.Second),
+							time.Duration((s.UserCPU+s.SystemCPU)*float64(time.Second)).Round(time.Second),
+							formatBytes(s.MaxRSS), s.InBlocks, s.OutBlocks)
+					}
+				}
+				return tw.Flush()
+			}
+			fmt.Fprintln(tw, "STARTED\tSTATUS\tDURATION\tSNAPSHOT\tADDED\tWARNINGS")
+			for _, run := range runs {
+				warnings := 0
+				for _, group := range run.Warnings {
+					warnings += group.Count
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", run.StartedAt.Local().Format("2006-01-02 15:04"), run.Status,
+					time.Duration(run.Duration*float64(time.Second)).Round(time.Second), run.SnapshotID,
+					formatBytes(run.BytesAdded), warnings)
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&since, "since", "30d", "list the runs started within the period, e.g. 30d or 12h")
+	cmd.Flags().StringVar(&stage, "stage", "", "list the resource usage of the stage, e.g. prune")
+	cmd.Flags().BoolVar(&jsonFlag, "json", false, "print the runs as JSON lines")
+	return cmd
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// hostNameInvalidRe matches the runs of characters replaced in the detected host name
+var hostNameInvalidRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeHostName turns the name of the machine into a host name usable as the restic host and a CloudWatch
+// dimension, e.g. "Jane's MacBook Pro" becomes "Janes-MacBook-Pro"
+func sanitizeHostName(name string) string {
+	name = strings.NewReplacer("'", "", "’", "").Replace(strings.TrimSpace(name))
+	name = strings.TrimSuffix(name, ".local")
+	return strings.Trim(hostNameInvalidRe.ReplaceAllString(name, "-"), "-.")
+}
+
+// detectHostName returns the name of the machine, the computer name set in the sharing settings on macOS, which
+// survives the network changes renaming the hostname, and the hostname elsewhere
+func detectHostName() string {
+	if runtime.GOOS == "darwin" {
+		if out, err := exec.Command("scutil", "--get", "ComputerName").Output(); err == nil {
+			if name := sanitizeHostName(string(out)); name != "" {
+				return name
+			}
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		if name := sanitizeHostName(hostname); name != "" {
+			return name
+		}
+	}
+	return legacyHostName
+}
+
+// legacyHostName is the host name of the installations made before the host name was detected
+const legacyHostName = "localhost"
+
+// defaultHostName returns the host name used when host_name is not configured: the detected name, or the legacy
+// localhost for an existing installation, so its metrics, notifications and snapshots keep their host
+func defaultHostName() string {
+	name := detectHostName()
+	state, err := loadStateFile(filepath.Join(expandPath(viper.GetString("backup_directory")), viper.GetString("state_file")))
+	if err != nil || state.LastRun == nil || name == legacyHostName {
+		return name
+	}
+	log.WithField("detected", name).Warn("host_name is not configured, keeping localhost of the existing " +
+		"installation, set host_name to the detected name or to localhost to silence this warning")
+	return legacyHostName
+}
+
+// migrateSnapshotHost moves the snapshots taken before the backups named their host, which restic named after the
+// hostname of the system, to host_name, so the next backup finds its parent and the retention policy keeps a single
+// group of snapshots. It returns false when the migration has to be retried.
+func migrateSnapshotHost(ctx context.Context) bool {
+	previous, err := os.Hostname()
+	if err != nil || previous == appConfig.HostName {
+		return true
+	}
+	snapshots, err := listSnapshots(ctx, "--no-lock", "--host", previous)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot list the snapshots of the previous host name")
+		return false
+	}
+	if len(snapshots) == 0 {
+		return true
+	}
+	fields := log.Fields{"host": previous, "host_name": appConfig.HostName, "snapshots": len(snapshots)}
+	version, err := installedResticVersion(ctx)
+	if err != nil || !version.atLeast(0, 17, 0) || appConfig.Security.AppendOnly {
+		log.WithFields(fields).Warn("The snapshots of the previous host name cannot be renamed (restic 0.17.0 or " +
+			"later without append_only is required), the next backup re-reads all files and the retention policy " +
+			"keeps the previous snapshots apart")
+		return true
+	}
+	if _, err = runResticCommand(ctx, "rewrite", "--forget", "--host", previous, "--new-host", appConfig.HostName); err != nil {
+		log.WithFields(fields).WithField("err", err).Error("cannot rename the host of the snapshots")
+		return false
+	}
+	log.WithFields(fields).Info("Renamed the host of the snapshots to host_name")
+	return true
+}
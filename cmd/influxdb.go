@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// influxMeasurement is the measurement of the run metrics
+const influxMeasurement = "restic_backup"
+
+// influxTagEscaper escapes the tag keys and values of the line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// camelCaseRe matches the word boundaries of a camel case name
+var camelCaseRe = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// influxEnabled reports whether the run metrics are written to InfluxDB
+func influxEnabled() bool {
+	return appConfig.InfluxDB.URL != ""
+}
+
+// influxField returns the field name of the metric, e.g. "BackupDuration" becomes "backup_duration"
+func influxField(name string) string {
+	return strings.ToLower(camelCaseRe.ReplaceAllString(name, "${1}_${2}"))
+}
+
+// influxLine returns the run metrics and the repository stats as a line of the InfluxDB line protocol
+func influxLine(summary *runSummary, state *runState, at time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurement)
+	fmt.Fprintf(&b, ",host=%s,status=%s", influxTagEscaper.Replace(appConfig.HostName), influxTagEscaper.Replace(summary.Status))
+	if activeProfile != "" {
+		fmt.Fprintf(&b, ",profile=%s", influxTagEscaper.Replace(activeProfile))
+	}
+	fields := []string{}
+	for _, metric := range runMetrics(summary) {
+		fields = append(fields, influxField(metric.Name)+"="+strconv.FormatFloat(metric.Value, 'f', -1, 64))
+	}
+	if summary.SnapshotID != "" {
+		fields = append(fields, fmt.Sprintf("bytes_added=%di", summary.BytesAdded))
+	}
+	if n := len(state.RepoSizes); n > 0 {
+		fields = append(fields, fmt.Sprintf("repo_size=%di", state.RepoSizes[n-1].Size))
+	}
+	fmt.Fprintf(&b, " %s %d", strings.Join(fields, ","), at.Unix())
+	return b.String()
+}
+
+// writeInfluxMetrics writes the run metrics to the InfluxDB v2 bucket
+func writeInfluxMetrics(ctx context.Context, summary *runSummary, state *runState) error {
+	query := url.Values{
+		"org":       []string{appConfig.InfluxDB.Org},
+		"bucket":    []string{appConfig.InfluxDB.Bucket},
+		"precision": []string{"s"},
+	}
+	writeURL := strings.TrimSuffix(appConfig.InfluxDB.URL, "/") + "/api/v2/write?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, writeURL, strings.NewReader(influxLine(summary, state, time.Now())))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Authorization", "Token "+appConfig.InfluxDB.Token)
+	return sendRequest(req)
+}
+
+// influxHandler writes the metrics of the finished runs to InfluxDB
+func influxHandler(ctx context.Context, event any) {
+	finished, ok := event.(runFinishedEvent)
+	if !ok || !influxEnabled() {
+		return
+	}
+	if err := writeInfluxMetrics(ctx, finished.Summary, finished.State); err != nil {
+		log.WithField("err", err).Error("cannot write the backup metrics to InfluxDB")
+		return
+	}
+	log.Info("Wrote backup metrics to InfluxDB")
+}
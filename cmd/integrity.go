@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// resticChecksumFile is the file in the backup directory recording the SHA256 of the trusted restic executable
+const resticChecksumFile = ".restic.sha256"
+
+// resticChecksumPath returns the path of the recorded checksum of the restic executable
+func resticChecksumPath() string {
+	return filepath.Join(appConfig.BackupDir, resticChecksumFile)
+}
+
+// resticExecutable returns the path of the restic executable with the symlinks resolved, e.g. of Homebrew
+func resticExecutable() (string, error) {
+	path, err := exec.LookPath(appConfig.Restic.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the restic command: %w", err)
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// fileSHA256 returns the hex encoded SHA256 of the file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// expectedResticChecksum returns the pinned restic.sha256, or else the recorded checksum, empty if there is none
+func expectedResticChecksum() (string, error) {
+	if appConfig.Restic.SHA256 != "" {
+		return strings.ToLower(appConfig.Restic.SHA256), nil
+	}
+	data, err := os.ReadFile(resticChecksumPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the recorded restic checksum: %w", err)
+	}
+	checksum, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	return checksum, nil
+}
+
+// recordResticChecksum records the checksum of the installed restic executable as the trusted one, returning whether
+// it changed
+func recordResticChecksum() (bool, string, error) {
+	path, err := resticExecutable()
+	if err != nil {
+		return false, "", err
+	}
+	checksum, err := fileSHA256(path)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to hash the restic executable: %w", err)
+	}
+	line := checksum + "  " + path + "\n"
+	if current, err := os.ReadFile(resticChecksumPath()); err == nil && string(current) == line {
+		return false, checksum, nil
+	}
+	if err = os.WriteFile(resticChecksumPath(), []byte(line), 0o600); err != nil {
+		return false, "", fmt.Errorf("failed to record the restic checksum: %w", err)
+	}
+	return true, checksum, nil
+}
+
+// verifyResticChecksum checks that the restic executable is the trusted one before it is handed the credentials.
+// Without a pinned or recorded checksum, the checksum of the installed executable is recorded.
+func verifyResticChecksum() error {
+	if !appConfig.Restic.VerifyChecksum {
+		return nil
+	}
+	expected, err := expectedResticChecksum()
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		_, checksum, err := recordResticChecksum()
+		if err == nil {
+			log.WithField("sha256", checksum).Info("Recorded the checksum of the restic executable")
+		}
+		return err
+	}
+	path, err := resticExecutable()
+	if err != nil {
+		return err
+	}
+	checksum, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash the restic executable: %w", err)
+	}
+	if checksum != expected {
+		return fmt.Errorf("the SHA256 of the restic executable %s is %s, expected %s", path, checksum, expected)
+	}
+	return nil
+}
+
+// trustedRestic verifies the restic executable once per process, every restic command is refused when it fails
+var trustedRestic = sync.OnceValue(verifyResticChecksum)
+
+// reportResticChecksum notifies the failed verification of the restic executable
+func reportResticChecksum(startTime time.Time, err error) {
+	state, loadErr := loadState()
+	if loadErr != nil {
+		state = &runState{}
+	}
+	reportCtx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	sendNotifications(reportCtx, &runSummary{
+		HostName:    appConfig.HostName,
+		StartedAt:   startTime,
+		Status:      runStatusFailed,
+		Duration:    time.Since(startTime),
+		Error:       "restic integrity: " + err.Error(),
+		LastSuccess: state.LastSuccess,
+	}, state)
+}
+
+// newPinResticCmd returns the command recording the checksum of the installed restic executable
+func newPinResticCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pin-restic",
+		Short: "Trust the installed restic executable",
+		Long: "Records the SHA256 of the installed restic executable, which is verified before every run. Run it " +
+			"after upgrading restic. A checksum pinned with restic.sha256 takes precedence.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			changed, checksum, err := recordResticChecksum()
+			if err != nil {
+				return err
+			}
+			result := "unchanged"
+			if changed {
+				result = "recorded"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", checksum, result)
+			if appConfig.Restic.SHA256 != "" && !strings.EqualFold(appConfig.Restic.SHA256, checksum) {
+				fmt.Fprintln(cmd.OutOrStdout(), "Warning: restic.sha256 pins another checksum, update it in the configuration")
+			}
+			return nil
+		},
+	}
+}
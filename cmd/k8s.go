@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// terminationLogPath is where Kubernetes reads the termination message of a container from
+const terminationLogPath = "/dev/termination-log"
+
+// Exit codes of a backup run in Kubernetes mode
+const (
+	exitSuccess    = 0
+	exitFailed     = 1
+	exitIncomplete = 3
+	exitPartial    = 4
+)
+
+// setupK8sLogging writes the log to the standard output as JSON, where the cluster collects it
+func setupK8sLogging() {
+	log.SetOutput(os.Stdout)
+	log.SetFormatter(&log.JSONFormatter{})
+}
+
+// k8sExitCode returns the exit code of the run status
+func k8sExitCode(status string) int {
+	switch status {
+	case runStatusFailed:
+		return exitFailed
+	case runStatusIncomplete:
+		return exitIncomplete
+	case runStatusPartial:
+		return exitPartial
+	}
+	return exitSuccess
+}
+
+// maxTerminationMessage is the size Kubernetes truncates the termination message to
+const maxTerminationMessage = 4096
+
+// writeTerminationMessage writes the result of the run to the termination log, shown by "kubectl describe pod"
+func writeTerminationMessage(summary *runSummary) {
+	message := map[string]any{"status": "skipped"}
+	if summary != nil {
+		message = map[string]any{
+			"status":      summary.Status,
+			"snapshot_id": summary.SnapshotID,
+			"bytes_added": summary.BytesAdded,
+			"duration":    summary.Duration.Round(time.Second).String(),
+			"error":       summary.Error,
+		}
+	}
+	saveTerminationMessage(message, message)
+}
+
+// saveTerminationMessage writes the message to the termination log, shortening the errors of the results so it
+// fits the size kept by Kubernetes: a truncated JSON could not be parsed
+func saveTerminationMessage(message map[string]any, results ...map[string]any) {
+	data, err := json.Marshal(message)
+	for err == nil && len(data) > maxTerminationMessage {
+		var longest map[string]any
+		text := ""
+		for _, result := range results {
+			if e, _ := result["error"].(string); len(e) > len(text) {
+				longest, text = result, e
+			}
+		}
+		if longest == nil {
+			break
+		}
+		// Keep the longest prefix of the error that fits, the escaping makes its encoded size unpredictable
+		longest["error"] = ""
+		data, _ = json.Marshal(message)
+		if len(data) > maxTerminationMessage {
+			continue
+		}
+		var cuts []int
+		for i := range text {
+			cuts = append(cuts, i)
+		}
+		best := ""
+		low, high := 0, len(cuts)-1
+		for low <= high {
+			middle := (low + high) / 2
+			longest["error"] = text[:cuts[middle]] + "..."
+			if encoded, _ := json.Marshal(message); len(encoded) <= maxTerminationMessage {
+				best, data = longest["error"].(string), encoded
+				low = middle + 1
+			} else {
+				high = middle - 1
+			}
+		}
+		longest["error"] = best
+	}
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(terminationLogPath, data, 0o644); err != nil {
+		log.WithField("err", err).Warn("cannot write the termination message")
+	}
+}
+
+// readTerminationMessage returns the termination message written by a child process, or nil if it wrote none
+func readTerminationMessage() map[string]any {
+	data, err := os.ReadFile(terminationLogPath)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var message map[string]any
+	if json.Unmarshal(data, &message) != nil {
+		return nil
+	}
+	return message
+}
+
+// exitSeverity orders the exit codes of the runs, a failure or an unknown exit code being the most severe
+func exitSeverity(code int) int {
+	switch code {
+	case exitSuccess:
+		return 0
+	case exitIncomplete:
+		return 1
+	case exitPartial:
+		return 2
+	}
+	return 3
+}
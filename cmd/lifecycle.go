@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// lifecycleRulePrefix names the lifecycle rules written by advise-lifecycle
+const lifecycleRulePrefix = "restic_wrapper-"
+
+// resticMetadataDirs are the directories of the repository read by every run, config is a single object
+var resticMetadataDirs = []string{"config", "keys/", "index/", "snapshots/", "locks/"}
+
+// lifecycleClasses are the storage classes the data packs can be transitioned to, with the days the objects are
+// billed for at least
+var lifecycleClasses = map[string]int{
+	"STANDARD_IA":         30,
+	"INTELLIGENT_TIERING": 0,
+	"GLACIER_IR":          90,
+	"GLACIER":             90,
+	"DEEP_ARCHIVE":        180,
+}
+
+// s3Object is an object of a bucket listing
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+// listObjects returns the objects of the bucket under the prefix
+func (b *s3Bucket) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var (
+		objects []s3Object
+		token   string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(ctx, http.MethodGet, "", query.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = s3Response(resp, &result)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list the objects of the bucket: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Response decodes the XML of the response, closing its body
+func s3Response(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+		}
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// lifecycleRule is a rule of the lifecycle configuration of the bucket. The rule is kept as it is, so applying the
+// advice does not change the rules of the other objects of the bucket.
+type lifecycleRule struct {
+	ID     string `xml:"ID"`
+	Status string `xml:"Status"`
+	// Prefix is the prefix of the deprecated rules without a filter
+	Prefix string `xml:"Prefix"`
+	Filter struct {
+		Prefix string    `xml:"Prefix"`
+		Tag    *struct{} `xml:"Tag"`
+		And    struct {
+			Prefix string     `xml:"Prefix"`
+			Tags   []struct{} `xml:"Tag"`
+		} `xml:"And"`
+	} `xml:"Filter"`
+	Transitions []struct {
+		Days         int    `xml:"Days"`
+		StorageClass string `xml:"StorageClass"`
+	} `xml:"Transition"`
+	Expiration *struct {
+		Days int    `xml:"Days"`
+		Date string `xml:"Date"`
+	} `xml:"Expiration"`
+	Raw string `xml:",innerxml"`
+}
+
+// prefix returns the key prefix the rule applies to
+func (r lifecycleRule) prefix() string {
+	for _, prefix := range []string{r.Filter.Prefix, r.Filter.And.Prefix, r.Prefix} {
+		if prefix != "" {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// covers reports whether the rule applies to some of the objects under the prefix. restic does not tag its objects,
+// the rules filtering on tags never apply to them.
+func (r lifecycleRule) covers(prefix string) bool {
+	if r.Status != "Enabled" || r.Filter.Tag != nil || len(r.Filter.And.Tags) > 0 {
+		return false
+	}
+	return strings.HasPrefix(prefix, r.prefix()) || strings.HasPrefix(r.prefix(), prefix)
+}
+
+// bucketLifecycle returns the lifecycle rules of the bucket, none when the bucket has no lifecycle configuration
+func (b *s3Bucket) bucketLifecycle(ctx context.Context) ([]lifecycleRule, error) {
+	resp, err := b.do(ctx, http.MethodGet, "", "lifecycle", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil
+	}
+	var config struct {
+		Rules []lifecycleRule `xml:"Rule"`
+	}
+	if err = s3Response(resp, &config); err != nil {
+		return nil, fmt.Errorf("cannot get the lifecycle rules of the bucket: %w", err)
+	}
+	return config.Rules, nil
+}
+
+// putBucketLifecycle replaces the lifecycle configuration of the bucket with the rules
+func (b *s3Bucket) putBucketLifecycle(ctx context.Context, rules []string) error {
+	body := []byte(`<?xml version="1.0" encoding="UTF-8"?><LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		strings.Join(rules, "") + "</LifecycleConfiguration>")
+	sum := md5.Sum(body)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := b.do(ctx, http.MethodPut, "", "lifecycle", body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("cannot put the lifecycle rules of the bucket: unexpected response %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// repositoryPrefix returns the key prefix of the path of the repository, e.g. "restic/index/"
+func (b *s3Bucket) repositoryPrefix(dir string) string {
+	if b.prefix == "" {
+		return dir
+	}
+	return b.prefix + "/" + dir
+}
+
+// lifecycleProblems returns what the rules would break in the repository. A rule deleting or archiving the
+// metadata makes the repository unusable, archiving the data packs makes prune and check --read-data-subset fail.
+func lifecycleProblems(b *s3Bucket, rules []lifecycleRule, readingPacks bool) []string {
+	var problems []string
+	for _, rule := range rules {
+		for _, dir := range append(slices.Clone(resticMetadataDirs), "data/") {
+			if !rule.covers(b.repositoryPrefix(dir)) {
+				continue
+			}
+			// An expiration only removing the delete markers of a versioned bucket is harmless
+			if rule.Expiration != nil && (rule.Expiration.Days > 0 || rule.Expiration.Date != "") {
+				problems = append(problems, fmt.Sprintf("rule %q expires the objects in %s, deleting them corrupts the repository", rule.ID, dir))
+			}
+			for _, transition := range rule.Transitions {
+				cold := slices.Contains(coldStorageClasses, transition.StorageClass)
+				switch {
+				case dir != "data/" && cold:
+					problems = append(problems, fmt.Sprintf("rule %q moves %s to %s, restic cannot read the repository once they are archived", rule.ID, dir, transition.StorageClass))
+				case dir != "data/":
+					problems = append(problems, fmt.Sprintf("rule %q moves %s to %s, they are read by every run and are billed for at least %d days", rule.ID, dir, transition.StorageClass, lifecycleClasses[transition.StorageClass]))
+				case cold && readingPacks:
+					problems = append(problems, fmt.Sprintf("rule %q moves the data packs to %s, prune and check --read-data-subset fail on the archived packs", rule.ID, transition.StorageClass))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// pruneInterval returns the average time between the prunes of the profile in the history, zero when it did not prune
+func pruneInterval(since time.Time) (time.Duration, int, error) {
+	runs, err := historyRuns(since)
+	if err != nil {
+		return 0, 0, err
+	}
+	var prunes []time.Time
+	for _, run := range runs {
+		if run.Profile != activeProfile {
+			continue
+		}
+		for _, stage := range run.Stages {
+			if stage.Name == "prune" && stage.Error == "" {
+				prunes = append(prunes, run.StartedAt)
+			}
+		}
+	}
+	if len(prunes) < 2 {
+		return 0, len(prunes), nil
+	}
+	return prunes[len(prunes)-1].Sub(prunes[0]) / time.Duration(len(prunes)-1), len(prunes), nil
+}
+
+// transitionDays returns after how many days the data packs are moved to the storage class. Most of the packs
+// removed by prune hold the data only referenced by the daily and weekly snapshots of the retention policy, so the
+// packs are moved once those snapshots were forgotten and pruned, and not before the minimum billed days of the
+// class, which a pack pruned earlier is charged for anyway.
+func transitionDays(class string, interval time.Duration) int {
+	days := 5*7 + int((interval+24*time.Hour-1)/(24*time.Hour))
+	return max(days, lifecycleClasses[class])
+}
+
+// lifecycleAdviceRules returns the rules advised for the repository: the data packs moved to the storage class and
+// the incomplete multipart uploads of interrupted backups removed
+func lifecycleAdviceRules(b *s3Bucket, class string, days int) []string {
+	var rules []string
+	if days > 0 {
+		rules = append(rules, fmt.Sprintf("<Rule><ID>%sdata</ID><Filter><Prefix>%s</Prefix></Filter><Status>Enabled</Status>"+
+			"<Transition><Days>%d</Days><StorageClass>%s</StorageClass></Transition></Rule>", lifecycleRulePrefix,
+			xmlEscape(b.repositoryPrefix("data/")), days, class))
+	}
+	rules = append(rules, fmt.Sprintf("<Rule><ID>%smultipart</ID><Filter><Prefix>%s</Prefix></Filter><Status>Enabled</Status>"+
+		"<AbortIncompleteMultipartUpload><DaysAfterInitiation>7</DaysAfterInitiation></AbortIncompleteMultipartUpload></Rule>",
+		lifecycleRulePrefix, xmlEscape(b.repositoryPrefix(""))))
+	return rules
+}
+
+// xmlEscape escapes the text for an XML element
+func xmlEscape(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+// newAdviseLifecycleCmd returns the command advising the lifecycle rules of the S3 bucket of the repository
+func newAdviseLifecycleCmd() *cobra.Command {
+	var (
+		class string
+		apply bool
+		yes   bool
+	)
+	cmd := &cobra.Command{
+		Use:   "advise-lifecycle",
+		Short: "Suggest S3 lifecycle rules compatible with restic",
+		Long: "Inspects the age and the storage class of the data packs of the S3 repository and the prune cadence of " +
+			"the profile, and suggests the bucket lifecycle rules moving the data packs to a cheaper storage class " +
+			"once they are unlikely to be pruned. Only the data packs are moved: the config, keys, index, snapshots " +
+			"and locks are read by every run. The existing rules that would corrupt the repository, e.g. expiring " +
+			"its objects or moving the metadata to Glacier, are reported. With --apply the rules are written to the " +
+			"bucket, replacing the rules covering the repository and keeping the other rules of the bucket.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, ok := lifecycleClasses[class]; !ok {
+				return fmt.Errorf("invalid storage class %q, expected one of %s", class, strings.Join(slices.Sorted(maps.Keys(lifecycleClasses)), ", "))
+			}
+			ctx := context.Background()
+			w := cmd.OutOrStdout()
+			setupEnv()
+			b, err := openS3Bucket(ctx, os.Getenv("RESTIC_REPOSITORY"))
+			if err != nil {
+				return err
+			}
+
+			objects, err := b.listObjects(ctx, b.repositoryPrefix("data/"))
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			ages := []struct {
+				label string
+				days  int
+				count int
+				size  int64
+			}{{"under 30 days", 30, 0, 0}, {"30 to 90 days", 90, 0, 0}, {"90 to 180 days", 180, 0, 0}, {"over 180 days", 1 << 30, 0, 0}}
+			classes := map[string]int64{}
+			var total int64
+			for _, object := range objects {
+				age := int(now.Sub(object.LastModified).Hours() / 24)
+				for i := range ages {
+					if age < ages[i].days {
+						ages[i].count++
+						ages[i].size += object.Size
+						break
+					}
+				}
+				storageClass := object.StorageClass
+				if storageClass == "" {
+					storageClass = "STANDARD"
+				}
+				classes[storageClass] += object.Size
+				total += object.Size
+			}
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "Data packs:\t%d, %s\n", len(objects), formatBytes(total))
+			for _, age := range ages {
+				fmt.Fprintf(tw, "  %s\t%d, %s\n", age.label, age.count, formatBytes(age.size))
+			}
+			for _, name := range slices.Sorted(maps.Keys(classes)) {
+				fmt.Fprintf(tw, "  in %s\t%s\n", name, formatBytes(classes[name]))
+			}
+
+			pruning := appConfig.CleanupOldBackups && !appConfig.Security.AppendOnly
+			interval, prunes, err := pruneInterval(now.AddDate(0, 0, -90))
+			if err != nil {
+				return fmt.Errorf("cannot read the history: %w", err)
+			}
+			switch {
+			case !pruning:
+				fmt.Fprintln(tw, "Prune:\tnever, the packs are never removed")
+			case prunes < 2:
+				fmt.Fprintf(tw, "Prune:\tafter every backup, %d prunes in the last 90 days\n", prunes)
+			default:
+				fmt.Fprintf(tw, "Prune:\tevery %.1f days on average, %d prunes in the last 90 days\n", interval.Hours()/24, prunes)
+			}
+			if err = tw.Flush(); err != nil {
+				return err
+			}
+
+			rules, err := b.bucketLifecycle(ctx)
+			if err != nil {
+				return err
+			}
+			// The checks reading the data download packs like prune
+			readingData := appConfig.Check.Interval > 0 && appConfig.Check.ReadDataSubsets > 0
+			problems := lifecycleProblems(b, rules, pruning || readingData)
+			if len(problems) > 0 {
+				fmt.Fprintln(w, "\nThe lifecycle rules of the bucket break the repository:")
+				for _, problem := range problems {
+					fmt.Fprintf(w, "  - %s\n", problem)
+				}
+			}
+
+			fmt.Fprintln(w)
+			days := transitionDays(class, interval)
+			switch {
+			case slices.Contains(coldStorageClasses, class) && pruning:
+				return fmt.Errorf("prune reads the packs it repacks, moving them to %s makes it fail; set "+
+					"cleanup_old_backups to false or choose a storage class readable without a restore", class)
+			case slices.Contains(coldStorageClasses, class) && readingData:
+				return fmt.Errorf("check reads a subset of the packs, moving them to %s makes it fail; set "+
+					"check.read_data_subsets to 0 or choose a storage class readable without a restore", class)
+			case appConfig.Restic.S3Storage == class:
+				fmt.Fprintf(w, "restic already uploads the data packs to %s, no transition is needed\n", class)
+				days = 0
+			default:
+				var moved int64
+				for _, object := range objects {
+					if now.Sub(object.LastModified) >= time.Duration(days)*24*time.Hour {
+						moved += object.Size
+					}
+				}
+				fmt.Fprintf(w, "Move the data packs to %s after %d days, %s of the packs now.\n", class, days, formatBytes(moved))
+				if slices.Contains(coldStorageClasses, class) {
+					fmt.Fprintln(w, "The restores then need restore --cold-storage.")
+				}
+			}
+			fmt.Fprintln(w, "Abort the incomplete multipart uploads of interrupted backups after 7 days.")
+
+			var kept, replaced []string
+			for _, rule := range rules {
+				if strings.HasPrefix(rule.ID, lifecycleRulePrefix) || rule.covers(b.repositoryPrefix("")) {
+					replaced = append(replaced, rule.ID)
+					continue
+				}
+				kept = append(kept, "<Rule>"+rule.Raw+"</Rule>")
+			}
+			advised := lifecycleAdviceRules(b, class, days)
+			if !apply {
+				fmt.Fprintln(w, "\nRules (apply them with --apply):")
+				for _, rule := range advised {
+					fmt.Fprintf(w, "  %s\n", rule)
+				}
+				return nil
+			}
+			if len(replaced) > 0 && !yes {
+				fmt.Fprintf(w, "\nThe rules %s cover the repository and are replaced.\n", strings.Join(replaced, ", "))
+				wz := &wizard{in: bufio.NewReader(cmd.InOrStdin()), out: w}
+				if ok, err := wz.askYes("Replace them?", false); err != nil || !ok {
+					if err == nil {
+						err = errors.New("the lifecycle rules were not changed")
+					}
+					return err
+				}
+			}
+			if err = b.putBucketLifecycle(ctx, append(kept, advised...)); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Applied %d rules to the bucket %s\n", len(advised), b.bucket)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&class, "storage-class", "STANDARD_IA", "the storage class the data packs are moved to")
+	cmd.Flags().BoolVar(&apply, "apply", false, "write the advised rules to the bucket")
+	cmd.Flags().BoolVar(&yes, "yes", false, "replace the existing rules covering the repository without asking")
+	return cmd
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// listSnapshotNodes returns the files, directories and symlinks of the snapshot under the path, all of them if the
+// path is empty
+func listSnapshotNodes(ctx context.Context, snapshotID, dir string) ([]snapshotNode, error) {
+	args := []string{"ls", "--json", snapshotID}
+	if dir != "" {
+		args = append(args, "--recursive", dir)
+	}
+	output, err := runResticCommand(ctx, args...)
+	if err != nil {
+		if fatal := fatalError(err); fatal != "" {
+			return nil, fmt.Errorf("restic ls failed: %s", fatal)
+		}
+		return nil, fmt.Errorf("restic ls failed: %w", err)
+	}
+	var nodes []snapshotNode
+	for _, line := range strings.Split(output, "\n") {
+		var node snapshotNode
+		if json.Unmarshal([]byte(line), &node) == nil && node.StructType == "node" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// filterNodes returns the nodes matching the pattern, like the search command matches them, with their parent
+// directories so they can be shown as a tree
+func filterNodes(nodes []snapshotNode, pattern string) []snapshotNode {
+	keep := map[string]bool{}
+	for _, node := range nodes {
+		if manifestMatch(pattern, node.Path) {
+			for p := node.Path; !keep[p]; p = path.Dir(p) {
+				keep[p] = true
+				if p == "/" || p == "." {
+					break
+				}
+			}
+		}
+	}
+	var filtered []snapshotNode
+	for _, node := range nodes {
+		if keep[node.Path] {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// nodeLabel returns the name of the node shown in the tree
+func nodeLabel(node snapshotNode, name string) string {
+	switch node.Type {
+	case "dir":
+		return name + "/"
+	case "symlink":
+		return name + " -> " + node.LinkTarget
+	case "file":
+		return name + " (" + formatBytes(node.Size) + ")"
+	}
+	return name
+}
+
+// writeTree writes the nodes as a tree, e.g.
+//
+//	/home/u/
+//	├── a.txt (2 KiB)
+//	└── docs/
+func writeTree(w io.Writer, nodes []snapshotNode) {
+	children := map[string][]snapshotNode{}
+	known := map[string]bool{}
+	for _, node := range nodes {
+		known[node.Path] = true
+	}
+	var roots []snapshotNode
+	for _, node := range nodes {
+		if parent := path.Dir(node.Path); known[parent] && parent != node.Path {
+			children[parent] = append(children[parent], node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	var walk func(node snapshotNode, prefix string)
+	walk = func(node snapshotNode, prefix string) {
+		kids := children[node.Path]
+		for i, child := range kids {
+			branch, indent := "├── ", "│   "
+			if i == len(kids)-1 {
+				branch, indent = "└── ", "    "
+			}
+			fmt.Fprintf(w, "%s%s%s\n", prefix, branch, nodeLabel(child, path.Base(child.Path)))
+			walk(child, prefix+indent)
+		}
+	}
+	for _, root := range roots {
+		fmt.Fprintln(w, nodeLabel(root, root.Path))
+		walk(root, "")
+	}
+}
+
+// writeLongListing writes the nodes with their mode, size and modification time
+func writeLongListing(w io.Writer, nodes []snapshotNode) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, node := range nodes {
+		size := ""
+		if node.Type == "file" {
+			size = formatBytes(node.Size)
+		}
+		name := node.Path
+		if node.Type == "symlink" {
+			name += " -> " + node.LinkTarget
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", node.Mode, size, node.Mtime.Local().Format("2006-01-02 15:04"), name)
+	}
+	return tw.Flush()
+}
+
+// pagedOutput returns the writer of a listing, piped to $PAGER when the output is a terminal, and the function
+// waiting for the pager to exit
+func pagedOutput(cmd *cobra.Command, noPager bool) (io.Writer, func() error) {
+	out := cmd.OutOrStdout()
+	file, ok := out.(*os.File)
+	if noPager || !ok || !term.IsTerminal(int(file.Fd())) {
+		return out, func() error { return nil }
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	pagerCmd := exec.Command("sh", "-c", pager)
+	pagerCmd.Stdout, pagerCmd.Stderr = file, os.Stderr
+	// Quit when the listing fits the screen and keep it on the screen afterwards
+	pagerCmd.Env = append(os.Environ(), "LESS="+os.Getenv("LESS")+"FRX")
+	stdin, err := pagerCmd.StdinPipe()
+	if err != nil || pagerCmd.Start() != nil {
+		return out, func() error { return nil }
+	}
+	return stdin, func() error {
+		stdin.Close()
+		return pagerCmd.Wait()
+	}
+}
+
+// newLsCmd returns the command listing the files of a snapshot
+func newLsCmd() *cobra.Command {
+	var (
+		long    bool
+		glob    string
+		noPager bool
+	)
+	cmd := &cobra.Command{
+		Use:   "ls <snapshot-id> [path]",
+		Short: "List the files of a snapshot",
+		Long: "Lists the files of the snapshot (or \"latest\") as a tree, or with --long as a listing with their mode, " +
+			"size and modification time, without mounting the repository. The path limits the listing to a " +
+			"directory of the snapshot, --glob to the files matching the pattern (with wildcards it is matched " +
+			"against the full path and the file name, otherwise as a part of the path). The listing is shown " +
+			"in $PAGER when the output is a terminal.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupEnv()
+			dir := ""
+			if len(args) == 2 {
+				dir = args[1]
+			}
+			nodes, err := listSnapshotNodes(context.Background(), args[0], dir)
+			if err != nil {
+				return err
+			}
+			if glob != "" {
+				nodes = filterNodes(nodes, glob)
+			}
+			if len(nodes) == 0 {
+				return fmt.Errorf("no files found in %s", args[0])
+			}
+			w, wait := pagedOutput(cmd, noPager)
+			if long {
+				err = writeLongListing(w, nodes)
+			} else {
+				writeTree(w, nodes)
+			}
+			if waitErr := wait(); err == nil {
+				err = waitErr
+			}
+			return err
+		},
+	}
+	cmd.Flags().BoolVarP(&long, "long", "l", false, "list the mode, size and modification time of the files")
+	cmd.Flags().StringVar(&glob, "glob", "", "only list the files matching the pattern, e.g. \"*.pdf\"")
+	cmd.Flags().BoolVar(&noPager, "no-pager", false, "do not show the listing in $PAGER")
+	return cmd
+}
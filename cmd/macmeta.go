@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// macMetadataAttributes are the extended attributes holding the resource forks and the Finder metadata
+var macMetadataAttributes = []string{"com.apple.ResourceFork", "com.apple.FinderInfo"}
+
+// macMetadataMaxFiles is the number of files visited to find the samples of the metadata check
+const macMetadataMaxFiles = 100000
+
+// errEnoughSamples stops the search for samples
+var errEnoughSamples = errors.New("enough samples")
+
+// macMetadata returns the resource fork and Finder metadata attributes of the file
+func macMetadata(path string) []string {
+	buf := make([]byte, 4096)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var found []string
+	for _, name := range bytes.Split(buf[:n], []byte{0}) {
+		if slices.Contains(macMetadataAttributes, string(name)) {
+			found = append(found, string(name))
+		}
+	}
+	return found
+}
+
+// macMetadataSamples returns up to count files of the sources with a resource fork or Finder metadata
+func macMetadataSamples(sources []string, count int) map[string][]string {
+	samples := map[string][]string{}
+	visited := 0
+	for _, source := range sources {
+		err := filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if visited++; visited > macMetadataMaxFiles {
+				return errEnoughSamples
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			if attributes := macMetadata(path); len(attributes) > 0 {
+				samples[path] = attributes
+			}
+			if len(samples) >= count {
+				return errEnoughSamples
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	return samples
+}
+
+// verifyMacMetadata checks that the sampled files of the sources kept their resource forks and Finder metadata in
+// the snapshot, returning the files missing some of them
+func verifyMacMetadata(ctx context.Context, snapshotID string, sources []string) (int, []string, error) {
+	samples := macMetadataSamples(sources, appConfig.MacOSMetadata.Samples)
+	var missing []string
+	for path, attributes := range samples {
+		node, err := snapshotFile(ctx, snapshotID, path)
+		if err != nil {
+			return 0, nil, err
+		}
+		if node == nil {
+			// Excluded from the backup
+			delete(samples, path)
+			continue
+		}
+		for _, attribute := range attributes {
+			if !slices.ContainsFunc(node.ExtendedAttributes, func(a extendedAttribute) bool { return a.Name == attribute }) {
+				missing = append(missing, fmt.Sprintf("%s (%s)", path, attribute))
+			}
+		}
+	}
+	slices.Sort(missing)
+	if len(missing) > 0 {
+		log.WithField("missing", missing).Warn("Some resource forks or Finder metadata are missing from the snapshot")
+	}
+	return len(samples), missing, nil
+}
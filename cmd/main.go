@@ -3,18 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/gofrs/flock"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -25,20 +33,432 @@ type Config struct {
 	BackupDir string `mapstructure:"backup_directory"`
 	LockFile  string `mapstructure:"lock_file"`
 	LogFile   string `mapstructure:"log_file"`
+	StateFile string `mapstructure:"state_file"`
+	NotesFile string `mapstructure:"notes_file"`
+	// HistoryFile is the database of the past runs
+	HistoryFile string `mapstructure:"history_file"`
+	History     struct {
+		// MaxAge is how long the runs are kept in the history
+		MaxAge time.Duration `mapstructure:"max_age"`
+	} `mapstructure:"history"`
+	// AuditLog appends every run to a hash-chained log, optionally signed and committed to a git repository
+	AuditLog struct {
+		Enabled       bool   `mapstructure:"enabled"`
+		Path          string `mapstructure:"path"`
+		SigningKey    string `mapstructure:"signing_key"`
+		GitRepository string `mapstructure:"git_repository"`
+		GitPush       bool   `mapstructure:"git_push"`
+	} `mapstructure:"audit_log"`
 
 	Restic struct {
 		Path        string `mapstructure:"executable_path"`
 		FilesFrom   string `mapstructure:"files_from"`
 		ExcludeFile string `mapstructure:"exclude_file"`
 		S3Storage   string `mapstructure:"s3_storage_class"`
+		// Sudo runs restic backup as root to read root-owned paths, through the root-owned SudoWrapper script
+		Sudo        bool   `mapstructure:"sudo"`
+		SudoWrapper string `mapstructure:"sudo_wrapper"`
+		// MemoryLimit is the soft memory limit of the restic Go runtime (GOMEMLIMIT), e.g. "2GiB"
+		MemoryLimit string `mapstructure:"memory_limit"`
+		// GOGC is the garbage collection target percentage of restic, 0 keeps the default
+		GOGC int `mapstructure:"gogc"`
+		// MemoryMax is the hard memory cap of restic enforced with a systemd scope on Linux, e.g. "4GiB"
+		MemoryMax string `mapstructure:"memory_max"`
+		// VerifyChecksum checks the SHA256 of the restic executable before every run, SHA256 pins it
+		VerifyChecksum bool   `mapstructure:"verify_checksum"`
+		SHA256         string `mapstructure:"sha256"`
 	} `mapstructure:"restic"`
 
-	HostName          string `mapstructure:"host_name"`
+	// Secrets configures where the repository and AWS secrets are read from
+	Secrets struct {
+		Source string `mapstructure:"source"`
+		Dir    string `mapstructure:"dir"`
+		// Prefix namespaces the accounts (or files) of the secrets, e.g. "nas-" reads "nas-password"
+		Prefix string `mapstructure:"prefix"`
+		// Accounts overrides the accounts (or files) of the secrets by environment variable, e.g. to reuse the
+		// keychain items created by another tool
+		Accounts map[string]string `mapstructure:"accounts"`
+		// PasswordCommand and PasswordFile let restic read the repository password itself, keeping it out of the
+		// environment
+		PasswordCommand string `mapstructure:"password_command"`
+		PasswordFile    string `mapstructure:"password_file"`
+	} `mapstructure:"secrets"`
+	// AWS configures the credentials of the metrics and the SNS notifications, kept apart from the restic credentials
+	AWS struct {
+		Profile string `mapstructure:"profile"`
+		RoleARN string `mapstructure:"role_arn"`
+		Region  string `mapstructure:"region"`
+	} `mapstructure:"aws"`
+	// HostRoot is where the host filesystem is mounted when backing up the host from a container
+	HostRoot string `mapstructure:"host_root"`
+
+	HostName string `mapstructure:"host_name"`
+	// Timezone is the IANA timezone of the schedules, the local timezone by default
+	Timezone          string `mapstructure:"timezone"`
 	SecurityService   string `mapstructure:"security_service"`
 	RequireAcPower    bool   `mapstructure:"require_ac_power"`
 	CleanupOldBackups bool   `mapstructure:"cleanup_old_backups"`
+	// RequireFullDiskAccess refuses to back up without macOS Full Disk Access
+	RequireFullDiskAccess bool `mapstructure:"require_full_disk_access"`
+	// AutoTags tags the snapshots taken on battery, with missing sources or unreadable files
+	AutoTags bool `mapstructure:"auto_tags"`
+	// SelfBackup backs up the configuration with the secrets redacted and the state after every backup
+	SelfBackup bool `mapstructure:"self_backup"`
+	// SystemManifest adds the lists of the installed packages, the scheduled jobs and the settings to every backup
+	SystemManifest struct {
+		Enabled         bool              `mapstructure:"enabled"`
+		DefaultsDomains []string          `mapstructure:"defaults_domains"`
+		Commands        map[string]string `mapstructure:"commands"`
+		Timeout         time.Duration     `mapstructure:"timeout"`
+	} `mapstructure:"system_manifest"`
+	// Enabled is unset to keep a profile in the configuration without backing it up
+	Enabled bool `mapstructure:"enabled"`
+
+	Retention struct {
+		KeepTag string `mapstructure:"keep_tag"`
+	} `mapstructure:"retention"`
+
+	Restore struct {
+		Sparse        bool     `mapstructure:"sparse"`
+		IncludeXattrs []string `mapstructure:"include_xattrs"`
+		ExcludeXattrs []string `mapstructure:"exclude_xattrs"`
+		ACLs          bool     `mapstructure:"acls"`
+		Overwrite     string   `mapstructure:"overwrite"`
+		Verify        bool     `mapstructure:"verify"`
+		Connections   int      `mapstructure:"connections"`
+		// ColdStorage restores the archived packs of S3 repositories before restic restore reads them
+		ColdStorage struct {
+			Enabled      bool          `mapstructure:"enabled"`
+			Tier         string        `mapstructure:"tier"`
+			Days         int           `mapstructure:"days"`
+			PollInterval time.Duration `mapstructure:"poll_interval"`
+			Timeout      time.Duration `mapstructure:"timeout"`
+			RenewBefore  time.Duration `mapstructure:"renew_before"`
+		} `mapstructure:"cold_storage"`
+	} `mapstructure:"restore"`
+
+	SizeRules []struct {
+		Path     string `mapstructure:"path"`
+		MaxSize  string `mapstructure:"max_size"`
+		WarnSize string `mapstructure:"warn_size"`
+	} `mapstructure:"size_rules"`
+	// Priorities are groups of backup sources backed up first, in their order, each in its own snapshot
+	Priorities []struct {
+		Name  string   `mapstructure:"name"`
+		Paths []string `mapstructure:"paths"`
+	} `mapstructure:"priorities"`
+	// Chunking splits the initial backup into chunks backed up in sequence, resuming after the last one backed up
+	Chunking struct {
+		Enabled bool   `mapstructure:"enabled"`
+		By      string `mapstructure:"by"`
+		MaxSize string `mapstructure:"max_size"`
+	} `mapstructure:"chunking"`
+	DockerVolumes struct {
+		Path        string   `mapstructure:"executable_path"`
+		HelperImage string   `mapstructure:"helper_image"`
+		Volumes     []string `mapstructure:"volumes"`
+	} `mapstructure:"docker_volumes"`
+
+	// Staging backs up to a local repository first and copies the snapshots to the remote one in the background
+	Staging struct {
+		Repository     string        `mapstructure:"repository"`
+		KeepLast       int           `mapstructure:"keep_last"`
+		KeepDaily      int           `mapstructure:"keep_daily"`
+		MaxSyncRuntime time.Duration `mapstructure:"max_sync_runtime"`
+		// SecretsPrefix namespaces the password of the staging repository, empty when it shares the password
+		SecretsPrefix string `mapstructure:"secrets_prefix"`
+	} `mapstructure:"staging"`
+
+	// Canary are the files restored from every new snapshot and compared with the source
+	Canary struct {
+		Paths []string `mapstructure:"paths"`
+	} `mapstructure:"canary"`
+
+	Warnings struct {
+		// MaxGroups limits the kinds of warnings listed in the notifications
+		MaxGroups int `mapstructure:"max_groups"`
+		// Ignore are the patterns of the known warnings that are not reported, matched against "<path>: <reason>"
+		Ignore []string `mapstructure:"ignore"`
+	} `mapstructure:"warnings"`
+
+	// Script is the Starlark script deciding whether to back up and computing the snapshot tags
+	Script struct {
+		File    string        `mapstructure:"file"`
+		Timeout time.Duration `mapstructure:"timeout"`
+	} `mapstructure:"script"`
+
+	// Plugins are the executables receiving the run events
+	Plugins struct {
+		Dir     string        `mapstructure:"dir"`
+		Timeout time.Duration `mapstructure:"timeout"`
+		// Env lists the environment variables passed to the hooks in addition to the base ones, the credentials
+		// are only passed when listed
+		Env []string `mapstructure:"env"`
+		// WorkDir is the working directory of the hooks, a temporary directory when empty
+		WorkDir   string `mapstructure:"work_dir"`
+		MaxOutput string `mapstructure:"max_output"`
+	} `mapstructure:"plugins"`
+
+	// Manifests stores the file list of every snapshot in the backup directory
+	Manifests struct {
+		Enabled bool          `mapstructure:"enabled"`
+		MaxAge  time.Duration `mapstructure:"max_age"`
+	} `mapstructure:"manifests"`
+
+	// Preset selects the built-in exclude lists, e.g. "macos-home"
+	Preset []string `mapstructure:"preset"`
+	// AppSettings selects the built-in application settings added to the backup sources, e.g. "vscode"
+	AppSettings []string `mapstructure:"app_settings"`
+	// MacOSMetadata checks that the resource forks and the Finder metadata of the sources are in the snapshots
+	MacOSMetadata struct {
+		Verify  bool `mapstructure:"verify"`
+		Samples int  `mapstructure:"samples"`
+	} `mapstructure:"macos_metadata"`
+
+	// TimeMachineExclusions imports the items excluded from Time Machine as restic excludes
+	TimeMachineExclusions bool `mapstructure:"time_machine_exclusions"`
+
+	SecretsScan struct {
+		Enabled  bool     `mapstructure:"enabled"`
+		Patterns []string `mapstructure:"patterns"`
+		Allow    []string `mapstructure:"allow"`
+		MaxFiles int      `mapstructure:"max_files"`
+	} `mapstructure:"secrets_scan"`
+
+	Check struct {
+		Interval        time.Duration `mapstructure:"interval"`
+		ReadDataSubsets int           `mapstructure:"read_data_subsets"`
+		// RepairIndex runs restic repair index when the check finds a damaged index
+		RepairIndex bool `mapstructure:"repair_index"`
+		// PruneMaxAge skips prune when the last passed check is older
+		PruneMaxAge time.Duration `mapstructure:"prune_max_age"`
+	} `mapstructure:"check"`
+
+	Health struct {
+		WarningThreshold int           `mapstructure:"warning_threshold"`
+		MaxCheckAge      time.Duration `mapstructure:"max_check_age"`
+		MaxPruneAge      time.Duration `mapstructure:"max_prune_age"`
+		StaleLockAge     time.Duration `mapstructure:"stale_lock_age"`
+		MaxGrowthRatio   float64       `mapstructure:"max_growth_ratio"`
+		// MinThroughputRatio is the share of the usual backup throughput below which it is considered collapsed
+		MinThroughputRatio float64 `mapstructure:"min_throughput_ratio"`
+	} `mapstructure:"health"`
+
+	// Guardrails alert when the newest snapshot is too old or the snapshot count drops unexpectedly
+	Guardrails struct {
+		MaxSnapshotAge time.Duration `mapstructure:"max_snapshot_age"`
+		// MaxCountDrop is the share of the snapshots of the host that may disappear between two checks
+		MaxCountDrop float64 `mapstructure:"max_count_drop"`
+	} `mapstructure:"guardrails"`
+
+	// Grafana annotates the backup windows on the Grafana dashboards
+	Grafana struct {
+		URL          string   `mapstructure:"url"`
+		Token        string   `mapstructure:"token"`
+		DashboardUID string   `mapstructure:"dashboard_uid"`
+		PanelID      int      `mapstructure:"panel_id"`
+		Tags         []string `mapstructure:"tags"`
+	} `mapstructure:"grafana"`
+
+	// InfluxDB receives the run metrics in the line protocol
+	InfluxDB struct {
+		URL    string `mapstructure:"url"`
+		Org    string `mapstructure:"org"`
+		Bucket string `mapstructure:"bucket"`
+		Token  string `mapstructure:"token"`
+	} `mapstructure:"influxdb"`
+
+	// Zabbix receives the result of every run in trapper items
+	Zabbix struct {
+		Server    string `mapstructure:"server"`
+		Host      string `mapstructure:"host"`
+		KeyPrefix string `mapstructure:"key_prefix"`
+	} `mapstructure:"zabbix"`
+
+	// Fleet is the policy the hosts sharing a remote configuration are checked against
+	Fleet struct {
+		RequiredProfiles []string      `mapstructure:"required_profiles"`
+		MaxBackupAge     time.Duration `mapstructure:"max_backup_age"`
+		LockedKeys       []string      `mapstructure:"locked_keys"`
+	} `mapstructure:"fleet"`
+
+	// System configures the system-wide mode backing up several users
+	System struct {
+		ConfDir string `mapstructure:"conf_dir"`
+	} `mapstructure:"system"`
+
+	// Network configures the proxies and the CA bundle used by restic and the program's own HTTP clients
+	Network struct {
+		HTTPProxy  string `mapstructure:"http_proxy"`
+		HTTPSProxy string `mapstructure:"https_proxy"`
+		NoProxy    string `mapstructure:"no_proxy"`
+		CABundle   string `mapstructure:"ca_bundle"`
+		// AddressFamily pins the connections of the program to "ipv4" or "ipv6"
+		AddressFamily string `mapstructure:"address_family"`
+	} `mapstructure:"network"`
+
+	// Offline defers the backups while the repository is unreachable
+	Offline struct {
+		Enabled       bool          `mapstructure:"enabled"`
+		RetryInterval time.Duration `mapstructure:"retry_interval"`
+		RetryFor      time.Duration `mapstructure:"retry_for"`
+		MaxDeferral   time.Duration `mapstructure:"max_deferral"`
+	} `mapstructure:"offline"`
+
+	// Daemon configures the long-running mode started with the daemon command
+	Daemon struct {
+		Interval time.Duration `mapstructure:"interval"`
+		// Watch triggers extra backups when enough files of the sources changed
+		Watch struct {
+			Enabled        bool          `mapstructure:"enabled"`
+			Paths          []string      `mapstructure:"paths"`
+			MinFiles       int           `mapstructure:"min_files"`
+			MinSize        string        `mapstructure:"min_size"`
+			Debounce       time.Duration `mapstructure:"debounce"`
+			MinInterval    time.Duration `mapstructure:"min_interval"`
+			MaxDirectories int           `mapstructure:"max_directories"`
+		} `mapstructure:"watch"`
+		// CatchUp backs up shortly after the login and after a wake from sleep when the last backup is stale
+		CatchUp struct {
+			Enabled bool          `mapstructure:"enabled"`
+			MaxAge  time.Duration `mapstructure:"max_age"`
+			Delay   time.Duration `mapstructure:"delay"`
+		} `mapstructure:"catch_up"`
+		// Heartbeat is how often the daemon checks the snapshot guardrails between the backups
+		Heartbeat time.Duration `mapstructure:"heartbeat"`
+		// HealthListen is the address of the health endpoint of the daemon, disabled when empty
+		HealthListen string `mapstructure:"health_listen"`
+		// Report sends the report of the backups every Interval, disabled when zero
+		Report struct {
+			Interval time.Duration `mapstructure:"interval"`
+			Format   string        `mapstructure:"format"`
+		} `mapstructure:"report"`
+	} `mapstructure:"daemon"`
+
+	MaxRuntime      time.Duration `mapstructure:"max_runtime"`
+	StopGracePeriod time.Duration `mapstructure:"stop_grace_period"`
+	// MaxUploadPerRun stops the backup gracefully once it uploaded this much data, e.g. "5GB"
+	MaxUploadPerRun string `mapstructure:"max_upload_per_run"`
+	// DebugHTTP configures the HTTP debug logs of the runs with --debug-http
+	DebugHTTP struct {
+		MaxAge time.Duration `mapstructure:"max_age"`
+	} `mapstructure:"debug_http"`
+	// RestoreCredentials configures the temporary read-only credentials of the restores on untrusted machines
+	RestoreCredentials struct {
+		// RoleARN is the role assumed for the credentials, a federation token of the IAM user is used when empty
+		RoleARN  string        `mapstructure:"role_arn"`
+		Duration time.Duration `mapstructure:"duration"`
+	} `mapstructure:"restore_credentials"`
+	// RestServer runs a local rest-server in front of the repository directory, e.g. on a NAS
+	RestServer struct {
+		Enabled      bool     `mapstructure:"enabled"`
+		Path         string   `mapstructure:"executable_path"`
+		DataDir      string   `mapstructure:"path"`
+		Listen       string   `mapstructure:"listen"`
+		AppendOnly   bool     `mapstructure:"append_only"`
+		HtpasswdFile string   `mapstructure:"htpasswd_file"`
+		Args         []string `mapstructure:"args"`
+	} `mapstructure:"rest_server"`
+	// Security hardens the program for ransomware resilient setups
+	Security struct {
+		// AppendOnly refuses the restic commands deleting data and probes that the credentials cannot delete
+		AppendOnly bool `mapstructure:"append_only"`
+	} `mapstructure:"security"`
+	// Audit configures the audit command
+	Audit struct {
+		// KeyUnusedAfter flags the keys of the hosts without a snapshot for this long
+		KeyUnusedAfter time.Duration `mapstructure:"key_unused_after"`
+	} `mapstructure:"audit"`
+	// BandwidthBudget limits the upload rate or defers the non-essential profiles when the data uploaded in the
+	// calendar month approaches the budget
+	BandwidthBudget struct {
+		Monthly         string `mapstructure:"monthly"`
+		ApproachPercent int    `mapstructure:"approach_percent"`
+		// LimitUpload is the upload rate in KiB/s once the budget is approached, 0 for no limit
+		LimitUpload int  `mapstructure:"limit_upload"`
+		Essential   bool `mapstructure:"essential"`
+	} `mapstructure:"bandwidth_budget"`
+	// ConcurrencyGuard defers or delays the backup while other backups read the disks
+	ConcurrencyGuard struct {
+		Enabled bool     `mapstructure:"enabled"`
+		Detect  []string `mapstructure:"detect"`
+		// Action is defer, wait or warn
+		Action  string        `mapstructure:"action"`
+		MaxWait time.Duration `mapstructure:"max_wait"`
+	} `mapstructure:"concurrency_guard"`
+	// PreventSleep keeps the system from sleeping while idle during the run
+	PreventSleep bool `mapstructure:"prevent_sleep"`
+	// SleepGracePeriod is how long the sleep or the shutdown of the system is delayed while the backup stops
+	SleepGracePeriod time.Duration `mapstructure:"sleep_grace_period"`
+
+	Notifications struct {
+		MessageTemplates `mapstructure:",squash"`
+
+		OnSuccess  bool   `mapstructure:"on_success"`
+		Digest     bool   `mapstructure:"digest"`
+		DigestTime string `mapstructure:"digest_time"`
+		QuietHours struct {
+			Start string `mapstructure:"start"`
+			End   string `mapstructure:"end"`
+		} `mapstructure:"quiet_hours"`
+
+		SNS struct {
+			TopicArn string `mapstructure:"topic_arn"`
+			Region   string `mapstructure:"region"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"sns"`
+		PagerDuty struct {
+			RoutingKey string `mapstructure:"routing_key"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"pagerduty"`
+		Opsgenie struct {
+			APIURL string `mapstructure:"api_url"`
+			APIKey string `mapstructure:"api_key"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"opsgenie"`
+		MQTT struct {
+			Broker                 string `mapstructure:"broker"`
+			Username               string `mapstructure:"username"`
+			Password               string `mapstructure:"password"`
+			TopicPrefix            string `mapstructure:"topic_prefix"`
+			HomeAssistantDiscovery bool   `mapstructure:"homeassistant_discovery"`
+			DiscoveryPrefix        string `mapstructure:"discovery_prefix"`
+		} `mapstructure:"mqtt"`
+		Ntfy struct {
+			Server string `mapstructure:"server"`
+			Topic  string `mapstructure:"topic"`
+			Token  string `mapstructure:"token"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"ntfy"`
+		Gotify struct {
+			Server string `mapstructure:"server"`
+			Token  string `mapstructure:"token"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"gotify"`
+		Apprise struct {
+			Path string   `mapstructure:"executable_path"`
+			URLs []string `mapstructure:"urls"`
+
+			MessageTemplates `mapstructure:",squash"`
+		} `mapstructure:"apprise"`
+	} `mapstructure:"notifications"`
+}
+
+// MessageTemplates holds the Go templates of notification messages
+type MessageTemplates struct {
+	Title string `mapstructure:"title_template"`
+	Body  string `mapstructure:"body_template"`
 }
 
+// resticExitIncomplete is the exit code of restic backup when the snapshot was created,
+// but some source files could not be read
+const resticExitIncomplete = 3
+
 var (
 	appConfig Config
 )
@@ -48,35 +468,351 @@ func init() {
 	if err != nil {
 		log.Fatal("Error getting user home directory:", err)
 	}
-	/// Set default values for configuration variables
-	viper.SetDefault("backup_directory", filepath.Join(homeDir, ".restic_backup"))
-	viper.SetDefault("lock_file", ".restic_backup_lock")
-	viper.SetDefault("log_file", "restic_backup.log")
-
-	viper.SetDefault("restic.executable_path", "/usr/local/bina/restic")
-	viper.SetDefault("restic.files_from", "backup.txt")
-	viper.SetDefault("restic.exclude_file", "exclude.txt")
-	viper.SetDefault("restic.s3_storage_class", "STANDARD_IA")
-
-	viper.SetDefault("host_name", "localhost")
-	viper.SetDefault("security_service", "restic_backup")
-
-	viper.SetDefault("require_ac_power", true)
-	viper.SetDefault("cleanup_old_backups", false)
+	setDefaults(viper.GetViper(), homeDir)
 
 	// Read the configuration from the config file
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(filepath.Join(homeDir, ".restic_backup"))
+	// The system-wide configuration of the root instance backing up the users
+	viper.AddConfigPath(systemConfigDir)
+	if configFile := os.Getenv(configFileEnv); configFile != "" {
+		viper.SetConfigFile(configFile)
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+	if err := loadConfig(configOptional(os.Args[1:])); err != nil {
+		log.Fatal(err)
+	}
+	setupLogging()
+}
+
+// setDefaults sets the default values of the configuration variables
+func setDefaults(v *viper.Viper, homeDir string) {
+	v.SetDefault("backup_directory", filepath.Join(homeDir, ".restic_backup"))
+	v.SetDefault("lock_file", ".restic_backup_lock")
+	v.SetDefault("log_file", "restic_backup.log")
+	v.SetDefault("state_file", "state.json")
+	v.SetDefault("notes_file", "notes.json")
+	v.SetDefault("history_file", "history.db")
+	v.SetDefault("history.max_age", 2*365*24*time.Hour)
+	v.SetDefault("audit_log.enabled", false)
+	v.SetDefault("audit_log.path", "audit.log")
+	v.SetDefault("audit_log.signing_key", "")
+	v.SetDefault("audit_log.git_repository", "")
+	v.SetDefault("audit_log.git_push", false)
+
+	v.SetDefault("restic.executable_path", "/usr/local/bina/restic")
+	v.SetDefault("restic.files_from", "backup.txt")
+	v.SetDefault("restic.exclude_file", "exclude.txt")
+	v.SetDefault("restic.s3_storage_class", "STANDARD_IA")
+	v.SetDefault("restic.sudo", false)
+	v.SetDefault("restic.sudo_wrapper", "/usr/local/libexec/restic_wrapper-sudo")
+	v.SetDefault("restic.memory_limit", "")
+	v.SetDefault("restic.gogc", 0)
+	v.SetDefault("restic.memory_max", "")
+	v.SetDefault("restic.verify_checksum", false)
+	v.SetDefault("restic.sha256", "")
+
+	v.SetDefault("remote_config.url", "")
+	v.SetDefault("remote_config.public_key", "")
+	v.SetDefault("remote_config.region", "")
+	v.SetDefault("aws.profile", "")
+	v.SetDefault("aws.role_arn", "")
+	v.SetDefault("aws.region", "")
+
+	v.SetDefault("secrets.source", "")
+	v.SetDefault("secrets.dir", "/run/secrets")
+	v.SetDefault("secrets.accounts", map[string]string{})
+	v.SetDefault("secrets.password_command", "")
+	v.SetDefault("secrets.password_file", "")
+	v.SetDefault("host_root", "")
+
+	// Detected when the configuration is loaded, see defaultHostName
+	v.SetDefault("host_name", "")
+	v.SetDefault("timezone", "")
+	v.SetDefault("security_service", "restic_backup")
+
+	v.SetDefault("enabled", true)
+	v.SetDefault("require_ac_power", true)
+	v.SetDefault("auto_tags", true)
+	v.SetDefault("self_backup", true)
+	v.SetDefault("system_manifest.enabled", false)
+	v.SetDefault("system_manifest.defaults_domains", []string{})
+	v.SetDefault("system_manifest.commands", map[string]string{})
+	v.SetDefault("system_manifest.timeout", time.Minute)
+	v.SetDefault("require_full_disk_access", true)
+	v.SetDefault("cleanup_old_backups", false)
+
+	v.SetDefault("retention.keep_tag", "nodelete")
+
+	v.SetDefault("chunking.enabled", false)
+	v.SetDefault("chunking.by", "directory")
+	v.SetDefault("chunking.max_size", "500GB")
+
+	v.SetDefault("restore.sparse", false)
+	v.SetDefault("restore.include_xattrs", []string{})
+	v.SetDefault("restore.exclude_xattrs", []string{})
+	v.SetDefault("restore.acls", true)
+	v.SetDefault("restore.overwrite", "")
+	v.SetDefault("restore.verify", false)
+	v.SetDefault("restore.connections", 0)
+	v.SetDefault("restore.cold_storage.enabled", false)
+	v.SetDefault("restore.cold_storage.tier", "Standard")
+	v.SetDefault("restore.cold_storage.days", 3)
+	v.SetDefault("restore.cold_storage.poll_interval", 15*time.Minute)
+	v.SetDefault("restore.cold_storage.timeout", 48*time.Hour)
+	v.SetDefault("restore.cold_storage.renew_before", 12*time.Hour)
+
+	v.SetDefault("staging.repository", "")
+	v.SetDefault("staging.keep_last", 10)
+	v.SetDefault("staging.keep_daily", 7)
+	v.SetDefault("staging.max_sync_runtime", 12*time.Hour)
+	v.SetDefault("staging.secrets_prefix", "")
+
+	v.SetDefault("canary.paths", []string{})
+	v.SetDefault("warnings.max_groups", 5)
+
+	v.SetDefault("script.file", "")
+	v.SetDefault("script.timeout", 30*time.Second)
+
+	v.SetDefault("plugins.dir", "plugins")
+	v.SetDefault("plugins.timeout", time.Minute)
+	v.SetDefault("plugins.env", []string{})
+	v.SetDefault("plugins.work_dir", "")
+	v.SetDefault("plugins.max_output", "64KiB")
+
+	v.SetDefault("manifests.enabled", false)
+	v.SetDefault("manifests.max_age", 400*24*time.Hour)
+
+	v.SetDefault("time_machine_exclusions", false)
+	v.SetDefault("preset", []string{})
+	v.SetDefault("app_settings", []string{})
+	v.SetDefault("macos_metadata.verify", false)
+	v.SetDefault("macos_metadata.samples", 20)
+
+	v.SetDefault("docker_volumes.executable_path", "docker")
+	v.SetDefault("docker_volumes.helper_image", "alpine:3.20")
+	v.SetDefault("docker_volumes.volumes", []string{})
+
+	v.SetDefault("secrets_scan.enabled", false)
+	v.SetDefault("secrets_scan.patterns", []string{
+		"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "*.pem", "*.key", "*.p12", "*.pfx",
+		".env", ".env.*", ".netrc", ".pgpass", "credentials", "*.kdbx",
+	})
+	v.SetDefault("secrets_scan.allow", []string{})
+	v.SetDefault("secrets_scan.max_files", 200000)
+
+	v.SetDefault("check.interval", 0)
+	v.SetDefault("check.read_data_subsets", 0)
+	v.SetDefault("check.prune_max_age", 0)
+	v.SetDefault("check.repair_index", false)
+
+	v.SetDefault("health.warning_threshold", 70)
+	v.SetDefault("health.max_check_age", 30*24*time.Hour)
+	v.SetDefault("health.max_prune_age", 30*24*time.Hour)
+	v.SetDefault("health.stale_lock_age", 24*time.Hour)
+	v.SetDefault("health.max_growth_ratio", 3.0)
+	v.SetDefault("health.min_throughput_ratio", 0.25)
+
+	v.SetDefault("guardrails.max_snapshot_age", 72*time.Hour)
+	v.SetDefault("guardrails.max_count_drop", 0.1)
+	v.SetDefault("grafana.url", "")
+	v.SetDefault("grafana.token", "")
+	v.SetDefault("grafana.dashboard_uid", "")
+	v.SetDefault("grafana.panel_id", 0)
+	v.SetDefault("grafana.tags", []string{})
+	v.SetDefault("influxdb.url", "")
+	v.SetDefault("influxdb.org", "")
+	v.SetDefault("influxdb.bucket", "restic")
+	v.SetDefault("influxdb.token", "")
+	v.SetDefault("zabbix.server", "")
+	v.SetDefault("zabbix.host", "")
+	v.SetDefault("zabbix.key_prefix", "restic")
+
+	v.SetDefault("fleet.required_profiles", []string{})
+	v.SetDefault("fleet.max_backup_age", 48*time.Hour)
+	v.SetDefault("fleet.locked_keys", []string{})
+
+	v.SetDefault("system.conf_dir", filepath.Join(systemConfigDir, "conf.d"))
+
+	v.SetDefault("network.http_proxy", "")
+	v.SetDefault("network.https_proxy", "")
+	v.SetDefault("network.no_proxy", "")
+	v.SetDefault("network.ca_bundle", "")
+	v.SetDefault("network.address_family", "")
+
+	v.SetDefault("offline.enabled", true)
+	v.SetDefault("offline.retry_interval", 30*time.Second)
+	v.SetDefault("offline.retry_for", 5*time.Minute)
+	v.SetDefault("offline.max_deferral", 24*time.Hour)
+
+	v.SetDefault("daemon.interval", time.Hour)
+	v.SetDefault("daemon.watch.enabled", false)
+	v.SetDefault("daemon.watch.paths", []string{})
+	v.SetDefault("daemon.watch.min_files", 100)
+	v.SetDefault("daemon.watch.min_size", "100MiB")
+	v.SetDefault("daemon.watch.debounce", 2*time.Minute)
+	v.SetDefault("daemon.watch.min_interval", 15*time.Minute)
+	// Every watched directory and file takes a file descriptor on macOS
+	if runtime.GOOS == "darwin" {
+		v.SetDefault("daemon.watch.max_directories", 1000)
+	} else {
+		v.SetDefault("daemon.watch.max_directories", 10000)
+	}
+	v.SetDefault("daemon.catch_up.enabled", true)
+	v.SetDefault("daemon.catch_up.max_age", 24*time.Hour)
+	v.SetDefault("daemon.catch_up.delay", 5*time.Minute)
+	v.SetDefault("daemon.heartbeat", 15*time.Minute)
+	v.SetDefault("daemon.health_listen", "")
+	v.SetDefault("daemon.report.interval", 7*24*time.Hour)
+	v.SetDefault("daemon.report.format", "markdown")
+	v.SetDefault("debug_http.max_age", 7*24*time.Hour)
+
+	v.SetDefault("max_runtime", 30*time.Minute)
+	v.SetDefault("stop_grace_period", 2*time.Minute)
+	v.SetDefault("max_upload_per_run", "")
+	v.SetDefault("restore_credentials.role_arn", "")
+	// The maximum session duration of a role by default
+	v.SetDefault("restore_credentials.duration", time.Hour)
+	v.SetDefault("security.append_only", false)
+
+	v.SetDefault("rest_server.enabled", false)
+	v.SetDefault("rest_server.executable_path", "rest-server")
+	v.SetDefault("rest_server.path", "")
+	v.SetDefault("rest_server.listen", "127.0.0.1:8000")
+	v.SetDefault("rest_server.append_only", true)
+	v.SetDefault("rest_server.htpasswd_file", "")
+	v.SetDefault("rest_server.args", []string{})
+	v.SetDefault("audit.key_unused_after", 180*24*time.Hour)
+	v.SetDefault("bandwidth_budget.monthly", "")
+	v.SetDefault("bandwidth_budget.approach_percent", 80)
+	v.SetDefault("bandwidth_budget.limit_upload", 0)
+	v.SetDefault("bandwidth_budget.essential", true)
+	v.SetDefault("concurrency_guard.enabled", false)
+	v.SetDefault("concurrency_guard.detect", []string{"time-machine", "restic", "profiles"})
+	v.SetDefault("concurrency_guard.action", "defer")
+	v.SetDefault("concurrency_guard.max_wait", 30*time.Minute)
+	v.SetDefault("prevent_sleep", true)
+	// The default InhibitDelayMaxSec of logind
+	v.SetDefault("sleep_grace_period", 5*time.Second)
+
+	v.SetDefault("notifications.on_success", true)
+	v.SetDefault("notifications.digest", false)
+	v.SetDefault("notifications.digest_time", "09:00")
+	v.SetDefault("notifications.quiet_hours.start", "")
+	v.SetDefault("notifications.quiet_hours.end", "")
+	v.SetDefault("notifications.sns.topic_arn", "")
+	v.SetDefault("notifications.sns.region", "")
+	v.SetDefault("notifications.pagerduty.routing_key", "")
+	v.SetDefault("notifications.opsgenie.api_url", "https://api.opsgenie.com")
+	v.SetDefault("notifications.opsgenie.api_key", "")
+	v.SetDefault("notifications.mqtt.broker", "")
+	v.SetDefault("notifications.mqtt.username", "")
+	v.SetDefault("notifications.mqtt.password", "")
+	v.SetDefault("notifications.mqtt.topic_prefix", "restic_wrapper")
+	v.SetDefault("notifications.mqtt.homeassistant_discovery", false)
+	v.SetDefault("notifications.mqtt.discovery_prefix", "homeassistant")
+	v.SetDefault("notifications.ntfy.server", "https://ntfy.sh")
+	v.SetDefault("notifications.ntfy.topic", "")
+	v.SetDefault("notifications.ntfy.token", "")
+	v.SetDefault("notifications.gotify.server", "")
+	v.SetDefault("notifications.gotify.token", "")
+	v.SetDefault("notifications.apprise.executable_path", "apprise")
+	v.SetDefault("notifications.apprise.urls", []string{})
+}
+
+// loadConfig reads the configuration file, merges the remote configuration and the selected profile,
+// and validates the result. A missing configuration file is ignored if optional is set.
+func loadConfig(optional bool) error {
+	if err := viper.ReadInConfig(); err != nil && !(optional && isConfigNotFound(err)) {
+		return fmt.Errorf("Error reading config file: %w", err)
+	}
+	if viper.GetString("host_name") == "" {
+		viper.SetDefault("host_name", defaultHostName())
+	}
+	// The remote configuration is fetched through the local proxy settings
+	if err := viper.UnmarshalKey("network", &appConfig.Network); err != nil {
+		return fmt.Errorf("Error unmarshaling config: %w", err)
+	}
+	if err := applyRemoteConfig(); err != nil {
+		if !optional {
+			return fmt.Errorf("Error reading remote config: %w", err)
+		}
+		// The commands documenting the program work with the local configuration
+		log.WithField("err", err).Warn("cannot read the remote configuration")
+	}
+	if activeProfile = profileFromArgs(os.Args[1:]); activeProfile != "" {
+		if err := applyProfile(activeProfile); err != nil {
+			return err
+		}
 	}
 
 	if err := viper.Unmarshal(&appConfig); err != nil {
-		log.Fatalf("Error unmarshaling config: %v", err)
+		return fmt.Errorf("Error unmarshaling config: %w", err)
 	}
-	setupLogging()
+	appConfig.BackupDir = expandPath(appConfig.BackupDir)
+	if appConfig.HostName == "" {
+		appConfig.HostName = detectHostName()
+	}
+	if err := setupTimezone(); err != nil {
+		return err
+	}
+	appConfig.Restic.Path = expandPath(appConfig.Restic.Path)
+	if appConfig.Secrets.Source == "" {
+		// Containers get their secrets from mounted files or the environment
+		appConfig.Secrets.Source = "keychain"
+		if inContainer() {
+			appConfig.Secrets.Source = "files"
+		}
+	}
+	if appConfig.RestServer.Enabled {
+		if appConfig.RestServer.DataDir == "" {
+			return errors.New("rest_server.path is required with rest_server.enabled")
+		}
+		// The deletions are refused by the server, the program does not attempt them
+		appConfig.Security.AppendOnly = appConfig.Security.AppendOnly || appConfig.RestServer.AppendOnly
+	}
+	if err := validatePriorities(); err != nil {
+		return err
+	}
+	if appConfig.Chunking.By != "directory" && appConfig.Chunking.By != "size" {
+		return fmt.Errorf("invalid chunking.by %q, expected directory or size", appConfig.Chunking.By)
+	}
+	if _, err := parseSize(appConfig.Chunking.MaxSize); err != nil {
+		return fmt.Errorf("invalid chunking.max_size: %w", err)
+	}
+	if err := validatePresets(appConfig.Preset); err != nil {
+		return err
+	}
+	if err := validateAppSettings(appConfig.AppSettings); err != nil {
+		return err
+	}
+	if err := validateConcurrencyGuard(); err != nil {
+		return err
+	}
+	if err := validateColdStorage(); err != nil {
+		return err
+	}
+	if _, ok := addressFamilies[appConfig.Network.AddressFamily]; !ok {
+		return fmt.Errorf("invalid network.address_family %q, expected ipv4 or ipv6", appConfig.Network.AddressFamily)
+	}
+	if appConfig.MaxUploadPerRun != "" {
+		if _, err := parseSize(appConfig.MaxUploadPerRun); err != nil {
+			return fmt.Errorf("invalid max_upload_per_run: %w", err)
+		}
+	}
+	if _, err := parseSize(appConfig.Plugins.MaxOutput); err != nil {
+		return fmt.Errorf("invalid plugins.max_output: %w", err)
+	}
+	if appConfig.BandwidthBudget.Monthly != "" {
+		if _, err := parseSize(appConfig.BandwidthBudget.Monthly); err != nil {
+			return fmt.Errorf("invalid bandwidth_budget.monthly: %w", err)
+		}
+	}
+	if appConfig.MaxRuntime <= appConfig.StopGracePeriod {
+		return fmt.Errorf("max_runtime (%s) must be longer than stop_grace_period (%s)", appConfig.MaxRuntime, appConfig.StopGracePeriod)
+	}
+	return nil
 }
 
 // setupLogging configures the logrus logger
@@ -123,52 +859,246 @@ func getSecurityData(service, account string) string {
 	return string(bytes.TrimSpace(out))
 }
 
-// runResticCommand runs the restic command with the given arguments
-func runResticCommand(ctx context.Context, args ...string) error {
-	cmd := exec.CommandContext(ctx, appConfig.Restic.Path, args...)
-	cmd.Env = os.Environ()
+// resticCommand returns the restic command with the given arguments
+func resticCommand(ctx context.Context, args ...string) *exec.Cmd {
+	// The global options follow the operation, so the sudo wrapper still accepts them
+	args = append(append([]string{args[0]}, caBundleArgs()...), args[1:]...)
+	name, cmdArgs := memoryCapCommandLine(resticCommandLine(args))
+	cmd := exec.CommandContext(ctx, name, cmdArgs...)
+	// The credentials are only handed to the trusted restic, Start returns the error
+	if err := trustedRestic(); err != nil {
+		cmd.Err = fmt.Errorf("the restic executable is not trusted: %w", err)
+	}
+	cmd.Env = append(append(append(append(append(os.Environ(), proxyEnv()...), memoryEnv()...), debugResticEnv()...), timezoneEnv()...), resticEnv(ctx)...)
+	if sudoCommand(args) && cmd.Err == nil {
+		if cmd.Stdin, cmd.Err = sudoInput(ctx, cmd.Env, args); cmd.Err != nil {
+			cmd.Err = fmt.Errorf("cannot run restic via sudo: %w", cmd.Err)
+		}
+	}
+	// Interrupt restic instead of killing it when the context is done, so it can finish gracefully.
+	// It is killed if it is still running after the grace period.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = appConfig.StopGracePeriod
+	return cmd
+}
+
+// runResticCommand runs the restic command with the given arguments and returns its output
+func runResticCommand(ctx context.Context, args ...string) (string, error) {
+	output, _, err := runResticCommandUsage(ctx, args...)
+	return output, err
+}
+
+// runResticCommandUsage runs the restic command like runResticCommand and also returns its resource usage
+func runResticCommandUsage(ctx context.Context, args ...string) (string, *resourceUsage, error) {
+	if err := checkAppendOnly(args); err != nil {
+		return "", nil, err
+	}
+	cmd := resticCommand(ctx, args...)
 
 	// Capture the command's stdout and stderr
 	var stdout, stderr bytes.Buffer
 
-	cmd.Stdout = &stdout
+	cmd.Stdout = resticStdout(ctx, &stdout)
 	cmd.Stderr = &stderr
 
 	// Run the command
-	if err := cmd.Run(); err != nil {
-		for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+	err := cmd.Run()
+	usage := processUsage(cmd.ProcessState)
+	for _, output := range []struct {
+		buffer *bytes.Buffer
+		stderr bool
+	}{{&stdout, false}, {&stderr, true}} {
+		for _, line := range strings.Split(strings.TrimSpace(output.buffer.String()), "\n") {
 			if line != "" {
-				log.WithFields(log.Fields{
-					"cmd":       appConfig.Restic.Path,
-					"operation": args[0],
-				}).Error(line)
+				publish(ctx, resticLineEvent{Operation: args[0], Line: line, Stderr: output.stderr, Failed: err != nil})
 			}
 		}
+	}
+	if err != nil {
 		log.WithFields(log.Fields{
 			"cmd":       appConfig.Restic.Path,
 			"operation": args[0],
 			"err":       err,
 		}).Error("failed to execute the command")
-		return err
+		return stdout.String(), usage, &resticError{err: err, stderr: stderr.String()}
 	}
-	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
-		if line != "" {
-			log.WithFields(log.Fields{
-				"cmd":       appConfig.Restic.Path,
-				"operation": args[0],
-			}).Info(line)
+	return stdout.String(), usage, nil
+}
+
+// resticError is a failed restic command, keeping its error output for diagnosis
+type resticError struct {
+	err    error
+	stderr string
+}
+
+func (e *resticError) Error() string {
+	return e.err.Error()
+}
+
+func (e *resticError) Unwrap() error {
+	return e.err
+}
+
+// cleanupOldBackups removes the snapshots outside the retention policy and prunes the repository,
+// unless the last repository check failed or is outdated
+func cleanupOldBackups(ctx context.Context, summary *runSummary, state *runState, retention []string) {
+	if _, err := summary.runStage(ctx, append([]string{"forget", "-q"}, retention...)...); err != nil {
+		log.WithFields(log.Fields{
+			"cmd":     appConfig.Restic.Path,
+			"command": "forget",
+		}).Errorf("Forget failed")
+		return
+	}
+	if reason := pruneBlockedReason(state, summary, time.Now()); reason != "" {
+		log.WithField("reason", reason).Error("Skipping prune, the repository may be corrupt")
+		summary.PruneSkipped = reason
+		return
+	}
+	output, err := summary.runStage(ctx, "prune")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cmd":     appConfig.Restic.Path,
+			"command": "prune",
+		}).Errorf("Prune failed")
+		return
+	}
+	summary.PruneFreedBytes = parsePruneFreedBytes(output)
+}
+
+// stageMetricNames maps the stages reported to CloudWatch to their duration metric names
+var stageMetricNames = map[string]string{
+	"forget": "ForgetDuration",
+	"prune":  "PruneDuration",
+	"check":  "CheckDuration",
+}
+
+// stageMemoryMetricNames maps the stages reported to CloudWatch to their peak memory metric names
+var stageMemoryMetricNames = map[string]string{
+	"backup": "BackupPeakMemory",
+	"prune":  "PrunePeakMemory",
+	"check":  "CheckPeakMemory",
+}
+
+// runMetric is a metric of a run reported to the metrics sinks
+type runMetric struct {
+	Name  string
+	Unit  types.StandardUnit
+	Value float64
+}
+
+// runMetrics returns the metrics of the run
+func runMetrics(summary *runSummary) []runMetric {
+	metrics := []runMetric{
+		{"BackupDuration", types.StandardUnitSeconds, summary.Duration.Seconds()},
+	}
+	if summary.snapshotCreated() {
+		metrics = append(metrics, runMetric{"BackupCount", types.StandardUnitCount, 1})
+		metrics = append(metrics, runMetric{"Warnings", types.StandardUnitCount, float64(summary.warningCount())})
+	}
+	if throughput := summary.throughput(); throughput > 0 {
+		metrics = append(metrics, runMetric{"Throughput", types.StandardUnitBytesSecond, throughput})
+	}
+	if ratio := summary.dedupRatio(); ratio > 0 {
+		metrics = append(metrics, runMetric{"DedupRatio", types.StandardUnitNone, ratio})
+	}
+	if summary.Health != nil {
+		metrics = append(metrics, runMetric{"HealthScore", types.StandardUnitNone, float64(summary.Health.Score)})
+	}
+	for _, stage := range summary.Stages {
+		if name, ok := stageMetricNames[stage.Name]; ok {
+			metrics = append(metrics, runMetric{name, types.StandardUnitSeconds, stage.Duration.Seconds()})
+		}
+		if name, ok := stageMemoryMetricNames[stage.Name]; ok && stage.Usage != nil {
+			metrics = append(metrics, runMetric{name, types.StandardUnitBytes, float64(stage.Usage.MaxRSS)})
 		}
 	}
-	return nil
+	if prune := summary.stage("prune"); prune != nil && prune.Err == nil {
+		metrics = append(metrics, runMetric{"PruneFreedBytes", types.StandardUnitBytes, float64(summary.PruneFreedBytes)})
+	}
+	if stagingEnabled() {
+		metrics = append(metrics, runMetric{"SyncBacklog", types.StandardUnitCount, float64(summary.SyncBacklog)})
+	}
+	if summary.Compliance != nil {
+		// 1 when the host complies with the fleet policy, 0 when it does not
+		compliant := 0.0
+		if summary.Compliance.compliant() {
+			compliant = 1
+		}
+		metrics = append(metrics, runMetric{"FleetCompliance", types.StandardUnitCount, compliant})
+	}
+	if check := summary.stage("check"); check != nil {
+		// 1 when the repository check passed, 0 when it failed
+		result := 0.0
+		if check.Err == nil {
+			result = 1
+		}
+		metrics = append(metrics, runMetric{"CheckResult", types.StandardUnitCount, result})
+	}
+	return metrics
 }
 
-// sendAwsMetrics sends the backup metrics to AWS CloudWatch
-func sendAwsMetrics(ctx context.Context, duration time.Duration) error {
-	// Load the SDK's configuration from environment and shared config, and create a new client
-	cfg, err := config.LoadDefaultConfig(ctx,
+// metricDatum builds a CloudWatch metric datum for the host
+func metricDatum(name string, unit types.StandardUnit, value float64) types.MetricDatum {
+	return types.MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: []types.Dimension{
+			{
+				Name:  aws.String("Environment"),
+				Value: aws.String(appConfig.HostName),
+			},
+		},
+		Timestamp: aws.Time(time.Now()),
+		Unit:      unit,
+		Value:     aws.Float64(value),
+	}
+}
+
+// loadAwsConfig loads the AWS SDK configuration from the environment
+func loadAwsConfig(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, append([]func(*config.LoadOptions) error{
 		config.WithSharedConfigFiles([]string{""}),
 		config.WithSharedCredentialsFiles([]string{""}),
-	)
+		// The SDK client keeps supporting AWS_CA_BUNDLE
+		config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(configureTransport)),
+	}, append(debugAwsOptions(), optFns...)...)...)
+}
+
+// loadMonitoringAwsConfig loads the AWS SDK configuration of the metrics and the notifications. With aws.profile
+// or aws.role_arn set, the credentials come from the shared AWS configuration and the restic credentials in the
+// environment are never used.
+func loadMonitoringAwsConfig(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+	if appConfig.AWS.Region != "" {
+		optFns = append([]func(*config.LoadOptions) error{config.WithRegion(appConfig.AWS.Region)}, optFns...)
+	}
+	if appConfig.AWS.Profile == "" && appConfig.AWS.RoleARN == "" {
+		return loadAwsConfig(ctx, optFns...)
+	}
+	profile := appConfig.AWS.Profile
+	if profile == "" {
+		profile = "default"
+	}
+	// A programmatically selected profile takes precedence over the credentials in the environment
+	cfg, err := loadAwsConfig(ctx, append([]func(*config.LoadOptions) error{
+		config.WithSharedConfigFiles(config.DefaultSharedConfigFiles),
+		config.WithSharedCredentialsFiles(config.DefaultSharedCredentialsFiles),
+		config.WithSharedConfigProfile(profile),
+	}, optFns...)...)
+	if err != nil {
+		return cfg, err
+	}
+	if appConfig.AWS.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), appConfig.AWS.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) { o.RoleSessionName = "restic_wrapper-" + appConfig.HostName }))
+	}
+	return cfg, nil
+}
+
+// sendAwsMetrics sends the backup metrics to AWS CloudWatch
+func sendAwsMetrics(ctx context.Context, summary *runSummary) error {
+	// Load the SDK's configuration from environment, and create a new client
+	cfg, err := loadMonitoringAwsConfig(ctx)
 	if err != nil {
 		log.WithField("err", err).Error("cannot load AWS SDK config")
 		return err
@@ -177,35 +1107,15 @@ func sendAwsMetrics(ctx context.Context, duration time.Duration) error {
 	// Create a new CloudWatch client
 	svc := cloudwatch.NewFromConfig(cfg)
 
+	var metrics []types.MetricDatum
+	for _, metric := range runMetrics(summary) {
+		metrics = append(metrics, metricDatum(metric.Name, metric.Unit, metric.Value))
+	}
+
 	// Create the input for the PutMetricData operation
 	input := &cloudwatch.PutMetricDataInput{
-		Namespace: aws.String("ResticBackup"),
-		MetricData: []types.MetricDatum{
-			{
-				MetricName: aws.String("BackupDuration"),
-				Dimensions: []types.Dimension{
-					{
-						Name:  aws.String("Environment"),
-						Value: aws.String(appConfig.HostName),
-					},
-				},
-				Timestamp: aws.Time(time.Now()),
-				Unit:      types.StandardUnitSeconds,
-				Value:     aws.Float64(duration.Seconds()),
-			},
-			{
-				MetricName: aws.String("BackupCount"),
-				Dimensions: []types.Dimension{
-					{
-						Name:  aws.String("Environment"),
-						Value: aws.String(appConfig.HostName),
-					},
-				},
-				Timestamp: aws.Time(time.Now()),
-				Unit:      types.StandardUnitCount,
-				Value:     aws.Float64(1),
-			},
-		},
+		Namespace:  aws.String("ResticBackup"),
+		MetricData: metrics,
 	}
 
 	// Send the metric data to CloudWatch
@@ -218,84 +1128,646 @@ func sendAwsMetrics(ctx context.Context, duration time.Duration) error {
 	return nil
 }
 
-// setupEnv sets up the environment variables for the restic command
+// secretEnv is an environment variable passed to restic and the account holding it
+type secretEnv struct {
+	env     string
+	account string
+}
+
+// secretAccounts maps the environment variables passed to restic to the accounts holding them
+var secretAccounts = []secretEnv{
+	{"AWS_DEFAULT_REGION", "aws-region"},
+	{"AWS_ACCESS_KEY_ID", "aws-access-key-id"},
+	{"AWS_SECRET_ACCESS_KEY", "aws-secret-access-key"},
+	{"RESTIC_REPOSITORY", "repository"},
+	{"RESTIC_PASSWORD", "password"},
+}
+
+// restServerSecrets are the credentials of restic for the managed rest-server run with an htpasswd file
+var restServerSecrets = []secretEnv{
+	{"RESTIC_REST_USERNAME", "rest-username"},
+	{"RESTIC_REST_PASSWORD", "rest-password"},
+}
+
+// stagingPasswordEnv holds the password of the staging repository when it differs from the remote one
+const stagingPasswordEnv = "RESTIC_STAGING_PASSWORD"
+
+// secretAccount returns the account (or file) of the secret: the one configured in secrets.accounts as it is,
+// or the default account in the namespace of the secrets.prefix
+func secretAccount(secret secretEnv) string {
+	return accountOf(secret, appConfig.Secrets.Accounts, appConfig.Secrets.Prefix)
+}
+
+// accountOf returns the account of the secret with the given account overrides and prefix
+func accountOf(secret secretEnv, accounts map[string]string, prefix string) string {
+	// The configuration keys are case-insensitive
+	for env, account := range accounts {
+		if strings.EqualFold(env, secret.env) && account != "" {
+			return account
+		}
+	}
+	return prefix + secret.account
+}
+
+// secretEnvs returns the secrets of the run with their accounts in the configured namespaces, including
+// the password of the staging repository when it has its own
+func secretEnvs() []secretEnv {
+	secrets := make([]secretEnv, 0, len(secretAccounts)+1)
+	for _, secret := range secretAccounts {
+		// restic reads the password itself
+		if secret.env == "RESTIC_PASSWORD" && passwordSourceConfigured() {
+			continue
+		}
+		secrets = append(secrets, secretEnv{secret.env, secretAccount(secret)})
+	}
+	if stagingEnabled() && appConfig.Staging.SecretsPrefix != "" {
+		secrets = append(secrets, secretEnv{stagingPasswordEnv, appConfig.Staging.SecretsPrefix + "password"})
+	}
+	// restic authenticates to the managed rest-server with the credentials of its htpasswd file
+	if appConfig.RestServer.Enabled && appConfig.RestServer.HtpasswdFile != "" {
+		for _, secret := range restServerSecrets {
+			secrets = append(secrets, secretEnv{secret.env, secretAccount(secret)})
+		}
+	}
+	return secrets
+}
+
+// setupEnv sets up the environment variables for the restic command from the configured secrets source
 func setupEnv() {
-	os.Setenv("AWS_DEFAULT_REGION", getSecurityData(appConfig.SecurityService, "aws-region"))
-	os.Setenv("AWS_ACCESS_KEY_ID", getSecurityData(appConfig.SecurityService, "aws-access-key-id"))
-	os.Setenv("AWS_SECRET_ACCESS_KEY", getSecurityData(appConfig.SecurityService, "aws-secret-access-key"))
-	os.Setenv("RESTIC_REPOSITORY", getSecurityData(appConfig.SecurityService, "repository"))
-	os.Setenv("RESTIC_PASSWORD", getSecurityData(appConfig.SecurityService, "password"))
+	for _, secret := range secretEnvs() {
+		account := secret.account
+		switch appConfig.Secrets.Source {
+		case "env":
+			// Passed to restic as they are
+		case "files":
+			data, err := os.ReadFile(filepath.Join(appConfig.Secrets.Dir, account))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"account": account, "err": err}).Fatal("cannot read the secret file")
+			}
+			os.Setenv(secret.env, string(bytes.TrimSpace(data)))
+		default:
+			os.Setenv(secret.env, getSecurityData(appConfig.SecurityService, account))
+		}
+	}
+	setupPasswordSource()
+	restServerEnv()
 }
 
-func main() {
+// newFileLock returns the lock preventing concurrent runs of the program
+func newFileLock() *flock.Flock {
+	return flock.New(filepath.Join(appConfig.BackupDir, appConfig.LockFile))
+}
+
+// backupOptions adjusts a backup run
+type backupOptions struct {
+	// waitForLock waits for a running instance to finish instead of skipping the run
+	waitForLock bool
+	// ignorePower runs the backup regardless of the power source
+	ignorePower bool
+	// tags are added to the snapshot
+	tags []string
+	// k8s writes a termination message and exits with the status of the run, see k8sExitCode
+	k8s bool
+	// force runs the backup now, without waiting for the contention and without the deferrals of the backup script,
+	// the bandwidth budget and the offline mode
+	force bool
+}
+
+// acquireLock takes the lock preventing concurrent runs, waiting for a running instance if wait is set.
+// It returns false when another instance is running.
+func acquireLock(fileLock *flock.Flock, wait bool) (bool, error) {
+	if !wait {
+		return fileLock.TryLock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+	defer cancel()
+	return fileLock.TryLockContext(ctx, time.Second)
+}
+
+// runBackup backs up the system and reports the result. It returns the summary of the run,
+// or nil when the run was skipped.
+func runBackup(opts backupOptions) *runSummary {
 	startTime := time.Now()
 
-	fileLock := flock.New(filepath.Join(appConfig.BackupDir, appConfig.LockFile))
-	locked, err := fileLock.TryLock()
+	if reason := backupsDisabled(startTime); reason != "" {
+		log.WithField("reason", reason).Info("The backups are disabled. Skipping backup.")
+		return nil
+	}
+
+	fileLock := newFileLock()
+	locked, err := acquireLock(fileLock, opts.waitForLock)
 	if err != nil {
 		log.WithField("err", err).Error("cannot lock the lock file")
 		os.Exit(1)
 	}
 	if !locked {
 		log.Warn("Another instance of the program is already running. Exiting.")
-		return
+		return nil
 	}
 	defer fileLock.Unlock()
 
-	// Create a new context and add a timeout to it
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-	defer cancel() // The cancel should be deferred so resources are cleaned up
+	// Stop gracefully when the program is terminated, e.g. by launchd or at the deadline of a Kubernetes job
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	if _, err = exec.LookPath(appConfig.Restic.Path); err != nil {
 		log.WithField("cmd", appConfig.Restic.Path).Error("cannot find the restic command")
-		return
+		return nil
+	}
+	// The credentials are only handed to the trusted restic
+	if err = trustedRestic(); err != nil {
+		log.WithField("err", err).Error("The restic executable changed unexpectedly, the backup is not run. " +
+			"Run restic_wrapper pin-restic after upgrading restic.")
+		reportResticChecksum(startTime, err)
+		os.Exit(1)
+	}
+	if appConfig.RequireFullDiskAccess && !checkFullDiskAccess() {
+		os.Exit(1)
 	}
 
-	// Check if the system is running on AC power
-	isAcPower, err := isOnPower()
-	if err != nil {
-		log.WithField("err", err).Error("cannot check if the system is running on AC power")
-		return
+	// Check if the system is running on AC power, containers have no power source to check
+	if appConfig.RequireAcPower && !opts.ignorePower && !inContainer() {
+		isAcPower, err := isOnPower()
+		if err != nil {
+			log.WithField("err", err).Error("cannot check if the system is running on AC power")
+			return nil
+		}
+		if !isAcPower {
+			log.Warn("The system is not running on AC power. Skipping backup.")
+			return nil
+		}
 	}
-	if appConfig.RequireAcPower && !isAcPower {
-		log.Warn("The system is not running on AC power. Skipping backup.")
-		return
+	// Time Machine or another backup reading the disks slows both backups down. Waiting for it does not use up the
+	// runtime budget.
+	if !opts.force && !checkContention(signalCtx) {
+		return nil
 	}
+	// Create a new context and add a timeout to it
+	ctx, cancel := context.WithTimeout(signalCtx, appConfig.MaxRuntime)
+	defer cancel() // The cancel should be deferred so resources are cleaned up
 
 	setupEnv()
 
-	if err = runResticCommand(ctx, "backup",
-		"-o", "s3.storage-class="+appConfig.Restic.S3Storage,
-		"--files-from", filepath.Join(appConfig.BackupDir, appConfig.Restic.FilesFrom),
-		"--exclude-file", filepath.Join(appConfig.BackupDir, appConfig.Restic.ExcludeFile),
-	); err != nil {
+	// Expand globs, "~" and environment variables in the files-from list
+	filesFrom, sources, err := writeExpandedSources(filepath.Join(appConfig.BackupDir, appConfig.Restic.FilesFrom))
+	if err != nil {
+		log.WithField("err", err).Error("cannot prepare the list of backup sources")
+		os.Exit(1)
+	}
+	// A broken script must not stop the backups
+	decision, err := runBackupScript(ctx, sources, startTime)
+	if err != nil {
+		log.WithField("err", err).Error("The backup script failed, running the backup anyway")
+		decision = &scriptDecision{}
+	}
+	if decision.Skip != "" && opts.force {
+		log.WithField("reason", decision.Skip).Info("The backup script skipped the backup, backing up anyway")
+	} else if decision.Skip != "" {
+		log.WithField("reason", decision.Skip).Info("The backup script skipped the backup")
+		return nil
+	}
+	opts.tags = append(opts.tags, decision.Tags...)
+	if appConfig.AutoTags {
+		opts.tags = append(opts.tags, preconditionTags(sources)...)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		log.WithField("err", err).Warn("cannot load the state, starting with a fresh one")
+		state = &runState{}
+	}
+	if state.LastRun != nil && state.LastRun.Status == runStatusPartial {
+		log.WithField("started_at", state.LastRun.StartedAt).Info("The previous backup was stopped before completion, resuming it")
+	}
+	// A run that crashed or left an incomplete snapshot is followed by a full backup and a repository check
+	recovery := state.recoveryReason()
+	if recovery != "" {
 		log.WithFields(log.Fields{
-			"cmd":     appConfig.Restic.Path,
-			"command": "backup",
-		}).Errorf("Backup failed")
+			"started_at": state.LastRun.StartedAt,
+			"reason":     recovery,
+		}).Warn("The previous run did not complete, running a full backup and a repository check")
+	}
+
+	deferral, budgetArgs := applyBudget(startTime)
+	if deferral != "" && opts.force {
+		log.WithField("reason", deferral).Info("The profile is not essential, backing up anyway")
+	} else if deferral != "" {
+		log.WithField("reason", deferral).Info("The profile is not essential, deferring the backup")
+		return nil
+	}
+
+	// An unavailable rest-server defers the backup like an unreachable repository
+	stopRestServer, err := ensureRestServer(ctx)
+	if err != nil {
+		log.WithField("err", err).Error("cannot start rest-server")
+	}
+	defer stopRestServer()
+
+	// The backups to the local staging repository do not need the network, a forced backup reports the failure
+	if !stagingEnabled() && !opts.force && !checkConnectivity(ctx, state, startTime) {
+		return nil
+	}
+
+	// Exclude the files over the size caps and the Time Machine exclusions, and warn about large new files
+	excludes, largeFiles := applySizeRules(state.LastSuccess)
+	excludes = append(excludes, presetExcludes(appConfig.Preset)...)
+	excludes = append(excludes, appSettingsExcludes(appConfig.AppSettings)...)
+	if appConfig.TimeMachineExclusions {
+		excludes = append(excludes, timeMachineExclusions(ctx, sources)...)
+	}
+	generatedExcludes, err := writeGeneratedExcludes(excludes)
+	if err != nil {
+		log.WithField("err", err).Error("cannot prepare the exclude list")
+		stopRestServer()
 		os.Exit(1)
 	}
-	if appConfig.CleanupOldBackups {
-		if err = runResticCommand(ctx, "forget", "-q",
-			"--prune",
-			"--keep-hourly", "4",
-			"--keep-daily", "7",
-			"--keep-weekly", "5",
-			"--keep-monthly", "12",
-			"--keep-yearly", "5",
-			"--keep-tag", "nodelete",
-		); err != nil {
+	var secretFiles []string
+	if appConfig.SecretsScan.Enabled {
+		secretFiles = warnAboutSecrets(sources, excludes)
+	}
+	var appendOnlyErr error
+	if repository := os.Getenv("RESTIC_REPOSITORY"); appConfig.Security.AppendOnly && state.appendOnlyProbeDue(repository, time.Now()) {
+		appendOnlyErr = probeAppendOnly(ctx, repository)
+		switch {
+		case errors.Is(appendOnlyErr, errNotAppendOnly):
+			log.WithField("err", appendOnlyErr).Error("The repository is not append-only for these credentials")
+			state.AppendOnlyVerified, state.AppendOnlyRepository = time.Time{}, ""
+		case errors.Is(appendOnlyErr, errProbeCredentials):
+			// Not a network hiccup, the probe is broken until the credentials are fixed
+			log.WithField("err", appendOnlyErr).Error("cannot verify that the repository is append-only")
+		case appendOnlyErr != nil:
+			log.WithField("err", appendOnlyErr).Warn("cannot verify that the repository is append-only")
+			appendOnlyErr = nil
+		default:
+			state.AppendOnlyVerified, state.AppendOnlyRepository = time.Now(), repository
+		}
+	}
+	if state.SnapshotHost != appConfig.HostName {
+		migrated := migrateSnapshotHost(ctx)
+		if stagingEnabled() {
+			migrated = migrateSnapshotHost(withStagingRepository(ctx)) && migrated
+		}
+		if migrated {
+			state.SnapshotHost = appConfig.HostName
+		}
+	}
+	state.startRun(startTime, recovery)
+	allowSleep := preventSleep()
+	defer allowSleep()
+	publish(ctx, runStartedEvent{StartedAt: startTime, Recovery: recovery})
+	if stagingEnabled() {
+		ctx = withStagingRepository(ctx)
+	}
+
+	// Interrupt the backup before the runtime budget is exhausted, so restic has time to stop gracefully
+	backupCtx, cancelBackup := context.WithTimeout(ctx, appConfig.MaxRuntime-appConfig.StopGracePeriod)
+	defer cancelBackup()
+	sleep := watchSleep(backupCtx)
+	defer sleep.stop()
+	uploadCtx, upload := withUploadMeter(sleep.ctx)
+
+	backupArgs := []string{"backup",
+		"--host", appConfig.HostName,
+		"-o", "s3.storage-class=" + appConfig.Restic.S3Storage,
+		"--exclude-file", filepath.Join(appConfig.BackupDir, appConfig.Restic.ExcludeFile),
+		"--exclude-file", generatedExcludes,
+	}
+	if recovery != "" {
+		// Re-read all files instead of trusting the parent snapshot
+		backupArgs = append(backupArgs, "--force")
+	}
+	if upload != nil {
+		// The verbose output reports the data added by every file
+		backupArgs = append(backupArgs, "-vv")
+	}
+	backupArgs = append(backupArgs, budgetArgs...)
+	for _, tag := range opts.tags {
+		backupArgs = append(backupArgs, "--tag", tag)
+	}
+	summary := &runSummary{
+		HostName:  appConfig.HostName,
+		StartedAt: startTime,
+		Status:    runStatusSuccess,
+		Recovery:  recovery,
+
+		SecretFiles: secretFiles,
+		LargeFiles:  largeFiles,
+	}
+	// The priority groups are backed up first, each in its own snapshot, the last group by the main backup stage
+	var groupResults []groupResult
+	groups := prioritySourceGroups(sources)
+	if chunkingActive(state) {
+		groups = seedGroups(state, groups)
+	}
+	if len(groups) > 1 || (len(groups) == 1 && groups[0].Chunk != "") {
+		var groupArgs []string
+		filesFrom, groupArgs, groupResults = backupPriorityGroups(uploadCtx, summary, state, filesFrom, groups, backupArgs)
+		backupArgs = append(backupArgs, groupArgs...)
+	}
+	backupArgs = append(backupArgs, "--files-from-verbatim", filesFrom)
+	if len(groups) > 0 && groups[len(groups)-1].Chunk != "" {
+		backupArgs = append(backupArgs, "--tag", tagSeedChunk)
+	}
+	output, err := summary.runStage(uploadCtx, backupArgs...)
+	sleep.stop()
+	summary.parseBackupOutput(output)
+	if summary.BytesUploaded == 0 && upload != nil {
+		// A stopped backup does not print its totals. The meter counted the priority groups as well.
+		summary.BytesUploaded = max(upload.uploadedBytes()-groupsUploaded(groupResults), 0)
+	}
+	summary.Warnings = backupWarnings(err)
+	// interrupted is set when the backup was stopped on purpose before it completed
+	interrupted := false
+	if err != nil {
+		var exitErr *exec.ExitError
+		switch {
+		case errors.Is(backupCtx.Err(), context.DeadlineExceeded):
+			log.WithField("max_runtime", appConfig.MaxRuntime).Warn("The runtime budget is exhausted, the backup is partial. It will be resumed on the next run.")
+			summary.Status = runStatusPartial
+			interrupted = true
+		case signalCtx.Err() != nil:
+			log.Warn("The program was terminated, the backup is partial. It will be resumed on the next run.")
+			summary.Status = runStatusPartial
+		case sleep.stopReason() != "":
+			log.WithField("reason", sleep.stopReason()).Warn("The backup was stopped before the system slept, the backup is partial. It will be resumed on the next run.")
+			summary.Status = runStatusPartial
+			interrupted = true
+		case upload.limitReached():
+			log.WithField("max_upload_per_run", appConfig.MaxUploadPerRun).Warn("The upload cap of the run is reached, the backup is partial. It will be resumed on the next run.")
+			summary.Status = runStatusPartial
+			interrupted = true
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == resticExitIncomplete && onlyIgnoredWarnings(err):
+			// Only known files that can never be read were skipped
+			log.Debug("The backup skipped only ignored files")
+			summary.Error = ""
+			summary.stage("backup").Err = nil
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == resticExitIncomplete:
+			// The snapshot was created, but some source files could not be read
+			log.Warn("The snapshot is incomplete, some files could not be read")
+			summary.Status = runStatusIncomplete
+		default:
+			log.WithFields(log.Fields{
+				"cmd":     appConfig.Restic.Path,
+				"command": "backup",
+			}).Errorf("Backup failed")
+			summary.Status = runStatusFailed
+		}
+	}
+	// Tagging replaces the snapshots, which an append-only repository refuses
+	if interrupted && appConfig.AutoTags && !appConfig.Security.AppendOnly {
+		tagInterruptedSnapshots(ctx, summary, groupResults)
+	}
+	applyGroupResults(summary, groupResults)
+	if len(groups) > 0 && groups[len(groups)-1].Chunk != "" {
+		if summary.snapshotCreated() && summary.SnapshotID != "" {
+			recordChunk(state, groups[len(groups)-1].Chunk, time.Now())
+		}
+	} else if summary.Status == runStatusSuccess && summary.SnapshotID != "" {
+		// The full backup covers the files of the chunks
+		forgetSeedChunks(ctx, state)
+	}
+	if appendOnlyErr != nil && summary.snapshotCreated() {
+		// The snapshot is stored, but the repository is not protected as configured or cannot be verified
+		summary.Status = runStatusFailed
+		summary.Error = "append-only: " + appendOnlyErr.Error()
+	}
+	// Tagging replaces the snapshot, which an append-only repository refuses
+	if appConfig.AutoTags && !appConfig.Security.AppendOnly && summary.Status == runStatusIncomplete && summary.SnapshotID != "" {
+		tagIncompleteSnapshot(ctx, summary)
+	}
+	if summary.snapshotCreated() && appConfig.SelfBackup {
+		// A broken copy must not fail the backup
+		if dir, err := writeSelfBackup(); err != nil {
+			log.WithField("err", err).Error("cannot copy the configuration and the state to the backup")
+		} else if err = backupAuxiliary(ctx, dir, tagSelfBackup); err != nil {
+			log.WithField("err", err).Error("cannot back up the configuration and the state")
+		}
+	}
+	// A container sees its own packages and jobs, not the ones of the host
+	if summary.snapshotCreated() && appConfig.SystemManifest.Enabled && !inContainer() {
+		if dir, err := writeSystemManifest(ctx, summary); err != nil {
+			log.WithField("err", err).Error("cannot capture the system manifest")
+		} else if err = backupAuxiliary(ctx, dir, tagSystemManifest); err != nil {
+			log.WithField("err", err).Error("cannot back up the system manifest")
+		}
+	}
+	if summary.snapshotCreated() && len(appConfig.DockerVolumes.Volumes) > 0 {
+		if err = backupDockerVolumes(ctx, summary); err != nil {
+			log.WithField("err", err).Error("Docker volume backup failed")
+			summary.Status = runStatusFailed
+		}
+	}
+	if appConfig.Manifests.Enabled && summary.snapshotCreated() && summary.SnapshotID != "" {
+		if err = writeManifest(ctx, summary.SnapshotID, startTime); err != nil {
+			log.WithField("err", err).Warn("cannot store the manifest of the snapshot")
+		}
+		expireManifests(startTime)
+	}
+	if len(appConfig.Canary.Paths) > 0 && summary.snapshotCreated() && summary.SnapshotID != "" {
+		if err = verifyCanary(ctx, summary); err != nil {
+			log.WithField("err", err).Error("The canary verification failed")
+			summary.Status = runStatusFailed
+			if summary.Error == "" {
+				summary.Error = "canary: " + err.Error()
+			}
+		}
+	}
+	if appConfig.MacOSMetadata.Verify && summary.snapshotCreated() && summary.SnapshotID != "" {
+		summary.MetadataVerified, summary.MetadataMissing, err = verifyMacMetadata(ctx, summary.SnapshotID, sources)
+		if err != nil {
+			log.WithField("err", err).Warn("cannot verify the macOS metadata of the snapshot")
+		}
+	}
+	if summary.snapshotCreated() && (recovery != "" || checkDue(state, startTime)) {
+		var output string
+		runErr := summary.Error
+		output, err = runCheck(ctx, summary, state)
+		if err != nil && appConfig.Check.RepairIndex && indexDamagedRe.MatchString(checkErrors(output, err)) {
+			if _, err = repairIndex(ctx, summary, state); err == nil {
+				// The repaired repository passed the check, the run did not fail
+				summary.Error = runErr
+			}
+		}
+		if err != nil {
 			log.WithFields(log.Fields{
 				"cmd":     appConfig.Restic.Path,
-				"command": "forget",
-			}).Errorf("Forget failed")
+				"command": "check",
+			}).Errorf("Repository check failed")
+			summary.Status = runStatusFailed
+		} else if recovery != "" {
+			log.WithField("reason", recovery).Info("Recovered from the previous run")
+		}
+	}
+	if guardrailsEnabled() {
+		added := len(summary.GroupSnapshots)
+		if summary.snapshotCreated() {
+			added++
+		}
+		// Checked before the retention policy removes snapshots
+		var count int
+		summary.Guardrails, count, err = checkGuardrails(ctx, state, added, time.Now())
+		if err != nil {
+			log.WithField("err", err).Warn("cannot check the snapshot guardrails")
+		} else {
+			state.SnapshotCount = count
+		}
+		for _, violation := range summary.Guardrails {
+			log.WithField("violation", violation).Warn("A snapshot guardrail is violated")
+		}
+		state.GuardrailViolations = summary.Guardrails
+	}
+	// Never prune a repository that failed the check. The retention of an append-only repository is applied by its
+	// administrator with other credentials. The sync applies the retention of the staging repository once it copied
+	// the snapshots.
+	if appConfig.CleanupOldBackups && !appConfig.Security.AppendOnly && !stagingEnabled() && summary.snapshotCreated() {
+		cleanupOldBackups(ctx, summary, state, retentionArgs())
+		if guardrailsEnabled() && summary.stage("forget") != nil {
+			// The snapshots removed by the retention policy are expected
+			if count, _, err := hostSnapshots(ctx); err == nil {
+				state.SnapshotCount = count
+			}
+		}
+	}
+	summary.Duration = time.Since(startTime)
+
+	if stagingEnabled() && summary.snapshotCreated() {
+		state.SyncBacklog++
+	}
+	state.finishRun(summary)
+	summary.LastSuccess = state.LastSuccess
+	runs := profileRuns(time.Now().Add(-healthPeriod))
+	if summary.ThroughputDrop = throughputDrop(runs); summary.ThroughputDrop != "" {
+		log.WithField("drop", summary.ThroughputDrop).Warn("The backup throughput collapsed")
+	}
+	summary.SyncBacklog = state.SyncBacklog
+
+	// Report the run with a separate timeout, the run context may already be exhausted
+	reportCtx, cancelReport := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancelReport()
+	summary.Health = assessHealth(reportCtx, state, runs)
+	if summary.Health.degraded() {
+		log.WithField("health", summary.Health.String()).Warn("The repository health is degraded")
+	}
+	if remotePolicy != nil {
+		summary.Compliance = checkCompliance(time.Now())
+		if !summary.Compliance.compliant() {
+			log.WithField("issues", summary.Compliance.Issues).Warn("The host does not comply with the fleet policy")
 		}
 	}
-	elapsedTime := time.Since(startTime)
-	if err = sendAwsMetrics(ctx, elapsedTime); err != nil {
-		log.WithField("err", err).Error("cannot send backup metrics to CloudWatch")
+	publish(reportCtx, runFinishedEvent{Summary: summary, State: state})
+	if stagingEnabled() && summary.snapshotCreated() {
+		startSync()
+	}
+
+	fields := log.Fields{"duration": summary.Duration}
+	if recovery != "" {
+		fields["recovery"] = recovery
+	}
+	for _, stage := range summary.Stages {
+		fields[stage.Name+"_duration"] = stage.Duration
+	}
+	if opts.k8s {
+		writeTerminationMessage(summary)
+	}
+	switch summary.Status {
+	case runStatusFailed:
+		log.WithFields(fields).Error("Run failed")
+		stopRestServer()
+		os.Exit(1)
+	case runStatusPartial:
+		log.WithFields(fields).Warn("Backup stopped before completion")
+	case runStatusIncomplete:
+		log.WithFields(fields).Warn("Backup completed, but some files could not be read")
+	default:
+		log.WithFields(fields).Info("Backup completed successfully")
+	}
+	if opts.k8s && k8sExitCode(summary.Status) != exitSuccess {
+		stopRestServer()
+		os.Exit(k8sExitCode(summary.Status))
+	}
+	return summary
+}
+
+func main() {
+	subscribeIntegrations()
+	var k8s bool
+	rootCmd := &cobra.Command{
+		Use:          "restic_wrapper",
+		Short:        "Back up the system with restic",
+		Long:         "restic_wrapper backs up the system with restic when run without a command.",
+		Version:      currentBuildInfo().String(),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(*cobra.Command, []string) error {
+			return startDebugHTTP()
+		},
+		RunE: func(*cobra.Command, []string) error {
+			if k8s {
+				setupK8sLogging()
+			}
+			// Without a selected profile every profile is backed up
+			if profiles := profileNames(); activeProfile == "" && len(profiles) > 0 {
+				var flags []string
+				if appConfig.HostRoot != "" {
+					flags = append(flags, "--host-root", appConfig.HostRoot)
+				}
+				if debugHTTP {
+					flags = append(flags, "--debug-http")
+				}
+				return runProfiles(profiles, k8s, flags...)
+			}
+			if summary := runBackup(backupOptions{k8s: k8s}); summary == nil && k8s {
+				writeTerminationMessage(nil)
+			}
+			return nil
+		},
+	}
+	rootCmd.Flags().BoolVar(&k8s, "k8s", false, "run as a Kubernetes CronJob: log JSON to stdout, write a termination message and exit with the run status")
+	rootCmd.Flags().StringVar(&appConfig.HostRoot, "host-root", appConfig.HostRoot, "prefix of the backup sources, where the host filesystem is mounted in a container")
+	rootCmd.PersistentFlags().BoolVar(&debugHTTP, "debug-http", false, "log the HTTP requests of restic and the program to a debug log, e.g. to diagnose 403 errors or throttling")
+	rootCmd.PersistentFlags().String("profile", "", "the profile to use (defaults to $"+profileEnv+")")
+	rootCmd.AddCommand(newReportCmd())
+	rootCmd.AddCommand(newForgetCmd())
+	rootCmd.AddCommand(newSnapshotsCmd())
+	rootCmd.AddCommand(newProtectCmd())
+	rootCmd.AddCommand(newUnprotectCmd())
+	rootCmd.AddCommand(newNoteCmd())
+	rootCmd.AddCommand(newCheckpointCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newDisableCmd())
+	rootCmd.AddCommand(newEnableCmd())
+	rootCmd.AddCommand(newDaemonCmd())
+	rootCmd.AddCommand(newRewriteCmd())
+	rootCmd.AddCommand(newRestoreCmd())
+	rootCmd.AddCommand(newLsCmd())
+	rootCmd.AddCommand(newVersionsCmd())
+	rootCmd.AddCommand(newVersionCmd())
+	rootCmd.AddCommand(newRecoverCmd())
+	rootCmd.AddCommand(newExportDRBundleCmd())
+	rootCmd.AddCommand(newSudoersCmd())
+	rootCmd.AddCommand(newSystemCmd())
+	rootCmd.AddCommand(newProvisionCmd())
+	rootCmd.AddCommand(newRepairCmd())
+	rootCmd.AddCommand(newSyncCmd())
+	rootCmd.AddCommand(newDoctorCmd())
+	rootCmd.AddCommand(newAuditCmd())
+	rootCmd.AddCommand(newAuditLogCmd())
+	rootCmd.AddCommand(newPinResticCmd())
+	rootCmd.AddCommand(newRestoreCredentialsCmd())
+	rootCmd.AddCommand(newMigrateEndpointCmd())
+	rootCmd.AddCommand(newAdviseLifecycleCmd())
+	rootCmd.AddCommand(newGenDocsCmd())
+	rootCmd.AddCommand(newConfigCmd())
+	rootCmd.AddCommand(newPresetsCmd())
+	rootCmd.AddCommand(newManifestCmd())
+	rootCmd.AddCommand(newPurgePathCmd())
+	rootCmd.AddCommand(newHistoryCmd())
+	rootCmd.AddCommand(newNagiosCmd())
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
 	}
-	log.WithFields(log.Fields{
-		"duration": elapsedTime,
-	}).Info("Backup completed successfully")
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// suspension is a temporary suspension of the backups, kept apart from the state file so a running backup does not
+// overwrite it
+type suspension struct {
+	Since time.Time `json:"since"`
+	// Until is when the backups resume, zero until they are enabled again
+	Until  time.Time `json:"until,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// suspensionPath returns the path of the suspension file next to the state file, e.g. "state.photos.suspended.json"
+func suspensionPath(statePath string) string {
+	return strings.TrimSuffix(statePath, filepath.Ext(statePath)) + ".suspended.json"
+}
+
+// loadSuspension reads the suspension next to the state file, returning nil if the backups are not suspended
+func loadSuspension(statePath string) (*suspension, error) {
+	data, err := os.ReadFile(suspensionPath(statePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the suspension: %w", err)
+	}
+	s := &suspension{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse the suspension: %w", err)
+	}
+	return s, nil
+}
+
+// active reports whether the suspension is still in effect
+func (s *suspension) active(now time.Time) bool {
+	return s != nil && (s.Until.IsZero() || now.Before(s.Until))
+}
+
+// String describes the suspension, e.g. "disabled until 2024-05-01 08:00: rebuilding the RAID"
+func (s *suspension) String() string {
+	description := "disabled until enabled again"
+	if !s.Until.IsZero() {
+		description = "disabled until " + s.Until.Local().Format("2006-01-02 15:04")
+	}
+	if s.Reason != "" {
+		description += ": " + s.Reason
+	}
+	return description
+}
+
+// backupsDisabled returns why the backups of the active configuration are disabled, or an empty string if they
+// are not
+func backupsDisabled(now time.Time) string {
+	if !appConfig.Enabled {
+		return "disabled in the configuration"
+	}
+	s, err := loadSuspension(statePath())
+	if err != nil {
+		// A broken suspension file must not stop the backups
+		return ""
+	}
+	if s.active(now) {
+		return s.String()
+	}
+	return ""
+}
+
+// parseUntil parses the end of a suspension: a duration from now ("3d", "12h"), a date or a local date and time
+func parseUntil(value string, now time.Time) (time.Time, error) {
+	if d, err := parseAge(value); err == nil {
+		return now.Add(d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration (e.g. 3d or 12h), a date or a date and time", value)
+}
+
+// suspensionStatePath returns the state file of the profile given as the argument, or of the selected profile
+func suspensionStatePath(args []string) (string, error) {
+	profiles := profileNames()
+	switch {
+	case len(args) == 1 && len(profiles) == 0:
+		return "", errors.New("no profiles are configured, run the command without a profile")
+	case len(args) == 1 && !slices.Contains(profiles, args[0]):
+		return "", fmt.Errorf("unknown profile %q, the configured profiles are: %s", args[0], strings.Join(profiles, ", "))
+	case len(args) == 1:
+		return profileStatePath(args[0]), nil
+	case activeProfile == "" && len(profiles) > 0:
+		return "", fmt.Errorf("select the profile, the configured profiles are: %s", strings.Join(profiles, ", "))
+	}
+	return statePath(), nil
+}
+
+// newDisableCmd returns the command suspending the backups of a profile
+func newDisableCmd() *cobra.Command {
+	var until, reason string
+	cmd := &cobra.Command{
+		Use:   "disable [profile]",
+		Short: "Suspend the backups of a profile",
+		Long: "Suspends the scheduled backups of the profile (or of the configuration without profiles) until the " +
+			"time given with --until, e.g. \"3d\", \"12h\" or \"2024-05-01 08:00\", or until \"restic_wrapper enable\" " +
+			"is run, e.g. while a source volume is being rebuilt. The configuration of the profile is kept.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := suspensionStatePath(args)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			s := &suspension{Since: now, Reason: reason}
+			if until != "" {
+				if s.Until, err = parseUntil(until, now); err != nil {
+					return err
+				}
+				if !s.Until.After(now) {
+					return fmt.Errorf("%s is in the past", s.Until.Local().Format("2006-01-02 15:04"))
+				}
+			}
+			data, err := json.MarshalIndent(s, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to encode the suspension: %w", err)
+			}
+			if err = os.WriteFile(suspensionPath(path), data, 0o600); err != nil {
+				return fmt.Errorf("failed to write the suspension: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Backups %s\n", s)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&until, "until", "", "resume the backups at this time or after this duration (default until enabled again)")
+	cmd.Flags().StringVar(&reason, "reason", "", "why the backups are suspended, shown by the status command")
+	return cmd
+}
+
+// newEnableCmd returns the command resuming the backups of a profile
+func newEnableCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "enable [profile]",
+		Short: "Resume the backups of a profile suspended with disable",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := suspensionStatePath(args)
+			if err != nil {
+				return err
+			}
+			if err = os.Remove(suspensionPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove the suspension: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "Backups enabled")
+			return nil
+		},
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// manifestDir is the directory of the snapshot manifests in the backup directory
+const manifestDir = "manifests"
+
+// manifestEntry is a file or directory of a snapshot as printed by restic ls --json
+type manifestEntry struct {
+	// StructType is "snapshot" for the first line of the output and "node" for the files
+	StructType string    `json:"struct_type,omitempty"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       uint64    `json:"size,omitempty"`
+	Mtime      time.Time `json:"mtime"`
+}
+
+// manifestHeader is the first line of a manifest, describing the snapshot
+type manifestHeader struct {
+	SnapshotID string    `json:"snapshot_id"`
+	Time       time.Time `json:"time"`
+}
+
+// manifestPath returns the path of the manifest of the snapshot. The name starts with the snapshot time,
+// so the manifests sort chronologically.
+func manifestPath(snapshotID string, at time.Time) string {
+	return filepath.Join(appConfig.BackupDir, manifestDir, at.UTC().Format("20060102T150405Z")+"-"+snapshotID+".jsonl.gz")
+}
+
+// writeManifest stores the list of files of the snapshot with their sizes and modification times
+// as a compressed manifest in the backup directory
+func writeManifest(ctx context.Context, snapshotID string, at time.Time) error {
+	if err := os.MkdirAll(filepath.Join(appConfig.BackupDir, manifestDir), 0o700); err != nil {
+		return fmt.Errorf("failed to create the manifest directory: %w", err)
+	}
+	target := manifestPath(snapshotID, at)
+	file, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create the manifest: %w", err)
+	}
+	defer os.Remove(target + ".tmp")
+	defer file.Close()
+
+	// The output is streamed, the file list of a large snapshot does not fit the log
+	cmd := resticCommand(ctx, "ls", "--json", snapshotID)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run restic ls: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run restic ls: %w", err)
+	}
+
+	zw := gzip.NewWriter(file)
+	encoder := json.NewEncoder(zw)
+	encodeErr := encoder.Encode(manifestHeader{SnapshotID: snapshotID, Time: at})
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && encodeErr == nil {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.StructType != "node" {
+			continue
+		}
+		entry.StructType = ""
+		encodeErr = encoder.Encode(entry)
+	}
+	// restic blocks on a full pipe when the loop stopped early, on a write error or a line over the buffer
+	io.Copy(io.Discard, stdout)
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("restic ls failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if encodeErr == nil {
+		encodeErr = scanner.Err()
+	}
+	if encodeErr == nil {
+		encodeErr = zw.Close()
+	}
+	if encodeErr != nil {
+		return fmt.Errorf("failed to write the manifest: %w", encodeErr)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	if err = os.Rename(target+".tmp", target); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	return nil
+}
+
+// manifestFiles returns the manifests in the backup directory, oldest first
+func manifestFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(appConfig.BackupDir, manifestDir, "*.jsonl.gz"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// expireManifests removes the manifests older than manifests.max_age
+func expireManifests(now time.Time) {
+	if appConfig.Manifests.MaxAge <= 0 {
+		return
+	}
+	files, err := manifestFiles()
+	if err != nil {
+		log.WithField("err", err).Warn("cannot list the manifests")
+		return
+	}
+	for _, file := range files {
+		at, err := time.Parse("20060102T150405Z", strings.SplitN(filepath.Base(file), "-", 2)[0])
+		if err != nil || now.Sub(at) <= appConfig.Manifests.MaxAge {
+			continue
+		}
+		if err = os.Remove(file); err != nil {
+			log.WithFields(log.Fields{"manifest": file, "err": err}).Warn("cannot remove the expired manifest")
+		}
+	}
+}
+
+// manifestMatch reports whether the path matches the search pattern. Patterns with wildcards are matched
+// against the full path and the file name, other patterns are matched as a substring of the path.
+func manifestMatch(pattern, filePath string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(filePath, pattern)
+	}
+	if ok, _ := path.Match(pattern, filePath); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(filePath))
+	return ok
+}
+
+// searchManifest calls found with the entries of the manifest matching the pattern
+func searchManifest(file, pattern string, found func(manifestHeader, manifestEntry)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+	}
+	decoder := json.NewDecoder(zr)
+	var header manifestHeader
+	if err = decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+	}
+	for {
+		var entry manifestEntry
+		err = decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+		}
+		if manifestMatch(pattern, entry.Path) {
+			found(header, entry)
+		}
+	}
+}
+
+// newManifestCmd returns the command searching the snapshot manifests
+func newManifestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "manifest",
+		Short: "Search the file lists of the snapshots",
+		Args:  cobra.NoArgs,
+	}
+	var day string
+	search := &cobra.Command{
+		Use:   "search <pattern>",
+		Short: "Find the snapshots containing the files matching the pattern",
+		Long: "Searches the manifests stored after every backup when manifests.enabled is set, without opening the " +
+			"repository. A pattern with wildcards (*, ?, [) is matched against the full path and the file name, " +
+			"any other pattern is matched as a part of the path.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var on time.Time
+			if day != "" {
+				var err error
+				if on, err = time.ParseInLocation("2006-01-02", day, time.Local); err != nil {
+					return fmt.Errorf("invalid date %q, expected YYYY-MM-DD: %w", day, err)
+				}
+			}
+			files, err := manifestFiles()
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return errors.New("no manifests found, enable manifests.enabled to store them after every backup")
+			}
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "Snapshot\tTime\tSize\tModified\tPath")
+			matches := 0
+			for _, file := range files {
+				err = searchManifest(file, args[0], func(header manifestHeader, entry manifestEntry) {
+					if !on.IsZero() && (header.Time.Before(on) || !header.Time.Before(on.AddDate(0, 0, 1))) {
+						return
+					}
+					matches++
+					size := ""
+					if entry.Type == "file" {
+						size = formatBytes(int64(entry.Size))
+					}
+					fmt.Fprintf(tw, "%.8s\t%s\t%s\t%s\t%s\n", header.SnapshotID, header.Time.Local().Format("2006-01-02 15:04"),
+						size, entry.Mtime.Local().Format("2006-01-02 15:04"), entry.Path)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if err = tw.Flush(); err != nil {
+				return err
+			}
+			if matches == 0 {
+				return fmt.Errorf("no files matching %q found", args[0])
+			}
+			return nil
+		},
+	}
+	search.Flags().StringVar(&day, "on", "", "only search the snapshots taken on the day (YYYY-MM-DD)")
+	cmd.AddCommand(search)
+	return cmd
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryEnv returns the Go runtime settings limiting the memory used by restic, see restic.memory_limit and restic.gogc
+func memoryEnv() []string {
+	var env []string
+	if appConfig.Restic.MemoryLimit != "" {
+		limit, err := parseSize(appConfig.Restic.MemoryLimit)
+		if err != nil {
+			log.WithField("err", err).Warn("Ignoring the invalid restic.memory_limit")
+		} else {
+			env = append(env, "GOMEMLIMIT="+strconv.FormatInt(limit, 10))
+		}
+	}
+	if appConfig.Restic.GOGC != 0 {
+		env = append(env, "GOGC="+strconv.Itoa(appConfig.Restic.GOGC))
+	}
+	return env
+}
+
+// memoryCapCommandLine wraps the command line in a transient systemd scope capping its memory to restic.memory_max,
+// so the kernel kills restic instead of letting it exhaust the memory of the host. The cap needs cgroups and is
+// only applied on Linux with systemd, without the user manager of a non-root user restic runs uncapped.
+func memoryCapCommandLine(name string, args []string) (string, []string) {
+	if appConfig.Restic.MemoryMax == "" {
+		return name, args
+	}
+	limit, err := parseSize(appConfig.Restic.MemoryMax)
+	if err != nil {
+		log.WithField("err", err).Warn("Ignoring the invalid restic.memory_max")
+		return name, args
+	}
+	if runtime.GOOS != "linux" {
+		log.Debug("restic.memory_max is only supported on Linux, set restic.memory_limit instead")
+		return name, args
+	}
+	systemdRun, err := exec.LookPath("systemd-run")
+	if err != nil {
+		log.Warn("Cannot cap the memory of restic, systemd-run is not installed")
+		return name, args
+	}
+	// The scope runs the command in place, keeping it the child process of the program
+	capArgs := []string{"--scope", "--quiet", "-p", "MemoryMax=" + strconv.FormatInt(limit, 10),
+		"-p", "MemorySwapMax=0", "--", name}
+	// root gets a scope of the system manager, the users one of their own manager
+	if os.Geteuid() != 0 {
+		if !userManagerRunning() {
+			userManagerWarning.Do(func() {
+				log.Warn("Cannot cap the memory of restic, the systemd user manager is not running (e.g. cron or a " +
+					"container), restic runs without restic.memory_max")
+			})
+			return name, args
+		}
+		capArgs = append([]string{"--user"}, capArgs...)
+	}
+	return systemdRun, append(capArgs, args...)
+}
+
+// userManagerWarning logs the missing systemd user manager once per run
+var userManagerWarning sync.Once
+
+// userManagerRunning reports whether the systemd user manager of the user is running, found through its private
+// socket in XDG_RUNTIME_DIR
+func userManagerRunning() bool {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	_, err := os.Stat(filepath.Join(runtimeDir, "systemd", "private"))
+	return err == nil
+}
+
+// outOfMemory reports whether the failed restic command ran out of memory: it was killed by the kernel OOM killer
+// or the memory cap, or the Go runtime failed to allocate memory
+func outOfMemory(err error) bool {
+	var rErr *resticError
+	if !errors.As(err, &rErr) {
+		return false
+	}
+	if strings.Contains(rErr.stderr, "fatal error: runtime: out of memory") ||
+		strings.Contains(rErr.stderr, "cannot allocate memory") {
+		return true
+	}
+	// The program interrupts restic when it is stopped, a SIGKILL comes from the OOM killer
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+// outOfMemoryError returns the description of the stage killed for running out of memory
+func outOfMemoryError(stage stageResult) string {
+	text := "killed, out of memory"
+	if stage.Usage != nil && stage.Usage.MaxRSS > 0 {
+		text += fmt.Sprintf(" (peak memory %s)", formatBytes(stage.Usage.MaxRSS))
+	}
+	return text
+}
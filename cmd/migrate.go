@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// repositoryID returns the ID of the repository, which a copy of the repository keeps
+func repositoryID(ctx context.Context) (string, error) {
+	output, err := runResticCommand(ctx, "cat", "config", "--no-lock")
+	if err != nil {
+		if fatal := fatalError(err); fatal != "" {
+			return "", errors.New(fatal)
+		}
+		return "", err
+	}
+	var config repositoryConfig
+	if err = json.Unmarshal([]byte(output), &config); err != nil {
+		return "", fmt.Errorf("failed to parse the repository configuration: %w", err)
+	}
+	return config.ID, nil
+}
+
+// missingSnapshots returns the snapshots of the seed repository missing from the uploaded copy, e.g. the ones
+// created after the drive was shipped
+func missingSnapshots(seedCtx, targetCtx context.Context) ([]snapshot, int, error) {
+	seed, err := listSnapshots(seedCtx, "--no-lock")
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list the snapshots of the seed repository: %w", err)
+	}
+	uploaded, err := listSnapshots(targetCtx, "--no-lock")
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list the snapshots of the new repository: %w", err)
+	}
+	present := map[string]bool{}
+	for _, s := range uploaded {
+		present[s.ID] = true
+		// The snapshots copied by restic copy refer to the seed snapshot
+		present[s.originalID()] = true
+	}
+	var missing []snapshot
+	for _, s := range seed {
+		if !present[s.ID] && !present[s.originalID()] {
+			missing = append(missing, s)
+		}
+	}
+	return missing, len(seed), nil
+}
+
+// storeSecret stores the secret in the configured secrets source. The environment cannot be written, the caller
+// reports the variable to set instead.
+func storeSecret(ctx context.Context, account, value string) error {
+	switch appConfig.Secrets.Source {
+	case "env":
+		return nil
+	case "files":
+		path := filepath.Join(appConfig.Secrets.Dir, account)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(value+"\n"), 0o600); err != nil {
+			return fmt.Errorf("failed to write the secret file %s: %w", account, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return fmt.Errorf("failed to replace the secret file %s: %w", account, err)
+		}
+		return nil
+	}
+	return storeKeychainSecret(ctx, appConfig.SecurityService, account, value)
+}
+
+// newMigrateEndpointCmd returns the command switching the profile from its local seed repository to the copy
+// uploaded to the cloud
+func newMigrateEndpointCmd() *cobra.Command {
+	var (
+		readDataSubset string
+		yes            bool
+	)
+	cmd := &cobra.Command{
+		Use:   "migrate-endpoint <repository>",
+		Short: "Switch from the local seed repository to its copy uploaded to the cloud",
+		Long: "Completes the seed-locally workflow: the initial backup goes to a repository on a local disk, the " +
+			"disk is shipped to the provider, e.g. AWS Snowball, which imports it into the bucket. migrate-endpoint " +
+			"then verifies the uploaded copy against the seed: the same repository ID, every snapshot of the seed " +
+			"present (the snapshots created since the drive was shipped are copied with restic copy) and the data " +
+			"readable with restic check --read-data-subset. Once verified, it stores the new repository URL in the " +
+			"secrets source of the profile, so the next backups go to the cloud.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			w := &wizard{in: bufio.NewReader(cmd.InOrStdin()), out: cmd.OutOrStdout()}
+			target := args[0]
+
+			// No backup may go to the seed repository during the migration
+			fileLock := newFileLock()
+			locked, err := fileLock.TryLock()
+			if err != nil {
+				return fmt.Errorf("cannot lock the lock file: %w", err)
+			}
+			if !locked {
+				return errors.New("a backup is running, retry when it is finished")
+			}
+			defer fileLock.Unlock()
+
+			setupEnv()
+			seedRepository := os.Getenv("RESTIC_REPOSITORY")
+			if seedRepository == target {
+				return errors.New("the profile already backs up to " + target)
+			}
+			if appConfig.RestServer.Enabled {
+				return errors.New("the repository is served by the managed rest-server, set rest_server.enabled to false " +
+					"and store the URL of the seed repository first")
+			}
+			fmt.Fprintf(w.out, "Seed repository: %s\nNew repository: %s\n", seedRepository, target)
+
+			// The copy shares the password of the seed, the credentials of the backend may be new
+			var credentials []secretEnv
+			if strings.HasPrefix(target, "s3:") && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+				for _, secret := range []struct {
+					secretEnv
+					question string
+				}{
+					{secretEnv{"AWS_ACCESS_KEY_ID", "aws-access-key-id"}, "AWS access key ID"},
+					{secretEnv{"AWS_SECRET_ACCESS_KEY", "aws-secret-access-key"}, "AWS secret access key"},
+				} {
+					value, err := w.askSecret(secret.question)
+					if err != nil {
+						return err
+					}
+					os.Setenv(secret.env, value)
+					credentials = append(credentials, secret.secretEnv)
+				}
+			}
+			seedCtx := ctx
+			targetCtx := withResticEnv(ctx, "RESTIC_REPOSITORY="+target)
+
+			seedID, err := repositoryID(seedCtx)
+			if err != nil {
+				return fmt.Errorf("cannot open the seed repository: %w", err)
+			}
+			targetID, err := repositoryID(targetCtx)
+			if err != nil {
+				return fmt.Errorf("cannot open the new repository: %w", err)
+			}
+			if seedID != targetID {
+				return fmt.Errorf("the new repository %s is not a copy of the seed repository %s", targetID, seedID)
+			}
+			fmt.Fprintf(w.out, "Repository ID: %s in both repositories\n", seedID)
+
+			missing, total, err := missingSnapshots(seedCtx, targetCtx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w.out, "Snapshots: %d of the %d of the seed in the new repository\n", total-len(missing), total)
+			if len(missing) > 0 {
+				ids := make([]string, len(missing))
+				for i, s := range missing {
+					ids[i] = s.ID
+					fmt.Fprintf(w.out, "  missing %s  %s\n", s.ShortID, s.Time.Local().Format("2006-01-02 15:04"))
+				}
+				if !yes {
+					if ok, err := w.askYes("Copy the missing snapshots to the new repository?", true); err != nil || !ok {
+						if err == nil {
+							err = errors.New("the new repository misses snapshots of the seed")
+						}
+						return err
+					}
+				}
+				copyCtx := withResticEnv(targetCtx, append([]string{"RESTIC_FROM_REPOSITORY=" + seedRepository,
+					"RESTIC_FROM_PASSWORD=" + os.Getenv("RESTIC_PASSWORD")}, passwordSourceEnv("RESTIC_FROM_")...)...)
+				if _, err = runResticCommand(copyCtx, append([]string{"copy"}, ids...)...); err != nil {
+					return fmt.Errorf("restic copy failed: %w", err)
+				}
+				fmt.Fprintf(w.out, "Copied %d snapshots\n", len(missing))
+			}
+
+			fmt.Fprintf(w.out, "Checking the new repository, reading %s of its data\n", readDataSubset)
+			if output, err := runResticCommand(targetCtx, "check", "--read-data-subset", readDataSubset); err != nil {
+				fmt.Fprint(w.out, output)
+				return fmt.Errorf("the new repository failed the check, the profile still backs up to the seed: %w", err)
+			}
+			fmt.Fprintln(w.out, "The new repository is intact")
+
+			if !yes {
+				if ok, err := w.askYes("Back up to "+target+" from now on?", true); err != nil || !ok {
+					return err
+				}
+			}
+			secrets := append([]secretEnv{{"RESTIC_REPOSITORY", "repository"}}, credentials...)
+			for _, secret := range secrets {
+				value := target
+				if secret.env != "RESTIC_REPOSITORY" {
+					value = os.Getenv(secret.env)
+				}
+				if appConfig.Secrets.Source == "env" {
+					fmt.Fprintf(w.out, "Set %s in the environment of the scheduled backups\n", secret.env)
+					continue
+				}
+				if err = storeSecret(ctx, secretAccount(secret), value); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(w.out, "The backups now go to %s. Keep the seed drive until the first backup to the new "+
+				"repository succeeded.\n", target)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&readDataSubset, "read-data-subset", "5%", "the part of the data of the new repository read by the check, e.g. 10% or 100%")
+	cmd.Flags().BoolVar(&yes, "yes", false, "copy the missing snapshots and switch without asking")
+	return cmd
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the Nagios plugin API
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+// nagiosLabels are the status labels of the Nagios exit codes
+var nagiosLabels = map[int]string{
+	nagiosOK:       "OK",
+	nagiosWarning:  "WARNING",
+	nagiosCritical: "CRITICAL",
+	nagiosUnknown:  "UNKNOWN",
+}
+
+// formatAge returns the duration in its largest unit, e.g. "2h" or "3d"
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+// nagiosStatus returns the Nagios exit code and the status line of the backups
+func nagiosStatus(state *runState, now time.Time, warningAge, criticalAge time.Duration) (int, string) {
+	if state.LastSuccess.IsZero() {
+		return nagiosCritical, "no successful backup"
+	}
+	age := now.Sub(state.LastSuccess)
+	text := "last backup " + formatAge(age) + " ago"
+	if state.LastRun != nil && state.LastRun.SnapshotID != "" {
+		text += ", " + formatBytes(state.LastRun.BytesAdded) + " added"
+	}
+	perfdata := fmt.Sprintf("age=%ds;%d;%d", int(age.Seconds()), int(warningAge.Seconds()), int(criticalAge.Seconds()))
+	if state.LastRun != nil {
+		perfdata += fmt.Sprintf(" bytes_added=%dB", state.LastRun.BytesAdded)
+	}
+	text += " | " + perfdata
+
+	switch {
+	case age >= criticalAge:
+		return nagiosCritical, text
+	case state.CheckFailed:
+		return nagiosCritical, "the last repository check failed, " + text
+	case age >= warningAge:
+		return nagiosWarning, text
+	case state.LastRun != nil && state.LastRun.Status != runStatusSuccess && state.LastRun.Status != runStatusRunning:
+		return nagiosWarning, "the last run is " + state.LastRun.Status + ", " + text
+	}
+	return nagiosOK, text
+}
+
+// newNagiosCmd returns the command printing the status of the backups as a Nagios plugin
+func newNagiosCmd() *cobra.Command {
+	var warningAge, criticalAge time.Duration
+	cmd := &cobra.Command{
+		Use:   "nagios",
+		Short: "Print the status of the backups as a Nagios check",
+		Long: "Prints a Nagios-compatible status line with performance data, e.g. \"OK - last backup 2h ago, " +
+			"1.2 GiB added\", and exits with the Nagios status code: WARNING when the last successful backup is older " +
+			"than --warning or the last run did not succeed, CRITICAL when it is older than --critical or the last " +
+			"repository check failed. Use it with NRPE, Icinga or any monitoring running Nagios plugins.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			code, text := nagiosUnknown, ""
+			state, err := loadState()
+			if err != nil {
+				text = err.Error()
+			} else {
+				code, text = nagiosStatus(state, time.Now(), warningAge, criticalAge)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s - %s\n", nagiosLabels[code], text)
+			os.Exit(code)
+		},
+	}
+	cmd.Flags().DurationVar(&warningAge, "warning", 26*time.Hour, "the age of the last successful backup causing a warning")
+	cmd.Flags().DurationVar(&criticalAge, "critical", 50*time.Hour, "the age of the last successful backup causing a critical status")
+	return cmd
+}
+
+// zabbixItem is a value sent to a Zabbix trapper item
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// zabbixSend sends the values to the Zabbix server or proxy using the Zabbix sender protocol
+func zabbixSend(ctx context.Context, items []zabbixItem) error {
+	payload, err := json.Marshal(map[string]any{"request": "sender data", "data": items})
+	if err != nil {
+		return err
+	}
+	server := appConfig.Zabbix.Server
+	if _, _, err = net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "10051")
+	}
+	dialer := &net.Dialer{Timeout: notificationTimeout}
+	conn, err := dialer.DialContext(ctx, dialNetwork(), server)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Zabbix server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notificationTimeout))
+
+	header := make([]byte, 13)
+	copy(header, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(header[5:], uint64(len(payload)))
+	if _, err = conn.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("failed to send the values to the Zabbix server: %w", err)
+	}
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read the response of the Zabbix server: %w", err)
+	}
+	var response struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err = json.NewDecoder(io.LimitReader(conn, int64(binary.LittleEndian.Uint64(header[5:])))).Decode(&response); err != nil {
+		return fmt.Errorf("failed to read the response of the Zabbix server: %w", err)
+	}
+	if response.Response != "success" {
+		return fmt.Errorf("the Zabbix server rejected the values: %s", response.Info)
+	}
+	log.WithField("info", response.Info).Debug("Sent the values to Zabbix")
+	return nil
+}
+
+// zabbixHandler sends the results of the finished runs to the Zabbix trapper items
+func zabbixHandler(ctx context.Context, event any) {
+	finished, ok := event.(runFinishedEvent)
+	if !ok || appConfig.Zabbix.Server == "" {
+		return
+	}
+	host := appConfig.Zabbix.Host
+	if host == "" {
+		host = appConfig.HostName
+	}
+	s := finished.Summary
+	values := map[string]string{
+		"status":      s.Status,
+		"duration":    strconv.FormatFloat(s.Duration.Seconds(), 'f', 0, 64),
+		"bytes_added": strconv.FormatInt(s.BytesAdded, 10),
+		"warnings":    strconv.Itoa(s.warningCount()),
+	}
+	if !s.LastSuccess.IsZero() {
+		values["last_success"] = strconv.FormatInt(s.LastSuccess.Unix(), 10)
+	}
+	var items []zabbixItem
+	for key, value := range values {
+		items = append(items, zabbixItem{Host: host, Key: appConfig.Zabbix.KeyPrefix + "." + key, Value: value})
+	}
+	if err := zabbixSend(ctx, items); err != nil {
+		log.WithField("err", err).Error("cannot send the backup status to Zabbix")
+	}
+}
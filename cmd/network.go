@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyEnv returns the proxy environment variables passed to restic, overriding the ones of the environment
+func proxyEnv() []string {
+	var env []string
+	for _, proxy := range []struct{ name, value string }{
+		{"HTTP_PROXY", appConfig.Network.HTTPProxy},
+		{"HTTPS_PROXY", appConfig.Network.HTTPSProxy},
+		{"NO_PROXY", appConfig.Network.NoProxy},
+	} {
+		if proxy.value != "" {
+			env = append(env, proxy.name+"="+proxy.value)
+		}
+	}
+	return env
+}
+
+// caBundleArgs returns the restic arguments trusting the custom CA bundle
+func caBundleArgs() []string {
+	if appConfig.Network.CABundle == "" {
+		return nil
+	}
+	return []string{"--cacert", expandPath(appConfig.Network.CABundle)}
+}
+
+// proxyFunc returns the proxy of a request, using the configured proxies and falling back to the environment
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if appConfig.Network.HTTPProxy != "" {
+		cfg.HTTPProxy = appConfig.Network.HTTPProxy
+	}
+	if appConfig.Network.HTTPSProxy != "" {
+		cfg.HTTPSProxy = appConfig.Network.HTTPSProxy
+	}
+	if appConfig.Network.NoProxy != "" {
+		cfg.NoProxy = appConfig.Network.NoProxy
+	}
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// endpointProxy returns the proxy restic connects to the "host:port" endpoint through, or nil if it connects directly
+func endpointProxy(endpoint string) *url.URL {
+	scheme := "https"
+	switch _, port, _ := net.SplitHostPort(endpoint); port {
+	case "22":
+		// SFTP does not go through HTTP proxies
+		return nil
+	case "80":
+		scheme = "http"
+	}
+	proxy, err := proxyFunc()(&http.Request{URL: &url.URL{Scheme: scheme, Host: endpoint}})
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
+
+// tlsConfig returns the TLS configuration trusting the system CAs and the custom CA bundle
+func tlsConfig() *tls.Config {
+	if appConfig.Network.CABundle == "" {
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(expandPath(appConfig.Network.CABundle))
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificates found")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"ca_bundle": appConfig.Network.CABundle,
+			"err":       err,
+		}).Error("cannot load the CA bundle, using the system CAs")
+		return nil
+	}
+	return &tls.Config{RootCAs: pool}
+}
+
+// configureTransport makes the transport use the configured proxies, CA bundle and address family
+func configureTransport(transport *http.Transport) {
+	transport.Proxy = proxyFunc()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, dialNetwork(), addr)
+	}
+	if tlsConfig := tlsConfig(); tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+}
+
+// newHTTPClient returns the HTTP client of the program, using the configured proxies and CA bundle
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	configureTransport(transport)
+	return &http.Client{Timeout: timeout, Transport: debugRoundTripper(transport)}
+}
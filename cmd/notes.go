@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// snapshotNotes maps the original snapshot IDs to their notes
+type snapshotNotes map[string]string
+
+// notesPath returns the path of the snapshot notes index
+func notesPath() string {
+	return filepath.Join(appConfig.BackupDir, appConfig.NotesFile)
+}
+
+// loadNotes reads the snapshot notes index, returning an empty index if it does not exist yet
+func loadNotes() (snapshotNotes, error) {
+	notes := snapshotNotes{}
+	data, err := os.ReadFile(notesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return notes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot notes: %w", err)
+	}
+	if err = json.Unmarshal(data, &notes); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot notes: %w", err)
+	}
+	return notes, nil
+}
+
+// save writes the snapshot notes index
+func (n snapshotNotes) save() error {
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot notes: %w", err)
+	}
+	if err = os.WriteFile(notesPath(), data, 0o600); err != nil {
+		return fmt.Errorf("failed to write snapshot notes: %w", err)
+	}
+	return nil
+}
+
+// note returns the note of the snapshot
+func (n snapshotNotes) note(s snapshot) string {
+	return n[s.originalID()]
+}
+
+// setNote attaches the note to the snapshot, removing the note when it is empty
+func setNote(ctx context.Context, id, note string) error {
+	snapshots, err := listSnapshots(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) != 1 {
+		return fmt.Errorf("snapshot %s not found", id)
+	}
+	notes, err := loadNotes()
+	if err != nil {
+		return err
+	}
+	if note == "" {
+		delete(notes, snapshots[0].originalID())
+	} else {
+		notes[snapshots[0].originalID()] = note
+	}
+	return notes.save()
+}
+
+// newNoteCmd returns the command attaching notes to snapshots
+func newNoteCmd() *cobra.Command {
+	var remove bool
+	cmd := &cobra.Command{
+		Use:   "note <snapshot-id> [note]",
+		Short: "Attach a note to a snapshot, e.g. \"before macOS upgrade\"",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			note := ""
+			switch {
+			case remove && len(args) == 2:
+				return errors.New("a note cannot be given with --remove")
+			case !remove && len(args) == 1:
+				return errors.New("the note is missing")
+			case !remove:
+				note = args[1]
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			setupEnv()
+			return setNote(ctx, args[0], note)
+		},
+	}
+	cmd.Flags().BoolVar(&remove, "remove", false, "remove the note of the snapshot")
+	return cmd
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notificationTimeout is the timeout of HTTP requests sent by notifiers
+const notificationTimeout = 30 * time.Second
+
+// message is a rendered notification message
+type message struct {
+	Title string
+	Body  string
+}
+
+// notifier sends run summaries to an external service
+type notifier interface {
+	// Name returns the name of the notifier used in logs
+	Name() string
+	// Notify sends the run summary rendered as the message
+	Notify(ctx context.Context, summary *runSummary, msg message) error
+}
+
+// channel is a notifier with its message templates
+type channel struct {
+	notifier
+	templates MessageTemplates
+	// always is set for channels tracking the status (incidents, MQTT), which receive every run
+	// regardless of the notification schedule
+	always bool
+}
+
+// setupNotifiers returns the notification channels enabled in the configuration
+func setupNotifiers() []channel {
+	var notifiers []channel
+	if appConfig.Notifications.SNS.TopicArn != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &snsNotifier{
+				topicArn: appConfig.Notifications.SNS.TopicArn,
+				region:   appConfig.Notifications.SNS.Region,
+			},
+			templates: appConfig.Notifications.SNS.MessageTemplates,
+		})
+	}
+	if appConfig.Notifications.PagerDuty.RoutingKey != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &pagerDutyNotifier{
+				routingKey: appConfig.Notifications.PagerDuty.RoutingKey,
+			},
+			templates: appConfig.Notifications.PagerDuty.MessageTemplates,
+			always:    true,
+		})
+	}
+	if appConfig.Notifications.Opsgenie.APIKey != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &opsgenieNotifier{
+				apiURL: appConfig.Notifications.Opsgenie.APIURL,
+				apiKey: appConfig.Notifications.Opsgenie.APIKey,
+			},
+			templates: appConfig.Notifications.Opsgenie.MessageTemplates,
+			always:    true,
+		})
+	}
+	if appConfig.Notifications.MQTT.Broker != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &mqttNotifier{
+				broker:          appConfig.Notifications.MQTT.Broker,
+				username:        appConfig.Notifications.MQTT.Username,
+				password:        appConfig.Notifications.MQTT.Password,
+				topicPrefix:     appConfig.Notifications.MQTT.TopicPrefix,
+				discovery:       appConfig.Notifications.MQTT.HomeAssistantDiscovery,
+				discoveryPrefix: appConfig.Notifications.MQTT.DiscoveryPrefix,
+			},
+			always: true,
+		})
+	}
+	if appConfig.Notifications.Ntfy.Topic != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &ntfyNotifier{
+				server: appConfig.Notifications.Ntfy.Server,
+				topic:  appConfig.Notifications.Ntfy.Topic,
+				token:  appConfig.Notifications.Ntfy.Token,
+			},
+			templates: appConfig.Notifications.Ntfy.MessageTemplates,
+		})
+	}
+	if appConfig.Notifications.Gotify.Server != "" {
+		notifiers = append(notifiers, channel{
+			notifier: &gotifyNotifier{
+				server: appConfig.Notifications.Gotify.Server,
+				token:  appConfig.Notifications.Gotify.Token,
+			},
+			templates: appConfig.Notifications.Gotify.MessageTemplates,
+		})
+	}
+	if len(appConfig.Notifications.Apprise.URLs) > 0 {
+		notifiers = append(notifiers, channel{
+			notifier: &appriseNotifier{
+				path: appConfig.Notifications.Apprise.Path,
+				urls: appConfig.Notifications.Apprise.URLs,
+			},
+			templates: appConfig.Notifications.Apprise.MessageTemplates,
+		})
+	}
+	return notifiers
+}
+
+// sendNotifications sends the run summary to all configured notifiers, following the notification schedule
+func sendNotifications(ctx context.Context, summary *runSummary, state *runState) {
+	now := time.Now()
+	action := scheduleNotification(summary, now)
+	channels := setupNotifiers()
+	for _, c := range channels {
+		if action != notifySend && !c.always {
+			continue
+		}
+		if err := c.Notify(ctx, summary, renderMessage(summary, c.templates)); err != nil {
+			log.WithFields(log.Fields{
+				"notifier": c.Name(),
+				"err":      err,
+			}).Error("cannot send the notification")
+			continue
+		}
+		log.WithField("notifier", c.Name()).Info("Sent the run summary")
+	}
+
+	digestChanged := false
+	if action == notifyQueue {
+		state.Digest = append(state.Digest, digestEntry{
+			StartedAt: summary.StartedAt,
+			Status:    summary.Status,
+			Text:      summary.text(),
+		})
+		digestChanged = true
+	}
+	if digestDue(state, now) {
+		sendDigest(ctx, channels, summary, state, now)
+		digestChanged = true
+	}
+	if digestChanged {
+		if err := state.save(); err != nil {
+			log.WithField("err", err).Error("cannot save the state")
+		}
+	}
+}
+
+// broadcastMessage sends the message to the message channels, skipping the channels tracking the status
+func broadcastMessage(ctx context.Context, channels []channel, summary *runSummary, msg message) {
+	for _, c := range channels {
+		if c.always {
+			continue
+		}
+		if err := c.Notify(ctx, summary, msg); err != nil {
+			log.WithFields(log.Fields{
+				"notifier": c.Name(),
+				"title":    msg.Title,
+				"err":      err,
+			}).Error("cannot send the message")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"notifier": c.Name(),
+			"title":    msg.Title,
+		}).Info("Sent the message")
+	}
+}
+
+// templateFuncs are the functions available in message templates
+var templateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+	"upper": strings.ToUpper,
+}
+
+// renderTemplate renders the Go template with the run summary as data
+func renderTemplate(name, text string, summary *runSummary) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+	var b strings.Builder
+	if err = tmpl.Execute(&b, summary); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// renderMessage renders the message of the run using the channel templates, falling back to
+// the global templates and then to the built-in message
+func renderMessage(summary *runSummary, templates MessageTemplates) message {
+	msg := message{Title: summary.subject(), Body: summary.text()}
+	render := func(name, channelText, globalText string, target *string) {
+		text := channelText
+		if text == "" {
+			text = globalText
+		}
+		if text == "" {
+			return
+		}
+		rendered, err := renderTemplate(name, text, summary)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"template": name,
+				"err":      err,
+			}).Error("cannot render the notification template, using the default message")
+			return
+		}
+		*target = rendered
+	}
+	render("title", templates.Title, appConfig.Notifications.Title, &msg.Title)
+	render("body", templates.Body, appConfig.Notifications.Body, &msg.Body)
+	return msg
+}
+
+// postJSON sends the payload encoded as JSON to the given URL
+func postJSON(ctx context.Context, url string, headers http.Header, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode the payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return sendRequest(req)
+}
+
+// sendRequest sends the HTTP request and checks the response status
+func sendRequest(req *http.Request) error {
+	client := newHTTPClient(notificationTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// appriseNotifier sends run summaries to Apprise notification URLs using the apprise command
+type appriseNotifier struct {
+	path string
+	urls []string
+}
+
+// Name returns the name of the notifier
+func (n *appriseNotifier) Name() string {
+	return "apprise"
+}
+
+// Notify sends the run summary to all the Apprise URLs
+func (n *appriseNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	notifyType := "success"
+	switch summary.Status {
+	case runStatusFailed:
+		notifyType = "failure"
+	case runStatusPartial, runStatusIncomplete:
+		notifyType = "warning"
+	}
+	args := append([]string{
+		"--title", msg.Title,
+		"--body", msg.Body,
+		"--notification-type", notifyType,
+	}, n.urls...)
+
+	cmd := exec.CommandContext(ctx, n.path, args...)
+	cmd.Env = append(os.Environ(), proxyEnv()...)
+	if appConfig.Network.CABundle != "" {
+		// Trusted by the Python requests library apprise is built on
+		cmd.Env = append(cmd.Env, "REQUESTS_CA_BUNDLE="+expandPath(appConfig.Network.CABundle))
+	}
+	// The URLs usually contain credentials, so they are not included in the error
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to execute apprise: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// incidentKey returns the key used to deduplicate incidents of the host and the profile, so the success of one
+// profile does not resolve the incident of another
+func incidentKey(summary *runSummary) string {
+	if activeProfile != "" {
+		return "restic_wrapper-" + summary.HostName + "-" + activeProfile
+	}
+	return "restic_wrapper-" + summary.HostName
+}
+
+// pagerDutyNotifier opens a PagerDuty incident when a run fails and resolves it on the next success
+type pagerDutyNotifier struct {
+	routingKey string
+}
+
+// Name returns the name of the notifier
+func (n *pagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+// Notify triggers or resolves the incident of the host using the Events API v2
+func (n *pagerDutyNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	event := map[string]any{
+		"routing_key": n.routingKey,
+		"dedup_key":   incidentKey(summary),
+	}
+	switch summary.Status {
+	case runStatusFailed:
+		event["event_action"] = "trigger"
+		event["payload"] = map[string]any{
+			"summary":        msg.Title,
+			"source":         summary.HostName,
+			"severity":       "error",
+			"custom_details": msg.Body,
+		}
+	case runStatusSuccess:
+		event["event_action"] = "resolve"
+	default:
+		return nil
+	}
+	return postJSON(ctx, pagerDutyEventsURL, nil, event)
+}
+
+// opsgenieNotifier opens an Opsgenie alert when a run fails and closes it on the next success
+type opsgenieNotifier struct {
+	apiURL string
+	apiKey string
+}
+
+// Name returns the name of the notifier
+func (n *opsgenieNotifier) Name() string {
+	return "opsgenie"
+}
+
+// Notify creates or closes the alert of the host using the Opsgenie Alert API
+func (n *opsgenieNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	headers := http.Header{"Authorization": []string{"GenieKey " + n.apiKey}}
+	alias := incidentKey(summary)
+	switch summary.Status {
+	case runStatusFailed:
+		return postJSON(ctx, n.apiURL+"/v2/alerts", headers, map[string]any{
+			"message":     msg.Title,
+			"alias":       alias,
+			"description": msg.Body,
+			"source":      summary.HostName,
+			"priority":    "P2",
+		})
+	case runStatusSuccess:
+		closeURL := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", n.apiURL, url.PathEscape(alias))
+		return postJSON(ctx, closeURL, headers, map[string]any{
+			"source": summary.HostName,
+			"note":   "The backup completed successfully",
+		})
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttSensor describes a value published to MQTT and its Home Assistant discovery attributes
+type mqttSensor struct {
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	value       func(summary *runSummary) string
+}
+
+// mqttSensors are the values of the run published to MQTT
+var mqttSensors = []mqttSensor{
+	{
+		key:   "status",
+		name:  "Backup status",
+		value: func(s *runSummary) string { return s.Status },
+	},
+	{
+		key:         "last_success",
+		name:        "Last successful backup",
+		deviceClass: "timestamp",
+		value: func(s *runSummary) string {
+			if s.LastSuccess.IsZero() {
+				return ""
+			}
+			return s.LastSuccess.Format(time.RFC3339)
+		},
+	},
+	{
+		key:         "bytes_added",
+		name:        "Backup data added",
+		deviceClass: "data_size",
+		unit:        "B",
+		value:       func(s *runSummary) string { return strconv.FormatInt(s.BytesAdded, 10) },
+	},
+	{
+		key:         "duration",
+		name:        "Backup duration",
+		deviceClass: "duration",
+		unit:        "s",
+		value:       func(s *runSummary) string { return strconv.Itoa(int(s.Duration.Seconds())) },
+	},
+}
+
+// mqttTopicReplacer replaces the characters that are not allowed in MQTT topic levels
+var mqttTopicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_")
+
+// mqttNotifier publishes the run status to an MQTT broker as retained messages
+type mqttNotifier struct {
+	broker          string
+	username        string
+	password        string
+	topicPrefix     string
+	discovery       bool
+	discoveryPrefix string
+}
+
+// Name returns the name of the notifier
+func (n *mqttNotifier) Name() string {
+	return "mqtt"
+}
+
+// Notify publishes the run status, and the Home Assistant discovery messages if enabled
+func (n *mqttNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	nodeID := "restic_wrapper_" + mqttTopicReplacer.Replace(summary.HostName)
+	opts := mqtt.NewClientOptions().
+		AddBroker(n.broker).
+		SetClientID(nodeID).
+		SetUsername(n.username).
+		SetPassword(n.password).
+		SetConnectTimeout(notificationTimeout)
+	if tlsConfig := tlsConfig(); tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	client := mqtt.NewClient(opts)
+	if err := waitMqttToken(ctx, client.Connect()); err != nil {
+		return fmt.Errorf("cannot connect to the MQTT broker: %w", err)
+	}
+	defer client.Disconnect(250)
+
+	stateTopic := n.topicPrefix + "/" + mqttTopicReplacer.Replace(summary.HostName)
+	for _, sensor := range mqttSensors {
+		topic := stateTopic + "/" + sensor.key
+		if n.discovery {
+			config, err := json.Marshal(map[string]any{
+				"name":                sensor.name,
+				"state_topic":         topic,
+				"unique_id":           nodeID + "_" + sensor.key,
+				"device_class":        sensor.deviceClass,
+				"unit_of_measurement": sensor.unit,
+				"device": map[string]any{
+					"identifiers": []string{nodeID},
+					"name":        "restic backup " + summary.HostName,
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to encode the discovery message: %w", err)
+			}
+			discoveryTopic := fmt.Sprintf("%s/sensor/%s/%s/config", n.discoveryPrefix, nodeID, sensor.key)
+			if err = waitMqttToken(ctx, client.Publish(discoveryTopic, 1, true, config)); err != nil {
+				return fmt.Errorf("cannot publish to %s: %w", discoveryTopic, err)
+			}
+		}
+		if err := waitMqttToken(ctx, client.Publish(topic, 1, true, sensor.value(summary))); err != nil {
+			return fmt.Errorf("cannot publish to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// waitMqttToken waits for the MQTT operation to complete or the context to be done
+func waitMqttToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return errors.Join(errors.New("MQTT operation timed out"), ctx.Err())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ntfyNotifier sends run summaries to an ntfy topic
+type ntfyNotifier struct {
+	server string
+	topic  string
+	token  string
+}
+
+// Name returns the name of the notifier
+func (n *ntfyNotifier) Name() string {
+	return "ntfy"
+}
+
+// Notify publishes the run summary to the ntfy topic
+func (n *ntfyNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	topicURL := strings.TrimRight(n.server, "/") + "/" + url.PathEscape(n.topic)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, topicURL, strings.NewReader(msg.Body))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Title", msg.Title)
+	if summary.Status == runStatusFailed {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return sendRequest(req)
+}
+
+// gotifyNotifier sends run summaries to a Gotify server
+type gotifyNotifier struct {
+	server string
+	token  string
+}
+
+// Name returns the name of the notifier
+func (n *gotifyNotifier) Name() string {
+	return "gotify"
+}
+
+// Notify sends the run summary as a Gotify message
+func (n *gotifyNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	priority := 5
+	if summary.Status == runStatusFailed {
+		priority = 8
+	}
+	headers := http.Header{"X-Gotify-Key": []string{n.token}}
+	return postJSON(ctx, strings.TrimRight(n.server, "/")+"/message", headers, map[string]any{
+		"title":    msg.Title,
+		"message":  msg.Body,
+		"priority": priority,
+	})
+}
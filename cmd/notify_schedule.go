@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notificationAction is what happens to the notification of a run
+type notificationAction int
+
+const (
+	notifySend notificationAction = iota
+	notifyQueue
+	notifyDrop
+)
+
+// digestEntry is a notification queued for the digest
+type digestEntry struct {
+	StartedAt time.Time `json:"started_at"`
+	Status    string    `json:"status"`
+	Text      string    `json:"text"`
+}
+
+// scheduleNotification decides whether the notification of the run is sent now, queued for the digest
+// or dropped. Failures are always sent.
+func scheduleNotification(summary *runSummary, now time.Time) notificationAction {
+	switch {
+	case summary.Status == runStatusFailed:
+		return notifySend
+	case summary.Status == runStatusSuccess && !appConfig.Notifications.OnSuccess && summary.PruneSkipped == "" && len(summary.Guardrails) == 0:
+		return notifyDrop
+	case appConfig.Notifications.Digest || inQuietHours(now):
+		return notifyQueue
+	}
+	return notifySend
+}
+
+// inQuietHours reports whether now is within the configured quiet hours
+func inQuietHours(now time.Time) bool {
+	quiet := appConfig.Notifications.QuietHours
+	if quiet.Start == "" || quiet.End == "" {
+		return false
+	}
+	start, err := clockTime(now, quiet.Start)
+	if err != nil {
+		log.WithField("err", err).Error("cannot parse the start of the quiet hours")
+		return false
+	}
+	end, err := clockTime(now, quiet.End)
+	if err != nil {
+		log.WithField("err", err).Error("cannot parse the end of the quiet hours")
+		return false
+	}
+	if start.Before(end) {
+		return !now.Before(start) && now.Before(end)
+	}
+	// The quiet hours span midnight
+	return !now.Before(start) || now.Before(end)
+}
+
+// digestDue reports whether the queued notifications should be sent as a digest now
+func digestDue(state *runState, now time.Time) bool {
+	if len(state.Digest) == 0 || inQuietHours(now) {
+		return false
+	}
+	if !appConfig.Notifications.Digest {
+		// Notifications were only queued for the quiet hours
+		return true
+	}
+	due, err := clockTime(now, appConfig.Notifications.DigestTime)
+	if err != nil {
+		log.WithField("err", err).Error("cannot parse the digest time")
+		return false
+	}
+	return !now.Before(due) && state.LastDigest.Before(due)
+}
+
+// digestMessage combines the queued notifications into a single message
+func digestMessage(hostName string, entries []digestEntry) message {
+	var b strings.Builder
+	for i, entry := range entries {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "--- %s: %s\n%s", entry.StartedAt.Format(time.RFC3339), entry.Status, entry.Text)
+	}
+	return message{
+		Title: fmt.Sprintf("restic backup digest on %s: %d runs", hostName, len(entries)),
+		Body:  b.String(),
+	}
+}
+
+// sendDigest sends the queued notifications to the message channels and clears the queue
+func sendDigest(ctx context.Context, channels []channel, summary *runSummary, state *runState, now time.Time) {
+	broadcastMessage(ctx, channels, summary, digestMessage(summary.HostName, state.Digest))
+	state.Digest = nil
+	state.LastDigest = now
+}
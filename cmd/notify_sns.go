@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// snsSubjectLimit is the maximum length of an SNS message subject
+const snsSubjectLimit = 100
+
+// snsNotifier publishes run summaries to an AWS SNS topic
+type snsNotifier struct {
+	topicArn string
+	region   string
+}
+
+// Name returns the name of the notifier
+func (n *snsNotifier) Name() string {
+	return "sns"
+}
+
+// Notify publishes the run summary to the SNS topic
+func (n *snsNotifier) Notify(ctx context.Context, summary *runSummary, msg message) error {
+	var optFns []func(*config.LoadOptions) error
+	if n.region != "" {
+		optFns = append(optFns, config.WithRegion(n.region))
+	}
+	cfg, err := loadMonitoringAwsConfig(ctx, optFns...)
+	if err != nil {
+		return fmt.Errorf("cannot load AWS SDK config: %w", err)
+	}
+
+	subject := msg.Title
+	if len(subject) > snsSubjectLimit {
+		subject = subject[:snsSubjectLimit]
+	}
+	_, err = sns.NewFromConfig(cfg).Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.topicArn),
+		Subject:  aws.String(subject),
+		Message:  aws.String(msg.Body),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot publish to SNS topic: %w", err)
+	}
+	return nil
+}
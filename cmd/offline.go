@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// repositoryEndpoint returns the "host:port" address restic connects to for the repository,
+// or an empty string for local repositories and backends the reachability is not checked for
+func repositoryEndpoint(repository string) string {
+	backend, location, found := strings.Cut(repository, ":")
+	if !found {
+		return ""
+	}
+	switch backend {
+	case "s3", "rest":
+		// e.g. "s3:https://s3.amazonaws.com/bucket", "s3:s3.amazonaws.com/bucket" or "rest:http://host:8000/"
+		if !strings.Contains(location, "://") {
+			location = "https://" + location
+		}
+		return urlEndpoint(location)
+	case "sftp":
+		// e.g. "sftp://user@host:2222/path" or "sftp:user@host:/path"
+		if strings.HasPrefix(location, "//") {
+			return urlEndpoint("sftp:" + location)
+		}
+		host, _, _ := strings.Cut(location, ":")
+		if _, after, found := strings.Cut(host, "@"); found {
+			host = after
+		}
+		return net.JoinHostPort(host, "22")
+	case "b2":
+		return "api.backblazeb2.com:443"
+	case "gs":
+		return "storage.googleapis.com:443"
+	case "azure":
+		if account := os.Getenv("AZURE_ACCOUNT_NAME"); account != "" {
+			return account + ".blob.core.windows.net:443"
+		}
+	}
+	return ""
+}
+
+// urlEndpoint returns the "host:port" address of the URL, using the default port of its scheme
+func urlEndpoint(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	ports := map[string]string{"http": "80", "https": "443", "sftp": "22"}
+	return net.JoinHostPort(u.Hostname(), ports[u.Scheme])
+}
+
+// dialEndpoint opens a TCP connection to the endpoint to check that it is reachable
+func dialEndpoint(ctx context.Context, endpoint string) error {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, dialNetwork(), endpoint)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// waitForRepository checks that the repository endpoint is reachable, retrying with an exponential backoff
+// for up to offline.retry_for
+func waitForRepository(ctx context.Context, endpoint string) error {
+	deadline := time.Now().Add(appConfig.Offline.RetryFor)
+	delay := appConfig.Offline.RetryInterval
+	for {
+		err := dialEndpoint(ctx, endpoint)
+		if err == nil {
+			return nil
+		}
+		if delay <= 0 || time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("the repository endpoint %s is unreachable: %w", endpoint, err)
+		}
+		log.WithFields(log.Fields{
+			"endpoint": endpoint,
+			"retry_in": delay,
+			"err":      err,
+		}).Info("The repository is unreachable, waiting for the network")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the repository endpoint %s is unreachable: %w", endpoint, err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// deferRun records that the backup was deferred because the repository is unreachable and
+// returns how long the backups have been deferred
+func (s *runState) deferRun(now time.Time, reason string) time.Duration {
+	if s.DeferredSince.IsZero() {
+		s.DeferredSince = now
+	}
+	s.DeferReason = reason
+	if err := s.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the state")
+	}
+	return now.Sub(s.DeferredSince)
+}
+
+// checkConnectivity checks that the repository is reachable before the backup. When it is not, the run is
+// deferred to the next scheduled run and false is returned. A failure is only reported once the backups
+// have been deferred for longer than offline.max_deferral.
+func checkConnectivity(ctx context.Context, state *runState, startTime time.Time) bool {
+	if !appConfig.Offline.Enabled {
+		return true
+	}
+	endpoint := repositoryEndpoint(os.Getenv("RESTIC_REPOSITORY"))
+	if endpoint == "" {
+		return true
+	}
+	// Behind a proxy only the proxy has to be reachable
+	if proxy := endpointProxy(endpoint); proxy != nil {
+		endpoint = urlEndpoint(proxy.String())
+	}
+	err := waitForRepository(ctx, endpoint)
+	if err == nil {
+		return true
+	}
+	deferred := state.deferRun(time.Now(), err.Error())
+	if deferred <= appConfig.Offline.MaxDeferral || state.DeferralReported {
+		log.WithFields(log.Fields{
+			"err":            err,
+			"deferred_since": state.DeferredSince,
+		}).Info("The repository is unreachable, the backup is deferred to the next run")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"err":            err,
+		"deferred_since": state.DeferredSince,
+	}).Error("The repository has been unreachable for too long")
+	reportCtx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	sendNotifications(reportCtx, &runSummary{
+		HostName:    appConfig.HostName,
+		StartedAt:   startTime,
+		Status:      runStatusFailed,
+		Duration:    time.Since(startTime),
+		Error:       err.Error(),
+		LastSuccess: state.LastSuccess,
+
+		DeferredSince: state.DeferredSince,
+	}, state)
+	state.DeferralReported = true
+	if err = state.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the state")
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// passwordSourceConfigured reports whether restic reads the repository password itself, from secrets.password_command
+// or secrets.password_file, instead of the password being passed in the environment
+func passwordSourceConfigured() bool {
+	return appConfig.Secrets.PasswordCommand != "" || appConfig.Secrets.PasswordFile != ""
+}
+
+// passwordSourceEnv returns the environment variables of the configured password command or file, with the prefix
+// of the repository, e.g. "RESTIC_" or "RESTIC_FROM_"
+func passwordSourceEnv(prefix string) []string {
+	switch {
+	case appConfig.Secrets.PasswordCommand != "":
+		return []string{prefix + "PASSWORD_COMMAND=" + appConfig.Secrets.PasswordCommand}
+	case appConfig.Secrets.PasswordFile != "":
+		return []string{prefix + "PASSWORD_FILE=" + expandPath(appConfig.Secrets.PasswordFile)}
+	}
+	return nil
+}
+
+// setupPasswordSource passes the configured password command or file to restic
+func setupPasswordSource() {
+	if appConfig.Secrets.PasswordCommand != "" && appConfig.Secrets.PasswordFile != "" {
+		log.Fatal("secrets.password_command and secrets.password_file are mutually exclusive")
+	}
+	if appConfig.Secrets.PasswordFile != "" {
+		if _, err := os.Stat(expandPath(appConfig.Secrets.PasswordFile)); err != nil {
+			log.WithField("err", err).Fatal("cannot read the password file")
+		}
+	}
+	setPasswordSourceEnv()
+}
+
+// setPasswordSourceEnv sets the environment variables of the configured password command or file
+func setPasswordSourceEnv() {
+	for _, env := range passwordSourceEnv("RESTIC_") {
+		name, value, _ := strings.Cut(env, "=")
+		os.Setenv(name, value)
+	}
+}
+
+// promptPassword asks for the repository password on the terminal when it is missing, or always when force is set,
+// e.g. to restore from a repository whose password is not stored on the machine
+func promptPassword(force bool) error {
+	if !force && (passwordSourceConfigured() || os.Getenv("RESTIC_PASSWORD") != "") {
+		return nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		if force {
+			return errors.New("cannot ask for the password, the standard input is not a terminal")
+		}
+		// restic reports the missing password
+		return nil
+	}
+	fmt.Fprint(os.Stderr, "Enter the repository password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to read the password: %w", err)
+	}
+	if len(password) == 0 {
+		return errors.New("empty password")
+	}
+	os.Setenv("RESTIC_PASSWORD", string(password))
+	// The password typed in takes precedence over the configured command or file
+	os.Unsetenv("RESTIC_PASSWORD_COMMAND")
+	os.Unsetenv("RESTIC_PASSWORD_FILE")
+	return nil
+}
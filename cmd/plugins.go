@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hook points the plugins are called at
+const (
+	hookPre       = "pre"
+	hookPost      = "post"
+	hookOnError   = "on-error"
+	hookOnSummary = "on-summary"
+)
+
+// pluginStage is a stage of the run as passed to the plugins
+type pluginStage struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// pluginEvent is the JSON document the plugins receive on the standard input
+type pluginEvent struct {
+	Hook     string    `json:"hook"`
+	Host     string    `json:"host"`
+	Profile  string    `json:"profile,omitempty"`
+	Time     time.Time `json:"time"`
+	Recovery string    `json:"recovery,omitempty"`
+	// Stage is the stage that completed (post) or failed (on-error)
+	Stage *pluginStage `json:"stage,omitempty"`
+
+	Status          string        `json:"status,omitempty"`
+	StartedAt       *time.Time    `json:"started_at,omitempty"`
+	Duration        float64       `json:"duration_seconds,omitempty"`
+	SnapshotID      string        `json:"snapshot_id,omitempty"`
+	BytesAdded      int64         `json:"bytes_added,omitempty"`
+	Warnings        int           `json:"warnings,omitempty"`
+	PruneFreedBytes int64         `json:"prune_freed_bytes,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	Stages          []pluginStage `json:"stages,omitempty"`
+	Text            string        `json:"text,omitempty"`
+}
+
+// newPluginStage converts the stage result for the plugins
+func newPluginStage(stage stageResult) *pluginStage {
+	s := &pluginStage{Name: stage.Name, Duration: stage.Duration.Seconds()}
+	if stage.Err != nil {
+		s.Error = stage.Err.Error()
+	}
+	return s
+}
+
+// pluginsDir returns the directory holding the plugin executables
+func pluginsDir() string {
+	dir := expandPath(appConfig.Plugins.Dir)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(appConfig.BackupDir, dir)
+	}
+	return dir
+}
+
+// pluginExecutables returns the executable files in the plugins directory in name order
+func pluginExecutables() []string {
+	entries, err := os.ReadDir(pluginsDir())
+	if err != nil {
+		return nil
+	}
+	var plugins []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		plugins = append(plugins, filepath.Join(pluginsDir(), entry.Name()))
+	}
+	sort.Strings(plugins)
+	return plugins
+}
+
+// runPlugins passes the event to every plugin. The plugins get the hook name as their argument and the event
+// as JSON on the standard input, and run in the sandbox of the hooks. A failing plugin is logged and does not affect
+// the run.
+func runPlugins(ctx context.Context, event pluginEvent) {
+	plugins := pluginExecutables()
+	if len(plugins) == 0 {
+		return
+	}
+	event.Host = appConfig.HostName
+	event.Profile = activeProfile
+	event.Time = time.Now()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.WithField("err", err).Error("cannot encode the plugin event")
+		return
+	}
+	for _, plugin := range plugins {
+		// The plugins also run when the run was interrupted
+		pluginCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), appConfig.Plugins.Timeout)
+		fields := log.Fields{"plugin": filepath.Base(plugin), "hook": event.Hook}
+		cmd, output, cleanup, err := hookCommand(pluginCtx, plugin, event.Hook)
+		if err == nil {
+			cmd.Stdin = bytes.NewReader(payload)
+			err = cmd.Run()
+			cleanup()
+		}
+		cancel()
+		if err != nil {
+			fields["err"] = err
+			if output != nil {
+				fields["output"] = output.String()
+			}
+			log.WithFields(fields).Error("The plugin failed")
+			continue
+		}
+		if output.Len() > 0 {
+			fields["output"] = output.String()
+		}
+		log.WithFields(fields).Info("Ran the plugin")
+	}
+}
+
+// pluginHandler calls the plugins at the hook points of the run events
+func pluginHandler(ctx context.Context, event any) {
+	switch e := event.(type) {
+	case runStartedEvent:
+		runPlugins(ctx, pluginEvent{Hook: hookPre, StartedAt: &e.StartedAt, Recovery: e.Recovery})
+	case stageCompletedEvent:
+		if e.Stage.Err != nil {
+			runPlugins(ctx, pluginEvent{Hook: hookOnError, Stage: newPluginStage(e.Stage)})
+		} else if e.Stage.Name == "backup" {
+			runPlugins(ctx, pluginEvent{Hook: hookPost, Stage: newPluginStage(e.Stage)})
+		}
+	case runFinishedEvent:
+		s := e.Summary
+		summary := pluginEvent{
+			Hook:            hookOnSummary,
+			Recovery:        s.Recovery,
+			Status:          s.Status,
+			StartedAt:       &s.StartedAt,
+			Duration:        s.Duration.Seconds(),
+			SnapshotID:      s.SnapshotID,
+			BytesAdded:      s.BytesAdded,
+			Warnings:        s.warningCount(),
+			PruneFreedBytes: s.PruneFreedBytes,
+			Error:           s.Error,
+			Text:            s.text(),
+		}
+		for _, stage := range s.Stages {
+			summary.Stages = append(summary.Stages, *newPluginStage(stage))
+		}
+		runPlugins(ctx, summary)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// preventSleep keeps the system from sleeping while idle until the returned function is called, so a scheduled run
+// isn't cut in half when the user walks away. macOS gets a caffeinate power assertion, Linux a systemd-logind idle
+// inhibitor. Closing the lid still sleeps, which is handled by sleep_grace_period.
+func preventSleep() func() {
+	if !appConfig.PreventSleep || inContainer() {
+		return func() {}
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// The assertion is released when the program exits, even if it crashes
+		cmd = exec.Command("caffeinate", "-i", "-w", strconv.Itoa(os.Getpid()))
+	case "linux":
+		// The inhibitor is released when its command exits, which it does when its standard input is closed. It only
+		// holds back the idle action: blocking sleep would also refuse the explicit suspends and lid closes, which
+		// the sleep_grace_period delay inhibitor handles.
+		cmd = exec.Command("systemd-inhibit", "--what=idle", "--mode=block", "--who=restic_wrapper",
+			"--why=Backup in progress", "cat")
+	default:
+		return func() {}
+	}
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": cmd.Path, "err": err}).Warn("cannot prevent the system from sleeping during the backup")
+		return func() {}
+	}
+	return func() {
+		stdin.Close()
+		if runtime.GOOS == "darwin" {
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+	}
+}
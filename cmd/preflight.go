@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tccProtectedPaths are readable only by processes with Full Disk Access
+var tccProtectedPaths = []string{
+	"~/Library/Application Support/com.apple.TCC/TCC.db",
+	"~/Library/Mail",
+	"~/Library/Safari",
+	"~/Library/Messages",
+}
+
+// hasFullDiskAccess reports whether the process can read the paths protected by macOS privacy controls (TCC).
+// Without Full Disk Access restic silently skips them, e.g. the Mail and Photos data.
+func hasFullDiskAccess() (bool, string) {
+	for _, path := range tccProtectedPaths {
+		path = expandPath(path)
+		file, err := os.Open(path)
+		if err == nil {
+			// Directories can be opened, only listing them is denied
+			_, err = file.Readdirnames(1)
+			file.Close()
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			return false, path
+		}
+	}
+	return true, ""
+}
+
+// checkFullDiskAccess logs instructions to grant Full Disk Access and returns false when it is missing
+func checkFullDiskAccess() bool {
+	ok, path := hasFullDiskAccess()
+	if ok {
+		return true
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "restic_wrapper"
+	}
+	log.WithFields(log.Fields{
+		"path":       path,
+		"executable": executable,
+	}).Error("The program has no Full Disk Access, the snapshots would miss protected data such as Mail and Photos. " +
+		"Open System Settings > Privacy & Security > Full Disk Access, add the executable and restic, " +
+		"then run the backup again. Set require_full_disk_access to false to back up without it.")
+	return false
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// excludePreset is a built-in exclude list selected with the preset setting
+type excludePreset struct {
+	description string
+	// patterns follow the restic exclude syntax, a leading "~/" is the home directory
+	patterns []string
+}
+
+// excludePresets are the built-in exclude lists by name
+var excludePresets = map[string]excludePreset{
+	"macos-home": {
+		description: "Caches, logs and indexes macOS and the apps rebuild by themselves",
+		patterns: []string{
+			"~/.Trash",
+			"~/.cache",
+			"~/Library/Caches",
+			"~/Library/Logs",
+			"~/Library/Saved Application State",
+			"~/Library/HTTPStorages",
+			"~/Library/WebKit",
+			"~/Library/Biome",
+			"~/Library/DuetExpertCenter",
+			"~/Library/Trial",
+			"~/Library/Suggestions",
+			"~/Library/Daemon Containers",
+			"~/Library/Metadata/CoreSpotlight",
+			"~/Library/Metadata/com.apple.IntelligentSuggestions",
+			"~/Library/Calendars/Calendar Cache",
+			"~/Library/Application Support/CrashReporter",
+			"~/Library/Application Support/**/Cache",
+			"~/Library/Application Support/**/Caches",
+			"~/Library/Application Support/**/Code Cache",
+			"~/Library/Application Support/**/GPUCache",
+			"~/Library/Application Support/**/ShaderCache",
+			"~/Library/Application Support/**/CacheStorage",
+			"~/Library/Application Support/Code/CachedData",
+			"~/Library/Application Support/Code/CachedExtensionVSIXs",
+			"~/Library/Application Support/Spotify/PersistentCache",
+			"~/Library/Containers/*/Data/Library/Caches",
+			"~/Library/Containers/*/Data/Library/Logs",
+			"~/Library/Containers/com.docker.docker/Data/vms",
+			"~/Library/Group Containers/*/Library/Caches",
+			"~/Library/Group Containers/*/Library/Logs",
+			"~/Library/Developer/Xcode/DerivedData",
+			"~/Library/Developer/Xcode/iOS DeviceSupport",
+			"~/Library/Developer/CoreSimulator/Caches",
+			"~/Library/Developer/CoreSimulator/Devices/*/data/Library/Caches",
+			"*.photoslibrary/resources/derivatives",
+			"*.photoslibrary/database/search",
+			".DS_Store",
+			".fseventsd",
+			".Spotlight-V100",
+			".DocumentRevisions-V100",
+			".TemporaryItems",
+			".Trashes",
+		},
+	},
+	"linux-home": {
+		description: "Caches, thumbnails, trash and search indexes of the Linux desktops",
+		patterns: []string{
+			"~/.cache",
+			"~/.thumbnails",
+			"~/.local/share/Trash",
+			"~/.local/share/baloo",
+			"~/.local/share/tracker",
+			"~/.local/share/gvfs-metadata",
+			"~/.local/share/containers/storage",
+			"~/.local/share/Steam/steamapps",
+			"~/.steam",
+			"~/.var/app/*/cache",
+			"~/snap/*/*/.cache",
+			"~/.config/**/Cache",
+			"~/.config/**/Code Cache",
+			"~/.config/**/GPUCache",
+			"~/.config/**/CacheStorage",
+			"~/.xsession-errors*",
+			"~/.gvfs",
+			".Trash-*",
+		},
+	},
+	"developer-node": {
+		description: "Node.js dependencies, package manager caches and build caches",
+		patterns: []string{
+			"node_modules",
+			"bower_components",
+			"~/.npm/_cacache",
+			"~/.pnpm-store",
+			"~/.yarn/berry/cache",
+			".next",
+			".nuxt",
+			".svelte-kit",
+			".parcel-cache",
+			".turbo",
+		},
+	},
+	"developer-python": {
+		description: "Python bytecode, virtual environments and tool caches",
+		patterns: []string{
+			"__pycache__",
+			"*.pyc",
+			".venv",
+			".tox",
+			".nox",
+			".eggs",
+			"*.egg-info",
+			".mypy_cache",
+			".pytest_cache",
+			".ruff_cache",
+			".ipynb_checkpoints",
+			"~/.pyenv/versions",
+		},
+	},
+	"docker-host": {
+		description: "Docker and containerd images, layers and container logs, back up the volumes instead",
+		patterns: []string{
+			"/var/lib/docker/overlay2",
+			"/var/lib/docker/image",
+			"/var/lib/docker/buildkit",
+			"/var/lib/docker/tmp",
+			"/var/lib/docker/containers/*/*-json.log*",
+			"/var/lib/containerd",
+		},
+	},
+}
+
+// appSettingsPreset is the settings of an application added to the backup sources with the app_settings setting
+type appSettingsPreset struct {
+	description string
+	// paths are added to the backup sources when they exist, a leading "~/" is the home directory
+	paths []string
+	// excludes are the caches within the paths, in the restic exclude syntax
+	excludes []string
+}
+
+// appSettingsPresets are the built-in application settings by name
+var appSettingsPresets = map[string]appSettingsPreset{
+	"dotfiles": {
+		description: "The shell, git, tmux and editor configuration files in the home directory",
+		paths: []string{
+			"~/.zshrc", "~/.zprofile", "~/.zshenv", "~/.bashrc", "~/.bash_profile", "~/.profile",
+			"~/.gitconfig", "~/.gitignore_global", "~/.config/git", "~/.tmux.conf", "~/.vimrc", "~/.config/nvim",
+			"~/.config/fish", "~/.config/starship.toml",
+		},
+	},
+	"vscode": {
+		description: "Visual Studio Code settings, keybindings and snippets",
+		paths:       []string{"~/Library/Application Support/Code/User", "~/.config/Code/User"},
+		excludes: []string{
+			"~/Library/Application Support/Code/User/workspaceStorage",
+			"~/Library/Application Support/Code/User/globalStorage/*/cache",
+			"~/.config/Code/User/workspaceStorage",
+			"~/.config/Code/User/globalStorage/*/cache",
+		},
+	},
+	"jetbrains": {
+		description: "JetBrains IDE settings, without the IDEs installed by the Toolbox",
+		paths:       []string{"~/Library/Application Support/JetBrains", "~/.config/JetBrains"},
+		excludes: []string{
+			"~/Library/Application Support/JetBrains/Toolbox/apps",
+			"~/Library/Application Support/JetBrains/*/plugins",
+			"~/.config/JetBrains/*/plugins",
+		},
+	},
+	"sublime-text": {
+		description: "Sublime Text user settings and packages",
+		paths:       []string{"~/Library/Application Support/Sublime Text/Packages/User", "~/.config/sublime-text/Packages/User"},
+	},
+	"iterm2": {
+		description: "iTerm2 preferences, dynamic profiles and scripts",
+		paths:       []string{"~/Library/Preferences/com.googlecode.iterm2.plist", "~/Library/Application Support/iTerm2"},
+		excludes:    []string{"~/Library/Application Support/iTerm2/SavedState", "~/Library/Application Support/iTerm2/iterm2env*"},
+	},
+	"terminal": {
+		description: "macOS Terminal profiles",
+		paths:       []string{"~/Library/Preferences/com.apple.Terminal.plist"},
+	},
+	"finder": {
+		description: "Finder, Dock and sidebar preferences",
+		paths: []string{
+			"~/Library/Preferences/com.apple.finder.plist",
+			"~/Library/Preferences/com.apple.dock.plist",
+			"~/Library/Application Support/com.apple.sharedfilelist",
+		},
+	},
+	"safari": {
+		description: "Safari bookmarks, history and extensions settings, Full Disk Access required",
+		paths:       []string{"~/Library/Safari"},
+		excludes:    []string{"~/Library/Safari/Favicon Cache", "~/Library/Safari/Touch Icons Cache", "~/Library/Safari/Template Icons"},
+	},
+	"firefox": {
+		description: "Firefox profiles: bookmarks, history, passwords and extensions",
+		paths:       []string{"~/Library/Application Support/Firefox", "~/.mozilla/firefox"},
+		excludes: []string{
+			"~/Library/Application Support/Firefox/Crash Reports",
+			"~/Library/Application Support/Firefox/Profiles/*/storage/default/*/cache",
+			"~/.mozilla/firefox/Crash Reports",
+			"~/.mozilla/firefox/*/storage/default/*/cache",
+		},
+	},
+	"chrome": {
+		description: "Google Chrome profiles: bookmarks, history, passwords and extensions",
+		paths:       []string{"~/Library/Application Support/Google/Chrome", "~/.config/google-chrome"},
+		excludes: []string{
+			"~/Library/Application Support/Google/Chrome/*/Service Worker/CacheStorage",
+			"~/Library/Application Support/Google/Chrome/*/File System",
+			"~/Library/Application Support/Google/Chrome/OptGuideOnDeviceModel",
+			"~/Library/Application Support/Google/Chrome/Safe Browsing",
+			"~/.config/google-chrome/*/Service Worker/CacheStorage",
+			"~/.config/google-chrome/*/File System",
+			"~/.config/google-chrome/OptGuideOnDeviceModel",
+			"~/.config/google-chrome/Safe Browsing",
+		},
+	},
+	"alfred": {
+		description: "Alfred preferences and workflows",
+		paths:       []string{"~/Library/Application Support/Alfred"},
+	},
+	"karabiner": {
+		description: "Karabiner-Elements key mappings",
+		paths:       []string{"~/.config/karabiner"},
+		excludes:    []string{"~/.config/karabiner/automatic_backups"},
+	},
+	"rectangle": {
+		description: "Rectangle window management shortcuts",
+		paths:       []string{"~/Library/Preferences/com.knollsoft.Rectangle.plist"},
+	},
+	"obsidian": {
+		description: "Obsidian vault list and app settings, the vaults are backed up with their directories",
+		paths:       []string{"~/Library/Application Support/obsidian/obsidian.json", "~/.config/obsidian/obsidian.json"},
+	},
+}
+
+// presetNames returns the names of the built-in presets
+func presetNames() []string {
+	names := make([]string, 0, len(excludePresets))
+	for name := range excludePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validatePresets checks that the selected presets exist
+func validatePresets(presets []string) error {
+	for _, preset := range presets {
+		if _, ok := excludePresets[preset]; !ok {
+			return fmt.Errorf("unknown preset %q, the built-in presets are: %s", preset, strings.Join(presetNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// appSettingsNames returns the names of the built-in application settings
+func appSettingsNames() []string {
+	return slices.Sorted(maps.Keys(appSettingsPresets))
+}
+
+// validateAppSettings checks that the selected application settings exist
+func validateAppSettings(apps []string) error {
+	for _, app := range apps {
+		if _, ok := appSettingsPresets[app]; !ok {
+			return fmt.Errorf("unknown app_settings %q, the built-in application settings are: %s", app, strings.Join(appSettingsNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// appSettingsSources returns the existing settings paths of the selected applications that are not within the
+// sources already
+func appSettingsSources(apps, sources []string) []string {
+	var added []string
+	for _, app := range apps {
+		for _, path := range appSettingsPresets[app].paths {
+			path = hostPath(expandPath(path))
+			if _, err := os.Lstat(path); err != nil {
+				// The application is not installed or not used on this platform
+				continue
+			}
+			within := func(source string) bool { return withinPath(path, source) }
+			if slices.ContainsFunc(sources, within) || slices.ContainsFunc(added, within) {
+				continue
+			}
+			added = append(added, path)
+		}
+	}
+	return added
+}
+
+// presetPattern resolves the home directory and the host root in an exclude pattern of a preset
+func presetPattern(pattern, home string) string {
+	if rest, found := strings.CutPrefix(pattern, "~/"); found {
+		return home + "/" + rest
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return hostPath(pattern)
+	}
+	return pattern
+}
+
+// appSettingsExcludes returns the exclude patterns of the caches of the selected applications
+func appSettingsExcludes(apps []string) []string {
+	home := excludePatternReplacer.Replace(hostPath(expandPath("~")))
+	var patterns []string
+	for _, app := range apps {
+		for _, pattern := range appSettingsPresets[app].excludes {
+			patterns = append(patterns, presetPattern(pattern, home))
+		}
+	}
+	return patterns
+}
+
+// presetExcludes returns the exclude patterns of the selected presets
+func presetExcludes(presets []string) []string {
+	home := excludePatternReplacer.Replace(hostPath(expandPath("~")))
+	var patterns []string
+	for _, preset := range presets {
+		for _, pattern := range excludePresets[preset].patterns {
+			patterns = append(patterns, presetPattern(pattern, home))
+		}
+	}
+	return patterns
+}
+
+// newPresetsCmd returns the command listing the built-in exclude presets and application settings
+func newPresetsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "presets [name]",
+		Short: "List the built-in exclude presets and application settings",
+		Long: "Lists the built-in exclude presets and application settings, marking the ones selected with the preset " +
+			"and app_settings settings. With a name, prints the exclude patterns of the preset as they are passed to " +
+			"restic, or the paths of the application and the exclude patterns of its caches.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w := cmd.OutOrStdout()
+			if len(args) == 1 {
+				if app, ok := appSettingsPresets[args[0]]; ok {
+					for _, path := range app.paths {
+						fmt.Fprintln(w, hostPath(expandPath(path)))
+					}
+					for _, pattern := range appSettingsExcludes(args) {
+						fmt.Fprintln(w, "--exclude "+pattern)
+					}
+					return nil
+				}
+				if err := validatePresets(args); err != nil {
+					return err
+				}
+				for _, pattern := range presetExcludes(args) {
+					fmt.Fprintln(w, pattern)
+				}
+				return nil
+			}
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tSELECTED\tPATTERNS\tDESCRIPTION")
+			for _, name := range presetNames() {
+				selected := ""
+				if slices.Contains(appConfig.Preset, name) {
+					selected = "yes"
+				}
+				preset := excludePresets[name]
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", name, selected, len(preset.patterns), preset.description)
+			}
+			fmt.Fprintln(tw, "\nAPP SETTINGS\tSELECTED\tPATHS\tDESCRIPTION")
+			for _, name := range appSettingsNames() {
+				selected := ""
+				if slices.Contains(appConfig.AppSettings, name) {
+					selected = "yes"
+				}
+				app := appSettingsPresets[name]
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", name, selected, len(app.paths), app.description)
+			}
+			return tw.Flush()
+		},
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// priorityNameRe matches the valid names of the priority groups, used in the stage and file names
+var priorityNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// validatePriorities checks the names of the priority groups
+func validatePriorities() error {
+	seen := map[string]bool{"default": true}
+	for _, priority := range appConfig.Priorities {
+		if !priorityNameRe.MatchString(priority.Name) {
+			return fmt.Errorf("invalid priorities name %q, use lowercase letters, digits, - and _", priority.Name)
+		}
+		if seen[priority.Name] {
+			return fmt.Errorf("duplicate or reserved priorities name %q", priority.Name)
+		}
+		seen[priority.Name] = true
+	}
+	return nil
+}
+
+// sourceGroup is a group of backup sources backed up in its own restic invocation
+type sourceGroup struct {
+	Name    string
+	Sources []string
+	// Chunk is the key of the chunk of the initial seed the group is, empty for the priority groups
+	Chunk string
+	// Excludes are the paths of the earlier groups inside the sources of the group, backed up by them already
+	Excludes []string
+}
+
+// args returns the restic backup arguments of the group excluding the paths of the earlier groups
+func (g sourceGroup) args() []string {
+	var args []string
+	for _, path := range g.Excludes {
+		args = append(args, "--exclude", excludePatternReplacer.Replace(path))
+	}
+	return args
+}
+
+// groupResult is the result of the backup of a priority group
+type groupResult struct {
+	Name          string
+	SnapshotID    string
+	BytesAdded    int64
+	BytesUploaded int64
+	Warnings      []warningGroup
+	Err           error
+}
+
+// withinPath reports whether the path is the root or inside it
+func withinPath(path, root string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// prioritySourceGroups splits the backup sources into the groups of priorities, in their order, followed by the
+// remaining sources. A source belongs to the first group with a path containing it, the empty groups are dropped.
+// A path of a group inside a remaining source, e.g. ~/Documents in ~, is split off: the group backs it up and the
+// later groups exclude it.
+func prioritySourceGroups(sources []string) []sourceGroup {
+	var groups []sourceGroup
+	remaining := slices.Clone(sources)
+	for _, priority := range appConfig.Priorities {
+		var roots []string
+		for _, path := range priority.Paths {
+			matches, err := expandSourcePattern(path)
+			if err != nil {
+				log.WithFields(log.Fields{"group": priority.Name, "err": err}).Error("invalid priority group path")
+				continue
+			}
+			roots = append(roots, matches...)
+		}
+		group := sourceGroup{Name: priority.Name}
+		remaining = slices.DeleteFunc(remaining, func(source string) bool {
+			if slices.ContainsFunc(roots, func(root string) bool { return withinPath(source, root) }) {
+				group.Sources = append(group.Sources, source)
+				return true
+			}
+			return false
+		})
+		for _, root := range roots {
+			if _, err := os.Lstat(root); err != nil {
+				continue
+			}
+			if slices.ContainsFunc(remaining, func(source string) bool { return root != source && withinPath(root, source) }) {
+				group.Sources = append(group.Sources, root)
+			}
+		}
+		if len(group.Sources) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	if len(remaining) > 0 {
+		groups = append(groups, sourceGroup{Name: "default", Sources: remaining})
+	}
+	for i := range groups {
+		for _, earlier := range groups[:i] {
+			for _, path := range earlier.Sources {
+				if slices.ContainsFunc(groups[i].Sources, func(source string) bool {
+					return path != source && withinPath(path, source)
+				}) {
+					groups[i].Excludes = append(groups[i].Excludes, path)
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// writeGroupSources writes the files-from list of the group next to the expanded files-from list
+func writeGroupSources(filesFrom string, group sourceGroup) (string, error) {
+	path := strings.TrimSuffix(filesFrom, ".expanded") + "." + group.Name + ".expanded"
+	if err := os.WriteFile(path, []byte(strings.Join(group.Sources, "\n")+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write the files-from list of the %s group: %w", group.Name, err)
+	}
+	return path, nil
+}
+
+// backupPriorityGroups backs up the groups before the remaining sources, each in its own snapshot, so an interrupted
+// run still protects the most important files. It returns the files-from list and the arguments of the last group,
+// backed up by the main backup stage, and the results of the others. The chunks of the seed are recorded in the
+// state once backed up.
+func backupPriorityGroups(ctx context.Context, summary *runSummary, state *runState, filesFrom string, groups []sourceGroup, args []string) (string, []string, []groupResult) {
+	var results []groupResult
+	for i, group := range groups {
+		groupFilesFrom, err := writeGroupSources(filesFrom, group)
+		if err != nil {
+			log.WithField("err", err).Error("cannot prepare the priority groups, backing up all sources at once")
+			return filesFrom, nil, results
+		}
+		if i == len(groups)-1 {
+			return groupFilesFrom, group.args(), results
+		}
+		if ctx.Err() != nil {
+			// The main backup stage reports the interruption
+			continue
+		}
+		log.WithFields(log.Fields{"group": group.Name, "sources": len(group.Sources)}).Info("Backing up the priority group")
+		groupArgs := append(append(slices.Clone(args), group.args()...), "--files-from-verbatim", groupFilesFrom)
+		if group.Chunk != "" {
+			groupArgs = append(groupArgs, "--tag", tagSeedChunk)
+		}
+		output, err := summary.runNamedStage(ctx, "backup-"+group.Name, groupArgs...)
+		groupSummary := &runSummary{}
+		groupSummary.parseBackupOutput(output)
+		results = append(results, groupResult{
+			Name:          group.Name,
+			SnapshotID:    groupSummary.SnapshotID,
+			BytesAdded:    groupSummary.BytesAdded,
+			BytesUploaded: groupSummary.BytesUploaded,
+			Warnings:      backupWarnings(err),
+			Err:           err,
+		})
+		if group.Chunk != "" && groupSummary.SnapshotID != "" {
+			recordChunk(state, group.Chunk, time.Now())
+		}
+	}
+	return filesFrom, nil, results
+}
+
+// groupsUploaded returns the data uploaded by the priority groups
+func groupsUploaded(results []groupResult) int64 {
+	var uploaded int64
+	for _, result := range results {
+		uploaded += result.BytesUploaded
+	}
+	return uploaded
+}
+
+// applyGroupResults adds the data and the warnings of the priority groups to the run and lowers its status for the
+// failed groups: an unreadable file makes it incomplete, a failure fails it. The throughput remains the one of the
+// main backup stage.
+func applyGroupResults(summary *runSummary, results []groupResult) {
+	for _, result := range results {
+		summary.BytesAdded += result.BytesAdded
+		summary.BytesUploaded += result.BytesUploaded
+		summary.Warnings = append(summary.Warnings, result.Warnings...)
+		if result.SnapshotID != "" {
+			summary.GroupSnapshots = append(summary.GroupSnapshots, result.Name+" "+result.SnapshotID)
+		}
+		if result.Err == nil || !summary.snapshotCreated() {
+			continue
+		}
+		var exitErr *exec.ExitError
+		if errors.As(result.Err, &exitErr) && exitErr.ExitCode() == resticExitIncomplete && result.SnapshotID != "" {
+			summary.Status = runStatusIncomplete
+			continue
+		}
+		log.WithFields(log.Fields{"group": result.Name, "err": result.Err}).Error("The backup of the priority group failed")
+		summary.Status = runStatusFailed
+	}
+}
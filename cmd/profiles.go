@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// profileEnv selects the profile when the --profile flag is not given
+const profileEnv = "RESTIC_WRAPPER_PROFILE"
+
+// activeProfile is the name of the selected profile, empty when no profile is selected
+var activeProfile string
+
+// profileFromArgs returns the profile selected by the --profile flag or the environment.
+// The flag is read before cobra parses the command line, because the configuration is loaded in init.
+func profileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if value, found := strings.CutPrefix(arg, "--profile="); found {
+			return value
+		}
+		if arg == "--profile" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv(profileEnv)
+}
+
+// profileNames returns the names of the configured profiles
+func profileNames() []string {
+	var names []string
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// profileFiles are the files kept per profile unless the profile sets them explicitly
+var profileFiles = []string{"lock_file", "log_file", "state_file", "notes_file", "history_file"}
+
+// unprofiledFiles holds the names of the per-profile files before the active profile was applied
+var unprofiledFiles = map[string]string{}
+
+// profileFileName inserts the profile name into the file name, e.g. "state.json" becomes "state.work.json"
+func profileFileName(name, profile string) string {
+	ext := filepath.Ext(name)
+	if ext == "" || ext == name {
+		return name + "." + profile
+	}
+	return strings.TrimSuffix(name, ext) + "." + profile + ext
+}
+
+// notificationChannels maps the notification channels to the setting enabling them and its disabled value
+var notificationChannels = map[string]struct {
+	key      string
+	disabled any
+}{
+	"sns":       {"topic_arn", ""},
+	"pagerduty": {"routing_key", ""},
+	"opsgenie":  {"api_key", ""},
+	"mqtt":      {"broker", ""},
+	"ntfy":      {"topic", ""},
+	"gotify":    {"server", ""},
+	"apprise":   {"urls", []string{}},
+}
+
+// routeProfileNotifications disables the global notification channels when the profile configures its own,
+// so the alerts of the profile only go to its channels. The global channels are the fallback of the profiles
+// without channels.
+func routeProfileNotifications(settings map[string]any) {
+	notifications, _ := settings["notifications"].(map[string]any)
+	own := false
+	for name := range notificationChannels {
+		if _, ok := notifications[name]; ok {
+			own = true
+		}
+	}
+	if !own {
+		return
+	}
+	for name, channel := range notificationChannels {
+		if _, ok := notifications[name]; !ok {
+			viper.Set("notifications."+name+"."+channel.key, channel.disabled)
+		}
+	}
+}
+
+// applyProfile merges the defaults block and the settings of the profile over the configuration
+func applyProfile(profile string) error {
+	if !slices.Contains(profileNames(), profile) {
+		return fmt.Errorf("unknown profile %q, the configured profiles are: %s", profile, strings.Join(profileNames(), ", "))
+	}
+	if err := viper.MergeConfigMap(viper.GetStringMap("defaults")); err != nil {
+		return fmt.Errorf("failed to apply the defaults: %w", err)
+	}
+	settings := viper.GetStringMap("profiles." + profile)
+	routeProfileNotifications(settings)
+	if err := viper.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("failed to apply the profile %q: %w", profile, err)
+	}
+	// Keep the runs of the profiles apart
+	for _, key := range profileFiles {
+		// The configuration may be loaded again, e.g. after provisioning
+		name, ok := unprofiledFiles[key]
+		if !ok {
+			name = viper.GetString(key)
+			unprofiledFiles[key] = name
+		}
+		if _, ok := settings[key]; !ok {
+			viper.Set(key, profileFileName(name, profile))
+		}
+	}
+	return nil
+}
+
+// profileStatePath returns the path of the state file of the given profile
+func profileStatePath(profile string) string {
+	name := viper.GetString("profiles." + profile + ".state_file")
+	if name == "" {
+		name = viper.GetString("state_file")
+		if unprofiled, ok := unprofiledFiles["state_file"]; ok {
+			name = unprofiled
+		}
+		name = profileFileName(name, profile)
+	}
+	return filepath.Join(appConfig.BackupDir, name)
+}
+
+// runProfiles backs up every profile one after another, each in its own process started with the given flags. In
+// Kubernetes mode the termination messages of the profiles are combined and the program exits with the most severe
+// exit code of the profiles.
+func runProfiles(profiles []string, k8s bool, flags ...string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %w", err)
+	}
+	if k8s {
+		flags = append(flags, "--k8s")
+	}
+	var failed []string
+	exitCode := exitSuccess
+	results := map[string]any{}
+	var messages []map[string]any
+	for _, profile := range profiles {
+		log.WithField("profile", profile).Info("Starting the backup of the profile")
+		if k8s {
+			// A profile that crashed leaves no message, not the one of the previous profile
+			os.WriteFile(terminationLogPath, nil, 0o644)
+		}
+		cmd := exec.Command(executable, append([]string{"--profile", profile}, flags...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		code := exitSuccess
+		if err = cmd.Run(); err != nil {
+			log.WithFields(log.Fields{"profile": profile, "err": err}).Error("The backup of the profile failed")
+			failed = append(failed, profile)
+			code = exitFailed
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+				code = exitErr.ExitCode()
+			}
+		}
+		if exitSeverity(code) > exitSeverity(exitCode) {
+			exitCode = code
+		}
+		if k8s {
+			message := readTerminationMessage()
+			if message == nil {
+				message = map[string]any{"status": "unknown"}
+				if err != nil {
+					message = map[string]any{"status": runStatusFailed, "error": err.Error()}
+				}
+			}
+			results[profile] = message
+			messages = append(messages, message)
+		}
+	}
+	if k8s {
+		saveTerminationMessage(map[string]any{"exit_code": exitCode, "profiles": results}, messages...)
+		if exitCode != exitSuccess {
+			os.Exit(exitCode)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("the backup failed for the profiles " + strings.Join(failed, ", "))
+	}
+	return nil
+}
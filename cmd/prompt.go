@@ -0,0 +1,19 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// confirm asks the user to confirm the action by typing "yes"
+func confirm(cmd *cobra.Command, prompt string) (bool, error) {
+	fmt.Fprintf(cmd.OutOrStdout(), "%s Type \"yes\" to continue: ", prompt)
+	answer, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+	if err != nil && answer == "" {
+		return false, fmt.Errorf("cannot read the answer: %w", err)
+	}
+	return strings.TrimSpace(answer) == "yes", nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configOptional reports whether the command runs without a configuration file, i.e. provisions it or prints the
+// version
+func configOptional(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--profile":
+			i++
+		case args[i] == "--version":
+			return true
+		case strings.HasPrefix(args[i], "-"):
+		default:
+			// The commands setting up or documenting the program work without a configuration
+			switch args[i] {
+			case "provision", "completion", "gen-docs", "config", "presets", "version", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+				return true
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// isConfigNotFound reports whether reading the configuration failed because the file does not exist
+func isConfigNotFound(err error) bool {
+	var notFound viper.ConfigFileNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist)
+}
+
+// configPath returns the path of the configuration file
+func configPath() string {
+	if path := viper.ConfigFileUsed(); path != "" {
+		return path
+	}
+	if path := os.Getenv(configFileEnv); path != "" {
+		return path
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".restic_backup", "config.yaml")
+}
+
+// provisionConfig writes the configuration if it differs from the current one and loads it.
+// It returns false when the configuration did not change.
+func provisionConfig(data []byte) (bool, error) {
+	// Refuse to install a configuration that cannot be read
+	if err := viper.New().MergeConfig(bytes.NewReader(data)); err != nil {
+		return false, fmt.Errorf("invalid configuration: %w", err)
+	}
+	path := configPath()
+	current, err := os.ReadFile(path)
+	changed := err != nil || !bytes.Equal(current, data)
+	if changed {
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return false, fmt.Errorf("failed to create the configuration directory: %w", err)
+		}
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err != nil {
+			return false, fmt.Errorf("failed to write the configuration: %w", err)
+		}
+		if err = os.Rename(tmp, path); err != nil {
+			return false, fmt.Errorf("failed to replace the configuration: %w", err)
+		}
+	}
+
+	viper.SetConfigFile(path)
+	if err = loadConfig(false); err != nil {
+		return false, err
+	}
+	if err = os.MkdirAll(appConfig.BackupDir, 0o700); err != nil {
+		return false, fmt.Errorf("failed to create the backup directory: %w", err)
+	}
+	setupLogging()
+	return changed, nil
+}
+
+// lookupKeychainSecret returns the secret stored in the keychain, or an error if there is none
+func lookupKeychainSecret(ctx context.Context, service, account string) (string, error) {
+	out, err := exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// storeKeychainSecret adds or updates the secret in the keychain. The command is passed on the standard input
+// of "security -i", so the secret does not show up in the process list.
+func storeKeychainSecret(ctx context.Context, service, account, secret string) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	cmd := exec.CommandContext(ctx, "security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n",
+		quote.Replace(service), quote.Replace(account), quote.Replace(secret)))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store %s in the keychain: %w: %s", account, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// provisionSecrets stores the secrets set in the environment in the keychain, returning the number of changed secrets
+func provisionSecrets(ctx context.Context) (int, error) {
+	changed := 0
+	for _, secret := range secretAccounts {
+		value := os.Getenv(secret.env)
+		if value == "" {
+			continue
+		}
+		account := secretAccount(secret)
+		if current, err := lookupKeychainSecret(ctx, appConfig.SecurityService, account); err == nil && current == value {
+			continue
+		}
+		if err := storeKeychainSecret(ctx, appConfig.SecurityService, account, value); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// provisionRepository initializes the repository unless it already exists.
+// It returns false when the repository was already initialized.
+func provisionRepository(ctx context.Context) (bool, error) {
+	if _, err := runResticCommand(ctx, "cat", "config"); err == nil {
+		return false, nil
+	}
+	if _, err := runResticCommand(ctx, "init"); err != nil {
+		return false, fmt.Errorf("failed to initialize the repository: %w", err)
+	}
+	return true, nil
+}
+
+// newProvisionCmd returns the command setting up the program non-interactively
+func newProvisionCmd() *cobra.Command {
+	var (
+		configFromStdin  bool
+		secretsFromEnv   bool
+		scheduleInterval time.Duration
+		skipInit         bool
+	)
+	cmd := &cobra.Command{
+		Use:   "provision",
+		Short: "Set up the configuration, secrets, schedule and repository non-interactively",
+		Long: "Sets up the program in one idempotent invocation for configuration management tools: installs the " +
+			"configuration, stores the secrets in the keychain, installs the launchd agent and initializes the " +
+			"repository. Every step prints whether it changed anything.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+			w := cmd.OutOrStdout()
+			report := func(step string, changed bool) {
+				result := "unchanged"
+				if changed {
+					result = "changed"
+				}
+				fmt.Fprintf(w, "%s: %s\n", step, result)
+			}
+
+			if configFromStdin {
+				data, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return fmt.Errorf("failed to read the configuration: %w", err)
+				}
+				changed, err := provisionConfig(data)
+				if err != nil {
+					return err
+				}
+				report("config", changed)
+			} else if viper.ConfigFileUsed() == "" {
+				return errors.New("no configuration file found, pass it with --config-from-stdin")
+			}
+
+			if secretsFromEnv {
+				changed, err := provisionSecrets(ctx)
+				if err != nil {
+					return err
+				}
+				report("secrets", changed > 0)
+			}
+
+			if scheduleInterval > 0 {
+				agent, err := newLaunchAgent(scheduleInterval)
+				if err != nil {
+					return err
+				}
+				changed, err := agent.install(ctx)
+				if err != nil {
+					return err
+				}
+				report("schedule", changed)
+				// The scheduled backups need the sudo wrapper, only root can install it
+				if appConfig.Restic.Sudo {
+					if err = writeSudoSetup(w); err != nil {
+						return err
+					}
+				}
+			}
+
+			if appConfig.Restic.VerifyChecksum && appConfig.Restic.SHA256 == "" {
+				changed, _, err := recordResticChecksum()
+				if err != nil {
+					return err
+				}
+				report("restic checksum", changed)
+			}
+
+			if !skipInit {
+				setupEnv()
+				changed, err := provisionRepository(ctx)
+				if err != nil {
+					return err
+				}
+				report("repository", changed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&configFromStdin, "config-from-stdin", false, "install the configuration read from the standard input")
+	cmd.Flags().BoolVar(&secretsFromEnv, "secrets-from-env", false, "store the secrets set in the environment (RESTIC_REPOSITORY, RESTIC_PASSWORD, AWS_*) in the keychain")
+	cmd.Flags().DurationVar(&scheduleInterval, "schedule-interval", time.Hour, "install a launchd agent backing up at this interval, 0 to skip")
+	cmd.Flags().BoolVar(&skipInit, "skip-init", false, "do not initialize the repository")
+	return cmd
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// purgeRepositories returns the repositories a purge has to remove the data from, with the contexts
+// running restic against them
+func purgeRepositories(ctx context.Context) map[string]context.Context {
+	repositories := map[string]context.Context{"repository": ctx}
+	if stagingEnabled() {
+		repositories["staging repository"] = withStagingRepository(ctx)
+	}
+	return repositories
+}
+
+// purgeManifests removes the purged paths from the stored snapshot manifests
+func purgeManifests(paths []string) error {
+	files, err := manifestFiles()
+	if err != nil {
+		return err
+	}
+	purged := func(entryPath string) bool {
+		for _, p := range paths {
+			if entryPath == p || strings.HasPrefix(entryPath, strings.TrimSuffix(p, "/")+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, file := range files {
+		if err = filterManifest(file, purged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterManifest rewrites the manifest without the entries whose path matches remove
+func filterManifest(file string, remove func(string) bool) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+	}
+	out, err := os.OpenFile(file+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite the manifest %s: %w", file, err)
+	}
+	defer os.Remove(file + ".tmp")
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	decoder := json.NewDecoder(zr)
+	encoder := json.NewEncoder(zw)
+	var header manifestHeader
+	if err = decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+	}
+	if err = encoder.Encode(header); err != nil {
+		return fmt.Errorf("failed to rewrite the manifest %s: %w", file, err)
+	}
+	for {
+		var entry manifestEntry
+		err = decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the manifest %s: %w", file, err)
+		}
+		if remove(entry.Path) {
+			continue
+		}
+		if err = encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to rewrite the manifest %s: %w", file, err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite the manifest %s: %w", file, err)
+	}
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite the manifest %s: %w", file, err)
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// newPurgePathCmd returns the command permanently removing paths from all the snapshots
+func newPurgePathCmd() *cobra.Command {
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "purge-path <path>...",
+		Short: "Permanently remove files or directories from the backup history",
+		Long: "Rewrites every snapshot without the given paths, forgets the original snapshots and prunes the " +
+			"repository, so the data is removed from the backup history, e.g. to honour a deletion request. " +
+			"With a staging repository both repositories are purged. A dry-run report is always shown first and " +
+			"the purge has to be confirmed. It cannot be undone.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+			w := cmd.OutOrStdout()
+
+			paths := make([]string, len(args))
+			for i, arg := range args {
+				paths[i] = filepath.Clean(hostPath(expandPath(arg)))
+				if !filepath.IsAbs(paths[i]) {
+					return fmt.Errorf("%s is not an absolute path", arg)
+				}
+			}
+
+			fileLock := newFileLock()
+			locked, err := fileLock.TryLock()
+			if err != nil {
+				return fmt.Errorf("cannot lock the lock file: %w", err)
+			}
+			if !locked {
+				return errors.New("another instance of the program is already running")
+			}
+			defer fileLock.Unlock()
+
+			state, err := loadState()
+			if err != nil {
+				return err
+			}
+			// Removing the data relies on prune, which must not run on a possibly corrupt repository
+			if reason := pruneBlockedReason(state, nil, time.Now()); reason != "" {
+				return fmt.Errorf("cannot purge, %s; run restic_wrapper repair first", reason)
+			}
+
+			setupEnv()
+			rewriteArgs := []string{"rewrite"}
+			for _, p := range paths {
+				rewriteArgs = append(rewriteArgs, "--exclude", p)
+			}
+			repositories := purgeRepositories(ctx)
+			for name, repoCtx := range repositories {
+				preview, err := runResticCommand(repoCtx, append(rewriteArgs, "--dry-run")...)
+				if err != nil {
+					return fmt.Errorf("restic rewrite --dry-run failed on the %s: %w", name, err)
+				}
+				fmt.Fprintf(w, "%s:\n%s", name, preview)
+			}
+
+			if !yes {
+				confirmed, err := confirm(cmd, "The snapshots above will be rewritten without "+strings.Join(paths, ", ")+
+					", the originals forgotten and the data pruned. This cannot be undone.")
+				if err != nil {
+					return err
+				}
+				if !confirmed {
+					return errors.New("the purge was not confirmed")
+				}
+			}
+
+			for name, repoCtx := range repositories {
+				if _, err = runResticCommand(repoCtx, append(rewriteArgs, "--forget")...); err != nil {
+					return fmt.Errorf("restic rewrite failed on the %s: %w", name, err)
+				}
+				// Repack every pack holding purged data, by default prune keeps some unused data
+				output, err := runResticCommand(repoCtx, "prune", "--max-unused", "0")
+				if err != nil {
+					return fmt.Errorf("restic prune failed on the %s: %w", name, err)
+				}
+				fmt.Fprintf(w, "Purged the %s, freed %s\n", name, formatBytes(parsePruneFreedBytes(output)))
+			}
+			if err = purgeManifests(paths); err != nil {
+				log.WithField("err", err).Error("cannot remove the purged paths from the manifests")
+				return fmt.Errorf("the snapshots were purged, but the manifests were not: %w", err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&yes, "yes", false, "purge without asking for confirmation after the dry-run report")
+	return cmd
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// wizard asks the questions of the interactive recovery
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks the question and returns the answer, or the default value when the answer is empty
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	answer, err := w.in.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", fmt.Errorf("cannot read the answer: %w", err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// askSecret asks for a secret without echoing it on the terminal
+func (w *wizard) askSecret(question string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return w.ask(question, "")
+	}
+	fmt.Fprintf(w.out, "%s: ", question)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(w.out)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the answer: %w", err)
+	}
+	return string(secret), nil
+}
+
+// askYes asks a yes or no question
+func (w *wizard) askYes(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	answer, err := w.ask(question+" ("+choices+")", "")
+	if err != nil || answer == "" {
+		return def, err
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// askChoice asks for one of the numbered choices, starting at 1
+func (w *wizard) askChoice(question string, count, def int) (int, error) {
+	for {
+		answer, err := w.ask(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= count {
+			return n, nil
+		}
+		fmt.Fprintf(w.out, "Enter a number between 1 and %d\n", count)
+	}
+}
+
+// setupRecoverySecrets loads the secrets found in the configured secrets source and asks for the missing ones
+func (w *wizard) setupRecoverySecrets(ctx context.Context) error {
+	found := 0
+	for _, secret := range secretEnvs() {
+		if value, ok, _ := lookupSecret(ctx, secret.env, secret.account); ok && value != "" {
+			os.Setenv(secret.env, value)
+			found++
+		}
+	}
+	if found > 0 {
+		fmt.Fprintf(w.out, "Loaded %d secrets from %s\n", found, appConfig.Secrets.Source)
+	}
+	setPasswordSourceEnv()
+
+	repository, err := w.ask("Repository URL, e.g. s3:s3.amazonaws.com/bucket/restic", os.Getenv("RESTIC_REPOSITORY"))
+	if err != nil {
+		return err
+	}
+	if repository == "" {
+		return errors.New("no repository given")
+	}
+	if repository != os.Getenv("RESTIC_REPOSITORY") {
+		// Another repository does not share the stored password
+		os.Setenv("RESTIC_REPOSITORY", repository)
+		os.Unsetenv("RESTIC_PASSWORD")
+		os.Unsetenv("RESTIC_PASSWORD_COMMAND")
+		os.Unsetenv("RESTIC_PASSWORD_FILE")
+	}
+	if strings.HasPrefix(repository, "s3:") && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		for _, secret := range []struct{ env, question string }{
+			{"AWS_ACCESS_KEY_ID", "AWS access key ID"},
+			{"AWS_SECRET_ACCESS_KEY", "AWS secret access key"},
+		} {
+			value, err := w.askSecret(secret.question)
+			if err != nil {
+				return err
+			}
+			os.Setenv(secret.env, value)
+		}
+	}
+	if os.Getenv("RESTIC_PASSWORD") == "" && os.Getenv("RESTIC_PASSWORD_COMMAND") == "" &&
+		os.Getenv("RESTIC_PASSWORD_FILE") == "" {
+		password, err := w.askSecret("Repository password")
+		if err != nil {
+			return err
+		}
+		os.Setenv("RESTIC_PASSWORD", password)
+	}
+	return nil
+}
+
+// chooseSnapshot lists the snapshots of the host and asks which one to restore, the latest by default
+func (w *wizard) chooseSnapshot(ctx context.Context) (snapshot, error) {
+	for {
+		host, err := w.ask("Hostname of the machine to recover", appConfig.HostName)
+		if err != nil {
+			return snapshot{}, err
+		}
+		snapshots, err := listSnapshots(ctx, "--host", host)
+		if err != nil {
+			return snapshot{}, err
+		}
+		// The copies of the configuration and the system manifest would be the latest
+		snapshots = slices.DeleteFunc(snapshots, func(s snapshot) bool {
+			return slices.Contains(s.Tags, tagSelfBackup) || slices.Contains(s.Tags, tagSystemManifest)
+		})
+		if len(snapshots) == 0 {
+			all, err := listSnapshots(ctx)
+			if err != nil {
+				return snapshot{}, err
+			}
+			hosts := map[string]bool{}
+			for _, s := range all {
+				hosts[s.Hostname] = true
+			}
+			fmt.Fprintf(w.out, "No snapshots of %s, the repository has snapshots of: %s\n", host,
+				strings.Join(slices.Sorted(maps.Keys(hosts)), ", "))
+			continue
+		}
+
+		// Latest first
+		tw := tabwriter.NewWriter(w.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tID\tTIME\tPATHS")
+		for i := range snapshots {
+			s := snapshots[len(snapshots)-1-i]
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i+1, s.ShortID, s.Time.Local().Format("2006-01-02 15:04"), strings.Join(s.Paths, ", "))
+		}
+		tw.Flush()
+		n, err := w.askChoice("Snapshot to restore", len(snapshots), 1)
+		if err != nil {
+			return snapshot{}, err
+		}
+		return snapshots[len(snapshots)-n], nil
+	}
+}
+
+// choosePaths asks which paths of the snapshot to restore, all of them by default
+func (w *wizard) choosePaths(s snapshot) ([]string, error) {
+	for i, path := range s.Paths {
+		fmt.Fprintf(w.out, "%d  %s\n", i+1, path)
+	}
+	answer, err := w.ask("Paths to restore (numbers or paths inside the snapshot, separated by spaces)", "all")
+	if err != nil || answer == "all" {
+		return nil, err
+	}
+	var paths []string
+	for _, field := range strings.Fields(answer) {
+		if n, err := strconv.Atoi(field); err == nil && n >= 1 && n <= len(s.Paths) {
+			paths = append(paths, s.Paths[n-1])
+		} else {
+			paths = append(paths, field)
+		}
+	}
+	return paths, nil
+}
+
+// restoreSize returns the size of the files of the snapshot under the paths, all of them if none are given
+func restoreSize(ctx context.Context, snapshotID string, paths []string) (int64, int, error) {
+	args := []string{"ls", "--json", snapshotID}
+	if len(paths) > 0 {
+		// Without --recursive restic only lists the direct children of the directories
+		args = append(append(args, "--recursive"), paths...)
+	}
+	output, err := runResticCommand(ctx, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("restic ls failed: %w", err)
+	}
+	var size int64
+	files := 0
+	for _, line := range strings.Split(output, "\n") {
+		var node struct {
+			Type       string `json:"type"`
+			Size       int64  `json:"size"`
+			StructType string `json:"struct_type"`
+		}
+		if json.Unmarshal([]byte(line), &node) == nil && node.StructType == "node" && node.Type == "file" {
+			size += node.Size
+			files++
+		}
+	}
+	return size, files, nil
+}
+
+// existingParent returns the path or its closest existing parent directory
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// restoreProgress prints the progress of restic restore --json on a single line
+type restoreProgress struct {
+	out  io.Writer
+	line []byte
+}
+
+func (p *restoreProgress) Write(data []byte) (int, error) {
+	p.line = append(p.line, data...)
+	for {
+		i := bytes.IndexByte(p.line, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		var status struct {
+			MessageType   string  `json:"message_type"`
+			PercentDone   float64 `json:"percent_done"`
+			FilesRestored int     `json:"files_restored"`
+			TotalFiles    int     `json:"total_files"`
+			BytesRestored int64   `json:"bytes_restored"`
+			TotalBytes    int64   `json:"total_bytes"`
+		}
+		if json.Unmarshal(p.line[:i], &status) == nil && (status.MessageType == "status" || status.MessageType == "summary") {
+			fmt.Fprintf(p.out, "\r%5.1f%%  %d / %d files  %s / %s", status.PercentDone*100, status.FilesRestored,
+				status.TotalFiles, formatBytes(status.BytesRestored), formatBytes(status.TotalBytes))
+		}
+		p.line = p.line[i+1:]
+	}
+}
+
+// runRecoveryRestore restores the snapshot, showing the progress when the installed restic reports it
+func runRecoveryRestore(ctx context.Context, out io.Writer, version resticVersion, args []string) error {
+	if !version.atLeast(0, 17, 0) {
+		output, err := runResticCommand(ctx, args...)
+		fmt.Fprint(out, output)
+		return err
+	}
+	cmd := resticCommand(ctx, append(args, "--json")...)
+	var stderr bytes.Buffer
+	cmd.Stdout = &restoreProgress{out: out}
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	fmt.Fprintln(out)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// newRecoverCmd returns the command guiding the restore of a machine from its backups
+func newRecoverCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "recover",
+		Short: "Restore the backups of a lost machine, step by step",
+		Long: "Guides the first restore on a fresh machine: it asks for the repository and its password (or loads " +
+			"them from the configured secrets source), lists the snapshots of the old hostname, asks which snapshot " +
+			"and paths to restore and where to, checks the free space of the target and restores with progress.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			w := &wizard{in: bufio.NewReader(cmd.InOrStdin()), out: cmd.OutOrStdout()}
+
+			if err := w.setupRecoverySecrets(ctx); err != nil {
+				return err
+			}
+			if _, err := runResticCommand(ctx, "cat", "config", "--no-lock"); err != nil {
+				if fatal := fatalError(err); fatal != "" {
+					return fmt.Errorf("cannot open the repository: %s", fatal)
+				}
+				return fmt.Errorf("cannot open the repository: %w", err)
+			}
+			fmt.Fprintln(w.out, "Opened the repository")
+			s, err := w.chooseSnapshot(ctx)
+			if err != nil {
+				return err
+			}
+			paths, err := w.choosePaths(s)
+			if err != nil {
+				return err
+			}
+			home, _ := os.UserHomeDir()
+			target, err := w.ask("Restore to (\"/\" restores the files to their original location)",
+				filepath.Join(home, "restore-"+s.ShortID))
+			if err != nil {
+				return err
+			}
+			target = expandPath(target)
+
+			size, files, err := restoreSize(ctx, s.ID, paths)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w.out, "The restore holds %d files, %s\n", files, formatBytes(size))
+			enough := true
+			if free, err := freeSpace(existingParent(target)); err == nil {
+				fmt.Fprintf(w.out, "%s available on the target\n", formatBytes(int64(free)))
+				if uint64(size) > free {
+					enough = false
+					fmt.Fprintln(w.out, "The target does not have enough free space for the restore")
+				}
+			}
+			if ok, err := w.askYes("Restore "+s.ShortID+" to "+target+"?", enough); err != nil || !ok {
+				return err
+			}
+
+			version, err := installedResticVersion(ctx)
+			if err != nil {
+				return fmt.Errorf("cannot get the restic version: %w", err)
+			}
+			optionArgs, err := configRestoreOptions().args(version)
+			if err != nil {
+				return err
+			}
+			restoreArgs := append([]string{"restore", s.ID, "--target", target}, optionArgs...)
+			for _, path := range paths {
+				restoreArgs = append(restoreArgs, "--include", path)
+			}
+			if err = runRecoveryRestore(ctx, w.out, version, restoreArgs); err != nil {
+				return fmt.Errorf("restic restore failed: %w", err)
+			}
+			fmt.Fprintf(w.out, "Restored %s to %s\n", s.ShortID, target)
+			return nil
+		},
+	}
+}
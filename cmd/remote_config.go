@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// remoteConfigTimeout limits fetching the remote configuration
+	remoteConfigTimeout = 30 * time.Second
+	// emptyPayloadHash is the SHA-256 of an empty request body, required by S3 to sign GET requests
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// errNotModified is returned when the remote configuration matches the cached ETag
+var errNotModified = errors.New("not modified")
+
+// remoteConfigCache returns the paths of the cached remote configuration and of its ETag
+func remoteConfigCache() (string, string) {
+	dir := expandPath(viper.GetString("backup_directory"))
+	return filepath.Join(dir, ".remote_config.yaml"), filepath.Join(dir, ".remote_config.etag")
+}
+
+// newRemoteConfigRequest returns a conditional GET request for the http(s) or s3 URL, signing the S3 requests
+func newRemoteConfigRequest(ctx context.Context, rawURL, etag string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote config URL: %w", err)
+	}
+	if u.Scheme != "s3" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err == nil && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		return req, err
+	}
+
+	// The credentials and the region of the repository are used for the S3 bucket
+	cfg, err := loadAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	secrets := remoteConfigSecrets(ctx)
+	if secrets["AWS_ACCESS_KEY_ID"] != "" && secrets["AWS_SECRET_ACCESS_KEY"] != "" {
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(secrets["AWS_ACCESS_KEY_ID"], secrets["AWS_SECRET_ACCESS_KEY"], "")
+	}
+	region := viper.GetString("remote_config.region")
+	if region == "" {
+		region = cfg.Region
+	}
+	if region == "" {
+		region = secrets["AWS_DEFAULT_REGION"]
+	}
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", u.Host, region, strings.TrimPrefix(u.Path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if err = v4.NewSigner().SignHTTP(ctx, credentials, req, emptyPayloadHash, "s3", region, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to sign the request: %w", err)
+	}
+	return req, nil
+}
+
+// remoteConfigSecrets returns the AWS secrets missing from the environment, read from the configured secrets source.
+// The configuration is not loaded yet, so the settings are read from viper and a missing secret is not an error.
+func remoteConfigSecrets(ctx context.Context) map[string]string {
+	source := viper.GetString("secrets.source")
+	if source == "" {
+		source = "keychain"
+		if inContainer() {
+			source = "files"
+		}
+	}
+	secrets := map[string]string{}
+	for _, secret := range secretAccounts {
+		if !strings.HasPrefix(secret.env, "AWS_") || os.Getenv(secret.env) != "" {
+			continue
+		}
+		account := accountOf(secret, viper.GetStringMapString("secrets.accounts"), viper.GetString("secrets.prefix"))
+		switch source {
+		case "files":
+			if data, err := os.ReadFile(filepath.Join(viper.GetString("secrets.dir"), account)); err == nil {
+				secrets[secret.env] = string(bytes.TrimSpace(data))
+			}
+		case "keychain":
+			if value, err := lookupKeychainSecret(ctx, viper.GetString("security_service"), account); err == nil {
+				secrets[secret.env] = value
+			}
+		}
+	}
+	return secrets
+}
+
+// fetchRemote downloads the URL, returning errNotModified when it still matches the ETag
+func fetchRemote(ctx context.Context, rawURL, etag string) ([]byte, string, error) {
+	req, err := newRemoteConfigRequest(ctx, rawURL, etag)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := newHTTPClient(0).Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch %s: unexpected response %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", rawURL, err)
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// verifyRemoteConfig checks the Ed25519 signature published next to the configuration as <url>.sig
+func verifyRemoteConfig(ctx context.Context, rawURL string, data []byte) error {
+	publicKey, err := base64.StdEncoding.DecodeString(viper.GetString("remote_config.public_key"))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("remote_config.public_key is not a base64 encoded Ed25519 public key")
+	}
+	encoded, _, err := fetchRemote(ctx, rawURL+".sig", "")
+	if err != nil {
+		return fmt.Errorf("failed to fetch the signature: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return fmt.Errorf("failed to decode the signature: %w", err)
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return errors.New("the signature of the remote configuration is invalid")
+	}
+	return nil
+}
+
+// loadRemoteConfig fetches the remote configuration, caching it with its ETag.
+// The cached copy is returned when the remote configuration cannot be fetched or verified.
+func loadRemoteConfig(rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+
+	cachePath, etagPath := remoteConfigCache()
+	cached, cacheErr := os.ReadFile(cachePath)
+	etag := ""
+	if cacheErr == nil {
+		if data, err := os.ReadFile(etagPath); err == nil {
+			etag = strings.TrimSpace(string(data))
+		}
+	}
+
+	data, newEtag, err := fetchRemote(ctx, rawURL, etag)
+	if err == nil && viper.GetString("remote_config.public_key") != "" {
+		err = verifyRemoteConfig(ctx, rawURL, data)
+	}
+	switch {
+	case errors.Is(err, errNotModified):
+		return cached, nil
+	case err != nil:
+		if cacheErr != nil {
+			return nil, fmt.Errorf("%w, and there is no cached copy", err)
+		}
+		log.WithField("err", err).Warn("cannot fetch the remote configuration, using the cached copy")
+		return cached, nil
+	}
+
+	if err = os.WriteFile(cachePath, data, 0o600); err != nil {
+		log.WithField("err", err).Warn("cannot cache the remote configuration")
+	} else if err = os.WriteFile(etagPath, []byte(newEtag), 0o600); err != nil {
+		log.WithField("err", err).Warn("cannot cache the ETag of the remote configuration")
+	}
+	return data, nil
+}
+
+// applyRemoteConfig merges the remote configuration and its overrides for the host over the local configuration
+func applyRemoteConfig() error {
+	rawURL := viper.GetString("remote_config.url")
+	if rawURL == "" {
+		return nil
+	}
+	data, err := loadRemoteConfig(rawURL)
+	if err != nil {
+		return err
+	}
+	if err = viper.MergeConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to parse the remote configuration: %w", err)
+	}
+	if err = applyHostOverrides(viper.GetViper()); err != nil {
+		return err
+	}
+
+	// Keep the policy apart to check the compliance of the effective configuration
+	remotePolicy = viper.New()
+	remotePolicy.SetConfigType("yaml")
+	if err = remotePolicy.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to parse the remote configuration: %w", err)
+	}
+	remotePolicy.SetDefault("host_name", viper.GetString("host_name"))
+	return applyHostOverrides(remotePolicy)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// indexDamagedRe matches the check errors fixed by restic repair index
+	indexDamagedRe = regexp.MustCompile(`(?i)repair index|not referenced in any index|contained in several indexes|index \S+ (?:is )?(?:damaged|invalid|corrupt)`)
+	// snapshotsDamagedRe matches the check errors about data missing from the snapshots
+	snapshotsDamagedRe = regexp.MustCompile(`(?i)repair snapshots|could not be loaded|blob \S+ not found|pack \S+ (?:is )?(?:missing|not found)`)
+)
+
+// checkErrors returns the output of the failed check, including its error output
+func checkErrors(output string, err error) string {
+	var resticErr *resticError
+	if errors.As(err, &resticErr) {
+		return output + "\n" + resticErr.stderr
+	}
+	return output
+}
+
+// repairIndex rebuilds the repository index and checks the repository again, as stages of the run
+func repairIndex(ctx context.Context, summary *runSummary, state *runState) (string, error) {
+	log.Warn("The repository index is damaged, running restic repair index")
+	if _, err := summary.runNamedStage(ctx, "repair index", "repair", "index"); err != nil {
+		return "", fmt.Errorf("restic repair index failed: %w", err)
+	}
+	log.Info("Repaired the repository index, checking the repository again")
+	return runCheck(ctx, summary, state)
+}
+
+// newRepairCmd returns the command running the guided repository recovery
+func newRepairCmd() *cobra.Command {
+	var (
+		snapshots bool
+		yes       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Check the repository and repair the index and snapshots",
+		Long: "Checks the repository and runs the guided recovery sequence when it is damaged: the index is rebuilt " +
+			"with restic repair index, then the repository is checked again. Removing the damaged data from the " +
+			"snapshots with restic repair snapshots --forget cannot be undone, so it only runs with --snapshots and " +
+			"has to be confirmed.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+			w := cmd.OutOrStdout()
+
+			fileLock := newFileLock()
+			locked, err := fileLock.TryLock()
+			if err != nil {
+				return fmt.Errorf("cannot lock the lock file: %w", err)
+			}
+			if !locked {
+				return errors.New("another instance of the program is already running")
+			}
+			defer fileLock.Unlock()
+
+			state, err := loadState()
+			if err != nil {
+				return err
+			}
+			setupEnv()
+			summary := &runSummary{HostName: appConfig.HostName}
+			// Record the final check, so a repaired repository can be pruned again
+			defer func() {
+				if check := summary.stage("check"); check != nil {
+					state.recordCheck(check.Err == nil, time.Now(), summary.CheckSubset)
+					if err := state.save(); err != nil {
+						log.WithField("err", err).Error("cannot save the state")
+					}
+				}
+			}()
+
+			fmt.Fprintln(w, "Checking the repository")
+			output, err := runCheck(ctx, summary, state)
+			if err == nil {
+				fmt.Fprintln(w, "The repository has no errors")
+				return nil
+			}
+			if indexDamagedRe.MatchString(checkErrors(output, err)) {
+				fmt.Fprintln(w, "The index is damaged, running restic repair index")
+				if output, err = repairIndex(ctx, summary, state); err == nil {
+					fmt.Fprintln(w, "The repository has no errors after repairing the index")
+					return nil
+				}
+			}
+			if !snapshotsDamagedRe.MatchString(checkErrors(output, err)) {
+				return fmt.Errorf("the repository check failed, see the log for the errors: %w", err)
+			}
+
+			if !snapshots {
+				return errors.New("data referenced by the snapshots is missing, " +
+					"run with --snapshots to remove it from the snapshots (cannot be undone)")
+			}
+			if !yes {
+				confirmed, err := confirm(cmd, "The damaged files will be removed from the snapshots and the original snapshots forgotten.")
+				if err != nil {
+					return err
+				}
+				if !confirmed {
+					return errors.New("the snapshot repair was not confirmed")
+				}
+			}
+			log.Warn("Removing the damaged data from the snapshots with restic repair snapshots --forget")
+			fmt.Fprintln(w, "Running restic repair snapshots --forget")
+			if _, err = summary.runNamedStage(ctx, "repair snapshots", "repair", "snapshots", "--forget"); err != nil {
+				return fmt.Errorf("restic repair snapshots failed: %w", err)
+			}
+			fmt.Fprintln(w, "Checking the repository again")
+			if _, err = runCheck(ctx, summary, state); err != nil {
+				return fmt.Errorf("the repository check still fails: %w", err)
+			}
+			fmt.Fprintln(w, "The repository has no errors after repairing the snapshots")
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&snapshots, "snapshots", false, "remove the damaged data from the snapshots if needed (destructive)")
+	cmd.Flags().BoolVar(&yes, "yes", false, "repair the snapshots without asking for confirmation")
+	return cmd
+}
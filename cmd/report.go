@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// backupReport aggregates the run history over a period
+type backupReport struct {
+	HostName    string
+	From        time.Time
+	To          time.Time
+	Runs        int
+	Successful  int
+	Degraded    int
+	Failed      int
+	LastSuccess time.Time
+	BytesAdded  int64
+	// BytesProcessed and Throughput cover the runs whose throughput is known
+	BytesProcessed  int64
+	ProcessedAdded  int64
+	Throughput      float64
+	throughputCount int
+
+	RepoSize       int64
+	RepoSizeChange int64
+	RepoSizeSince  time.Time
+
+	Checks       int
+	ChecksFailed int
+	Failures     []historyRun
+}
+
+// DedupRatio returns how many times more data the backups read than they added to the repository
+func (r *backupReport) DedupRatio() float64 {
+	if r.ProcessedAdded == 0 {
+		return 0
+	}
+	return float64(r.BytesProcessed) / float64(r.ProcessedAdded)
+}
+
+// SuccessRate returns the percentage of successful runs
+func (r *backupReport) SuccessRate() float64 {
+	if r.Runs == 0 {
+		return 0
+	}
+	return float64(r.Successful) / float64(r.Runs) * 100
+}
+
+const markdownReport = `# Backup report for {{ .HostName }}
+
+{{ .From.Format "2006-01-02" }} – {{ .To.Format "2006-01-02" }}
+
+## Runs
+
+- Runs: {{ .Runs }}
+- Successful: {{ .Successful }} ({{ printf "%.1f" .SuccessRate }}%)
+- Partial or incomplete: {{ .Degraded }}
+- Failed: {{ .Failed }}
+- Last successful backup: {{ if .LastSuccess.IsZero }}never{{ else }}{{ .LastSuccess.Format "2006-01-02 15:04" }}{{ end }}
+
+## Growth
+
+- Data added: {{ bytes .BytesAdded }}
+{{- if .Throughput }}
+- Average throughput: {{ rate .Throughput }}
+- Dedup ratio: {{ printf "%.1f" .DedupRatio }}x
+{{- end }}
+{{- if .RepoSize }}
+- Repository size: {{ bytes .RepoSize }}
+{{- if not .RepoSizeSince.IsZero }}
+- Repository size change since {{ .RepoSizeSince.Format "2006-01-02" }}: {{ signedBytes .RepoSizeChange }}
+{{- end }}
+{{- end }}
+
+## Repository checks
+
+- Checks: {{ .Checks }}
+- Failed checks: {{ .ChecksFailed }}
+{{- if .Failures }}
+
+## Failed runs
+{{ range .Failures }}
+- {{ .StartedAt.Local.Format "2006-01-02 15:04" }}{{ if .Recovery }} (recovery: {{ .Recovery }}){{ end }}
+{{- end }}
+{{- end }}
+`
+
+const htmlReport = `<h1>Backup report for {{ .HostName }}</h1>
+<p>{{ .From.Format "2006-01-02" }} – {{ .To.Format "2006-01-02" }}</p>
+<h2>Runs</h2>
+<ul>
+<li>Runs: {{ .Runs }}</li>
+<li>Successful: {{ .Successful }} ({{ printf "%.1f" .SuccessRate }}%)</li>
+<li>Partial or incomplete: {{ .Degraded }}</li>
+<li>Failed: {{ .Failed }}</li>
+<li>Last successful backup: {{ if .LastSuccess.IsZero }}never{{ else }}{{ .LastSuccess.Format "2006-01-02 15:04" }}{{ end }}</li>
+</ul>
+<h2>Growth</h2>
+<ul>
+<li>Data added: {{ bytes .BytesAdded }}</li>
+{{- if .Throughput }}
+<li>Average throughput: {{ rate .Throughput }}</li>
+<li>Dedup ratio: {{ printf "%.1f" .DedupRatio }}x</li>
+{{- end }}
+{{- if .RepoSize }}
+<li>Repository size: {{ bytes .RepoSize }}</li>
+{{- if not .RepoSizeSince.IsZero }}
+<li>Repository size change since {{ .RepoSizeSince.Format "2006-01-02" }}: {{ signedBytes .RepoSizeChange }}</li>
+{{- end }}
+{{- end }}
+</ul>
+<h2>Repository checks</h2>
+<ul>
+<li>Checks: {{ .Checks }}</li>
+<li>Failed checks: {{ .ChecksFailed }}</li>
+</ul>
+{{- if .Failures }}
+<h2>Failed runs</h2>
+<ul>
+{{- range .Failures }}
+<li>{{ .StartedAt.Local.Format "2006-01-02 15:04" }}{{ if .Recovery }} (recovery: {{ .Recovery }}){{ end }}</li>
+{{- end }}
+</ul>
+{{- end }}
+`
+
+// signedBytes formats the size difference with its sign
+func signedBytes(size int64) string {
+	if size < 0 {
+		return "-" + formatBytes(-size)
+	}
+	return "+" + formatBytes(size)
+}
+
+// buildReport aggregates the runs of the history between from and to
+func buildReport(state *runState, runs []historyRun, from, to time.Time) *backupReport {
+	report := &backupReport{
+		HostName:    appConfig.HostName,
+		From:        from,
+		To:          to,
+		LastSuccess: state.LastSuccess,
+	}
+	for _, run := range runs {
+		if run.StartedAt.Before(from) || run.StartedAt.After(to) {
+			continue
+		}
+		report.Runs++
+		report.BytesAdded += run.BytesAdded
+		if run.Throughput > 0 {
+			report.BytesProcessed += run.BytesProcessed
+			report.ProcessedAdded += run.BytesAdded
+			// The running mean of the throughput of the runs
+			report.throughputCount++
+			report.Throughput += (run.Throughput - report.Throughput) / float64(report.throughputCount)
+		}
+		switch run.Status {
+		case runStatusSuccess:
+			report.Successful++
+		case runStatusFailed:
+			report.Failed++
+			report.Failures = append(report.Failures, run)
+		default:
+			report.Degraded++
+		}
+		if run.CheckPassed != nil {
+			report.Checks++
+			if !*run.CheckPassed {
+				report.ChecksFailed++
+			}
+		}
+	}
+
+	// Compare the current repository size with the oldest sample within the period
+	if n := len(state.RepoSizes); n > 0 {
+		current := state.RepoSizes[n-1]
+		report.RepoSize = current.Size
+		for _, sample := range state.RepoSizes[:n-1] {
+			if !sample.Time.Before(from) {
+				report.RepoSizeSince = sample.Time
+				report.RepoSizeChange = current.Size - sample.Size
+				break
+			}
+		}
+	}
+	return report
+}
+
+// renderReport renders the report as Markdown or HTML
+func renderReport(report *backupReport, format string) (string, error) {
+	funcs := map[string]any{
+		"bytes":       formatBytes,
+		"signedBytes": signedBytes,
+		"rate":        formatRate,
+	}
+	var b strings.Builder
+	switch format {
+	case "markdown":
+		tmpl := template.Must(template.New("report").Funcs(funcs).Parse(markdownReport))
+		if err := tmpl.Execute(&b, report); err != nil {
+			return "", fmt.Errorf("failed to render the report: %w", err)
+		}
+	case "html":
+		tmpl := htmltemplate.Must(htmltemplate.New("report").Funcs(funcs).Parse(htmlReport))
+		if err := tmpl.Execute(&b, report); err != nil {
+			return "", fmt.Errorf("failed to render the report: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown report format %q", format)
+	}
+	return b.String(), nil
+}
+
+// repositorySize returns the size of the data stored in the repository
+func repositorySize(ctx context.Context) (int64, error) {
+	output, err := runResticCommand(ctx, "stats", "--mode", "raw-data", "--json")
+	if err != nil {
+		return 0, err
+	}
+	var stats struct {
+		TotalSize int64 `json:"total_size"`
+	}
+	if err = json.Unmarshal([]byte(output), &stats); err != nil {
+		return 0, fmt.Errorf("failed to parse restic stats: %w", err)
+	}
+	return stats.TotalSize, nil
+}
+
+// sendReport builds the report of the last days, writes it to w and sends it via the configured notifiers unless
+// dryRun is set, recording when it was sent
+func sendReport(ctx context.Context, w io.Writer, days int, format string, dryRun bool) error {
+	// Wait for a running backup, the report updates the state
+	fileLock := newFileLock()
+	if _, err := fileLock.TryLockContext(ctx, time.Second); err != nil {
+		return fmt.Errorf("cannot lock the lock file: %w", err)
+	}
+	defer fileLock.Unlock()
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	setupEnv()
+	size, err := repositorySize(ctx)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot get the repository size")
+	} else {
+		state.RepoSizes = append(state.RepoSizes, repoSizeSample{Time: time.Now(), Size: size})
+		if len(state.RepoSizes) > historyLimit {
+			state.RepoSizes = state.RepoSizes[len(state.RepoSizes)-historyLimit:]
+		}
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -days)
+	report := buildReport(state, profileRuns(from), from, to)
+	text, err := renderReport(report, format)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, text)
+
+	if !dryRun {
+		summary := &runSummary{HostName: appConfig.HostName, Status: runStatusSuccess}
+		broadcastMessage(ctx, setupNotifiers(), summary, message{
+			Title: fmt.Sprintf("Backup report for %s: %d days", appConfig.HostName, days),
+			Body:  text,
+		})
+		state.LastReport = to
+	}
+	return state.save()
+}
+
+// reportDue returns when the daemon sends the next report: daemon.report.interval after the last report, or after
+// the start of the daemon when no report was sent yet. Zero when the reports are disabled.
+func reportDue(started time.Time) time.Time {
+	if appConfig.Daemon.Report.Interval <= 0 {
+		return time.Time{}
+	}
+	state, err := loadState()
+	if err != nil {
+		log.WithField("err", err).Warn("cannot read the state, scheduling the report from the start of the daemon")
+		state = &runState{}
+	}
+	last := state.LastReport
+	if last.IsZero() {
+		last = started
+	}
+	return last.Add(appConfig.Daemon.Report.Interval)
+}
+
+// runDaemonReport sends the report of the last daemon.report.interval, a failure is logged and retried at the next
+// interval
+func runDaemonReport(ctx context.Context) {
+	days := max(int(appConfig.Daemon.Report.Interval/(24*time.Hour)), 1)
+	reportCtx, cancel := context.WithTimeout(ctx, appConfig.MaxRuntime)
+	defer cancel()
+	log.WithField("days", days).Info("Sending the backup report")
+	if err := sendReport(reportCtx, io.Discard, days, appConfig.Daemon.Report.Format, false); err != nil {
+		log.WithField("err", err).Error("The backup report failed")
+	}
+}
+
+// newReportCmd returns the command generating the backup report
+func newReportCmd() *cobra.Command {
+	var (
+		weekly bool
+		days   int
+		format string
+		dryRun bool
+	)
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Generate a report of the recent backups and send it via the configured notifiers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if weekly {
+				days = 7
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+			return sendReport(ctx, cmd.OutOrStdout(), days, format, dryRun)
+		},
+	}
+	cmd.Flags().BoolVar(&weekly, "weekly", false, "report the last 7 days")
+	cmd.Flags().IntVar(&days, "days", 7, "number of days to report")
+	cmd.Flags().StringVar(&format, "format", "markdown", "report format: markdown or html")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the report without sending it")
+	return cmd
+}
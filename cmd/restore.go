@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// resticVersion is the version of the installed restic, e.g. {0, 17, 3}
+type resticVersion [3]int
+
+// resticVersionRe matches the version in the output of restic version
+var resticVersionRe = regexp.MustCompile(`restic (\d+)\.(\d+)\.(\d+)`)
+
+// String returns the version as "0.17.3"
+func (v resticVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// atLeast reports whether the version is the same as or newer than the given one
+func (v resticVersion) atLeast(major, minor, patch int) bool {
+	for i, n := range []int{major, minor, patch} {
+		if v[i] != n {
+			return v[i] > n
+		}
+	}
+	return true
+}
+
+// installedResticVersion returns the version of the configured restic executable
+func installedResticVersion(ctx context.Context) (resticVersion, error) {
+	var version resticVersion
+	output, err := runResticCommand(ctx, "version")
+	if err != nil {
+		return version, err
+	}
+	match := resticVersionRe.FindStringSubmatch(output)
+	if match == nil {
+		return version, fmt.Errorf("cannot parse the restic version from %q", output)
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	return version, nil
+}
+
+// restoreOptions holds the restore options passed to restic restore
+type restoreOptions struct {
+	sparse        bool
+	includeXattrs []string
+	excludeXattrs []string
+	acls          bool
+	// overwrite is the restic --overwrite policy, empty keeps the restic default
+	overwrite string
+	verify    bool
+	// connections is the number of parallel connections to the backend, 0 keeps the restic default
+	connections int
+}
+
+// configRestoreOptions returns the restore options of the restore section of the configuration
+func configRestoreOptions() restoreOptions {
+	return restoreOptions{
+		sparse:        appConfig.Restore.Sparse,
+		includeXattrs: appConfig.Restore.IncludeXattrs,
+		excludeXattrs: appConfig.Restore.ExcludeXattrs,
+		acls:          appConfig.Restore.ACLs,
+		overwrite:     appConfig.Restore.Overwrite,
+		verify:        appConfig.Restore.Verify,
+		connections:   appConfig.Restore.Connections,
+	}
+}
+
+// overwritePolicies are the values of restic restore --overwrite
+var overwritePolicies = []string{"always", "if-changed", "if-newer", "never"}
+
+// resticBackends are the restic backends taking the connections option
+var resticBackends = []string{"s3", "b2", "azure", "gs", "rest", "swift", "sftp", "rclone"}
+
+// repositoryBackend returns the backend of the repository, e.g. "s3" for "s3:s3.amazonaws.com/bucket"
+func repositoryBackend(repository string) string {
+	if backend, _, found := strings.Cut(repository, ":"); found && slices.Contains(resticBackends, backend) {
+		return backend
+	}
+	return "local"
+}
+
+// aclXattrs are the extended attributes holding the POSIX ACLs on Linux
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// args returns the restic restore flags of the options, validating that the installed restic supports them
+func (o restoreOptions) args(version resticVersion) ([]string, error) {
+	var args []string
+	if o.sparse {
+		if !version.atLeast(0, 14, 0) {
+			return nil, fmt.Errorf("restic %s does not support sparse restores, 0.14.0 or later is required", version)
+		}
+		args = append(args, "--sparse")
+	}
+	excludeXattrs := slices.Clone(o.excludeXattrs)
+	if !o.acls {
+		excludeXattrs = append(excludeXattrs, aclXattrs...)
+	}
+	if len(o.includeXattrs) > 0 || len(excludeXattrs) > 0 {
+		if !version.atLeast(0, 17, 0) {
+			return nil, fmt.Errorf("restic %s cannot filter extended attributes, 0.17.0 or later is required", version)
+		}
+		if len(o.includeXattrs) > 0 && len(excludeXattrs) > 0 {
+			return nil, errors.New("extended attributes can either be included or excluded, not both")
+		}
+	}
+	for _, pattern := range o.includeXattrs {
+		args = append(args, "--include-xattr", pattern)
+	}
+	for _, pattern := range excludeXattrs {
+		args = append(args, "--exclude-xattr", pattern)
+	}
+	if o.overwrite != "" {
+		if !slices.Contains(overwritePolicies, o.overwrite) {
+			return nil, fmt.Errorf("invalid overwrite policy %q, expected one of %s", o.overwrite,
+				strings.Join(overwritePolicies, ", "))
+		}
+		if !version.atLeast(0, 17, 0) {
+			return nil, fmt.Errorf("restic %s does not support overwrite policies, 0.17.0 or later is required", version)
+		}
+		args = append(args, "--overwrite", o.overwrite)
+	}
+	if o.verify {
+		args = append(args, "--verify")
+	}
+	if o.connections > 0 {
+		args = append(args, "-o", fmt.Sprintf("%s.connections=%d", repositoryBackend(os.Getenv("RESTIC_REPOSITORY")), o.connections))
+	}
+	return args, nil
+}
+
+// Restore summary lines of restic, e.g. "Summary: Restored 12 files/dirs (1.2 MiB) in 0:01, skipped 3 files/dirs 4 KiB"
+var (
+	restoreSummaryRe  = regexp.MustCompile(`Summary: Restored (\d+) files/dirs \(([^)]+)\) in [^,\s]+(?:, skipped (\d+) files/dirs (.+))?`)
+	restoreVerifiedRe = regexp.MustCompile(`finished verifying (\d+) files`)
+)
+
+// restoreSummary returns a short summary of the restore from the output of restic restore, or an empty string
+func restoreSummary(output string, verify bool, err error) string {
+	var parts []string
+	if match := restoreSummaryRe.FindStringSubmatch(output); match != nil {
+		parts = append(parts, fmt.Sprintf("restored %s files and directories (%s)", match[1], match[2]))
+		if match[3] != "" {
+			parts = append(parts, fmt.Sprintf("skipped %s unchanged (%s)", match[3], strings.TrimSpace(match[4])))
+		}
+	}
+	if verify {
+		switch match := restoreVerifiedRe.FindStringSubmatch(output); {
+		case err != nil:
+			reason := fatalError(err)
+			if reason == "" {
+				reason = err.Error()
+			}
+			parts = append(parts, "verification failed: "+reason)
+		case match != nil:
+			parts = append(parts, "verified "+match[1]+" files")
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.ToUpper(parts[0][:1]) + strings.Join(parts, ", ")[1:]
+}
+
+// newRestoreCmd returns the command restoring a snapshot
+func newRestoreCmd() *cobra.Command {
+	var (
+		target      string
+		includes    []string
+		askPassword bool
+		delta       bool
+		coldStorage = appConfig.Restore.ColdStorage.Enabled
+		noWait      bool
+		opts        = configRestoreOptions()
+	)
+	cmd := &cobra.Command{
+		Use:   "restore <snapshot-id>",
+		Short: "Restore a snapshot",
+		Long: "Restores the snapshot (or \"latest\") to the target directory. The sparse file, extended attribute, " +
+			"overwrite, verification and connection options default to the restore section of the configuration " +
+			"and are validated against the installed restic version. When the repository password is not " +
+			"available, it is asked for on the terminal; --ask-password always asks for it, e.g. to restore from a " +
+			"repository whose password is not stored on the machine. With --delta the target is compared with the " +
+			"snapshot first (size and modification time) and only the differing files are restored, restic then " +
+			"rewrites only their changed chunks; --include then takes paths of the snapshot limiting the comparison. " +
+			"With --cold-storage the packs of the files to restore are restored from the S3 Glacier storage classes " +
+			"first, waiting until all of them are readable; --no-wait only requests them, run the restore again later.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			setupEnv()
+			if err := promptPassword(askPassword); err != nil {
+				return err
+			}
+			version, err := installedResticVersion(ctx)
+			if err != nil {
+				return fmt.Errorf("cannot get the restic version: %w", err)
+			}
+			optionArgs, err := opts.args(version)
+			if err != nil {
+				return err
+			}
+
+			restoreArgs := append([]string{"restore", args[0], "--target", expandPath(target)}, optionArgs...)
+			// The paths of the snapshot restored, all of them when empty
+			restored := includes
+			if delta {
+				if !version.atLeast(0, 17, 0) {
+					return fmt.Errorf("restic %s cannot restore a delta, 0.17.0 or later is required", version)
+				}
+				// The includes are the paths the comparison is limited to
+				changed, total, size, err := restoreDelta(ctx, args[0], expandPath(target), includes)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%d of %d files differ from the snapshot, %s to restore\n", len(changed), total,
+					formatBytes(size))
+				if len(changed) == 0 {
+					return nil
+				}
+				includeFile, err := writeIncludeFile(changed)
+				if err != nil {
+					return err
+				}
+				defer os.Remove(includeFile)
+				restoreArgs = append(restoreArgs, "--include-file", includeFile)
+				restored = changed
+				if opts.overwrite == "" {
+					restoreArgs = append(restoreArgs, "--overwrite", "if-changed")
+				}
+				includes = nil
+			}
+			if coldStorage {
+				ready, err := warmUpColdStorage(ctx, cmd.OutOrStdout(), args[0], restored, !noWait)
+				if err != nil || !ready {
+					return err
+				}
+			}
+			for _, include := range includes {
+				restoreArgs = append(restoreArgs, "--include", include)
+			}
+			output, err := runResticCommand(ctx, restoreArgs...)
+			fmt.Fprint(cmd.OutOrStdout(), output)
+			if summary := restoreSummary(output, opts.verify, err); summary != "" {
+				fmt.Fprintln(cmd.OutOrStdout(), summary)
+			}
+			if err != nil {
+				return fmt.Errorf("restic restore failed: %w", err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&target, "target", "", "directory to restore the files to")
+	cmd.MarkFlagRequired("target")
+	cmd.Flags().StringArrayVar(&includes, "include", nil, "only restore the files matching the pattern (can be repeated)")
+	cmd.Flags().BoolVar(&opts.sparse, "sparse", opts.sparse, "restore files as sparse files")
+	cmd.Flags().StringArrayVar(&opts.includeXattrs, "include-xattr", opts.includeXattrs, "only restore the extended attributes matching the pattern (can be repeated)")
+	cmd.Flags().StringArrayVar(&opts.excludeXattrs, "exclude-xattr", opts.excludeXattrs, "do not restore the extended attributes matching the pattern (can be repeated)")
+	cmd.Flags().BoolVar(&opts.acls, "acls", opts.acls, "restore the ACLs stored as extended attributes")
+	cmd.Flags().StringVar(&opts.overwrite, "overwrite", opts.overwrite, "overwrite the existing files: always, if-changed, if-newer or never")
+	cmd.Flags().BoolVar(&opts.verify, "verify", opts.verify, "verify the restored files against the snapshot")
+	cmd.Flags().IntVar(&opts.connections, "connections", opts.connections, "number of parallel connections to the backend")
+	cmd.Flags().BoolVar(&delta, "delta", false, "only restore the files that differ from the target")
+	cmd.Flags().BoolVar(&coldStorage, "cold-storage", coldStorage, "restore the packs from the S3 Glacier storage classes first")
+	cmd.Flags().BoolVar(&noWait, "no-wait", false, "with --cold-storage, request the packs and exit without waiting for them")
+	cmd.Flags().BoolVar(&askPassword, "ask-password", false, "ask for the repository password on the terminal")
+	return cmd
+}
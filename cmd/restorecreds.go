@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/spf13/cobra"
+)
+
+// s3Location splits the S3 repository into its bucket and the prefix of the repository in the bucket
+func s3Location(repository string) (string, string, error) {
+	location, found := strings.CutPrefix(repository, "s3:")
+	if !found {
+		return "", "", fmt.Errorf("the repository %q is not on S3", repository)
+	}
+	if !strings.Contains(location, "://") {
+		location = "https://" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository URL: %w", err)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("the repository %q has no bucket", repository)
+	}
+	return bucket, prefix, nil
+}
+
+// restorePolicy returns the IAM policy of the restore credentials: reading the repository, and writing and deleting
+// the locks so the restic commands work without --no-lock
+func restorePolicy(bucket, prefix string) (string, error) {
+	objects := "arn:aws:s3:::" + bucket + "/*"
+	locks := "arn:aws:s3:::" + bucket + "/locks/*"
+	if prefix != "" {
+		objects = "arn:aws:s3:::" + bucket + "/" + prefix + "/*"
+		locks = "arn:aws:s3:::" + bucket + "/" + prefix + "/locks/*"
+	}
+	list := map[string]any{"Effect": "Allow", "Action": []string{"s3:ListBucket"}, "Resource": "arn:aws:s3:::" + bucket}
+	if prefix != "" {
+		// The other repositories of the bucket are not listed either
+		list["Condition"] = map[string]any{"StringLike": map[string]any{"s3:prefix": []string{prefix, prefix + "/*"}}}
+	}
+	policy := map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{
+			list,
+			{"Effect": "Allow", "Action": []string{"s3:GetBucketLocation"}, "Resource": "arn:aws:s3:::" + bucket},
+			{"Effect": "Allow", "Action": []string{"s3:GetObject"}, "Resource": objects},
+			{"Effect": "Allow", "Action": []string{"s3:PutObject", "s3:DeleteObject"}, "Resource": locks},
+		},
+	}
+	data, err := json.Marshal(policy)
+	return string(data), err
+}
+
+// restoreCredentials returns temporary credentials limited to the restore policy. With restore_credentials.role_arn
+// the role is assumed, otherwise a federation token of the IAM user of the restic credentials is requested.
+func restoreCredentials(ctx context.Context, policy string, duration time.Duration) (*types.Credentials, error) {
+	cfg, err := loadAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		// STS is a global service
+		cfg.Region = "us-east-1"
+	}
+	client := sts.NewFromConfig(cfg)
+	seconds := aws.Int32(int32(duration.Seconds()))
+	if appConfig.RestoreCredentials.RoleARN != "" {
+		// The name of a role session is at most 64 characters
+		session := "restic_wrapper-restore-" + appConfig.HostName
+		output, err := client.AssumeRole(ctx, &sts.AssumeRoleInput{
+			RoleArn:         aws.String(appConfig.RestoreCredentials.RoleARN),
+			RoleSessionName: aws.String(session[:min(len(session), 64)]),
+			Policy:          aws.String(policy),
+			DurationSeconds: seconds,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to assume the restore role: %w", err)
+		}
+		return output.Credentials, nil
+	}
+	// The name of a federated user is at most 32 characters
+	name := "restore-" + appConfig.HostName
+	output, err := client.GetFederationToken(ctx, &sts.GetFederationTokenInput{
+		Name:            aws.String(name[:min(len(name), 32)]),
+		Policy:          aws.String(policy),
+		DurationSeconds: seconds,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a federation token: %w", err)
+	}
+	return output.Credentials, nil
+}
+
+// writeRestoreEnv prints the environment of the restore as shell exports
+func writeRestoreEnv(w io.Writer, repository string, credentials *types.Credentials, password string) {
+	vars := [][2]string{
+		{"RESTIC_REPOSITORY", repository},
+		{"AWS_ACCESS_KEY_ID", aws.ToString(credentials.AccessKeyId)},
+		{"AWS_SECRET_ACCESS_KEY", aws.ToString(credentials.SecretAccessKey)},
+		{"AWS_SESSION_TOKEN", aws.ToString(credentials.SessionToken)},
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		vars = append(vars, [2]string{"AWS_DEFAULT_REGION", region})
+	}
+	if password != "" {
+		vars = append(vars, [2]string{"RESTIC_PASSWORD", password})
+	}
+	fmt.Fprintf(w, "# Read-only restore credentials of %s, valid until %s\n", appConfig.HostName,
+		aws.ToTime(credentials.Expiration).Local().Format("2006-01-02 15:04 MST"))
+	for _, v := range vars {
+		fmt.Fprintf(w, "export %s='%s'\n", v[0], strings.ReplaceAll(v[1], "'", `'\''`))
+	}
+}
+
+// newRestoreCredentialsCmd returns the command creating temporary read-only credentials for a restore
+func newRestoreCredentialsCmd() *cobra.Command {
+	var (
+		duration        time.Duration
+		includePassword bool
+	)
+	cmd := &cobra.Command{
+		Use:   "restore-credentials",
+		Short: "Create temporary read-only credentials to restore on an untrusted machine",
+		Long: "Requests temporary AWS credentials limited to reading the S3 repository (and taking the restic " +
+			"locks) and prints them as shell exports for a temporary or untrusted machine, so the full read-write " +
+			"keys never touch it. The credentials expire after --duration.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			setupEnv()
+			repository := os.Getenv("RESTIC_REPOSITORY")
+			bucket, prefix, err := s3Location(repository)
+			if err != nil {
+				return err
+			}
+			policy, err := restorePolicy(bucket, prefix)
+			if err != nil {
+				return err
+			}
+			password := ""
+			if includePassword {
+				if password, err = repositoryPassword(ctx); err != nil {
+					return err
+				}
+			}
+			if duration == 0 {
+				duration = appConfig.RestoreCredentials.Duration
+			}
+			if duration < 15*time.Minute {
+				return errors.New("the credentials must be valid for at least 15 minutes")
+			}
+			credentials, err := restoreCredentials(ctx, policy, duration)
+			if err != nil {
+				return err
+			}
+			writeRestoreEnv(cmd.OutOrStdout(), repository, credentials, password)
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&duration, "duration", 0, "how long the credentials are valid, restore_credentials.duration by default")
+	cmd.Flags().BoolVar(&includePassword, "include-password", false, "also export the repository password")
+	return cmd
+}
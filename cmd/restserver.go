@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// restServerStartTimeout is how long a started rest-server has to answer
+	restServerStartTimeout = 10 * time.Second
+	// restServerHealthInterval is how often the daemon checks that its rest-server answers
+	restServerHealthInterval = 30 * time.Second
+	// restServerMaxBackoff caps the delay between the restarts of a crashing rest-server
+	restServerMaxBackoff = 5 * time.Minute
+)
+
+// restServerURL returns the URL of the managed rest-server
+func restServerURL() string {
+	return "http://" + appConfig.RestServer.Listen + "/"
+}
+
+// restServerRepository returns the restic repository served by the managed rest-server
+func restServerRepository() string {
+	return "rest:" + restServerURL()
+}
+
+// restServerHealthy checks that the rest-server answers HTTP requests, any status below 500 is an answer
+func restServerHealthy(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, restServerURL(), nil)
+	if err != nil {
+		return err
+	}
+	// The server is local, it is never reached through the proxies
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("rest-server answered %s", resp.Status)
+	}
+	return nil
+}
+
+// restServer is a running rest-server process
+type restServer struct {
+	cmd  *exec.Cmd
+	done chan error
+}
+
+// startRestServer starts rest-server and waits until it answers
+func startRestServer(ctx context.Context) (*restServer, error) {
+	// rest-server creates a missing directory, e.g. the mount point of a NAS that is not mounted
+	if _, err := os.Stat(expandPath(appConfig.RestServer.DataDir)); err != nil {
+		return nil, fmt.Errorf("the rest-server directory is not available: %w", err)
+	}
+	args := []string{"--path", expandPath(appConfig.RestServer.DataDir), "--listen", appConfig.RestServer.Listen}
+	if appConfig.RestServer.AppendOnly {
+		args = append(args, "--append-only")
+	}
+	if appConfig.RestServer.HtpasswdFile != "" {
+		args = append(args, "--htpasswd-file", expandPath(appConfig.RestServer.HtpasswdFile))
+	} else {
+		args = append(args, "--no-auth")
+	}
+	args = append(args, appConfig.RestServer.Args...)
+	cmd := exec.Command(appConfig.RestServer.Path, args...)
+	// The output of rest-server goes to the log of the program
+	cmd.Stdout = log.StandardLogger().WriterLevel(log.InfoLevel)
+	cmd.Stderr = log.StandardLogger().WriterLevel(log.WarnLevel)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start rest-server: %w", err)
+	}
+	server := &restServer{cmd: cmd, done: make(chan error, 1)}
+	go func() { server.done <- cmd.Wait() }()
+
+	deadline := time.Now().Add(restServerStartTimeout)
+	for {
+		err := restServerHealthy(ctx)
+		if err == nil {
+			log.WithFields(log.Fields{"pid": cmd.Process.Pid, "listen": appConfig.RestServer.Listen}).Info("Started rest-server")
+			return server, nil
+		}
+		select {
+		case exitErr := <-server.done:
+			return nil, fmt.Errorf("rest-server exited at the start: %v", exitErr)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			server.stop()
+			return nil, fmt.Errorf("rest-server does not answer: %w", err)
+		}
+	}
+}
+
+// stop terminates rest-server gracefully, killing it after the grace period
+func (s *restServer) stop() {
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(appConfig.StopGracePeriod):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+	log.WithField("pid", s.cmd.Process.Pid).Info("Stopped rest-server")
+}
+
+// ensureRestServer starts rest-server for the run unless it is already running, e.g. supervised by the daemon, and
+// returns the function stopping the one it started
+func ensureRestServer(ctx context.Context) (func(), error) {
+	if !appConfig.RestServer.Enabled || restServerHealthy(ctx) == nil {
+		return func() {}, nil
+	}
+	server, err := startRestServer(ctx)
+	if err != nil {
+		return func() {}, err
+	}
+	// Called before the exits of the run as well as deferred
+	return sync.OnceFunc(server.stop), nil
+}
+
+// superviseRestServer runs rest-server until the context is done, restarting it when it exits or stops answering
+func superviseRestServer(ctx context.Context) {
+	backoff := time.Second
+	for {
+		server, err := startRestServer(ctx)
+		if err == nil {
+			started := time.Now()
+			err = watchRestServer(ctx, server)
+			if time.Since(started) > restServerMaxBackoff {
+				// It was up for a while, it is not crashing in a loop
+				backoff = time.Second
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithFields(log.Fields{"err": err, "retry_in": backoff}).Error("rest-server failed, restarting it")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, restServerMaxBackoff)
+	}
+}
+
+// watchRestServer health-checks the running rest-server, stopping it with the context. It returns why it stopped.
+func watchRestServer(ctx context.Context, server *restServer) error {
+	ticker := time.NewTicker(restServerHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			server.stop()
+			return ctx.Err()
+		case err := <-server.done:
+			if err == nil {
+				err = errors.New("rest-server exited")
+			}
+			return err
+		case <-ticker.C:
+			if err := restServerHealthy(ctx); err != nil && ctx.Err() == nil {
+				server.stop()
+				return fmt.Errorf("rest-server stopped answering: %w", err)
+			}
+		}
+	}
+}
+
+// restServerEnv points restic at the managed rest-server, its credentials are read with the other secrets
+func restServerEnv() {
+	if appConfig.RestServer.Enabled {
+		os.Setenv("RESTIC_REPOSITORY", restServerRepository())
+	}
+}
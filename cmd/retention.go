@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// retentionArgs returns the restic forget arguments implementing the retention policy
+func retentionArgs() []string {
+	return []string{
+		"--keep-hourly", "4",
+		"--keep-daily", "7",
+		"--keep-weekly", "5",
+		"--keep-monthly", "12",
+		"--keep-yearly", "5",
+		"--keep-tag", appConfig.Retention.KeepTag,
+	}
+}
+
+// forgetGroup is a group of snapshots as printed by restic forget --json
+type forgetGroup struct {
+	Host    string     `json:"host"`
+	Paths   []string   `json:"paths"`
+	Tags    []string   `json:"tags"`
+	Keep    []snapshot `json:"keep"`
+	Remove  []snapshot `json:"remove"`
+	Reasons []struct {
+		Snapshot snapshot `json:"snapshot"`
+		Matches  []string `json:"matches"`
+	} `json:"reasons"`
+}
+
+// explainForget prints, per snapshot, whether it is kept or removed and by which rule
+func explainForget(w io.Writer, groups []forgetGroup) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "host %s, paths %s\n", group.Host, strings.Join(group.Paths, ", "))
+		reasons := make(map[string][]string, len(group.Reasons))
+		for _, reason := range group.Reasons {
+			reasons[reason.Snapshot.ID] = reason.Matches
+		}
+		for _, s := range group.Keep {
+			fmt.Fprintf(tw, "  keep\t%s\t%s\t%s\n", s.ShortID, s.Time.Local().Format("2006-01-02 15:04"), strings.Join(reasons[s.ID], ", "))
+		}
+		for _, s := range group.Remove {
+			fmt.Fprintf(tw, "  remove\t%s\t%s\t%s\n", s.ShortID, s.Time.Local().Format("2006-01-02 15:04"), "no retention rule matches")
+		}
+	}
+	return tw.Flush()
+}
+
+// newForgetCmd returns the command applying the retention policy
+func newForgetCmd() *cobra.Command {
+	var (
+		dryRun  bool
+		explain bool
+		prune   bool
+		force   bool
+	)
+	cmd := &cobra.Command{
+		Use:   "forget",
+		Short: "Remove the snapshots outside the retention policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			// The explanation is a preview, it never removes anything
+			dryRun = dryRun || explain
+			if !dryRun {
+				fileLock := newFileLock()
+				locked, err := fileLock.TryLock()
+				if err != nil {
+					return fmt.Errorf("cannot lock the lock file: %w", err)
+				}
+				if !locked {
+					return fmt.Errorf("another instance of the program is already running")
+				}
+				defer fileLock.Unlock()
+			}
+
+			if prune && !dryRun && !force {
+				state, err := loadState()
+				if err != nil {
+					return err
+				}
+				if reason := pruneBlockedReason(state, nil, time.Now()); reason != "" {
+					return fmt.Errorf("refusing to prune, %s (use --force to prune anyway)", reason)
+				}
+			}
+
+			setupEnv()
+			forgetArgs := append([]string{"forget"}, retentionArgs()...)
+			if dryRun {
+				forgetArgs = append(forgetArgs, "--dry-run")
+			}
+			if explain {
+				forgetArgs = append(forgetArgs, "--json")
+			}
+			if prune && !dryRun {
+				forgetArgs = append(forgetArgs, "--prune")
+			}
+			output, err := runResticCommand(ctx, forgetArgs...)
+			if err != nil {
+				return fmt.Errorf("restic forget failed: %w", err)
+			}
+			if !explain {
+				fmt.Fprint(cmd.OutOrStdout(), output)
+				return nil
+			}
+
+			// The JSON document is printed on the first line, followed by the prune output if any
+			document, _, _ := strings.Cut(output, "\n")
+			var groups []forgetGroup
+			if err = json.Unmarshal([]byte(document), &groups); err != nil {
+				return fmt.Errorf("failed to parse restic forget output: %w", err)
+			}
+			return explainForget(cmd.OutOrStdout(), groups)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only show what would be removed")
+	cmd.Flags().BoolVar(&explain, "explain", false, "show per snapshot whether it would be kept and by which rule, implies --dry-run")
+	cmd.Flags().BoolVar(&prune, "prune", false, "prune the repository after removing the snapshots")
+	cmd.Flags().BoolVar(&force, "force", false, "prune even if the last repository check failed or is outdated")
+	return cmd
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// newRewriteCmd returns the command removing files from existing snapshots
+func newRewriteCmd() *cobra.Command {
+	var (
+		excludes []string
+		yes      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "rewrite [snapshot-id...]",
+		Short: "Remove accidentally backed up files from existing snapshots",
+		Long: "Rewrites the snapshots (all of them unless snapshot IDs are given) without the files matching the " +
+			"exclude patterns, replacing the original snapshots. A dry-run preview is always shown first and the " +
+			"rewrite has to be confirmed. Run prune afterwards to free the space.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(excludes) == 0 {
+				return errors.New("at least one --exclude pattern is required")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			fileLock := newFileLock()
+			locked, err := fileLock.TryLock()
+			if err != nil {
+				return fmt.Errorf("cannot lock the lock file: %w", err)
+			}
+			if !locked {
+				return errors.New("another instance of the program is already running")
+			}
+			defer fileLock.Unlock()
+
+			setupEnv()
+			rewriteArgs := []string{"rewrite"}
+			for _, exclude := range excludes {
+				rewriteArgs = append(rewriteArgs, "--exclude", exclude)
+			}
+
+			preview, err := runResticCommand(ctx, append(append(rewriteArgs, "--dry-run"), args...)...)
+			if err != nil {
+				return fmt.Errorf("restic rewrite --dry-run failed: %w", err)
+			}
+			fmt.Fprint(cmd.OutOrStdout(), preview)
+
+			if !yes {
+				confirmed, err := confirm(cmd, "The snapshots above will be rewritten and the originals forgotten.")
+				if err != nil {
+					return err
+				}
+				if !confirmed {
+					return errors.New("the rewrite was not confirmed")
+				}
+			}
+
+			output, err := runResticCommand(ctx, append(append(rewriteArgs, "--forget"), args...)...)
+			if err != nil {
+				return fmt.Errorf("restic rewrite failed: %w", err)
+			}
+			fmt.Fprint(cmd.OutOrStdout(), output)
+			return nil
+		},
+	}
+	cmd.Flags().StringArrayVar(&excludes, "exclude", nil, "exclude pattern of the files to remove (can be repeated)")
+	cmd.Flags().BoolVar(&yes, "yes", false, "rewrite without asking for confirmation after the preview")
+	return cmd
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// hookBaseEnv are the environment variables passed to the hooks, the plugins and the commands of the backup script
+var hookBaseEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_ALL", "LC_CTYPE", "TZ", "TMPDIR"}
+
+// hookWaitDelay is how long a hook is waited for after it was killed, e.g. for the children holding its output open
+const hookWaitDelay = 5 * time.Second
+
+// credentialEnv reports whether the environment variable holds a credential of the repository or the storage
+func credentialEnv(name string) bool {
+	if strings.HasPrefix(name, "RESTIC_") || strings.HasPrefix(name, "AWS_") {
+		return true
+	}
+	return slices.ContainsFunc(secretEnvs(), func(secret secretEnv) bool { return secret.env == name })
+}
+
+// hookEnv returns the restricted environment of the hooks: the base variables and the ones passed through with
+// plugins.env. The credentials are only passed when they are listed explicitly.
+func hookEnv() []string {
+	var env []string
+	for _, name := range append(slices.Clone(hookBaseEnv), appConfig.Plugins.Env...) {
+		if value, ok := os.LookupEnv(name); ok && !slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, name+"=") }) {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// hookEnvAllowed reports whether the backup script may read the environment variable
+func hookEnvAllowed(name string) bool {
+	return !credentialEnv(name) || slices.Contains(appConfig.Plugins.Env, name)
+}
+
+// cappedBuffer keeps the first bytes of the output of a hook, dropping the rest. The buffer is not embedded, its
+// ReadFrom would bypass the cap.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(data []byte) (int, error) {
+	n := len(data)
+	if room := b.max - int64(b.buf.Len()); int64(n) > room {
+		b.truncated = true
+		data = data[:max(room, 0)]
+	}
+	b.buf.Write(data)
+	// Keep reading, so the hook is not blocked on a full pipe
+	return n, nil
+}
+
+// Len returns the length of the kept output
+func (b *cappedBuffer) Len() int {
+	return b.buf.Len()
+}
+
+// String returns the kept output, marking a truncated output
+func (b *cappedBuffer) String() string {
+	output := string(bytes.TrimSpace(b.buf.Bytes()))
+	if b.truncated {
+		output += fmt.Sprintf(" [truncated at %s]", formatBytes(b.max))
+	}
+	return output
+}
+
+// hookCommand returns the command of a hook running in the sandbox: with the restricted environment, in the hook
+// working directory and in its own process group, killed with its children at the timeout of the context. It returns
+// the buffer of the output, capped at plugins.max_output, and the function removing the temporary working directory.
+func hookCommand(ctx context.Context, name string, args ...string) (*exec.Cmd, *cappedBuffer, func(), error) {
+	dir, cleanup := expandPath(appConfig.Plugins.WorkDir), func() {}
+	if dir == "" {
+		temp, err := os.MkdirTemp("", "restic_wrapper-hook-")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create the hook working directory: %w", err)
+		}
+		dir, cleanup = temp, func() { os.RemoveAll(temp) }
+	}
+	maxOutput, _ := parseSize(appConfig.Plugins.MaxOutput)
+	output := &cappedBuffer{max: maxOutput}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = hookEnv()
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+	return cmd, output, cleanup, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// launchdLabel is the label of the launchd agent running the backups
+const launchdLabel = "com.github.myarik.restic_wrapper"
+
+// launchAgent describes the launchd agent running the backups on a schedule
+type launchAgent struct {
+	Label     string
+	Arguments []string
+	Interval  int
+	Env       map[string]string
+}
+
+const launchAgentPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{ xml .Label }}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Arguments }}
+		<string>{{ xml . }}</string>
+{{- end }}
+	</array>
+	<key>StartInterval</key>
+	<integer>{{ .Interval }}</integer>
+{{- if .Env }}
+	<key>EnvironmentVariables</key>
+	<dict>
+{{- range $name, $value := .Env }}
+		<key>{{ xml $name }}</key>
+		<string>{{ xml $value }}</string>
+{{- end }}
+	</dict>
+{{- end }}
+</dict>
+</plist>
+`
+
+// newLaunchAgent returns the launchd agent backing up the active profile every interval
+func newLaunchAgent(interval time.Duration) (*launchAgent, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the executable: %w", err)
+	}
+	agent := &launchAgent{
+		Label:     launchdLabel,
+		Arguments: []string{executable},
+		Interval:  int(interval.Seconds()),
+		Env:       map[string]string{},
+	}
+	if activeProfile != "" {
+		agent.Label += "." + activeProfile
+		agent.Arguments = append(agent.Arguments, "--profile", activeProfile)
+	}
+	if configFile := os.Getenv(configFileEnv); configFile != "" {
+		agent.Env[configFileEnv] = configFile
+	}
+	return agent, nil
+}
+
+// path returns the path of the property list of the agent
+func (a *launchAgent) path() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, "Library", "LaunchAgents", a.Label+".plist")
+}
+
+// render returns the property list of the agent
+func (a *launchAgent) render() ([]byte, error) {
+	tmpl := template.Must(template.New("plist").Funcs(template.FuncMap{
+		"xml": template.HTMLEscapeString,
+	}).Parse(launchAgentPlist))
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, a); err != nil {
+		return nil, fmt.Errorf("failed to render the launchd agent: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// install writes and loads the agent. It returns false when the agent was already installed and loaded.
+func (a *launchAgent) install(ctx context.Context) (bool, error) {
+	plist, err := a.render()
+	if err != nil {
+		return false, err
+	}
+	domain := fmt.Sprintf("gui/%d", os.Getuid())
+	current, err := os.ReadFile(a.path())
+	loaded := exec.CommandContext(ctx, "launchctl", "print", domain+"/"+a.Label).Run() == nil
+	if err == nil && bytes.Equal(current, plist) && loaded {
+		return false, nil
+	}
+
+	if err = os.MkdirAll(filepath.Dir(a.path()), 0o755); err != nil {
+		return false, fmt.Errorf("failed to create the launch agents directory: %w", err)
+	}
+	if err = os.WriteFile(a.path(), plist, 0o644); err != nil {
+		return false, fmt.Errorf("failed to write the launchd agent: %w", err)
+	}
+	if loaded {
+		// Reload the changed agent
+		exec.CommandContext(ctx, "launchctl", "bootout", domain+"/"+a.Label).Run()
+	}
+	if output, err := exec.CommandContext(ctx, "launchctl", "bootstrap", domain, a.path()).CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to load the launchd agent: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return true, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// scriptDecision is the result of the backup script for a run
+type scriptDecision struct {
+	// Skip is the reason to skip the backup, empty if the backup runs
+	Skip string
+	// Tags are added to the snapshot
+	Tags []string
+}
+
+// scriptBuiltins returns the functions available to the backup script
+func scriptBuiltins(ctx context.Context) starlark.StringDict {
+	return starlark.StringDict{
+		"getenv": starlark.NewBuiltin("getenv", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &name); err != nil {
+				return nil, err
+			}
+			// The credentials are not readable unless they are passed through to the hooks
+			if !hookEnvAllowed(name) {
+				return starlark.String(""), nil
+			}
+			return starlark.String(os.Getenv(name)), nil
+		}),
+		"exists": starlark.NewBuiltin("exists", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path string
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &path); err != nil {
+				return nil, err
+			}
+			_, err := os.Stat(expandPath(path))
+			return starlark.Bool(err == nil), nil
+		}),
+		// command returns the trimmed output of the command, or None if it failed
+		"command": starlark.NewBuiltin("command", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(kwargs) > 0 || len(args) == 0 {
+				return nil, fmt.Errorf("%s: expected the command and its arguments", fn.Name())
+			}
+			command := make([]string, len(args))
+			for i, arg := range args {
+				s, ok := starlark.AsString(arg)
+				if !ok {
+					return nil, fmt.Errorf("%s: argument %d is not a string", fn.Name(), i+1)
+				}
+				command[i] = s
+			}
+			runCtx, cancel := context.WithTimeout(ctx, appConfig.Script.Timeout)
+			defer cancel()
+			cmd, output, cleanup, err := hookCommand(runCtx, command[0], command[1:]...)
+			if err != nil {
+				return starlark.None, nil
+			}
+			defer cleanup()
+			// Only the standard output is returned
+			cmd.Stderr = nil
+			if err = cmd.Run(); err != nil {
+				return starlark.None, nil
+			}
+			return starlark.String(strings.TrimSpace(output.buf.String())), nil
+		}),
+	}
+}
+
+// scriptRun returns the description of the run passed to the script functions
+func scriptRun(sources []string, now time.Time) *starlarkstruct.Struct {
+	values := make([]starlark.Value, len(sources))
+	for i, source := range sources {
+		values[i] = starlark.String(source)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("run"), starlark.StringDict{
+		"host":    starlark.String(appConfig.HostName),
+		"profile": starlark.String(activeProfile),
+		"sources": starlark.NewList(values),
+		"time":    starlark.String(now.Format(time.RFC3339)),
+		"hour":    starlark.MakeInt(now.Hour()),
+		"weekday": starlark.String(now.Weekday().String()),
+	})
+}
+
+// callScriptFunction calls the function of the script if it defines it, returning nil otherwise
+func callScriptFunction(thread *starlark.Thread, globals starlark.StringDict, name string, run starlark.Value) (starlark.Value, error) {
+	fn, ok := globals[name].(starlark.Callable)
+	if !ok {
+		return nil, nil
+	}
+	result, err := starlark.Call(thread, fn, starlark.Tuple{run}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+	return result, nil
+}
+
+// runBackupScript runs the Starlark backup script. The script can define should_backup(run), returning False or
+// the reason to skip the backup, and tags(run), returning the tags to add to the snapshot.
+func runBackupScript(ctx context.Context, sources []string, now time.Time) (*scriptDecision, error) {
+	decision := &scriptDecision{}
+	if appConfig.Script.File == "" {
+		return decision, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Script.Timeout)
+	defer cancel()
+	thread := &starlark.Thread{
+		Name:  "backup script",
+		Print: func(_ *starlark.Thread, msg string) { log.WithField("script", appConfig.Script.File).Info(msg) },
+	}
+	// Stop the script at the timeout, e.g. an endless loop
+	go func() {
+		<-ctx.Done()
+		thread.Cancel(ctx.Err().Error())
+	}()
+
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, expandPath(appConfig.Script.File), nil, scriptBuiltins(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the backup script: %w", err)
+	}
+	run := scriptRun(sources, now)
+
+	result, err := callScriptFunction(thread, globals, "should_backup", run)
+	if err != nil {
+		return nil, err
+	}
+	switch result := result.(type) {
+	case nil, starlark.NoneType:
+	case starlark.String:
+		decision.Skip = string(result)
+	case starlark.Bool:
+		if !result {
+			decision.Skip = "should_backup returned False"
+		}
+	default:
+		return nil, fmt.Errorf("should_backup returned %s, expected a bool or a string", result.Type())
+	}
+	if decision.Skip != "" {
+		return decision, nil
+	}
+
+	result, err = callScriptFunction(thread, globals, "tags", run)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		iterable, ok := result.(starlark.Iterable)
+		if !ok {
+			return nil, fmt.Errorf("tags returned %s, expected a list of strings", result.Type())
+		}
+		iter := iterable.Iterate()
+		defer iter.Done()
+		var tag starlark.Value
+		for iter.Next(&tag) {
+			s, ok := starlark.AsString(tag)
+			if !ok {
+				return nil, fmt.Errorf("tags returned %s, expected a list of strings", tag.String())
+			}
+			if s != "" {
+				decision.Tags = append(decision.Tags, s)
+			}
+		}
+	}
+	return decision, nil
+}
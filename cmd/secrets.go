@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxReportedSecrets is the number of credential-looking files listed in the log
+const maxReportedSecrets = 20
+
+// errScanLimit stops the walk when the scan limit is reached
+var errScanLimit = errors.New("scan limit reached")
+
+// scanForSecrets walks the backup sources and returns the files whose names look like credentials, skipping the
+// files restic excludes with the exclude patterns. Only the file names are matched, the contents are not read.
+func scanForSecrets(sources, excludes []string) []string {
+	allowed := make([]string, 0, len(appConfig.SecretsScan.Allow))
+	for _, path := range appConfig.SecretsScan.Allow {
+		allowed = append(allowed, expandPath(path))
+	}
+	var found []string
+	visited := 0
+	for _, source := range sources {
+		err := filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Unreadable directories are reported by restic
+				return nil
+			}
+			if excluded, skip := excludedPath(path, d.IsDir(), excludes); skip {
+				return filepath.SkipDir
+			} else if excluded {
+				return nil
+			}
+			visited++
+			if visited > appConfig.SecretsScan.MaxFiles {
+				return errScanLimit
+			}
+			if d.IsDir() || slices.Contains(allowed, path) {
+				return nil
+			}
+			for _, pattern := range appConfig.SecretsScan.Patterns {
+				if matched, _ := filepath.Match(pattern, d.Name()); matched {
+					found = append(found, path)
+					break
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errScanLimit) {
+			log.WithField("max_files", appConfig.SecretsScan.MaxFiles).Warn("The secrets scan stopped at the file limit")
+			break
+		}
+	}
+	return found
+}
+
+// warnAboutSecrets scans the backup sources and logs the credential-looking files not excluded by the exclude file
+// or the generated exclude patterns
+func warnAboutSecrets(sources, generated []string) []string {
+	excludes, err := readExcludeFile(filepath.Join(appConfig.BackupDir, appConfig.Restic.ExcludeFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithField("err", err).Warn("cannot read the exclude file, the secrets scan does not apply it")
+	}
+	found := scanForSecrets(sources, append(excludes, generated...))
+	if len(found) == 0 {
+		return nil
+	}
+	for _, path := range found[:min(len(found), maxReportedSecrets)] {
+		log.WithField("path", path).Warn("A file that looks like a credential is backed up")
+	}
+	log.WithField("count", len(found)).Warn("Credential-looking files are backed up, exclude them or add them to secrets_scan.allow")
+	return found
+}
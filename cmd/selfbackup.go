@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// selfBackupDirName is the directory in backup_directory holding the copy of the configuration and the state
+// backed up after every backup
+const selfBackupDirName = "self-backup"
+
+// The tags of the snapshots of the directories written by the program
+const (
+	tagSelfBackup     = "self-backup"
+	tagSystemManifest = "system-manifest"
+)
+
+// redactedValue replaces the secrets in the copy of the configuration
+const redactedValue = "REDACTED"
+
+// selfBackupDir returns the directory of the copy of the configuration and the state backed up after the backups
+func selfBackupDir() string {
+	return filepath.Join(appConfig.BackupDir, selfBackupDirName)
+}
+
+// secretConfigKey reports whether the configuration key holds a secret, e.g. a token of the notifications
+func secretConfigKey(key string) bool {
+	switch key {
+	case "password", "token", "api_key", "routing_key", "urls":
+		return true
+	}
+	return strings.Contains(key, "secret") && !strings.HasPrefix(key, "secrets")
+}
+
+// redactSettings replaces the secrets in the settings, including the passwords of the URLs
+func redactSettings(settings map[string]any) {
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]any:
+			redactSettings(v)
+		case []any:
+			for _, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					redactSettings(m)
+				}
+			}
+			if secretConfigKey(key) && len(v) > 0 {
+				settings[key] = []any{redactedValue}
+			}
+		case string:
+			if secretConfigKey(key) && v != "" {
+				settings[key] = redactedValue
+			} else if u, err := url.Parse(v); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), redactedValue)
+					settings[key] = u.String()
+				}
+			}
+		}
+	}
+}
+
+// writeRedactedConfig writes the configuration file with the secrets redacted
+func writeRedactedConfig(path string) error {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return nil
+	}
+	source := viper.New()
+	source.SetConfigFile(file)
+	if err := source.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read the configuration: %w", err)
+	}
+	settings := source.AllSettings()
+	redactSettings(settings)
+	redacted := viper.New()
+	for key, value := range settings {
+		redacted.Set(key, value)
+	}
+	if err := redacted.WriteConfigAs(path); err != nil {
+		return fmt.Errorf("failed to write the redacted configuration: %w", err)
+	}
+	return os.Chmod(path, 0o600)
+}
+
+// copyHistory writes a consistent copy of the history database, which may be open by another process
+func copyHistory(path string) error {
+	if _, err := os.Stat(filepath.Join(appConfig.BackupDir, appConfig.HistoryFile)); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := openHistory(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0o600)
+	})
+}
+
+// writeSelfBackup refreshes the copy of the configuration with the secrets redacted, the files-from and exclude
+// files, the state and the history, and returns its directory, which is backed up after every backup so a disaster
+// recovery restores the backup configuration as well
+func writeSelfBackup() (string, error) {
+	dir := selfBackupDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the self-backup directory: %w", err)
+	}
+	if err := writeRedactedConfig(filepath.Join(dir, "config.yaml")); err != nil {
+		return "", err
+	}
+	for _, name := range []string{appConfig.Restic.FilesFrom, appConfig.Restic.ExcludeFile, appConfig.StateFile} {
+		data, err := os.ReadFile(filepath.Join(appConfig.BackupDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, filepath.Base(name)), data, 0o600); err != nil {
+			return "", fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+	if err := copyHistory(filepath.Join(dir, filepath.Base(appConfig.HistoryFile))); err != nil {
+		return "", fmt.Errorf("failed to copy the history: %w", err)
+	}
+	return dir, nil
+}
+
+// backupAuxiliary backs up a directory written by the program into a snapshot of its own with the tag. Added to the
+// backup, it would change the paths of the snapshots, which the retention policy groups them by and the next backup
+// finds its parent by.
+func backupAuxiliary(ctx context.Context, dir, tag string) error {
+	_, err := runResticCommand(ctx, "backup", "--host", appConfig.HostName,
+		"-o", "s3.storage-class="+appConfig.Restic.S3Storage, "--tag", tag, dir)
+	return err
+}
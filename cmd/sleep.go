@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sleepWatch stops the backup gracefully when the system is about to sleep or shut down. A delay inhibitor of
+// systemd-logind holds the sleep back until restic stopped, at most for sleep_grace_period.
+type sleepWatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// grace is how long the sleep is held back, sleep_grace_period capped by the limit of logind
+	grace time.Duration
+
+	mu       sync.Mutex
+	reason   string
+	released chan struct{}
+	stopOnce sync.Once
+}
+
+// prepareForSleepSignals maps the logind signals announcing a sleep or a shutdown to the reason of the stop
+var prepareForSleepSignals = map[string]string{
+	"PrepareForSleep (true":    "the system is going to sleep",
+	"PrepareForShutdown (true": "the system is shutting down",
+}
+
+// inhibitDelayMax returns how long logind lets a delay inhibitor hold back a sleep, InhibitDelayMaxSec of logind.conf,
+// or 0 if it cannot be read
+func inhibitDelayMax(ctx context.Context) time.Duration {
+	output, err := exec.CommandContext(ctx, "gdbus", "call", "--system", "--dest", "org.freedesktop.login1",
+		"--object-path", "/org/freedesktop/login1", "--method", "org.freedesktop.DBus.Properties.Get",
+		"org.freedesktop.login1.Manager", "InhibitDelayMaxUSec").Output()
+	if err != nil {
+		return 0
+	}
+	// The reply is e.g. "(<uint64 5000000>,)"
+	match := inhibitDelayRe.FindSubmatch(output)
+	if match == nil {
+		return 0
+	}
+	usec, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// inhibitDelayRe matches the value of the InhibitDelayMaxUSec property
+var inhibitDelayRe = regexp.MustCompile(`uint64 (\d+)`)
+
+// watchSleep returns the watch of the backup context. It only watches on Linux with systemd: macOS announces the
+// sleep only through IOKit, which the program does not use. Its shutdown terminates the program, which stops the
+// backup gracefully as well.
+func watchSleep(parent context.Context) *sleepWatch {
+	w := &sleepWatch{released: make(chan struct{})}
+	w.ctx, w.cancel = context.WithCancel(parent)
+	if runtime.GOOS != "linux" || appConfig.SleepGracePeriod <= 0 {
+		return w
+	}
+	if _, err := exec.LookPath("gdbus"); err != nil {
+		log.Debug("gdbus is missing, the backup is not stopped before the system sleeps")
+		return w
+	}
+	w.grace = appConfig.SleepGracePeriod
+	// logind lets the sleep proceed after its own limit, waiting longer would stop restic after the sleep
+	if limit := inhibitDelayMax(parent); limit > 0 && limit < w.grace {
+		log.WithFields(log.Fields{"sleep_grace_period": w.grace, "InhibitDelayMaxSec": limit}).Warn("sleep_grace_period " +
+			"exceeds the limit of logind, raise InhibitDelayMaxSec in /etc/systemd/logind.conf")
+		w.grace = limit
+	}
+	// The inhibitor is released when its command exits, which it does when its standard input is closed
+	inhibitor := exec.Command("systemd-inhibit", "--what=sleep:shutdown", "--mode=delay",
+		"--who=restic_wrapper", "--why=Stopping the backup gracefully", "cat")
+	stdin, err := inhibitor.StdinPipe()
+	if err == nil {
+		if err = inhibitor.Start(); err == nil {
+			go func() {
+				<-w.ctx.Done()
+				// Keep the sleep waiting while restic stops
+				if w.stopReason() != "" {
+					select {
+					case <-w.released:
+					case <-time.After(w.grace):
+					}
+				}
+				stdin.Close()
+				inhibitor.Wait()
+			}()
+		}
+	}
+	if err != nil {
+		log.WithField("err", err).Warn("cannot take the sleep inhibitor, the sleep is not delayed while the backup stops")
+	}
+
+	monitor := exec.CommandContext(w.ctx, "gdbus", "monitor", "--system", "--dest", "org.freedesktop.login1",
+		"--object-path", "/org/freedesktop/login1")
+	stdout, err := monitor.StdoutPipe()
+	if err == nil {
+		err = monitor.Start()
+	}
+	if err != nil {
+		log.WithField("err", err).Warn("cannot watch the sleep of the system")
+		return w
+	}
+	go func() {
+		defer monitor.Wait()
+		w.watchSignals(stdout)
+	}()
+	return w
+}
+
+// watchSignals stops the backup when logind announces a sleep or a shutdown
+func (w *sleepWatch) watchSignals(signals io.Reader) {
+	scanner := bufio.NewScanner(signals)
+	for scanner.Scan() {
+		for signal, reason := range prepareForSleepSignals {
+			if strings.Contains(scanner.Text(), signal) {
+				w.mu.Lock()
+				w.reason = reason
+				w.mu.Unlock()
+				log.WithFields(log.Fields{"reason": reason, "grace_period": w.grace}).Warn("Stopping the backup before the system sleeps")
+				w.cancel()
+				return
+			}
+		}
+	}
+}
+
+// stopReason returns why the backup was stopped, or an empty string if the system did not go to sleep
+func (w *sleepWatch) stopReason() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason
+}
+
+// stop ends the watch once the backup stopped, letting the system sleep
+func (w *sleepWatch) stop() {
+	w.stopOnce.Do(func() {
+		close(w.released)
+		w.cancel()
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// snapshot is a restic snapshot as printed by the --json commands
+type snapshot struct {
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Username string    `json:"username"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+	// Original is the ID of the snapshot before it was modified, e.g. by restic tag
+	Original string `json:"original"`
+	// Summary holds the statistics of the backup, recorded by restic 0.17.0 or later
+	Summary *struct {
+		DataAddedPacked int64 `json:"data_added_packed"`
+	} `json:"summary,omitempty"`
+}
+
+// originalID returns the ID the snapshot was created with, which does not change when the snapshot is tagged
+func (s snapshot) originalID() string {
+	if s.Original != "" {
+		return s.Original
+	}
+	return s.ID
+}
+
+// protected reports whether the snapshot is tagged with the keep tag of the retention policy
+func (s snapshot) protected() bool {
+	return slices.Contains(s.Tags, appConfig.Retention.KeepTag)
+}
+
+// listSnapshots returns the snapshots in the repository
+func listSnapshots(ctx context.Context, args ...string) ([]snapshot, error) {
+	output, err := runResticCommand(ctx, append([]string{"snapshots", "--json"}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("restic snapshots failed: %w", err)
+	}
+	var snapshots []snapshot
+	if err = json.Unmarshal([]byte(output), &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse restic snapshots output: %w", err)
+	}
+	return snapshots, nil
+}
+
+// newSnapshotsCmd returns the command listing the snapshots
+func newSnapshotsCmd() *cobra.Command {
+	var search string
+	cmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the snapshots with their notes, marking the ones protected from the retention policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+			defer cancel()
+
+			setupEnv()
+			snapshots, err := listSnapshots(ctx)
+			if err != nil {
+				return err
+			}
+			notes, err := loadNotes()
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tTime\tHost\tProtected\tTags\tPaths\tNote")
+			for _, s := range snapshots {
+				note := notes.note(s)
+				if search != "" && !strings.Contains(strings.ToLower(note), strings.ToLower(search)) {
+					continue
+				}
+				protected := ""
+				if s.protected() {
+					protected = "yes"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					s.ShortID,
+					s.Time.Local().Format("2006-01-02 15:04"),
+					s.Hostname,
+					protected,
+					strings.Join(s.Tags, ","),
+					strings.Join(s.Paths, ", "),
+					note,
+				)
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&search, "search", "", "only list the snapshots whose note contains the text")
+	return cmd
+}
+
+// newProtectCmd returns the command protecting snapshots from the retention policy
+func newProtectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "protect <snapshot-id>...",
+		Short: "Protect snapshots from the retention policy by tagging them with the keep tag",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return tagSnapshots(cmd, "--add", args)
+		},
+	}
+}
+
+// newUnprotectCmd returns the command removing the protection from snapshots
+func newUnprotectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unprotect <snapshot-id>...",
+		Short: "Remove the keep tag from snapshots, so the retention policy applies to them again",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return tagSnapshots(cmd, "--remove", args)
+		},
+	}
+}
+
+// tagSnapshots adds or removes the keep tag of the retention policy to the snapshots
+func tagSnapshots(cmd *cobra.Command, operation string, ids []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+	defer cancel()
+
+	setupEnv()
+	output, err := runResticCommand(ctx, append([]string{"tag", operation, appConfig.Retention.KeepTag}, ids...)...)
+	if err != nil {
+		return fmt.Errorf("restic tag failed: %w", err)
+	}
+	fmt.Fprint(cmd.OutOrStdout(), output)
+	return nil
+}
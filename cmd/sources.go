@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// expandPath expands environment variables and a leading "~" in the given path
+func expandPath(path string) string {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			log.WithField("err", err).Warn("cannot expand home directory")
+			return path
+		}
+		path = filepath.Join(homeDir, path[1:])
+	}
+	return path
+}
+
+// expandSourcePattern expands a single files-from entry into concrete paths
+func expandSourcePattern(pattern string) ([]string, error) {
+	path := hostPath(expandPath(pattern))
+	if !strings.ContainsAny(path, "*?[") {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return matches, nil
+}
+
+// expandSources reads the files-from list and expands globs, "~" and environment variables in every entry
+func expandSources(filesFrom string) ([]string, error) {
+	file, err := os.Open(filesFrom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open files-from list: %w", err)
+	}
+	defer file.Close()
+
+	var sources []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Skip empty lines and comments, the same way restic does
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths, err := expandSourcePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			log.WithField("pattern", line).Warn("backup source pattern matched no files")
+			continue
+		}
+		if len(paths) != 1 || paths[0] != line {
+			log.WithFields(log.Fields{
+				"pattern": line,
+				"paths":   paths,
+			}).Info("expanded backup source")
+		}
+		sources = append(sources, paths...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read files-from list: %w", err)
+	}
+	return sources, nil
+}
+
+// writeExpandedSources expands the files-from list, adds the settings of the selected applications and writes the
+// result next to it, returning the path of the expanded list and the expanded sources
+func writeExpandedSources(filesFrom string) (string, []string, error) {
+	sources, err := expandSources(filesFrom)
+	if err != nil {
+		return "", nil, err
+	}
+	sources = append(sources, appSettingsSources(appConfig.AppSettings, sources)...)
+	if len(sources) == 0 {
+		return "", nil, fmt.Errorf("no backup sources found in %s", filesFrom)
+	}
+
+	expanded := filepath.Join(filepath.Dir(filesFrom), "."+filepath.Base(filesFrom)+".expanded")
+	if err = os.WriteFile(expanded, []byte(strings.Join(sources, "\n")+"\n"), 0o600); err != nil {
+		return "", nil, fmt.Errorf("failed to write expanded files-from list: %w", err)
+	}
+	return expanded, sources, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// resticEnvKey is the context key of the environment variables added to the restic commands
+type resticEnvKey struct{}
+
+// withResticEnv returns a context running the restic commands with the additional environment variables
+func withResticEnv(ctx context.Context, env ...string) context.Context {
+	current, _ := ctx.Value(resticEnvKey{}).([]string)
+	return context.WithValue(ctx, resticEnvKey{}, append(append([]string{}, current...), env...))
+}
+
+// resticEnv returns the additional environment variables of the restic commands run with the context
+func resticEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(resticEnvKey{}).([]string)
+	return env
+}
+
+// stagingEnabled reports whether the backups go to the local staging repository first
+func stagingEnabled() bool {
+	return appConfig.Staging.Repository != ""
+}
+
+// stagingPasswordVars returns the environment variables passing the password of the staging repository with the
+// prefix of the repository, e.g. "RESTIC_" or "RESTIC_FROM_", see staging.secrets_prefix
+func stagingPasswordVars(prefix string) []string {
+	if password := os.Getenv(stagingPasswordEnv); password != "" {
+		// The staging password takes precedence over the password command or file of the remote repository
+		return []string{prefix + "PASSWORD=" + password, prefix + "PASSWORD_COMMAND=", prefix + "PASSWORD_FILE="}
+	}
+	return append([]string{prefix + "PASSWORD=" + os.Getenv("RESTIC_PASSWORD")}, passwordSourceEnv(prefix)...)
+}
+
+// withStagingRepository returns a context running the restic commands against the local staging repository
+func withStagingRepository(ctx context.Context) context.Context {
+	return withResticEnv(ctx, append([]string{"RESTIC_REPOSITORY=" + expandPath(appConfig.Staging.Repository)},
+		stagingPasswordVars("RESTIC_")...)...)
+}
+
+// stagingRetentionArgs returns the restic forget arguments of the retention policy of the staging repository
+func stagingRetentionArgs() []string {
+	return []string{
+		"--keep-last", strconv.Itoa(appConfig.Staging.KeepLast),
+		"--keep-daily", strconv.Itoa(appConfig.Staging.KeepDaily),
+		"--keep-tag", appConfig.Retention.KeepTag,
+	}
+}
+
+// startSync starts copying the new snapshots to the remote repository in the background, so the run
+// does not wait for the upload
+func startSync() {
+	executable, err := os.Executable()
+	if err != nil {
+		log.WithField("err", err).Error("cannot start the sync to the remote repository")
+		return
+	}
+	args := []string{"sync"}
+	if activeProfile != "" {
+		args = append(args, "--profile", activeProfile)
+	}
+	cmd := exec.Command(executable, args...)
+	// Detach the sync from the run, it outlives it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		log.WithField("err", err).Error("cannot start the sync to the remote repository")
+		return
+	}
+	log.WithField("pid", cmd.Process.Pid).Info("Started the sync to the remote repository")
+	cmd.Process.Release()
+}
+
+// unsyncedSnapshots returns the snapshots of the staging repository missing from the remote repository, matched by
+// the ID restic copy records as the original of the copies
+func unsyncedSnapshots(ctx context.Context) ([]snapshot, error) {
+	staged, err := listSnapshots(withStagingRepository(ctx), "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+	copied, err := listSnapshots(ctx, "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+	remote := map[string]bool{}
+	for _, s := range copied {
+		remote[s.originalID()] = true
+	}
+	return slices.DeleteFunc(staged, func(s snapshot) bool { return remote[s.originalID()] }), nil
+}
+
+// snapshotsAdded returns the data the snapshots added to their repository, which their copy uploads again
+func snapshotsAdded(snapshots []snapshot) int64 {
+	var added int64
+	for _, s := range snapshots {
+		if s.Summary != nil {
+			added += s.Summary.DataAddedPacked
+		}
+	}
+	return added
+}
+
+// updateSyncState records the result of a sync, the recounted backlog, negative when unknown, and the data uploaded
+// by the copy in the state file, waiting for a running backup
+func updateSyncState(syncErr error, backlog int, uploaded int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.MaxRuntime)
+	defer cancel()
+	fileLock := newFileLock()
+	if _, err := fileLock.TryLockContext(ctx, time.Second); err != nil {
+		return fmt.Errorf("cannot lock the lock file: %w", err)
+	}
+	defer fileLock.Unlock()
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if syncErr != nil {
+		state.SyncError = syncErr.Error()
+	} else {
+		state.LastSync = time.Now()
+		state.SyncError = ""
+		state.recordUpload(state.LastSync, uploaded)
+	}
+	if backlog >= 0 {
+		state.SyncBacklog = backlog
+	}
+	return state.save()
+}
+
+// newSyncCmd returns the command copying the snapshots of the staging repository to the remote repository
+func newSyncCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "sync",
+		Short: "Copy the new snapshots of the local staging repository to the remote repository",
+		Long: "Copies the snapshots missing from the remote repository with restic copy, then applies the retention " +
+			"policy to the remote repository when cleanup_old_backups is set. Started in the background after " +
+			"every backup to the staging repository, it can also be scheduled on its own.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !stagingEnabled() {
+				return errors.New("staging.repository is not configured")
+			}
+			// Backups to the staging repository continue while the sync uploads
+			syncLock := flock.New(filepath.Join(appConfig.BackupDir, appConfig.LockFile+".sync"))
+			locked, err := syncLock.TryLock()
+			if err != nil {
+				return fmt.Errorf("cannot lock the sync lock file: %w", err)
+			}
+			if !locked {
+				log.Info("Another sync is already running")
+				return nil
+			}
+			defer syncLock.Unlock()
+
+			remoteCtx, cancel := context.WithTimeout(context.Background(), appConfig.Staging.MaxSyncRuntime)
+			defer cancel()
+			setupEnv()
+			ctx := withResticEnv(remoteCtx, append([]string{"RESTIC_FROM_REPOSITORY=" + expandPath(appConfig.Staging.Repository)},
+				stagingPasswordVars("RESTIC_FROM_")...)...)
+
+			// The backups to the staging repository don't count towards the bandwidth budget, their copies do
+			var uploaded int64
+			if pending, err := unsyncedSnapshots(remoteCtx); err != nil {
+				log.WithField("err", err).Warn("cannot list the snapshots waiting for the sync")
+			} else {
+				uploaded = snapshotsAdded(pending)
+			}
+
+			log.Info("Copying the new snapshots to the remote repository")
+			summary := &runSummary{HostName: appConfig.HostName}
+			_, syncErr := summary.runStage(ctx, "copy")
+			if syncErr == nil && appConfig.CleanupOldBackups {
+				state, err := loadState()
+				if err != nil {
+					return err
+				}
+				// The retention policy of the staging repository is applied once its snapshots are copied, so it
+				// never removes a snapshot the remote repository does not have yet
+				if !appConfig.Security.AppendOnly {
+					staging := &runSummary{HostName: appConfig.HostName}
+					cleanupOldBackups(withStagingRepository(remoteCtx), staging, state, stagingRetentionArgs())
+					cleanupOldBackups(remoteCtx, summary, state, retentionArgs())
+				}
+			}
+			backlog := -1
+			if pending, err := unsyncedSnapshots(remoteCtx); err != nil {
+				log.WithField("err", err).Warn("cannot count the snapshots waiting for the sync")
+			} else {
+				backlog = len(pending)
+			}
+			if err = updateSyncState(syncErr, backlog, uploaded); err != nil {
+				log.WithField("err", err).Error("cannot save the state")
+			}
+			if syncErr != nil {
+				return fmt.Errorf("restic copy failed: %w", syncErr)
+			}
+			log.Info("Copied the new snapshots to the remote repository")
+			return nil
+		},
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Run statuses stored in the state file
+const (
+	runStatusRunning = "running"
+	runStatusSuccess = "success"
+	runStatusPartial = "partial"
+	// runStatusIncomplete means a snapshot was created, but some source files could not be read
+	runStatusIncomplete = "incomplete"
+	runStatusFailed     = "failed"
+)
+
+// runRecord describes a single run of the program
+type runRecord struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Status     string    `json:"status"`
+	// Recovery is the reason the run recovers from an interrupted previous run
+	Recovery string `json:"recovery,omitempty"`
+
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	BytesAdded int64  `json:"bytes_added,omitempty"`
+	// BytesProcessed is the source data read by the backup
+	BytesProcessed int64 `json:"bytes_processed,omitempty"`
+	// Throughput is the source data read by the backup per second
+	Throughput float64 `json:"throughput,omitempty"`
+}
+
+// repoSizeSample is the size of the repository at a point in time
+type repoSizeSample struct {
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// historyLimit is the number of repository size samples kept in the state
+const historyLimit = 1000
+
+// runState is the state persisted between runs
+type runState struct {
+	LastRun     *runRecord `json:"last_run,omitempty"`
+	LastSuccess time.Time  `json:"last_success,omitempty"`
+	LastPrune   time.Time  `json:"last_prune,omitempty"`
+	LastCheck   time.Time  `json:"last_check,omitempty"`
+	// CheckSubset is the last data subset read by a successful repository check
+	CheckSubset int `json:"check_subset,omitempty"`
+	// CheckFailed is set when the last repository check failed
+	CheckFailed bool `json:"check_failed,omitempty"`
+
+	// RepoSizes holds the sizes of the repository sampled by the reports, oldest first. The runs are kept in the
+	// history database, see recordRun.
+	RepoSizes []repoSizeSample `json:"repo_sizes,omitempty"`
+
+	// SyncBacklog is the number of snapshots of the staging repository not yet copied to the remote repository
+	SyncBacklog int       `json:"sync_backlog,omitempty"`
+	LastSync    time.Time `json:"last_sync,omitempty"`
+	SyncError   string    `json:"sync_error,omitempty"`
+
+	// SnapshotCount is the number of snapshots of the host after the last run, GuardrailViolations the snapshot
+	// guardrails violated at the last check
+	SnapshotCount       int      `json:"snapshot_count,omitempty"`
+	GuardrailViolations []string `json:"guardrail_violations,omitempty"`
+
+	// AppendOnlyVerified is when the probe last found AppendOnlyRepository append-only, see appendOnlyProbeDue
+	AppendOnlyVerified   time.Time `json:"append_only_verified,omitempty"`
+	AppendOnlyRepository string    `json:"append_only_repository,omitempty"`
+
+	// SnapshotHost is the host name the snapshots were migrated to, see migrateSnapshotHost
+	SnapshotHost string `json:"snapshot_host,omitempty"`
+
+	// Seed is the progress of the initial backup split into chunks
+	Seed *seedState `json:"seed,omitempty"`
+
+	// Uploads holds the data uploaded by the backups in the recent calendar months, oldest first
+	Uploads []monthlyUpload `json:"uploads,omitempty"`
+
+	// DeferredSince is when the backups started being deferred because the repository is unreachable
+	DeferredSince time.Time `json:"deferred_since,omitempty"`
+	DeferReason   string    `json:"defer_reason,omitempty"`
+	// DeferralReported is set once the deferral exceeding offline.max_deferral has been reported
+	DeferralReported bool `json:"deferral_reported,omitempty"`
+
+	// Digest holds the notifications queued for the next digest
+	Digest     []digestEntry `json:"digest,omitempty"`
+	LastDigest time.Time     `json:"last_digest,omitempty"`
+
+	// LastReport is when the last report was sent, the daemon schedules the next one from it
+	LastReport time.Time `json:"last_report,omitempty"`
+}
+
+// statePath returns the path of the state file
+func statePath() string {
+	return filepath.Join(appConfig.BackupDir, appConfig.StateFile)
+}
+
+// loadState reads the state file, returning an empty state if it does not exist yet
+func loadState() (*runState, error) {
+	return loadStateFile(statePath())
+}
+
+// loadStateFile reads the given state file, returning an empty state if it does not exist yet
+func loadStateFile(path string) (*runState, error) {
+	state := &runState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	return state, nil
+}
+
+// save writes the state file atomically
+func (s *runState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp := statePath() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err = os.Rename(tmp, statePath()); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// recoveryReason returns why the previous run has to be recovered, or an empty string if it does not
+func (s *runState) recoveryReason() string {
+	if s.LastRun == nil {
+		return ""
+	}
+	switch s.LastRun.Status {
+	case runStatusRunning:
+		return "the previous run was interrupted"
+	case runStatusSuccess, runStatusIncomplete:
+		// An incomplete snapshot was created, rerunning would skip the same unreadable files
+		return ""
+	}
+	// Keep recovering until a run completes
+	return s.LastRun.Recovery
+}
+
+// startRun records the start of a new run in the state file
+func (s *runState) startRun(startedAt time.Time, recovery string) {
+	s.LastRun = &runRecord{StartedAt: startedAt, Status: runStatusRunning, Recovery: recovery}
+	// The repository is reachable again
+	s.DeferredSince = time.Time{}
+	s.DeferReason = ""
+	s.DeferralReported = false
+	if err := s.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the state")
+	}
+}
+
+// recordCheck records the result of a repository check
+func (s *runState) recordCheck(passed bool, at time.Time, subset int) {
+	s.CheckFailed = !passed
+	// A failed check reads the same subset again next time
+	if passed {
+		s.LastCheck = at
+		if subset > 0 {
+			s.CheckSubset = subset
+		}
+	}
+}
+
+// finishRun records the result of the current run in the state file and in the history database
+func (s *runState) finishRun(summary *runSummary) {
+	s.LastRun.FinishedAt = time.Now()
+	s.LastRun.Status = summary.Status
+	s.LastRun.SnapshotID = summary.SnapshotID
+	s.LastRun.BytesAdded = summary.BytesAdded
+	s.LastRun.BytesProcessed = summary.BytesProcessed
+	s.LastRun.Throughput = summary.throughput()
+	// The sync records the upload of the backups to the staging repository
+	if !stagingEnabled() {
+		s.recordUpload(s.LastRun.FinishedAt, summary.BytesUploaded)
+	}
+	if check := summary.stage("check"); check != nil {
+		s.recordCheck(check.Err == nil, s.LastRun.FinishedAt, summary.CheckSubset)
+	}
+	if summary.Status == runStatusSuccess {
+		s.LastSuccess = s.LastRun.FinishedAt
+	}
+	if prune := summary.stage("prune"); prune != nil && prune.Err == nil {
+		s.LastPrune = s.LastRun.FinishedAt
+	}
+	if err := s.save(); err != nil {
+		log.WithField("err", err).Error("cannot save the state")
+	}
+	// Recorded before the health of the run is assessed from the history
+	if err := recordRun(summary); err != nil {
+		log.WithField("err", err).Error("cannot record the run in the history")
+	}
+}
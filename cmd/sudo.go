@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// sudoEnv are the environment variables sudo keeps for the wrapper running restic. The password is passed on the
+// standard input, a password command would run as root and the sudoers rule does not allow setting variables.
+var sudoEnv = []string{
+	"AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "RESTIC_REPOSITORY", "RESTIC_REST_USERNAME",
+	"RESTIC_REST_PASSWORD", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "GOMEMLIMIT", "GOGC", "TZ",
+}
+
+// sudoWrapperScript is the root-owned script sudo runs without arguments: it reads the password and the arguments
+// of restic backup from the standard input, one per line, pins the restic executable and only accepts the options
+// the program passes, so the passwordless sudo cannot run anything else as root
+const sudoWrapperScript = `#!/bin/sh
+# Generated by restic_wrapper for restic.sudo. Runs restic backup as root with the options of the program only.
+# Install it owned by root and writable by root only.
+set -eu
+deny() {
+	echo "restic_wrapper-sudo: $1 is not allowed" >&2
+	exit 2
+}
+IFS= read -r RESTIC_PASSWORD || deny "a missing password"
+export RESTIC_PASSWORD
+unset RESTIC_PASSWORD_FILE RESTIC_PASSWORD_COMMAND
+set --
+while IFS= read -r arg; do
+	set -- "$@" "$arg"
+done
+[ "${1:-}" = backup ] || deny "restic ${1:-}"
+shift
+case "${RESTIC_REPOSITORY:-}" in
+sftp:* | rclone:*) deny "a repository starting a program" ;;
+esac
+expect=""
+for arg in "$@"; do
+	if [ -n "$expect" ]; then
+		if [ "$expect" = -o ]; then
+			case "$arg" in
+			s3.storage-class=*) ;;
+			*) deny "the option $arg" ;;
+			esac
+		fi
+		expect=""
+		continue
+	fi
+	case "$arg" in
+	--host | --tag | --exclude | --exclude-file | --files-from-verbatim | --limit-upload | --cacert | -o) expect="$arg" ;;
+	--force | -v | -vv) ;;
+	-*) deny "$arg" ;;
+	esac
+done
+[ -z "$expect" ] || deny "$expect without a value"
+exec %s backup "$@" </dev/null
+`
+
+// shellQuote quotes the string for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sudoWrapper returns the wrapper script pinning the configured restic executable
+func sudoWrapper() string {
+	return fmt.Sprintf(sudoWrapperScript, shellQuote(appConfig.Restic.Path))
+}
+
+// sudoCommand reports whether the restic operation runs as root via sudo. Only the backups of the sources do, the
+// Docker volumes are read with a command restic starts, which must not run as root.
+func sudoCommand(args []string) bool {
+	return appConfig.Restic.Sudo && len(args) > 0 && args[0] == "backup" && !slices.Contains(args, "--stdin-from-command")
+}
+
+// resticCommandLine returns the executable and the arguments running the restic operation, wrapping the privileged
+// operations with sudo and the wrapper script, which reads the arguments from the standard input, see sudoInput
+func resticCommandLine(args []string) (string, []string) {
+	if !sudoCommand(args) {
+		return appConfig.Restic.Path, args
+	}
+	// Never prompt for a password, the program runs unattended
+	return "sudo", []string{"-n", appConfig.Restic.SudoWrapper}
+}
+
+// sudoInput returns the standard input of the wrapper script: the password and the arguments, one per line
+func sudoInput(ctx context.Context, env, args []string) (io.Reader, error) {
+	if err := checkSudoWrapper(); err != nil {
+		return nil, err
+	}
+	password, err := sudoPassword(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range append([]string{password}, args...) {
+		if strings.ContainsAny(arg, "\r\n") {
+			return nil, fmt.Errorf("the password or an argument of restic contains a line break, which the sudo wrapper cannot read")
+		}
+	}
+	return strings.NewReader(password + "\n" + strings.Join(args, "\n") + "\n"), nil
+}
+
+// checkSudoWrapper checks that the wrapper script is owned by root and writable by root only, otherwise the user
+// could change what runs as root
+func checkSudoWrapper() error {
+	info, err := os.Stat(appConfig.Restic.SudoWrapper)
+	if err != nil {
+		return fmt.Errorf("the sudo wrapper is not installed, see restic_wrapper sudoers: %w", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid != 0 || info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("the sudo wrapper %s must be owned by root and writable by root only", appConfig.Restic.SudoWrapper)
+	}
+	return nil
+}
+
+// lookupEnv returns the last value of the variable in the environment list
+func lookupEnv(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// sudoPassword resolves the repository password of the environment as the user, so the password file is read and
+// the password command runs without the privileges of restic
+func sudoPassword(ctx context.Context, env []string) (string, error) {
+	if password, ok := lookupEnv(env, "RESTIC_PASSWORD"); ok && password != "" {
+		return password, nil
+	}
+	if path, ok := lookupEnv(env, "RESTIC_PASSWORD_FILE"); ok && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the password file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if command, ok := lookupEnv(env, "RESTIC_PASSWORD_COMMAND"); ok && command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = env
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("the password command failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+	return "", fmt.Errorf("no repository password is configured")
+}
+
+// sudoersRule returns the sudoers rule allowing the user to run the wrapper script without a password, keeping the
+// environment variables restic needs
+func sudoersRule(username string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Defaults!%s env_keep += \"%s\"\n", appConfig.Restic.SudoWrapper, strings.Join(sudoEnv, " "))
+	// "" allows no argument, the wrapper reads them from the standard input
+	fmt.Fprintf(&b, "%s ALL=(root) NOPASSWD: %s \"\"\n", username, appConfig.Restic.SudoWrapper)
+	return b.String()
+}
+
+// writeSudoSetup writes the wrapper script and the sudoers rule of restic.sudo to the backup directory and prints
+// how to install them as root
+func writeSudoSetup(w io.Writer) error {
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to get the current user: %w", err)
+	}
+	dir := filepath.Join(appConfig.BackupDir, "sudo")
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create the sudo directory: %w", err)
+	}
+	wrapper, rule := filepath.Join(dir, filepath.Base(appConfig.Restic.SudoWrapper)), filepath.Join(dir, "sudoers")
+	if err = os.WriteFile(wrapper, []byte(sudoWrapper()), 0o700); err != nil {
+		return fmt.Errorf("failed to write the sudo wrapper: %w", err)
+	}
+	if err = os.WriteFile(rule, []byte(sudoersRule(current.Username)), 0o600); err != nil {
+		return fmt.Errorf("failed to write the sudoers rule: %w", err)
+	}
+	fmt.Fprintln(w, "restic.sudo runs restic backup as root through a wrapper script, install it and the sudoers rule with:")
+	fmt.Fprintf(w, "  sudo install -d -o root -m 0755 %s\n", filepath.Dir(appConfig.Restic.SudoWrapper))
+	fmt.Fprintf(w, "  sudo install -o root -m 0755 %s %s\n", wrapper, appConfig.Restic.SudoWrapper)
+	fmt.Fprintf(w, "  sudo visudo -cf %s && sudo install -o root -m 0440 %s /etc/sudoers.d/restic_wrapper\n", rule, rule)
+	return nil
+}
+
+// newSudoersCmd returns the command preparing the wrapper script and the sudoers rule required by restic.sudo
+func newSudoersCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "sudoers",
+		Short: "Prepare the sudoers rule allowing restic to back up root-owned paths",
+		Long: "Writes the wrapper script running restic backup as root and the sudoers rule allowing it without a " +
+			"password to the sudo directory of the backup directory, and prints the commands installing them. The " +
+			"wrapper pins the restic executable and only accepts the options of the program, the password and the " +
+			"arguments are passed on the standard input. The schedule installed by provision prints the same when restic.sudo is set.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writeSudoSetup(cmd.OutOrStdout())
+		},
+	}
+}
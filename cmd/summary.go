@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stageResult holds the outcome of a single restic command run as part of a run
+type stageResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+	// Usage is the resources used by the restic command, nil if unknown
+	Usage *resourceUsage
+}
+
+// runSummary collects the results of a run
+type runSummary struct {
+	HostName  string
+	StartedAt time.Time
+	Status    string
+	Recovery  string
+	Duration  time.Duration
+	Stages    []stageResult
+	// Error describes the first stage that failed
+	Error string
+
+	SnapshotID      string
+	BytesAdded      int64
+	PruneFreedBytes int64
+	// BytesProcessed is the source data read by the backup
+	BytesProcessed int64
+	// BytesUploaded is the data the backup sent to the repository, compressed
+	BytesUploaded int64
+	// ThroughputDrop describes the collapse of the backup throughput, e.g. because of throttling or a failing disk
+	ThroughputDrop string
+	// GroupSnapshots are the snapshots of the priority groups backed up before the other sources, "<group> <id>"
+	GroupSnapshots []string
+	// Guardrails are the violated snapshot guardrails, e.g. a snapshot count that dropped unexpectedly
+	Guardrails []string
+	// PruneSkipped is the reason prune was skipped to protect a possibly corrupt repository
+	PruneSkipped string
+	// CheckSubset is the data subset read by the repository check
+	CheckSubset int
+	LastSuccess time.Time
+	Health      *healthReport
+	// DeferredSince is set when the backups are deferred because the repository is unreachable
+	DeferredSince time.Time
+	// SyncBacklog is the number of snapshots waiting to be copied to the remote repository
+	SyncBacklog int
+	// Compliance is set when the host follows a fleet policy
+	Compliance *complianceReport
+	// Warnings groups the files restic could not read by the reason
+	Warnings []warningGroup
+	// SecretFiles are the credential-looking files found in the backup sources
+	SecretFiles []string
+	// LargeFiles are the new files exceeding the warn size of the size rules
+	LargeFiles []string
+	// CanaryVerified is the number of canary files restored and compared with the source
+	CanaryVerified int
+	// MetadataVerified is the number of files whose resource forks and Finder metadata were found in the snapshot,
+	// MetadataMissing the files missing some of them
+	MetadataVerified int
+	MetadataMissing  []string
+}
+
+// runStage runs the restic command and records its duration and result as a stage of the run
+func (s *runSummary) runStage(ctx context.Context, args ...string) (string, error) {
+	return s.runNamedStage(ctx, args[0], args...)
+}
+
+// runNamedStage runs the restic command and records it as a stage with the given name
+func (s *runSummary) runNamedStage(ctx context.Context, name string, args ...string) (string, error) {
+	start := time.Now()
+	output, usage, err := runResticCommandUsage(ctx, args...)
+	stage := stageResult{
+		Name:     name,
+		Duration: time.Since(start),
+		Err:      err,
+		Usage:    usage,
+	}
+	s.Stages = append(s.Stages, stage)
+	publish(ctx, stageCompletedEvent{Stage: stage})
+	if err != nil && s.Error == "" {
+		s.Error = fmt.Sprintf("%s: %v", name, err)
+		// The fatal error explains the failure better than the exit status
+		if fatal := fatalError(err); fatal != "" {
+			s.Error = fmt.Sprintf("%s: %s", name, fatal)
+		}
+		// A restic killed after the grace period of a stop did not run out of memory
+		if ctx.Err() == nil && outOfMemory(err) {
+			s.Error = fmt.Sprintf("%s: %s", name, outOfMemoryError(stage))
+			log.WithField("stage", name).Error("restic ran out of memory, raise restic.memory_max or set restic.memory_limit below it")
+		}
+	}
+	return output, err
+}
+
+// snapshotCreated reports whether the backup stage created a snapshot
+func (s *runSummary) snapshotCreated() bool {
+	return s.Status == runStatusSuccess || s.Status == runStatusIncomplete
+}
+
+// warningCount returns the number of files restic could not read
+func (s *runSummary) warningCount() int {
+	count := 0
+	for _, group := range s.Warnings {
+		count += group.Count
+	}
+	return count
+}
+
+// subject returns a one-line description of the run
+func (s *runSummary) subject() string {
+	if s.Status == runStatusIncomplete && len(s.Warnings) > 0 {
+		return fmt.Sprintf("restic backup on %s: completed with %d warnings", s.HostName, s.warningCount())
+	}
+	return fmt.Sprintf("restic backup on %s: %s", s.HostName, s.Status)
+}
+
+// text returns a human-readable description of the run
+func (s *runSummary) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host: %s\n", s.HostName)
+	fmt.Fprintf(&b, "Status: %s\n", s.Status)
+	fmt.Fprintf(&b, "Started: %s\n", s.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Duration: %s\n", s.Duration.Round(time.Second))
+	if s.Recovery != "" {
+		fmt.Fprintf(&b, "Recovery: %s\n", s.Recovery)
+	}
+	if len(s.GroupSnapshots) > 0 {
+		fmt.Fprintf(&b, "Snapshots of the priority groups: %s\n", strings.Join(s.GroupSnapshots, ", "))
+	}
+	if s.SnapshotID != "" {
+		fmt.Fprintf(&b, "Snapshot: %s\n", s.SnapshotID)
+		fmt.Fprintf(&b, "Added to the repository: %s\n", formatBytes(s.BytesAdded))
+	}
+	if throughput := s.throughput(); throughput > 0 {
+		fmt.Fprintf(&b, "Processed: %s at %s", formatBytes(s.BytesProcessed), formatRate(throughput))
+		if ratio := s.dedupRatio(); ratio > 0 {
+			fmt.Fprintf(&b, ", dedup ratio %.1fx", ratio)
+		}
+		b.WriteString("\n")
+	}
+	if s.ThroughputDrop != "" {
+		fmt.Fprintf(&b, "Warning: %s\n", s.ThroughputDrop)
+	}
+	if !s.DeferredSince.IsZero() {
+		fmt.Fprintf(&b, "Backups deferred since %s, the repository is unreachable\n", s.DeferredSince.Format(time.RFC3339))
+	}
+	if len(s.Stages) > 0 {
+		b.WriteString("Stages:\n")
+	}
+	for _, stage := range s.Stages {
+		result := "ok"
+		switch {
+		case stage.Name == "backup" && s.Status == runStatusIncomplete:
+			result = fmt.Sprintf("completed with %d warnings", s.warningCount())
+		case stage.Err != nil:
+			result = "failed: " + stage.Err.Error()
+		}
+		if stage.Usage != nil {
+			result += ", " + stage.Usage.String()
+		}
+		fmt.Fprintf(&b, "  %s: %s (%s)\n", stage.Name, stage.Duration.Round(time.Second), result)
+	}
+	if len(s.Warnings) > 0 {
+		writeWarnings(&b, s.Warnings)
+	}
+	if s.CanaryVerified > 0 {
+		fmt.Fprintf(&b, "Canary files verified: %d\n", s.CanaryVerified)
+	}
+	if s.MetadataVerified > 0 {
+		fmt.Fprintf(&b, "macOS metadata verified: %d files\n", s.MetadataVerified)
+	}
+	if len(s.MetadataMissing) > 0 {
+		fmt.Fprintf(&b, "macOS metadata missing from the snapshot: %s\n", strings.Join(s.MetadataMissing, ", "))
+	}
+	if len(s.SecretFiles) > 0 {
+		fmt.Fprintf(&b, "Credential-looking files backed up: %d\n", len(s.SecretFiles))
+	}
+	if len(s.LargeFiles) > 0 {
+		fmt.Fprintf(&b, "Large new files backed up: %s\n", strings.Join(s.LargeFiles, ", "))
+	}
+	for _, violation := range s.Guardrails {
+		fmt.Fprintf(&b, "Guardrail: %s\n", violation)
+	}
+	if s.Health != nil && s.Health.degraded() {
+		fmt.Fprintf(&b, "Health: %s\n", s.Health)
+	}
+	if s.Compliance != nil && !s.Compliance.compliant() {
+		fmt.Fprintf(&b, "Fleet policy: %s\n", s.Compliance)
+	}
+	if s.SyncBacklog > 0 {
+		fmt.Fprintf(&b, "Snapshots waiting for the sync to the remote repository: %d\n", s.SyncBacklog)
+	}
+	if s.PruneSkipped != "" {
+		fmt.Fprintf(&b, "Prune skipped: %s\n", s.PruneSkipped)
+	}
+	if s.PruneFreedBytes > 0 {
+		fmt.Fprintf(&b, "Freed by prune: %s\n", formatBytes(s.PruneFreedBytes))
+	}
+	return b.String()
+}
+
+// stage returns the result of the last stage with the given name, or nil if the stage did not run
+func (s *runSummary) stage(name string) *stageResult {
+	for i := len(s.Stages) - 1; i >= 0; i-- {
+		if s.Stages[i].Name == name {
+			return &s.Stages[i]
+		}
+	}
+	return nil
+}
+
+var (
+	// snapshotSavedRe matches the ID of the snapshot created by restic backup
+	snapshotSavedRe = regexp.MustCompile(`snapshot ([0-9a-f]+) saved`)
+	// addedToRepoRe matches the amount of data added by restic backup and stored after compression,
+	// e.g. "Added to the repository: 1.234 MiB (512 KiB stored)" or "Added to the repo: 1.234 MiB" in older versions
+	addedToRepoRe = regexp.MustCompile(`Added to the repo(?:sitory)?: ([\d.]+ [KMGT]?i?B)(?: \(([\d.]+ [KMGT]?i?B) stored\))?`)
+	// processedRe matches the amount of source data read by restic backup, e.g. "processed 1234 files, 5.432 GiB in 1:23"
+	processedRe = regexp.MustCompile(`processed \d+ files, ([\d.]+ [KMGT]?i?B) in`)
+)
+
+// parseBackupOutput extracts the snapshot ID and the amount of added data from the output of restic backup
+func (s *runSummary) parseBackupOutput(output string) {
+	if match := snapshotSavedRe.FindStringSubmatch(output); match != nil {
+		s.SnapshotID = match[1]
+	}
+	if match := addedToRepoRe.FindStringSubmatch(output); match != nil {
+		s.BytesAdded = parseResticSize(match[1])
+		s.BytesUploaded = s.BytesAdded
+		if match[2] != "" {
+			s.BytesUploaded = parseResticSize(match[2])
+		}
+	}
+	if match := processedRe.FindStringSubmatch(output); match != nil {
+		s.BytesProcessed = parseResticSize(match[1])
+	}
+}
+
+// throughput returns the source data read by the backup per second, or zero if it is unknown
+func (s *runSummary) throughput() float64 {
+	backup := s.stage("backup")
+	if backup == nil || s.BytesProcessed == 0 || backup.Duration <= 0 {
+		return 0
+	}
+	return float64(s.BytesProcessed) / backup.Duration.Seconds()
+}
+
+// dedupRatio returns how many times more data the backup read than it added to the repository, or zero if unknown
+func (s *runSummary) dedupRatio() float64 {
+	if s.BytesProcessed == 0 || s.BytesAdded == 0 {
+		return 0
+	}
+	return float64(s.BytesProcessed) / float64(s.BytesAdded)
+}
+
+// formatRate formats a throughput in bytes per second, e.g. "12.500 MiB/s"
+func formatRate(bytesPerSecond float64) string {
+	return formatBytes(int64(bytesPerSecond)) + "/s"
+}
+
+// pruneFreedRe matches the amount of data removed by restic prune,
+// e.g. "total prune:      25 blobs / 1.502 MiB" or "this frees 1.502 MiB" in older versions
+var pruneFreedRe = regexp.MustCompile(`(?:total prune:\s+\d+ blobs /|this frees)\s+([\d.]+ [KMGT]?i?B)`)
+
+// parsePruneFreedBytes extracts the number of bytes freed by restic prune from its output
+func parsePruneFreedBytes(output string) int64 {
+	match := pruneFreedRe.FindStringSubmatch(output)
+	if match == nil {
+		return 0
+	}
+	return parseResticSize(match[1])
+}
+
+// parseResticSize converts a size formatted by restic (e.g. "1.502 MiB") to bytes
+func parseResticSize(size string) int64 {
+	value, unit, found := strings.Cut(strings.TrimSpace(size), " ")
+	if !found {
+		return 0
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	multipliers := map[string]float64{
+		"B":   1,
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+		"TiB": 1 << 40,
+	}
+	return int64(number * multipliers[unit])
+}
+
+// formatBytes formats the size in bytes the way restic does, e.g. "1.502 MiB"
+func formatBytes(size int64) string {
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	if size < 1<<10 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	unit := ""
+	for _, unit = range units {
+		value /= 1 << 10
+		if value < 1<<10 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.3f %s", value, unit)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// systemManifestDirName is the directory in backup_directory holding the system manifest backed up after the backups
+const systemManifestDirName = "system-manifest"
+
+// systemCommand is a command whose output is saved to a file of the system manifest
+type systemCommand struct {
+	file string
+	args []string
+}
+
+// systemCommands returns the commands describing the installed software and the scheduled jobs of the platform.
+// The commands whose executable is not installed are skipped.
+func systemCommands() []systemCommand {
+	commands := []systemCommand{
+		{"crontab.txt", []string{"crontab", "-l"}},
+		{"pip-packages.txt", []string{"pip3", "list", "--format=freeze", "--user"}},
+		{"npm-global.txt", []string{"npm", "ls", "--global", "--depth=0"}},
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		commands = append(commands,
+			systemCommand{"Brewfile", []string{"brew", "bundle", "dump", "--file=-"}},
+			systemCommand{"brew-versions.txt", []string{"brew", "list", "--versions"}},
+			systemCommand{"mas-apps.txt", []string{"mas", "list"}},
+			systemCommand{"applications.txt", []string{"ls", "-1", "/Applications"}},
+			systemCommand{"launchd-jobs.txt", []string{"launchctl", "list"}},
+			systemCommand{"software-version.txt", []string{"sw_vers"}},
+		)
+		for _, domain := range appConfig.SystemManifest.DefaultsDomains {
+			commands = append(commands, systemCommand{"defaults/" + domain + ".plist", []string{"defaults", "export", domain, "-"}})
+		}
+	case "linux":
+		commands = append(commands,
+			systemCommand{"apt-selections.txt", []string{"dpkg", "--get-selections"}},
+			systemCommand{"apt-manual.txt", []string{"apt-mark", "showmanual"}},
+			systemCommand{"rpm-packages.txt", []string{"rpm", "-qa"}},
+			systemCommand{"snap-packages.txt", []string{"snap", "list"}},
+			systemCommand{"flatpak-apps.txt", []string{"flatpak", "list", "--app"}},
+			systemCommand{"systemd-units.txt", []string{"systemctl", "list-unit-files", "--state=enabled"}},
+			systemCommand{"systemd-user-units.txt", []string{"systemctl", "--user", "list-unit-files", "--state=enabled"}},
+			systemCommand{"os-release.txt", []string{"cat", "/etc/os-release"}},
+		)
+	}
+	for _, name := range slices.Sorted(maps.Keys(appConfig.SystemManifest.Commands)) {
+		commands = append(commands, systemCommand{"custom/" + name + ".txt", []string{"sh", "-c", appConfig.SystemManifest.Commands[name]}})
+	}
+	return commands
+}
+
+// systemUnitDirs are the directories of the user's own launchd agents and systemd units, copied as they are
+func systemUnitDirs() []string {
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{filepath.Join(home, "Library", "LaunchAgents")}
+	case "linux":
+		return []string{filepath.Join(home, ".config", "systemd", "user")}
+	}
+	return nil
+}
+
+// runSystemCommand returns the output of the command, an empty crontab is not an error
+func runSystemCommand(ctx context.Context, command systemCommand) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.SystemManifest.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command.args[0], command.args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil && command.args[0] == "crontab" && strings.Contains(stderr.String(), "no crontab") {
+		return nil, nil
+	}
+	if message := bytes.TrimSpace(stderr.Bytes()); err != nil && len(message) > 0 {
+		return nil, fmt.Errorf("%w: %s", err, message)
+	}
+	return output, err
+}
+
+// copyUnitFiles copies the regular files of the directory to the manifest directory
+func copyUnitFiles(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(dst, 0o700); err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dst, entry.Name()), data, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSystemManifest captures the installed packages, the scheduled jobs and the exported settings into a
+// directory backed up after the backup, recorded as the system-manifest stage of the run, and returns the directory.
+// A failing command is logged and skipped, it does not fail the run.
+func writeSystemManifest(ctx context.Context, summary *runSummary) (string, error) {
+	start := time.Now()
+	dir := filepath.Join(appConfig.BackupDir, systemManifestDirName)
+	// The files of the software removed since the last run must not linger
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to clear the system manifest: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the system manifest directory: %w", err)
+	}
+	captured := 0
+	for _, command := range systemCommands() {
+		if _, err := exec.LookPath(command.args[0]); err != nil {
+			continue
+		}
+		output, err := runSystemCommand(ctx, command)
+		if err != nil {
+			log.WithFields(log.Fields{"command": strings.Join(command.args, " "), "err": err}).Warn("cannot capture the system manifest entry")
+			continue
+		}
+		path := filepath.Join(dir, command.file)
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return "", fmt.Errorf("failed to create the system manifest directory: %w", err)
+		}
+		if err = os.WriteFile(path, output, 0o600); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", command.file, err)
+		}
+		captured++
+	}
+	for _, unitDir := range systemUnitDirs() {
+		if err := copyUnitFiles(unitDir, filepath.Join(dir, "units")); err != nil {
+			log.WithFields(log.Fields{"path": unitDir, "err": err}).Warn("cannot copy the units to the system manifest")
+		}
+	}
+	stage := stageResult{Name: "system-manifest", Duration: time.Since(start)}
+	summary.Stages = append(summary.Stages, stage)
+	publish(ctx, stageCompletedEvent{Stage: stage})
+	log.WithFields(log.Fields{"entries": captured, "path": dir}).Info("Captured the system manifest")
+	return dir, nil
+}
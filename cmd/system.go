@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// systemConfigDir holds the configuration of a system-wide install
+	systemConfigDir = "/etc/restic_wrapper"
+	// configFileEnv overrides the path of the configuration file
+	configFileEnv = "RESTIC_WRAPPER_CONFIG"
+)
+
+// userConfig is a per-user configuration of the system-wide mode
+type userConfig struct {
+	Path      string
+	User      *user.User
+	StateFile string
+}
+
+// loadUserConfigs reads the per-user configurations from the conf.d directory
+func loadUserConfigs() ([]userConfig, error) {
+	paths, err := filepath.Glob(filepath.Join(appConfig.System.ConfDir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the user configurations: %w", err)
+	}
+	var configs []userConfig
+	for _, path := range paths {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err = v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		username := v.GetString("user")
+		if username == "" {
+			return nil, fmt.Errorf("%s does not set the user to back up", path)
+		}
+		u, err := user.Lookup(username)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the user of %s: %w", path, err)
+		}
+
+		// Resolve the state file the way the instance running as the user does
+		backupDir := v.GetString("backup_directory")
+		if backupDir == "" {
+			backupDir = filepath.Join(u.HomeDir, ".restic_backup")
+		} else if backupDir == "~" || strings.HasPrefix(backupDir, "~/") {
+			backupDir = filepath.Join(u.HomeDir, backupDir[1:])
+		}
+		stateFile := v.GetString("state_file")
+		if stateFile == "" {
+			stateFile = "state.json"
+		}
+		configs = append(configs, userConfig{
+			Path:      path,
+			User:      u,
+			StateFile: filepath.Join(backupDir, stateFile),
+		})
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no user configurations found in %s", appConfig.System.ConfDir)
+	}
+	return configs, nil
+}
+
+// command returns the command running the program with the given arguments as the user of the configuration
+func (c userConfig) command(args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the executable: %w", err)
+	}
+	uid, err := strconv.ParseUint(c.User.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of %s: %w", c.User.Username, err)
+	}
+	gid, err := strconv.ParseUint(c.User.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of %s: %w", c.User.Username, err)
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	// Every user runs with their own home directory, and therefore their own keychain and logs
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + c.User.HomeDir,
+		"USER=" + c.User.Username,
+		"LOGNAME=" + c.User.Username,
+		configFileEnv + "=" + c.Path,
+	}
+	return cmd, nil
+}
+
+// printUserStatus prints the last run of every user
+func printUserStatus(w io.Writer, configs []userConfig) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCONFIG\tLAST RUN\tSTATUS\tLAST SUCCESS")
+	for _, c := range configs {
+		lastRun, status, lastSuccess := "never", "-", "never"
+		state, err := loadStateFile(c.StateFile)
+		if err != nil {
+			status = "unknown: " + err.Error()
+		} else {
+			if state.LastRun != nil {
+				lastRun = state.LastRun.StartedAt.Local().Format("2006-01-02 15:04")
+				status = state.LastRun.Status
+			}
+			if !state.LastSuccess.IsZero() {
+				lastSuccess = state.LastSuccess.Local().Format("2006-01-02 15:04")
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.User.Username, filepath.Base(c.Path), lastRun, status, lastSuccess)
+	}
+	tw.Flush()
+}
+
+// newSystemCmd returns the commands of the system-wide mode backing up several users
+func newSystemCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "system",
+		Short: "Back up several users from a system-wide install",
+		Long: "Runs as root and backs up every user configured in system.conf_dir. Each configuration sets the " +
+			"user to back up, and the backup runs as that user with their own home directory, keychain and repository.",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "backup",
+		Short: "Back up every configured user, one after another",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if os.Geteuid() != 0 {
+				return errors.New("the system-wide mode must run as root")
+			}
+			configs, err := loadUserConfigs()
+			if err != nil {
+				return err
+			}
+			var failed []string
+			for _, c := range configs {
+				fields := log.Fields{"user": c.User.Username, "config": c.Path}
+				log.WithFields(fields).Info("Starting the backup of the user")
+				run, err := c.command()
+				if err == nil {
+					err = run.Run()
+				}
+				if err != nil {
+					log.WithFields(fields).WithField("err", err).Error("The backup of the user failed")
+					failed = append(failed, c.User.Username)
+					continue
+				}
+				log.WithFields(fields).Info("The backup of the user finished")
+			}
+			printUserStatus(cmd.OutOrStdout(), configs)
+			if len(failed) > 0 {
+				return fmt.Errorf("the backup failed for %s", strings.Join(failed, ", "))
+			}
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show the last run of every configured user",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configs, err := loadUserConfigs()
+			if err != nil {
+				return err
+			}
+			printUserStatus(cmd.OutOrStdout(), configs)
+			return nil
+		},
+	})
+	return cmd
+}
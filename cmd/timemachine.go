@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// timeMachinePreferences is the system-wide Time Machine configuration holding the fixed-path exclusions
+const timeMachinePreferences = "/Library/Preferences/com.apple.TimeMachine.plist"
+
+// timeMachineStickyQuery finds the items excluded with "tmutil addexclusion", which sets the
+// com_apple_backup_excludeItem metadata attribute on the item itself
+const timeMachineStickyQuery = "com_apple_backup_excludeItem = 'com.apple.backupd'"
+
+// timeMachineSkipPaths returns the fixed-path exclusions configured in the Time Machine preferences
+func timeMachineSkipPaths(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "plutil", "-extract", "SkipPaths", "json", "-o", "-", timeMachinePreferences)
+	output, err := cmd.Output()
+	if err != nil {
+		// The key is missing when nothing is excluded
+		return nil, nil
+	}
+	var paths []string
+	if err = json.Unmarshal(output, &paths); err != nil {
+		return nil, fmt.Errorf("failed to parse Time Machine skip paths: %w", err)
+	}
+	for i, path := range paths {
+		paths[i] = expandPath(path)
+	}
+	return paths, nil
+}
+
+// timeMachineStickyExclusions returns the items excluded from Time Machine by their metadata attribute within the root
+func timeMachineStickyExclusions(ctx context.Context, root string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "mdfind", "-onlyin", root, timeMachineStickyQuery)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Spotlight for Time Machine exclusions: %w", err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// timeMachineExclusions returns exclude patterns for the items excluded from Time Machine within the backup sources
+func timeMachineExclusions(ctx context.Context, sources []string) []string {
+	paths, err := timeMachineSkipPaths(ctx)
+	if err != nil {
+		log.WithField("err", err).Warn("cannot read the Time Machine exclusions")
+	}
+	for _, source := range sources {
+		if info, err := os.Stat(source); err != nil || !info.IsDir() {
+			continue
+		}
+		sticky, err := timeMachineStickyExclusions(ctx, source)
+		if err != nil {
+			log.WithFields(log.Fields{"source": source, "err": err}).Warn("cannot read the Time Machine exclusions")
+			continue
+		}
+		paths = append(paths, sticky...)
+	}
+
+	patterns := make([]string, 0, len(paths))
+	for _, path := range paths {
+		patterns = append(patterns, excludePatternReplacer.Replace(path))
+	}
+	if len(patterns) > 0 {
+		log.WithField("count", len(patterns)).Info("excluding the Time Machine exclusions")
+	}
+	return patterns
+}
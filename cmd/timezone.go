@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	// The zone database of the containers without tzdata
+	_ "time/tzdata"
+)
+
+// setupTimezone makes the configured timezone the local time of the program, so the quiet hours, the digest time,
+// the suspensions, the monthly budgets, the reports and the times in the logs and notifications all use it
+func setupTimezone() error {
+	if appConfig.Timezone == "" || appConfig.Timezone == "Local" {
+		return nil
+	}
+	location, err := time.LoadLocation(appConfig.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	time.Local = location
+	return nil
+}
+
+// timezoneEnv returns the environment of restic using the configured timezone, which buckets the snapshots by day,
+// week and month for the retention policy in its local time
+func timezoneEnv() []string {
+	if appConfig.Timezone == "" || appConfig.Timezone == "Local" {
+		return nil
+	}
+	return []string{"TZ=" + appConfig.Timezone}
+}
+
+// clockTime returns the time of the day given as "15:04" on the local day of now. A time skipped by the clocks going
+// forward becomes the same time after the change, e.g. 02:30 becomes 03:30, so it is not skipped. A time repeated by
+// the clocks going back is its first occurrence, so it is not doubled.
+func clockTime(now time.Time, clock string) (time.Time, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of day %q: %w", clock, err)
+	}
+	now = now.In(time.Local)
+	at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+	_, offset := at.Zone()
+	_, dayOffset := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Zone()
+	if dayOffset > offset {
+		// The clocks went back earlier in the day, the time may have occurred before the change as well
+		if first := at.Add(-time.Duration(dayOffset-offset) * time.Second); first.Hour() == t.Hour() && first.Minute() == t.Minute() {
+			at = first
+		}
+	}
+	return at, nil
+}
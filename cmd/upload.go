@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// fileSavedRe matches the data added by a file in the verbose output of restic backup, e.g.
+	// "new       /home/user/file, saved in 0.003s (1.234 MiB added)" or "(1.234 MiB added, 512 KiB stored)" with
+	// compression
+	fileSavedRe = regexp.MustCompile(`^(?:new|modified)\s+.*, saved in [\d.]+s \(([\d.]+ [KMGT]?i?B) added(?:, ([\d.]+ [KMGT]?i?B) stored)?`)
+	// fileStatusRe matches the per-file lines of the verbose output, which are not kept in the output of the run
+	fileStatusRe = regexp.MustCompile(`^(?:new|modified|unchanged)\s+/`)
+)
+
+// uploadMeter counts the data the backup uploads from the verbose output of restic backup, and stops the backup when
+// max_upload_per_run is reached
+type uploadMeter struct {
+	limit  int64
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	out      io.Writer
+	line     []byte
+	uploaded int64
+	reached  bool
+}
+
+// resticStdoutKey is the context key of the upload meter reading the output of restic
+type resticStdoutKey struct{}
+
+// withUploadMeter returns a context running the backup with the upload cap of the run, and the meter. It returns the
+// context unchanged and a nil meter when max_upload_per_run is not set.
+func withUploadMeter(ctx context.Context) (context.Context, *uploadMeter) {
+	limit, _ := parseSize(appConfig.MaxUploadPerRun)
+	if appConfig.MaxUploadPerRun == "" || limit <= 0 {
+		return ctx, nil
+	}
+	meter := &uploadMeter{limit: limit}
+	ctx, meter.cancel = context.WithCancel(ctx)
+	return context.WithValue(ctx, resticStdoutKey{}, meter), meter
+}
+
+// resticStdout returns the writer of the standard output of the restic commands run with the context
+func resticStdout(ctx context.Context, out io.Writer) io.Writer {
+	meter, _ := ctx.Value(resticStdoutKey{}).(*uploadMeter)
+	if meter == nil {
+		return out
+	}
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	meter.out = out
+	return meter
+}
+
+func (m *uploadMeter) Write(data []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.line = append(m.line, data...)
+	for {
+		i := bytes.IndexByte(m.line, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		line := m.line[:i+1]
+		m.line = m.line[i+1:]
+		if !fileStatusRe.Match(line) {
+			m.out.Write(line)
+			continue
+		}
+		match := fileSavedRe.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// The stored size is the compressed data actually sent to the repository
+		size := match[1]
+		if len(match[2]) > 0 {
+			size = match[2]
+		}
+		m.uploaded += parseResticSize(string(size))
+		if m.uploaded >= m.limit && !m.reached {
+			m.reached = true
+			log.WithFields(log.Fields{
+				"uploaded":           formatBytes(m.uploaded),
+				"max_upload_per_run": appConfig.MaxUploadPerRun,
+			}).Warn("The upload cap of the run is reached, stopping the backup")
+			m.cancel()
+		}
+	}
+}
+
+// uploadedBytes returns the data uploaded by the backup so far
+func (m *uploadMeter) uploadedBytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.uploaded
+}
+
+// limitReached reports whether the backup was stopped by the upload cap, false for a nil meter
+func (m *uploadMeter) limitReached() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reached
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// resourceUsage is the resources used by a restic command
+type resourceUsage struct {
+	UserCPU   time.Duration
+	SystemCPU time.Duration
+	// MaxRSS is the peak resident memory in bytes
+	MaxRSS int64
+	// InBlocks and OutBlocks are the block input and output operations on the filesystems
+	InBlocks  int64
+	OutBlocks int64
+}
+
+// processUsage returns the resource usage of the exited process, or nil if it is unknown
+func processUsage(state *os.ProcessState) *resourceUsage {
+	if state == nil {
+		return nil
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	maxRSS := int64(rusage.Maxrss)
+	// Linux reports the peak memory in KiB, macOS in bytes
+	if runtime.GOOS != "darwin" {
+		maxRSS *= 1024
+	}
+	return &resourceUsage{
+		UserCPU:   state.UserTime(),
+		SystemCPU: state.SystemTime(),
+		MaxRSS:    maxRSS,
+		InBlocks:  int64(rusage.Inblock),
+		OutBlocks: int64(rusage.Oublock),
+	}
+}
+
+// cpu returns the total CPU time
+func (u *resourceUsage) cpu() time.Duration {
+	return u.UserCPU + u.SystemCPU
+}
+
+// String returns a short description of the usage, e.g. "cpu 12s, peak memory 1.2 GiB"
+func (u *resourceUsage) String() string {
+	return fmt.Sprintf("cpu %s, peak memory %s", u.cpu().Round(time.Second), formatBytes(u.MaxRSS))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/cobra"
+)
+
+// Build metadata, set at build time with -ldflags "-X main.version=1.2.0 -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is the build metadata of the program
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// currentBuildInfo returns the build metadata, falling back to the VCS information embedded by the Go toolchain
+// for the builds without ldflags
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if len(info.Commit) > 12 {
+		info.Commit = info.Commit[:12]
+	}
+	return info
+}
+
+// String returns the build metadata on one line, e.g. "1.2.0 (commit 3f2a9c1e0b7d, built 2026-10-01T12:00:00Z,
+// go1.23.4 darwin/arm64)"
+func (b buildInfo) String() string {
+	s := b.Version + " ("
+	if b.Commit != "" {
+		s += "commit " + b.Commit + ", "
+	}
+	if b.BuildDate != "" {
+		s += "built " + b.BuildDate + ", "
+	}
+	return s + b.GoVersion + " " + b.Platform + ")"
+}
+
+// newVersionCmd returns the command printing the version of the program
+func newVersionCmd() *cobra.Command {
+	var jsonFlag bool
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of the program",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info := currentBuildInfo()
+			if jsonFlag {
+				return json.NewEncoder(cmd.OutOrStdout()).Encode(info)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "restic_wrapper %s\n", info)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&jsonFlag, "json", false, "print the build metadata as JSON")
+	return cmd
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// treeNode is a node of a restic tree as printed by restic cat tree
+type treeNode struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mtime   time.Time `json:"mtime"`
+	Content []string  `json:"content"`
+	// ExtendedAttributes holds e.g. the resource forks and the Finder metadata on macOS
+	ExtendedAttributes []extendedAttribute `json:"extended_attributes"`
+}
+
+// extendedAttribute is an extended attribute of a restic tree node
+type extendedAttribute struct {
+	Name string `json:"name"`
+}
+
+// fileVersion is the file in a snapshot
+type fileVersion struct {
+	Snapshot snapshot
+	Node     *treeNode
+	Change   string
+}
+
+// snapshotFile returns the node of the file in the snapshot, or nil if the snapshot does not contain it
+func snapshotFile(ctx context.Context, snapshotID, path string) (*treeNode, error) {
+	output, err := runResticCommand(ctx, "cat", "tree", snapshotID+":"+filepath.Dir(path))
+	if err != nil {
+		// The directory is missing from the snapshot
+		if fatal := fatalError(err); strings.Contains(fatal, "not found") || strings.Contains(fatal, "not a directory") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("restic cat tree failed: %w", err)
+	}
+	var tree struct {
+		Nodes []treeNode `json:"nodes"`
+	}
+	if err = json.Unmarshal([]byte(output), &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse the tree of %s: %w", snapshotID, err)
+	}
+	for _, node := range tree.Nodes {
+		if node.Name == filepath.Base(path) {
+			return &node, nil
+		}
+	}
+	return nil, nil
+}
+
+// fileChange describes how the file changed between two snapshots, or returns an empty string if it did not
+func fileChange(previous, current *treeNode) string {
+	switch {
+	case previous == nil && current == nil:
+		return ""
+	case previous == nil:
+		return "added"
+	case current == nil:
+		return "deleted"
+	case previous.Size != current.Size || strings.Join(previous.Content, ",") != strings.Join(current.Content, ","):
+		return "modified"
+	case !previous.Mtime.Equal(current.Mtime):
+		return "touched"
+	}
+	return ""
+}
+
+// fileVersions returns the snapshots in which the file differs from the previous snapshot, oldest first
+func fileVersions(ctx context.Context, path string, snapshots []snapshot) ([]fileVersion, error) {
+	var (
+		versions []fileVersion
+		previous *treeNode
+	)
+	for _, s := range snapshots {
+		covered := false
+		for _, p := range s.Paths {
+			if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+				covered = true
+			}
+		}
+		if !covered {
+			continue
+		}
+		node, err := snapshotFile(ctx, s.ID, path)
+		if err != nil {
+			return nil, err
+		}
+		if change := fileChange(previous, node); change != "" {
+			versions = append(versions, fileVersion{Snapshot: s, Node: node, Change: change})
+		}
+		previous = node
+	}
+	return versions, nil
+}
+
+// newVersionsCmd returns the command listing the versions of a file
+func newVersionsCmd() *cobra.Command {
+	var host string
+	cmd := &cobra.Command{
+		Use:   "versions <path>",
+		Short: "List the versions of a file in the snapshots",
+		Long: "Lists the snapshots in which the file was added, modified (its size or contents changed), touched " +
+			"(only its modification time changed) or deleted, oldest first, to pick the version to restore. " +
+			"The contents are compared by their restic blob hashes, no data is downloaded. Requires restic 0.17.0 " +
+			"or later.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			setupEnv()
+			path, err := filepath.Abs(expandPath(args[0]))
+			if err != nil {
+				return err
+			}
+			version, err := installedResticVersion(ctx)
+			if err != nil {
+				return fmt.Errorf("cannot get the restic version: %w", err)
+			}
+			if !version.atLeast(0, 17, 0) {
+				return fmt.Errorf("restic %s cannot list the versions of a file, 0.17.0 or later is required", version)
+			}
+			if host == "" {
+				host = appConfig.HostName
+			}
+			snapshots, err := listSnapshots(ctx, "--host", host)
+			if err != nil {
+				return err
+			}
+			versions, err := fileVersions(ctx, path, snapshots)
+			if err != nil {
+				return err
+			}
+			if len(versions) == 0 {
+				return fmt.Errorf("%s is not in the snapshots of %s", path, host)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SNAPSHOT\tTIME\tCHANGE\tSIZE\tMODIFIED")
+			for _, v := range versions {
+				size, modified := "", ""
+				if v.Node != nil {
+					size, modified = formatBytes(v.Node.Size), v.Node.Mtime.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.Snapshot.ShortID, v.Snapshot.Time.Local().Format("2006-01-02 15:04"),
+					v.Change, size, modified)
+			}
+			if err = tw.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "\nRestore a version with: restic_wrapper restore <snapshot> --target <dir> --include %s\n", path)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&host, "host", "", "list the versions in the snapshots of the host (default the host name)")
+	return cmd
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wakeCheckInterval is how often the daemon looks for a sleep of the system
+const wakeCheckInterval = 30 * time.Second
+
+// watchWake sends an event after every wake of the system from sleep. The monotonic clock stops while the system
+// sleeps, on macOS and on Linux, so a wall clock running ahead of it reveals the sleep.
+func watchWake(ctx context.Context, wakes chan<- time.Duration) {
+	ticker := time.NewTicker(wakeCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+			last = now
+			if slept < time.Minute {
+				continue
+			}
+			select {
+			case wakes <- slept:
+			default:
+			}
+		}
+	}
+}
+
+// backedUpStatePaths returns the state file of the active profile, or of every profile when every profile is
+// backed up
+func backedUpStatePaths() []string {
+	paths := []string{statePath()}
+	if profiles := profileNames(); activeProfile == "" && len(profiles) > 0 {
+		paths = nil
+		for _, profile := range profiles {
+			paths = append(paths, profileStatePath(profile))
+		}
+	}
+	return paths
+}
+
+// lastBackupStale reports whether the last successful backup of the active profile, or of any profile when every
+// profile is backed up, is older than the age
+func lastBackupStale(maxAge time.Duration, now time.Time) bool {
+	for _, path := range backedUpStatePaths() {
+		state, err := loadStateFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{"path": path, "err": err}).Warn("cannot load the state")
+			return true
+		}
+		if now.Sub(state.LastSuccess) > maxAge {
+			return true
+		}
+	}
+	return false
+}
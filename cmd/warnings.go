@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// resticWarningRe matches a file restic could not read, e.g. "error: open /Users/me/x: permission denied"
+var resticWarningRe = regexp.MustCompile(`^error: (\w+) (.+): ([^:]+)$`)
+
+// isResticWarning reports whether the line of the restic error output is a warning rather than an error,
+// e.g. a file that could not be read or vanished during the backup
+func isResticWarning(line string) bool {
+	return resticWarningRe.MatchString(line) || strings.HasPrefix(line, "Warning: ")
+}
+
+// fatalError returns the fatal error reported by the failed restic command, or an empty string
+func fatalError(err error) string {
+	var rErr *resticError
+	if !errors.As(err, &rErr) {
+		return ""
+	}
+	for _, line := range strings.Split(rErr.stderr, "\n") {
+		if fatal, found := strings.CutPrefix(strings.TrimSpace(line), "Fatal: "); found {
+			return fatal
+		}
+	}
+	return ""
+}
+
+// warningIgnoreRes returns the compiled warnings.ignore patterns. A "*" matches any text, including "/".
+func warningIgnoreRes() []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(appConfig.Warnings.Ignore))
+	for _, pattern := range appConfig.Warnings.Ignore {
+		expr := regexp.QuoteMeta(expandPath(pattern))
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		res = append(res, regexp.MustCompile("^"+expr+"$"))
+	}
+	return res
+}
+
+// ignoredWarning reports whether the warning of the file matches one of the ignore patterns
+func ignoredWarning(ignore []*regexp.Regexp, filePath, reason string) bool {
+	for _, re := range ignore {
+		if re.MatchString(filePath + ": " + reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyIgnoredWarnings reports whether restic printed ignored file warnings and no other error, so the backup
+// is complete as far as the user is concerned. An exit without any warning, e.g. killed or with its output lost,
+// is not.
+func onlyIgnoredWarnings(err error) bool {
+	var rErr *resticError
+	if !errors.As(err, &rErr) {
+		return false
+	}
+	ignore := warningIgnoreRes()
+	matched := 0
+	for _, line := range strings.Split(rErr.stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "error: ") {
+			continue
+		}
+		match := resticWarningRe.FindStringSubmatch(line)
+		if match == nil || !ignoredWarning(ignore, match[2], match[3]) {
+			return false
+		}
+		matched++
+	}
+	return matched > 0
+}
+
+// warningGroup is a kind of warning repeated for several files
+type warningGroup struct {
+	Kind   string `json:"kind"`
+	Count  int    `json:"count"`
+	Sample string `json:"sample"`
+}
+
+// groupWarnings groups the file warnings in the error output of restic backup by their reason,
+// most frequent first. The warnings matching warnings.ignore are left out.
+func groupWarnings(stderr string) []warningGroup {
+	ignore := warningIgnoreRes()
+	groups := map[string]*warningGroup{}
+	for _, line := range strings.Split(stderr, "\n") {
+		match := resticWarningRe.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || ignoredWarning(ignore, match[2], match[3]) {
+			continue
+		}
+		kind := match[1] + ": " + match[3]
+		if group, ok := groups[kind]; ok {
+			group.Count++
+			continue
+		}
+		groups[kind] = &warningGroup{Kind: kind, Count: 1, Sample: match[2]}
+	}
+	result := make([]warningGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Kind < result[j].Kind
+	})
+	return result
+}
+
+// backupWarnings returns the grouped file warnings of the failed restic backup
+func backupWarnings(err error) []warningGroup {
+	var rErr *resticError
+	if !errors.As(err, &rErr) {
+		return nil
+	}
+	return groupWarnings(rErr.stderr)
+}
+
+// writeWarnings writes the warning groups to the summary text, limited to warnings.max_groups kinds,
+// so thousands of unreadable files make one short section instead of a flood
+func writeWarnings(b *strings.Builder, groups []warningGroup) {
+	total := 0
+	for _, group := range groups {
+		total += group.Count
+	}
+	fmt.Fprintf(b, "Warnings, files that could not be read: %d\n", total)
+	for i, group := range groups {
+		if max := appConfig.Warnings.MaxGroups; max > 0 && i == max {
+			fmt.Fprintf(b, "  ... and %d more kinds\n", len(groups)-max)
+			break
+		}
+		fmt.Fprintf(b, "  %s: %d, e.g. %s\n", group.Kind, group.Count, group.Sample)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// changeWatcher watches the source directories and accumulates the changed files until the next backup
+type changeWatcher struct {
+	watcher  *fsnotify.Watcher
+	ignore   []string
+	minFiles int
+	minSize  int64
+	debounce time.Duration
+	maxDirs  int
+	// maxFiles is the number of file descriptors the watches may take, 0 when the watches don't take any
+	maxFiles int
+
+	mu         sync.Mutex
+	dirs       int
+	files      int
+	changed    map[string]int64
+	lastChange time.Time
+}
+
+// newChangeWatcher returns a watcher of the directories under the paths
+func newChangeWatcher(paths []string) (*changeWatcher, error) {
+	minSize, err := parseSize(appConfig.Daemon.Watch.MinSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daemon.watch.min_size: %w", err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the file watcher: %w", err)
+	}
+	w := &changeWatcher{
+		watcher:  watcher,
+		minFiles: appConfig.Daemon.Watch.MinFiles,
+		minSize:  minSize,
+		debounce: appConfig.Daemon.Watch.Debounce,
+		maxDirs:  appConfig.Daemon.Watch.MaxDirectories,
+		maxFiles: watchFileBudget(),
+		changed:  map[string]int64{},
+	}
+	// The program's own files and the restic cache change during every backup
+	w.ignore = append(w.ignore, appConfig.BackupDir)
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		w.ignore = append(w.ignore, filepath.Join(cacheDir, "restic"))
+	}
+	for _, path := range paths {
+		w.addTree(path)
+	}
+	if w.dirs == 0 {
+		watcher.Close()
+		return nil, fmt.Errorf("none of the paths %s can be watched", strings.Join(paths, ", "))
+	}
+	log.WithField("directories", w.dirs).Info("Watching the backup sources for changes")
+	return w, nil
+}
+
+// ignored reports whether the changes of the path are not counted
+func (w *changeWatcher) ignored(path string) bool {
+	for _, dir := range w.ignore {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree watches the directory and its subdirectories, up to daemon.watch.max_directories
+func (w *changeWatcher) addTree(root string) {
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if w.ignored(path) {
+			return filepath.SkipDir
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.dirs >= w.maxDirs {
+			log.WithFields(log.Fields{"limit": w.maxDirs, "path": path}).Warn("Too many directories to watch, the rest is not watched")
+			return filepath.SkipAll
+		}
+		var files int
+		if w.maxFiles > 0 {
+			// kqueue opens the directory and every entry of it
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil
+			}
+			files = len(entries) + 1
+			if w.files+files > w.maxFiles {
+				log.WithFields(log.Fields{"limit": w.maxFiles, "path": path}).Warn("Too many files to watch for the open file limit, the rest is not watched")
+				return filepath.SkipAll
+			}
+		}
+		if err := w.watcher.Add(path); err != nil {
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				log.WithFields(log.Fields{"path": path, "err": err}).Warn("Out of file descriptors, the rest is not watched")
+				return filepath.SkipAll
+			}
+			log.WithFields(log.Fields{"path": path, "err": err}).Warn("cannot watch the directory")
+			return nil
+		}
+		w.dirs++
+		w.files += files
+		return nil
+	})
+}
+
+// watchFileReserve is the number of file descriptors left to the daemon itself, e.g. for the logs and the restic pipes
+const watchFileReserve = 256
+
+// watchFileBudget returns the number of file descriptors the watches may take: on macOS every watched directory and
+// file takes one, so the soft open file limit, 256 by default, is raised to the hard limit and the watches stop short
+// of it. It returns 0 elsewhere, inotify watches don't take file descriptors.
+func watchFileBudget() int {
+	if runtime.GOOS != "darwin" {
+		return 0
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		log.WithField("err", err).Warn("cannot read the open file limit")
+		return watchFileReserve
+	}
+	if limit.Cur < limit.Max {
+		// macOS refuses a limit above OPEN_MAX
+		raised := limit
+		raised.Cur = min(limit.Max, 10240)
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+			log.WithFields(log.Fields{"limit": limit.Cur, "err": err}).Warn("cannot raise the open file limit")
+		} else {
+			limit = raised
+		}
+	}
+	return max(int(limit.Cur)-watchFileReserve, 1)
+}
+
+// record counts the change of the file, keeping its latest size
+func (w *changeWatcher) record(event fsnotify.Event) {
+	if w.ignored(event.Name) || event.Op == fsnotify.Chmod {
+		return
+	}
+	var size int64
+	if info, err := os.Lstat(event.Name); err == nil {
+		if info.IsDir() {
+			// New directories are watched as well
+			if event.Has(fsnotify.Create) {
+				w.addTree(event.Name)
+			}
+			return
+		}
+		size = info.Size()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changed[event.Name] = size
+	w.lastChange = time.Now()
+}
+
+// pending returns the number and the size of the files changed since the last reset
+func (w *changeWatcher) pending() (int, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var size int64
+	for _, s := range w.changed {
+		size += s
+	}
+	return len(w.changed), size
+}
+
+// due reports whether enough changes accumulated and none happened during the debounce period
+func (w *changeWatcher) due(now time.Time) bool {
+	files, size := w.pending()
+	if files == 0 || (files < w.minFiles && size < w.minSize) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return now.Sub(w.lastChange) >= w.debounce
+}
+
+// reset forgets the changes, called when a backup starts
+func (w *changeWatcher) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changed = map[string]int64{}
+}
+
+// run watches the changes until the context is done, sending a trigger whenever a backup is due
+func (w *changeWatcher) run(ctx context.Context, triggers chan<- string) {
+	defer w.watcher.Close()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.record(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithField("err", err).Warn("The file watcher failed")
+		case now := <-ticker.C:
+			if !w.due(now) {
+				continue
+			}
+			files, size := w.pending()
+			select {
+			case triggers <- fmt.Sprintf("%d files (%s) changed", files, formatBytes(size)):
+			default:
+			}
+		}
+	}
+}